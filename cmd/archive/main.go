@@ -0,0 +1,100 @@
+// Command archive lists the event partitions of the archive store and
+// imports them back into user_events, e.g. to reprocess purged data:
+//
+//	archive list [-app APP]
+//	archive import [-app APP] [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-dry-run]
+//
+// The database and the archive store are configured with the same APPSTATS_*
+// environment variables as the server. The partitions are read from the
+// manifest in the store, so they can be imported into another database.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"appstats/internal/archive"
+	"appstats/internal/config"
+	"appstats/internal/models"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	app := fs.String("app", "", "only partitions of this app")
+	from := fs.String("from", "", "first day to import (YYYY-MM-DD)")
+	to := fs.String("to", "", "last day to import (YYYY-MM-DD)")
+	dryRun := fs.Bool("dry-run", false, "list the partitions to import without importing")
+	fs.Parse(os.Args[2:])
+
+	cfg := config.Load()
+	store, err := archive.OpenStore(archive.ConfigFrom(cfg))
+	if err != nil {
+		fail(err)
+	}
+	if store == nil {
+		fail(fmt.Errorf("no archive store configured, set APPSTATS_ARCHIVE_DIR or APPSTATS_ARCHIVE_S3_ENDPOINT"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	m, err := archive.ReadManifest(ctx, store)
+	if err != nil {
+		fail(err)
+	}
+	var parts []models.ArchivePartition
+	for _, p := range m.Partitions {
+		if (*app == "" || p.App == *app) && (*from == "" || p.Day >= *from) && (*to == "" || p.Day <= *to) {
+			parts = append(parts, p)
+		}
+	}
+
+	switch os.Args[1] {
+	case "list":
+		for _, p := range parts {
+			fmt.Printf("%s\t%s\t%d events\t%d bytes\t%s\n", p.App, p.Day, p.Events, p.Bytes, p.Key)
+		}
+	case "import":
+		if *dryRun {
+			for _, p := range parts {
+				fmt.Printf("would import %s %s (%d events)\n", p.App, p.Day, p.Events)
+			}
+			return
+		}
+		db, err := gorm.Open(mysql.Open(cfg.DSN), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+		if err != nil {
+			fail(err)
+		}
+		var total int64
+		for _, p := range parts {
+			n, err := archive.Import(ctx, db, store, p)
+			total += n
+			if err != nil {
+				fail(fmt.Errorf("import %s %s: %w", p.App, p.Day, err))
+			}
+			fmt.Printf("imported %s %s: %d of %d events inserted\n", p.App, p.Day, n, p.Events)
+		}
+		fmt.Printf("%d partitions, %d events inserted\n", len(parts), total)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: archive list|import [-app APP] [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-dry-run]")
+	os.Exit(2)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "archive:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,275 @@
+package alerts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+	"appstats/internal/notify"
+	"appstats/internal/stats"
+	"appstats/internal/traffic"
+)
+
+// MetricIngestErrorRate is the share of rejected reports, measured in-process.
+const MetricIngestErrorRate = "ingest_error_rate"
+
+// Rule kinds.
+const (
+	KindThreshold = "threshold"
+	KindAnomaly   = "anomaly"
+)
+
+// Defaults applied to rules that leave the fields empty.
+const (
+	defaultWindowMinutes   = 24 * 60
+	defaultIntervalMinutes = 60
+	defaultBaselineWeeks   = 4
+)
+
+// Validate checks a rule and fills in defaults.
+func Validate(r *models.AlertRule) error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	switch r.Metric {
+	case stats.MetricNewUsers, stats.MetricActiveUsers, stats.MetricEvents, MetricIngestErrorRate:
+	default:
+		return fmt.Errorf("unsupported metric %q", r.Metric)
+	}
+	switch r.Kind {
+	case KindThreshold:
+		if r.Operator != "<" && r.Operator != ">" {
+			return errors.New(`threshold rules need operator "<" or ">"`)
+		}
+	case KindAnomaly:
+		if r.Metric == MetricIngestErrorRate {
+			return errors.New("ingest_error_rate only supports threshold rules")
+		}
+		if r.Operator != "drop" && r.Operator != "rise" && r.Operator != "both" {
+			return errors.New(`anomaly rules need operator "drop", "rise" or "both"`)
+		}
+		if r.Threshold <= 0 {
+			return errors.New("anomaly threshold must be a positive deviation, e.g. 0.3")
+		}
+	default:
+		return fmt.Errorf("unsupported kind %q", r.Kind)
+	}
+	if r.WindowMinutes <= 0 {
+		r.WindowMinutes = defaultWindowMinutes
+	}
+	if r.IntervalMinutes <= 0 {
+		r.IntervalMinutes = defaultIntervalMinutes
+	}
+	if r.BaselineWeeks <= 0 {
+		r.BaselineWeeks = defaultBaselineWeeks
+	}
+	if r.State == "" {
+		r.State = models.AlertStateOK
+	}
+	return nil
+}
+
+// Engine evaluates enabled alert rules on a schedule, records alert history
+// and sends notifications on state changes. Only one instance should run
+// per database.
+type Engine struct {
+	db       *gorm.DB
+	channels *notify.Registry
+	tick     time.Duration
+	now      func() time.Time
+
+	// OnTransition, when set, is called after a firing or resolved alert
+	// event has been recorded.
+	OnTransition func(rule models.AlertRule, evt models.AlertEvent)
+}
+
+// NewEngine returns an engine checking for due rules every tick.
+func NewEngine(db *gorm.DB, channels *notify.Registry, tick time.Duration) *Engine {
+	return &Engine{db: db, channels: channels, tick: tick, now: time.Now}
+}
+
+// Run evaluates due rules until ctx is cancelled.
+func (e *Engine) Run(ctx context.Context) {
+	t := time.NewTicker(e.tick)
+	defer t.Stop()
+	for {
+		e.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue evaluates every enabled rule whose interval has elapsed.
+func (e *Engine) RunDue(ctx context.Context) {
+	var rules []models.AlertRule
+	if err := e.db.Where("enabled = ?", true).Find(&rules).Error; err != nil {
+		slog.Error("load alert rules failed", slog.Any("error", err))
+		return
+	}
+	now := e.now()
+	for i := range rules {
+		r := &rules[i]
+		if r.LastEvaluatedAt != nil && now.Sub(*r.LastEvaluatedAt) < time.Duration(r.IntervalMinutes)*time.Minute {
+			continue
+		}
+		if _, err := e.Evaluate(ctx, r); err != nil {
+			slog.Error("evaluate alert rule failed", slog.Uint64("rule_id", uint64(r.ID)), slog.Any("error", err))
+		}
+	}
+}
+
+// Result is the outcome of evaluating a rule.
+type Result struct {
+	Value    float64  `json:"value"`
+	Baseline *float64 `json:"baseline"`
+	Firing   bool     `json:"firing"`
+	Message  string   `json:"message"`
+}
+
+// Check computes the rule outcome without changing state or notifying.
+func (e *Engine) Check(r *models.AlertRule) (*Result, error) {
+	window := time.Duration(r.WindowMinutes) * time.Minute
+	to := e.now().UTC()
+	from := to.Add(-window)
+
+	value, err := e.measure(r, from, to)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{Value: value}
+
+	if r.Kind == KindThreshold {
+		res.Firing = (r.Operator == ">" && value > r.Threshold) || (r.Operator == "<" && value < r.Threshold)
+		res.Message = fmt.Sprintf("%s = %s (阈值 %s %s)", r.Metric, formatValue(value), r.Operator, formatValue(r.Threshold))
+		return res, nil
+	}
+
+	// Seasonal baseline: the same window in each of the previous weeks.
+	var sum float64
+	for k := 1; k <= r.BaselineWeeks; k++ {
+		shift := time.Duration(k) * 7 * 24 * time.Hour
+		v, err := e.measure(r, from.Add(-shift), to.Add(-shift))
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+	}
+	baseline := sum / float64(r.BaselineWeeks)
+	res.Baseline = &baseline
+	if baseline == 0 {
+		res.Message = fmt.Sprintf("%s = %s，基线为 0，跳过", r.Metric, formatValue(value))
+		return res, nil
+	}
+
+	dev := (value - baseline) / baseline
+	switch r.Operator {
+	case "drop":
+		res.Firing = dev <= -r.Threshold
+	case "rise":
+		res.Firing = dev >= r.Threshold
+	default:
+		res.Firing = math.Abs(dev) >= r.Threshold
+	}
+	res.Message = fmt.Sprintf("%s = %s，基线 %s（前 %d 周同期），偏离 %+.1f%%",
+		r.Metric, formatValue(value), formatValue(baseline), r.BaselineWeeks, dev*100)
+	return res, nil
+}
+
+// Evaluate checks the rule, persists its new state and records and notifies
+// transitions between ok and firing.
+func (e *Engine) Evaluate(ctx context.Context, r *models.AlertRule) (*Result, error) {
+	res, err := e.Check(r)
+	if err != nil {
+		return nil, err
+	}
+
+	now := e.now()
+	prev := r.State
+	r.LastEvaluatedAt = &now
+	r.LastValue = res.Value
+	if res.Firing {
+		r.State = models.AlertStateFiring
+	} else {
+		r.State = models.AlertStateOK
+	}
+	if err := e.db.Model(r).Select("state", "last_value", "last_evaluated_at").Updates(r).Error; err != nil {
+		return nil, err
+	}
+
+	var status string
+	switch {
+	case res.Firing && prev != models.AlertStateFiring:
+		status = models.AlertStateFiring
+	case !res.Firing && prev == models.AlertStateFiring:
+		status = models.AlertResolved
+	default:
+		return res, nil
+	}
+
+	evt := models.AlertEvent{
+		RuleID:   r.ID,
+		RuleName: r.Name,
+		Status:   status,
+		Value:    res.Value,
+		Baseline: res.Baseline,
+		Message:  res.Message,
+	}
+	subject := "[告警] " + r.Name
+	if status == models.AlertResolved {
+		subject = "[恢复] " + r.Name
+	}
+	if err := e.channels.SendAll(ctx, r.Channels, notify.Message{
+		Subject: subject,
+		Text:    res.Message,
+		Fields: map[string]any{
+			"rule_id":  r.ID,
+			"status":   status,
+			"metric":   r.Metric,
+			"value":    res.Value,
+			"baseline": res.Baseline,
+		},
+	}); err != nil {
+		evt.NotifyError = models.Truncate(err.Error(), 512)
+		slog.Warn("alert notification failed", slog.Uint64("rule_id", uint64(r.ID)), slog.Any("error", err))
+	}
+	if err := e.db.Create(&evt).Error; err != nil {
+		return nil, err
+	}
+	if e.OnTransition != nil {
+		e.OnTransition(*r, evt)
+	}
+	return res, nil
+}
+
+func (e *Engine) measure(r *models.AlertRule, from, to time.Time) (float64, error) {
+	if r.Metric == MetricIngestErrorRate {
+		rate, _ := metrics.IngestErrorRate(to.Sub(from))
+		return rate, nil
+	}
+
+	var f stats.Filter
+	if r.App != "" {
+		f = append(f, stats.Condition{Field: stats.FieldApp, Op: stats.OpEquals, Values: []string{r.App}})
+	}
+	if r.Metric == stats.MetricEvents && r.EventType != "" {
+		f = append(f, stats.Condition{Field: stats.FieldEventType, Op: stats.OpEquals, Values: []string{r.EventType}})
+	}
+	return stats.Measure(e.db, r.Metric, from, to, traffic.ExcludeInternal(e.db, f))
+}
+
+func formatValue(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.4g", v)
+}
@@ -0,0 +1,207 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/notify"
+	"appstats/internal/stats"
+	"appstats/internal/testdb"
+)
+
+var now = time.Date(2024, 3, 29, 12, 0, 0, 0, time.UTC)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t, &models.UserEvent{}, &models.AlertRule{}, &models.AlertEvent{})
+}
+
+// seed stores n launch events of app at t.
+func seed(t *testing.T, db *gorm.DB, app string, at time.Time, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := db.Create(&models.UserEvent{App: app, UserID: "u", EventType: "launch", EventTime: at}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newEngine(db *gorm.DB, channels *notify.Registry) *Engine {
+	e := NewEngine(db, channels, time.Minute)
+	e.now = func() time.Time { return now }
+	return e
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    models.AlertRule
+		wantErr string
+	}{
+		{name: "threshold", rule: models.AlertRule{Name: "a", Metric: stats.MetricEvents, Kind: KindThreshold, Operator: ">"}},
+		{name: "anomaly", rule: models.AlertRule{Name: "a", Metric: stats.MetricActiveUsers, Kind: KindAnomaly, Operator: "drop", Threshold: 0.3}},
+		{name: "no name", rule: models.AlertRule{Metric: stats.MetricEvents, Kind: KindThreshold, Operator: ">"}, wantErr: "name"},
+		{name: "unknown metric", rule: models.AlertRule{Name: "a", Metric: "x", Kind: KindThreshold, Operator: ">"}, wantErr: "metric"},
+		{name: "threshold operator", rule: models.AlertRule{Name: "a", Metric: stats.MetricEvents, Kind: KindThreshold, Operator: "drop"}, wantErr: "operator"},
+		{name: "anomaly operator", rule: models.AlertRule{Name: "a", Metric: stats.MetricEvents, Kind: KindAnomaly, Operator: ">", Threshold: 0.3}, wantErr: "operator"},
+		{name: "anomaly threshold", rule: models.AlertRule{Name: "a", Metric: stats.MetricEvents, Kind: KindAnomaly, Operator: "rise"}, wantErr: "positive"},
+		{name: "anomaly error rate", rule: models.AlertRule{Name: "a", Metric: MetricIngestErrorRate, Kind: KindAnomaly, Operator: "rise", Threshold: 1}, wantErr: "threshold rules"},
+		{name: "unknown kind", rule: models.AlertRule{Name: "a", Metric: stats.MetricEvents, Kind: "x"}, wantErr: "kind"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(&tt.rule)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.rule.WindowMinutes != defaultWindowMinutes || tt.rule.IntervalMinutes != defaultIntervalMinutes ||
+				tt.rule.BaselineWeeks != defaultBaselineWeeks || tt.rule.State != models.AlertStateOK {
+				t.Errorf("defaults not applied: %+v", tt.rule)
+			}
+		})
+	}
+}
+
+func TestCheckThreshold(t *testing.T) {
+	db := openTestDB(t)
+	seed(t, db, "shop", now.Add(-30*time.Minute), 5)
+	seed(t, db, "shop", now.Add(-2*time.Hour), 7) // outside the window
+	seed(t, db, "other", now.Add(-10*time.Minute), 9)
+	e := newEngine(db, nil)
+
+	tests := []struct {
+		operator  string
+		threshold float64
+		firing    bool
+	}{
+		{">", 4, true},
+		{">", 5, false},
+		{"<", 6, true},
+		{"<", 5, false},
+	}
+	for _, tt := range tests {
+		r := &models.AlertRule{App: "shop", Metric: stats.MetricEvents, Kind: KindThreshold, Operator: tt.operator,
+			Threshold: tt.threshold, WindowMinutes: 60}
+		res, err := e.Check(r)
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if res.Value != 5 || res.Firing != tt.firing || res.Baseline != nil {
+			t.Errorf("%s %v: got value %v firing %v baseline %v, want 5 %v nil",
+				tt.operator, tt.threshold, res.Value, res.Firing, res.Baseline, tt.firing)
+		}
+	}
+}
+
+func TestCheckSeasonalBaseline(t *testing.T) {
+	db := openTestDB(t)
+	week := 7 * 24 * time.Hour
+	seed(t, db, "shop", now.Add(-time.Minute), 9)
+	seed(t, db, "shop", now.Add(-week-time.Minute), 10)
+	seed(t, db, "shop", now.Add(-2*week-time.Minute), 20)
+	seed(t, db, "shop", now.Add(-3*week-time.Minute), 1000) // beyond BaselineWeeks
+	e := newEngine(db, nil)
+
+	tests := []struct {
+		operator  string
+		threshold float64
+		firing    bool
+	}{
+		{"drop", 0.3, true}, // 9 is 40% below the baseline of 15
+		{"drop", 0.5, false},
+		{"rise", 0.3, false},
+		{"both", 0.4, true},
+		{"both", 0.41, false},
+	}
+	for _, tt := range tests {
+		r := &models.AlertRule{App: "shop", Metric: stats.MetricEvents, Kind: KindAnomaly, Operator: tt.operator,
+			Threshold: tt.threshold, WindowMinutes: 60, BaselineWeeks: 2}
+		res, err := e.Check(r)
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if res.Value != 9 || res.Baseline == nil || *res.Baseline != 15 || res.Firing != tt.firing {
+			t.Errorf("%s %v: got %+v, want value 9, baseline 15, firing %v", tt.operator, tt.threshold, res, tt.firing)
+		}
+	}
+
+	// Without history there is no baseline to compare with.
+	r := &models.AlertRule{App: "new", Metric: stats.MetricEvents, Kind: KindAnomaly, Operator: "both",
+		Threshold: 0.1, WindowMinutes: 60, BaselineWeeks: 2}
+	res, err := e.Check(r)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if res.Firing || res.Baseline == nil || *res.Baseline != 0 || !strings.Contains(res.Message, "跳过") {
+		t.Errorf("zero baseline: got %+v", res)
+	}
+}
+
+func TestEvaluateNotifiesTransitions(t *testing.T) {
+	db := openTestDB(t)
+	var mu sync.Mutex
+	var got []notify.Message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg notify.Message
+		json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		got = append(got, msg)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	rule := models.AlertRule{Name: "too many", App: "shop", Metric: stats.MetricEvents, Kind: KindThreshold,
+		Operator: ">", Threshold: 2, WindowMinutes: 60, Enabled: true,
+		Channels: []models.ChannelSpec{{Type: "webhook", URL: srv.URL}}}
+	if err := Validate(&rule); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&rule)
+	e := newEngine(db, notify.NewRegistry(nil))
+	var transitions []string
+	e.OnTransition = func(_ models.AlertRule, evt models.AlertEvent) { transitions = append(transitions, evt.Status) }
+
+	seed(t, db, "shop", now.Add(-time.Minute), 3)
+	if _, err := e.Evaluate(context.Background(), &rule); err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+	// Still firing: no new notification.
+	if _, err := e.Evaluate(context.Background(), &rule); err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	if _, err := e.Evaluate(context.Background(), &rule); err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+
+	if strings.Join(transitions, ",") != "firing,resolved" {
+		t.Errorf("transitions = %v", transitions)
+	}
+	if len(got) != 2 || got[0].Subject != "[告警] too many" || got[1].Subject != "[恢复] too many" {
+		t.Errorf("notifications = %+v", got)
+	}
+	var events []models.AlertEvent
+	db.Order("id").Find(&events)
+	if len(events) != 2 || events[0].NotifyError != "" {
+		t.Errorf("alert history = %+v", events)
+	}
+	var stored models.AlertRule
+	db.First(&stored, rule.ID)
+	if stored.State != models.AlertStateOK || stored.LastEvaluatedAt == nil {
+		t.Errorf("stored rule = %+v", stored)
+	}
+}
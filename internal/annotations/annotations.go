@@ -0,0 +1,90 @@
+package annotations
+
+import (
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"appstats/internal/models"
+)
+
+// VersionWatcher creates a release annotation the first time an app version
+// is seen in user_events.
+type VersionWatcher struct {
+	db   *gorm.DB
+	seen sync.Map // app + "\x00" + version -> struct{}
+
+	// OnFirstSeen, when set, is called after the annotation of a new
+	// version has been created.
+	OnFirstSeen func(ann models.Annotation)
+}
+
+// NewVersionWatcher returns a watcher backed by db.
+func NewVersionWatcher(db *gorm.DB) *VersionWatcher {
+	return &VersionWatcher{db: db}
+}
+
+// Observe records that app reported version. It is cheap for versions that
+// were already handled by this process. It reports whether a new annotation
+// was created.
+func (w *VersionWatcher) Observe(app, version string) (bool, error) {
+	if version == "" {
+		return false, nil
+	}
+	key := app + "\x00" + version
+	if _, ok := w.seen.Load(key); ok {
+		return false, nil
+	}
+
+	// The version may predate this process or the annotations table, so date
+	// the annotation by its earliest event rather than by now.
+	var first sql.NullTime
+	if err := w.db.Raw(`
+        SELECT MIN(event_time) FROM user_events WHERE app_version = ? AND app = ?
+    `, version, app).Row().Scan(&first); err != nil {
+		return false, err
+	}
+	date := time.Now().UTC()
+	if first.Valid {
+		date = first.Time.UTC()
+	}
+
+	v := version
+	ann := models.Annotation{
+		Date:       time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC),
+		App:        app,
+		Label:      "发布 " + version,
+		Category:   models.AnnotationRelease,
+		AppVersion: &v,
+		Source:     models.AnnotationSourceAuto,
+	}
+	res := w.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ann)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	w.seen.Store(key, struct{}{})
+
+	created := res.RowsAffected > 0
+	if created {
+		slog.Info("version first seen", slog.String("app", app), slog.String("app_version", version))
+		if w.OnFirstSeen != nil {
+			w.OnFirstSeen(ann)
+		}
+	}
+	return created, nil
+}
+
+// List returns the annotations dated within [start, end), optionally for one app.
+func List(db *gorm.DB, start, end time.Time, app string) ([]models.Annotation, error) {
+	q := db.Where("date >= ? AND date < ?", start, end)
+	if app != "" {
+		q = q.Where("app = ?", app)
+	}
+	var res []models.Annotation
+	err := q.Order("date, id").Find(&res).Error
+	return res, err
+}
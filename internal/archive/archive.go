@@ -0,0 +1,681 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"appstats/internal/models"
+)
+
+const (
+	// ManifestKey is the key of the manifest listing all partitions.
+	ManifestKey = "manifest.json"
+	// maxPartitionsPerRun bounds the work of a single archiver run.
+	maxPartitionsPerRun = 50
+	// batchSize is the number of events read or inserted at a time.
+	batchSize = 1000
+)
+
+// Manifest lists the partitions in an archive store, so that it can be
+// re-imported without the database it was written from.
+type Manifest struct {
+	Version    int                       `json:"version"`
+	UpdatedAt  time.Time                 `json:"updated_at"`
+	Partitions []models.ArchivePartition `json:"partitions"`
+}
+
+// PartitionKey returns the key of the partition of app and day with the
+// SHA-256 checksum sum. Each version of a partition gets a key of its own,
+// so the recorded partition keeps matching its object until the record is
+// switched to the new one.
+func PartitionKey(app, day, sum string) string {
+	return "events/app=" + url.PathEscape(app) + "/" + day + "-" + sum[:16] + ".ndjson.gz"
+}
+
+// Archiver writes completed days of user_events to the store once they are
+// older than a number of days.
+//
+// Only one instance should run per database.
+type Archiver struct {
+	db        *gorm.DB
+	store     Store
+	afterDays int
+	tick      time.Duration
+	now       func() time.Time
+	// replaced are the keys of partition versions to delete once the
+	// manifest no longer lists them.
+	replaced []string
+}
+
+// NewArchiver returns an archiver writing the events older than afterDays
+// days to store, checking every tick.
+func NewArchiver(db *gorm.DB, store Store, afterDays int, tick time.Duration) *Archiver {
+	return &Archiver{db: db, store: store, afterDays: afterDays, tick: tick, now: time.Now}
+}
+
+// Run archives events until ctx is cancelled.
+func (a *Archiver) Run(ctx context.Context) {
+	t := time.NewTicker(a.tick)
+	defer t.Stop()
+	for {
+		if _, err := a.RunDue(ctx); err != nil {
+			slog.Error("archive events failed", slog.String("store", a.store.String()), slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue archives, per app and in day order, the days with events that
+// are old enough and not archived yet, then rewrites the manifest. It
+// returns the partitions written.
+func (a *Archiver) RunDue(ctx context.Context) ([]models.ArchivePartition, error) {
+	now := a.now().UTC()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -a.afterDays)
+
+	var apps []string
+	if err := a.db.Model(&models.UserEvent{}).Distinct("app").Pluck("app", &apps).Error; err != nil {
+		return nil, err
+	}
+	var written []models.ArchivePartition
+	var err error
+	for _, app := range apps {
+		if err = a.archiveApp(ctx, app, cutoff, &written); err != nil {
+			break
+		}
+	}
+	if len(written) > 0 {
+		merr := WriteManifest(ctx, a.db, a.store)
+		if merr == nil {
+			a.replaced = deleteObjects(ctx, a.store, a.replaced)
+		} else if err == nil {
+			err = merr
+		}
+	}
+	return written, err
+}
+
+// deleteObjects deletes the objects under keys and returns the keys that
+// could not be deleted, to try again later.
+func deleteObjects(ctx context.Context, store Store, keys []string) []string {
+	var failed []string
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			slog.Warn("delete replaced archive object failed", slog.String("key", key), slog.Any("error", err))
+			failed = append(failed, key)
+		}
+	}
+	return failed
+}
+
+func (a *Archiver) archiveApp(ctx context.Context, app string, cutoff time.Time, written *[]models.ArchivePartition) error {
+	// Late events on archived days are merged into their partitions first,
+	// as they keep retention from purging those days.
+	stale, err := StaleDays(a.db, app, maxPartitionsPerRun-len(*written))
+	if err != nil {
+		return err
+	}
+	for _, day := range stale {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p, err := a.ArchiveDay(ctx, app, day)
+		if err != nil {
+			return fmt.Errorf("archive %s of %s: %w", day.Format("2006-01-02"), app, err)
+		}
+		*written = append(*written, *p)
+	}
+
+	start, err := ArchivedBefore(a.db, app)
+	if err != nil {
+		return err
+	}
+	for len(*written) < maxPartitionsPerRun {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		q := a.db.Where("app = ? AND event_time < ?", app, cutoff)
+		if !start.IsZero() {
+			q = q.Where("event_time >= ?", start)
+		}
+		next, err := firstEventTime(q)
+		if err != nil || next == nil {
+			return err
+		}
+		day := next.UTC().Truncate(24 * time.Hour)
+		p, err := a.ArchiveDay(ctx, app, day)
+		if err != nil {
+			return fmt.Errorf("archive %s of %s: %w", day.Format("2006-01-02"), app, err)
+		}
+		*written = append(*written, *p)
+		start = day.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+// ArchivedBefore returns the day after the last archived day of app, or the
+// zero time when nothing is archived. Days are archived in order, so every
+// event of app before that day was archived, except the late events
+// reported by StaleDays.
+func ArchivedBefore(db *gorm.DB, app string) (time.Time, error) {
+	var last []models.ArchivePartition
+	if err := db.Where("app = ?", app).Order("day DESC").Limit(1).Find(&last).Error; err != nil || len(last) == 0 {
+		return time.Time{}, err
+	}
+	day, err := time.Parse("2006-01-02", last[0].Day)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+// StaleDays returns, in order, up to limit archived days of app with events
+// inserted after their partition was written, e.g. events reported late.
+func StaleDays(db *gorm.DB, app string, limit int) ([]time.Time, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	first, err := firstEventTime(db.Where("app = ?", app))
+	if err != nil || first == nil {
+		return nil, err
+	}
+	var parts []models.ArchivePartition
+	if err := db.Select("day", "max_event_id").Where("app = ? AND day >= ?", app, first.UTC().Format("2006-01-02")).
+		Order("day").Find(&parts).Error; err != nil {
+		return nil, err
+	}
+	var stale []time.Time
+	for _, p := range parts {
+		day, err := time.Parse("2006-01-02", p.Day)
+		if err != nil {
+			return nil, err
+		}
+		var ids []uint
+		if err := db.Model(&models.UserEvent{}).Where("app = ? AND event_time >= ? AND event_time < ? AND id > ?",
+			app, day, day.AddDate(0, 0, 1), p.MaxEventID).Limit(1).Pluck("id", &ids).Error; err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			if stale = append(stale, day); len(stale) == limit {
+				break
+			}
+		}
+	}
+	return stale, nil
+}
+
+// firstEventTime returns the earliest event time of the events selected by
+// q, or nil when there are none.
+func firstEventTime(q *gorm.DB) (*time.Time, error) {
+	var first []time.Time
+	if err := q.Model(&models.UserEvent{}).Order("event_time").Limit(1).Pluck("event_time", &first).Error; err != nil || len(first) == 0 {
+		return nil, err
+	}
+	return &first[0], nil
+}
+
+// ArchiveDay writes the events of app on day (a UTC midnight) to the store
+// and records the partition. When the day was archived before, the events
+// inserted since are appended to the events of the existing partition, as
+// retention may have purged those from user_events already. The new version
+// is written under a key of its own; RunDue deletes the old one after
+// rewriting the manifest.
+func (a *Archiver) ArchiveDay(ctx context.Context, app string, day time.Time) (*models.ArchivePartition, error) {
+	p := &models.ArchivePartition{App: app, Day: day.Format("2006-01-02")}
+	var prev []models.ArchivePartition
+	if err := a.db.Where("app = ? AND day = ?", app, p.Day).Limit(1).Find(&prev).Error; err != nil {
+		return nil, err
+	}
+	if len(prev) > 0 {
+		p = &prev[0]
+	}
+
+	pf, err := newPartitionFile()
+	if err != nil {
+		return nil, err
+	}
+	defer pf.remove()
+	if len(prev) > 0 {
+		if err := copyPartition(ctx, a.store, p, pf.zw); err != nil {
+			return nil, err
+		}
+	}
+	enc := json.NewEncoder(pf.zw)
+	var events []models.UserEvent
+	res := a.db.Where("app = ? AND event_time >= ? AND event_time < ? AND id > ?", app, day, day.AddDate(0, 0, 1), p.MaxEventID).
+		Order("id").FindInBatches(&events, batchSize, func(tx *gorm.DB, batch int) error {
+		for i := range events {
+			if err := enc.Encode(&events[i]); err != nil {
+				return err
+			}
+			if p.MinEventID == 0 || events[i].ID < p.MinEventID {
+				p.MinEventID = events[i].ID
+			}
+			p.MaxEventID = events[i].ID
+		}
+		p.Events += int64(len(events))
+		return ctx.Err()
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	replaced, err := pf.save(ctx, a.db, a.store, p)
+	if err != nil {
+		return nil, err
+	}
+	if replaced != "" {
+		a.replaced = append(a.replaced, replaced)
+	}
+	slog.Info("events archived", slog.String("app", app), slog.String("day", p.Day),
+		slog.Int64("events", p.Events), slog.String("key", p.Key))
+	return p, nil
+}
+
+// partitionFile is a new version of a partition, compressed into a
+// temporary file.
+type partitionFile struct {
+	f   *os.File
+	sum hash.Hash
+	zw  *gzip.Writer
+}
+
+func newPartitionFile() (*partitionFile, error) {
+	f, err := os.CreateTemp("", "appstats-archive-*.ndjson.gz")
+	if err != nil {
+		return nil, err
+	}
+	pf := &partitionFile{f: f, sum: sha256.New()}
+	pf.zw = gzip.NewWriter(io.MultiWriter(f, pf.sum))
+	return pf, nil
+}
+
+func (pf *partitionFile) remove() {
+	pf.f.Close()
+	os.Remove(pf.f.Name())
+}
+
+// save stores the file as the new version of p and then records p, so the
+// recorded partition always matches a stored object: should either step
+// fail, the previous version stays in place. A partition left without
+// events is deleted instead. It returns the key of the replaced version,
+// which the caller deletes once the manifest no longer lists it.
+func (pf *partitionFile) save(ctx context.Context, db *gorm.DB, store Store, p *models.ArchivePartition) (string, error) {
+	if err := pf.zw.Close(); err != nil {
+		return "", err
+	}
+	old := p.Key
+	if p.Events == 0 {
+		if p.ID == 0 {
+			return "", nil
+		}
+		return old, db.Delete(p).Error
+	}
+	size, err := pf.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	if _, err := pf.f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	next := *p
+	next.Bytes = size
+	next.SHA256 = hex.EncodeToString(pf.sum.Sum(nil))
+	next.Key = PartitionKey(p.App, p.Day, next.SHA256)
+	if err := store.Put(ctx, next.Key, pf.f, next.Bytes); err != nil {
+		return "", err
+	}
+	if err := db.Save(&next).Error; err != nil {
+		return "", err
+	}
+	*p = next
+	if old == p.Key {
+		return "", nil
+	}
+	return old, nil
+}
+
+// copyPartition writes the decompressed events of the stored partition p to
+// w, after verifying its checksum.
+func copyPartition(ctx context.Context, store Store, p *models.ArchivePartition, w io.Writer) error {
+	f, err := download(ctx, store, *p)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	_, err = io.Copy(w, zr)
+	return err
+}
+
+// WriteManifest writes the manifest of all recorded partitions to store.
+func WriteManifest(ctx context.Context, db *gorm.DB, store Store) error {
+	m := Manifest{Version: 1, UpdatedAt: time.Now().UTC()}
+	if err := db.Order("app, day").Find(&m.Partitions).Error; err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, ManifestKey, bytes.NewReader(body), int64(len(body)))
+}
+
+// ReadManifest reads the manifest of store.
+func ReadManifest(ctx context.Context, store Store) (*Manifest, error) {
+	r, err := store.Get(ctx, ManifestKey)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// Import inserts the events of partition p back into user_events after
+// verifying its checksum. Events that still exist, by ID, are skipped, so a
+// partition can be imported again safely. Events reported under an ID that
+// has since been linked to a user are stored under that user, as Link does
+// with user_events. EraseUsers rewrites partitions when a user's data is
+// erased, but a partition restored from a backup or written into another
+// database may predate that, so events of users with a delete or anonymize
+// audit record in db, or opted out of p.App, are skipped as well. It returns
+// the number of events inserted.
+func Import(ctx context.Context, db *gorm.DB, store Store, p models.ArchivePartition) (int64, error) {
+	// Download first, so a corrupt file is detected before anything is inserted.
+	f, err := download(ctx, store, p)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var inserted, skipped int64
+	batch := make([]models.UserEvent, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		canonical, err := resolveAliases(db, batch)
+		if err != nil {
+			return err
+		}
+		erased, err := erasedUsers(db, p.App, batch, canonical)
+		if err != nil {
+			return err
+		}
+		keep := batch[:0]
+		for _, evt := range batch {
+			reported := evt.UserID
+			if id, ok := canonical[reported]; ok {
+				evt.UserID = id
+			}
+			if erased[reported] || erased[evt.UserID] {
+				skipped++
+				continue
+			}
+			keep = append(keep, evt)
+		}
+		batch = batch[:0]
+		if len(keep) == 0 {
+			return nil
+		}
+		res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&keep)
+		inserted += res.RowsAffected
+		return res.Error
+	}
+	for line := 1; sc.Scan(); line++ {
+		var evt models.UserEvent
+		if err := json.Unmarshal(sc.Bytes(), &evt); err != nil {
+			return inserted, fmt.Errorf("%s line %d: %w", p.Key, line, err)
+		}
+		if evt.ID == 0 {
+			return inserted, fmt.Errorf("%s line %d: missing event id", p.Key, line)
+		}
+		batch = append(batch, evt)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return inserted, err
+			}
+			if ctx.Err() != nil {
+				return inserted, ctx.Err()
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return inserted, err
+	}
+	if err := flush(); err != nil {
+		return inserted, err
+	}
+	if skipped > 0 {
+		slog.Info("archived events of erased users skipped", slog.String("key", p.Key), slog.Int64("events", skipped))
+	}
+	return inserted, nil
+}
+
+// EraseUsers removes the archived events of the user IDs ids from the
+// partitions of app, or of every app when app is empty. With a pseudonym
+// the events are kept under it without their properties instead, as
+// privacy.Erase anonymizes user_events. Partitions holding such events are
+// written again under a new key and partitions left empty are deleted;
+// the manifest is rewritten before the old versions are deleted. Every
+// partition of the apps is read, as partitions are not indexed by user. It
+// returns the number of archived events removed or anonymized.
+func EraseUsers(ctx context.Context, db *gorm.DB, store Store, ids []string, app, pseudonym string) (int64, error) {
+	q := db.Order("app, day")
+	if app != "" {
+		q = q.Where("app = ?", app)
+	}
+	var parts []models.ArchivePartition
+	if err := q.Find(&parts).Error; err != nil {
+		return 0, err
+	}
+	erase := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		erase[id] = true
+	}
+	var total int64
+	var replaced []string
+	var err error
+	for i := range parts {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var n int64
+		var old string
+		if n, old, err = eraseFromPartition(ctx, db, store, &parts[i], erase, pseudonym); err != nil {
+			err = fmt.Errorf("erase from %s: %w", parts[i].Key, err)
+			break
+		}
+		total += n
+		if old != "" {
+			replaced = append(replaced, old)
+		}
+	}
+	if total > 0 {
+		if merr := WriteManifest(ctx, db, store); merr != nil {
+			// The old versions stay listed; they are left in place.
+			return total, errors.Join(err, merr)
+		}
+		if failed := deleteObjects(ctx, store, replaced); len(failed) > 0 && err == nil {
+			err = fmt.Errorf("delete replaced archive objects %v", failed)
+		}
+	}
+	return total, err
+}
+
+// eraseFromPartition writes p again without the events of the users in
+// erase, or with them moved to pseudonym. It returns the number of events
+// changed and the key of the replaced version, if p was written again.
+func eraseFromPartition(ctx context.Context, db *gorm.DB, store Store, p *models.ArchivePartition,
+	erase map[string]bool, pseudonym string) (int64, string, error) {
+	f, err := download(ctx, store, *p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, "", err
+	}
+	defer zr.Close()
+	sc := bufio.NewScanner(zr)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	pf, err := newPartitionFile()
+	if err != nil {
+		return 0, "", err
+	}
+	defer pf.remove()
+	enc := json.NewEncoder(pf.zw)
+	next := *p
+	next.Events, next.MinEventID = 0, 0
+	var changed int64
+	for line := 1; sc.Scan(); line++ {
+		var evt models.UserEvent
+		if err := json.Unmarshal(sc.Bytes(), &evt); err != nil {
+			return 0, "", fmt.Errorf("line %d: %w", line, err)
+		}
+		if erase[evt.UserID] {
+			changed++
+			if pseudonym == "" {
+				continue
+			}
+			evt.UserID, evt.Properties = pseudonym, nil
+			err = enc.Encode(&evt)
+		} else {
+			_, err = pf.zw.Write(append(sc.Bytes(), '\n'))
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		next.Events++
+		if next.MinEventID == 0 || evt.ID < next.MinEventID {
+			next.MinEventID = evt.ID
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, "", err
+	}
+	if changed == 0 {
+		return 0, "", nil
+	}
+	// MaxEventID is kept: StaleDays compares it with the IDs in user_events.
+	old, err := pf.save(ctx, db, store, &next)
+	if err != nil {
+		return 0, "", err
+	}
+	slog.Info("archived events erased", slog.String("key", p.Key), slog.Int64("events", changed))
+	return changed, old, nil
+}
+
+// download copies the stored partition p to a temporary file, verifies its
+// checksum and returns the file positioned at its start. The caller removes
+// the file.
+func download(ctx context.Context, store Store, p models.ArchivePartition) (*os.File, error) {
+	r, err := store.Get(ctx, p.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	f, err := os.CreateTemp("", "appstats-partition-*.ndjson.gz")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, sum), r)
+	if got := hex.EncodeToString(sum.Sum(nil)); err == nil && p.SHA256 != "" && got != p.SHA256 {
+		err = fmt.Errorf("checksum mismatch for %s: got %s, want %s", p.Key, got, p.SHA256)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// resolveAliases returns the user each aliased user ID of events is linked
+// to.
+func resolveAliases(db *gorm.DB, events []models.UserEvent) (map[string]string, error) {
+	ids := make([]string, 0, len(events))
+	for _, evt := range events {
+		ids = append(ids, evt.UserID)
+	}
+	var aliases []models.UserAlias
+	if err := db.Where("alias_id IN ?", ids).Find(&aliases).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(aliases))
+	for _, a := range aliases {
+		res[a.AliasID] = a.UserID
+	}
+	return res, nil
+}
+
+// erasedUsers returns which users of events, or of the users they are
+// aliases of, must not be imported into app: those whose data was deleted
+// or anonymized and those who opted out.
+func erasedUsers(db *gorm.DB, app string, events []models.UserEvent, canonical map[string]string) (map[string]bool, error) {
+	ids := make([]string, 0, len(events)+len(canonical))
+	for _, evt := range events {
+		ids = append(ids, evt.UserID)
+	}
+	for _, id := range canonical {
+		ids = append(ids, id)
+	}
+	var erased, optedOut []string
+	if err := db.Model(&models.PrivacyAudit{}).Distinct("user_id").
+		Where("action IN ? AND error = '' AND user_id IN ?", []string{models.PrivacyDelete, models.PrivacyAnonymize}, ids).
+		Pluck("user_id", &erased).Error; err != nil {
+		return nil, err
+	}
+	if err := db.Model(&models.ConsentOptOut{}).Where("app = ? AND user_id IN ?", app, ids).
+		Pluck("user_id", &optedOut).Error; err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(erased)+len(optedOut))
+	for _, id := range append(erased, optedOut...) {
+		set[id] = true
+	}
+	return set, nil
+}
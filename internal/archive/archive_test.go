@@ -0,0 +1,448 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+// openTestDB returns an empty in-memory database with the tables the
+// archive reads and writes.
+func openTestDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t, &models.UserEvent{}, &models.ArchivePartition{}, &models.PrivacyAudit{}, &models.ConsentOptOut{},
+		&models.UserAlias{})
+}
+
+var day = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func seedEvents(t *testing.T, db *gorm.DB, events ...models.UserEvent) {
+	t.Helper()
+	for i := range events {
+		if err := db.Create(&events[i]).Error; err != nil {
+			t.Fatalf("create event: %v", err)
+		}
+	}
+}
+
+func event(app, user string, at time.Time) models.UserEvent {
+	return models.UserEvent{
+		App: app, UserID: user, EventType: "launch", AppVersion: "1.0.0", Platform: "ios", EventTime: at,
+		Properties: map[string]any{"screen": "home"},
+	}
+}
+
+// eventKeys describes events by the fields that must survive a round trip.
+func eventKeys(t *testing.T, db *gorm.DB) []string {
+	t.Helper()
+	var events []models.UserEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(events))
+	for _, e := range events {
+		keys = append(keys, strings.Join([]string{
+			e.App, e.UserID, e.EventType, e.EventTime.UTC().Format(time.RFC3339), e.Properties["screen"].(string),
+		}, "|"))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestArchiveDayImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db,
+		event("default", "u1", day.Add(time.Hour)),
+		event("default", "u2", day.Add(23*time.Hour)),
+		event("default", "u1", day.AddDate(0, 0, 1)), // next day
+		event("other", "u1", day.Add(2*time.Hour)),   // other app
+	)
+	want := eventKeys(t, db)[:0]
+	for _, k := range eventKeys(t, db) {
+		if strings.HasPrefix(k, "default|") && strings.Contains(k, "2024-03-01") {
+			want = append(want, k)
+		}
+	}
+
+	a := NewArchiver(db, store, 30, time.Hour)
+	p, err := a.ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	if p.Events != 2 || p.Key != "events/app=default/2024-03-01-"+p.SHA256[:16]+".ndjson.gz" || p.MinEventID != 1 || p.MaxEventID != 2 {
+		t.Errorf("partition = %+v", p)
+	}
+	raw := readObject(t, store, p.Key)
+	if sum := sha256.Sum256(raw); hex.EncodeToString(sum[:]) != p.SHA256 || int64(len(raw)) != p.Bytes {
+		t.Errorf("stored file does not match the recorded checksum and size")
+	}
+	if lines := strings.Count(string(gunzip(t, raw)), "\n"); lines != 2 {
+		t.Errorf("partition has %d lines, want 2", lines)
+	}
+
+	// Purge the archived day, then import it back.
+	if err := db.Where("app = ? AND event_time < ?", "default", day.AddDate(0, 0, 1)).Delete(&models.UserEvent{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	n, err := Import(ctx, db, store, *p)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Import inserted %d events, want 2", n)
+	}
+	var got []string
+	for _, k := range eventKeys(t, db) {
+		if strings.HasPrefix(k, "default|") && strings.Contains(k, "2024-03-01") {
+			got = append(got, k)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("imported events = %v, want %v", got, want)
+	}
+
+	// Importing again skips the events that exist.
+	if n, err := Import(ctx, db, store, *p); err != nil || n != 0 {
+		t.Errorf("second Import = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db, event("default", "u1", day.Add(time.Hour)))
+	p, err := NewArchiver(db, store, 30, time.Hour).ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+
+	p.SHA256 = strings.Repeat("0", 64)
+	if _, err := Import(ctx, db, store, *p); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Import err = %v, want a checksum mismatch", err)
+	}
+	var count int64
+	db.Model(&models.UserEvent{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d events inserted from a corrupt partition", count)
+	}
+}
+
+func TestImportSkipsErasedUsers(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db,
+		event("default", "kept", day.Add(time.Hour)),
+		event("default", "deleted", day.Add(time.Hour)),
+		event("default", "anonymized", day.Add(time.Hour)),
+		event("default", "failed", day.Add(time.Hour)),
+		event("default", "opted-out", day.Add(time.Hour)),
+		event("default", "opted-out-elsewhere", day.Add(time.Hour)),
+	)
+	p, err := NewArchiver(db, store, 30, time.Hour).ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	db.Create(&[]models.PrivacyAudit{
+		{Action: models.PrivacyDelete, UserID: "deleted"},
+		{Action: models.PrivacyAnonymize, UserID: "anonymized"},
+		{Action: models.PrivacyDelete, UserID: "failed", Error: "timeout"},
+		{Action: models.PrivacyExport, UserID: "kept"},
+	})
+	db.Create(&[]models.ConsentOptOut{
+		{App: "default", UserID: "opted-out"},
+		{App: "other", UserID: "opted-out-elsewhere"},
+	})
+
+	n, err := Import(ctx, db, store, *p)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	var users []string
+	db.Model(&models.UserEvent{}).Order("user_id").Pluck("user_id", &users)
+	if want := "failed,kept,opted-out-elsewhere"; strings.Join(users, ",") != want || n != 3 {
+		t.Errorf("Import inserted %d events of %v, want 3 of %s", n, users, want)
+	}
+}
+
+func TestArchiveDayMergesLateEvents(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db, event("default", "u1", day.Add(time.Hour)), event("default", "u2", day.Add(2*time.Hour)))
+	a := NewArchiver(db, store, 30, time.Hour)
+	first, err := a.ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	if stale, err := StaleDays(db, "default", 10); err != nil || len(stale) != 0 {
+		t.Fatalf("StaleDays before a late event = %v, %v", stale, err)
+	}
+
+	// Retention purges the day, then a late event arrives for it.
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	seedEvents(t, db, event("default", "late", day.Add(3*time.Hour)))
+	stale, err := StaleDays(db, "default", 10)
+	if err != nil || len(stale) != 1 || !stale[0].Equal(day) {
+		t.Fatalf("StaleDays = %v, %v; want [%s]", stale, err, day)
+	}
+
+	p, err := a.ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay again: %v", err)
+	}
+	if p.ID != first.ID || p.Events != 3 || p.MinEventID != 1 || p.MaxEventID != 3 || p.Key == first.Key {
+		t.Errorf("merged partition = %+v", p)
+	}
+	// The first version is kept until the manifest no longer lists it.
+	readObject(t, store, first.Key)
+	if len(a.replaced) != 1 || a.replaced[0] != first.Key {
+		t.Errorf("replaced = %v, want %s", a.replaced, first.Key)
+	}
+	var count int64
+	db.Model(&models.ArchivePartition{}).Count(&count)
+	if count != 1 {
+		t.Errorf("%d partitions recorded, want 1", count)
+	}
+	if stale, err := StaleDays(db, "default", 10); err != nil || len(stale) != 0 {
+		t.Errorf("StaleDays after merging = %v, %v", stale, err)
+	}
+
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	if n, err := Import(ctx, db, store, *p); err != nil || n != 3 {
+		t.Errorf("Import = %d, %v; want 3, nil", n, err)
+	}
+}
+
+func TestRunDueArchivesInDayOrder(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db,
+		event("default", "u1", day.Add(time.Hour)),
+		event("default", "u1", day.AddDate(0, 0, 2)),
+		event("default", "u1", day.AddDate(0, 0, 9)), // too recent
+	)
+	a := NewArchiver(db, store, 5, time.Hour)
+	a.now = func() time.Time { return day.AddDate(0, 0, 10).Add(time.Hour) }
+
+	written, err := a.RunDue(ctx)
+	if err != nil {
+		t.Fatalf("RunDue: %v", err)
+	}
+	var days []string
+	for _, p := range written {
+		days = append(days, p.Day)
+	}
+	if strings.Join(days, ",") != "2024-03-01,2024-03-03" {
+		t.Errorf("archived days = %v", days)
+	}
+	m, err := ReadManifest(ctx, store)
+	if err != nil {
+		t.Fatalf("ReadManifest: %v", err)
+	}
+	if len(m.Partitions) != 2 {
+		t.Errorf("manifest lists %d partitions, want 2", len(m.Partitions))
+	}
+	before, err := ArchivedBefore(db, "default")
+	if err != nil || !before.Equal(day.AddDate(0, 0, 3)) {
+		t.Errorf("ArchivedBefore = %s, %v", before, err)
+	}
+
+	if written, err := a.RunDue(ctx); err != nil || len(written) != 0 {
+		t.Errorf("second RunDue wrote %d partitions, %v", len(written), err)
+	}
+}
+
+func gunzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// failingStore fails every Put.
+type failingStore struct{ Store }
+
+func (failingStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return errors.New("store unavailable")
+}
+
+func TestArchiveDayFailedPutKeepsPartition(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db, event("default", "u1", day.Add(time.Hour)))
+	first, err := NewArchiver(db, store, 30, time.Hour).ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	seedEvents(t, db, event("default", "late", day.Add(2*time.Hour)))
+	if _, err := NewArchiver(db, failingStore{store}, 30, time.Hour).ArchiveDay(ctx, "default", day); err == nil {
+		t.Fatal("ArchiveDay with a failing store succeeded")
+	}
+	var p models.ArchivePartition
+	db.First(&p, first.ID)
+	if p.Key != first.Key || p.SHA256 != first.SHA256 || p.Events != 1 {
+		t.Errorf("partition after a failed Put = %+v, want %+v", p, first)
+	}
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	if n, err := Import(ctx, db, store, p); err != nil || n != 1 {
+		t.Errorf("Import after a failed Put = %d, %v; want 1, nil", n, err)
+	}
+}
+
+func TestRunDueDeletesReplacedVersions(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db, event("default", "u1", day.Add(time.Hour)))
+	a := NewArchiver(db, store, 5, time.Hour)
+	a.now = func() time.Time { return day.AddDate(0, 0, 10) }
+	written, err := a.RunDue(ctx)
+	if err != nil || len(written) != 1 {
+		t.Fatalf("RunDue = %v, %v", written, err)
+	}
+	seedEvents(t, db, event("default", "late", day.Add(2*time.Hour)))
+	again, err := a.RunDue(ctx)
+	if err != nil || len(again) != 1 || again[0].Key == written[0].Key {
+		t.Fatalf("second RunDue = %v, %v", again, err)
+	}
+	if _, err := store.Get(ctx, written[0].Key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("replaced version still stored: %v", err)
+	}
+	m, err := ReadManifest(ctx, store)
+	if err != nil || len(m.Partitions) != 1 || m.Partitions[0].Key != again[0].Key || m.Partitions[0].Events != 2 {
+		t.Errorf("manifest = %+v, %v", m, err)
+	}
+}
+
+func TestEraseUsers(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		app       string
+		pseudonym string
+		want      []string // users of the archived events, by partition
+		wantN     int64
+	}{
+		{name: "delete", want: []string{"kept", "kept"}, wantN: 4},
+		{name: "anonymize", pseudonym: "anon_1", want: []string{"anon_1,anon_1,kept", "anon_1,kept", "anon_1"}, wantN: 4},
+		{name: "one app", app: "default", want: []string{"kept", "kept", "u1"}, wantN: 3},
+	}
+	for _, tt := range tests {
+		db := openTestDB(t)
+		store := &LocalStore{Dir: t.TempDir()}
+		seedEvents(t, db,
+			event("default", "u1", day.Add(time.Hour)),
+			event("default", "device", day.Add(2*time.Hour)),
+			event("default", "kept", day.Add(3*time.Hour)),
+			event("default", "u1", day.AddDate(0, 0, 1)),
+			event("default", "kept", day.AddDate(0, 0, 1)),
+			// Only the erased user on this day: the partition goes.
+			event("other", "u1", day),
+		)
+		a := NewArchiver(db, store, 1, time.Hour)
+		a.now = func() time.Time { return day.AddDate(0, 0, 10) }
+		before, err := a.RunDue(ctx)
+		if err != nil || len(before) != 3 {
+			t.Fatalf("%s: RunDue = %v, %v", tt.name, before, err)
+		}
+
+		n, err := EraseUsers(ctx, db, store, []string{"u1", "device"}, tt.app, tt.pseudonym)
+		if err != nil || n != tt.wantN {
+			t.Errorf("%s: EraseUsers = %d, %v; want %d", tt.name, n, err, tt.wantN)
+		}
+		var parts []models.ArchivePartition
+		db.Order("app, day").Find(&parts)
+		var got []string
+		for _, p := range parts {
+			var users []string
+			for _, line := range strings.Split(strings.TrimSpace(string(gunzip(t, readObject(t, store, p.Key)))), "\n") {
+				var e models.UserEvent
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatal(err)
+				}
+				if e.UserID != "kept" && e.Properties != nil && tt.pseudonym != "" {
+					t.Errorf("%s: anonymized event keeps its properties", tt.name)
+				}
+				users = append(users, e.UserID)
+			}
+			sort.Strings(users)
+			got = append(got, strings.Join(users, ","))
+			if int64(len(users)) != p.Events {
+				t.Errorf("%s: partition %s records %d events, holds %d", tt.name, p.Day, p.Events, len(users))
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: archived users %v, want %v", tt.name, got, tt.want)
+		}
+		// The manifest lists the new versions, and the old ones are gone.
+		m, err := ReadManifest(ctx, store)
+		if err != nil || len(m.Partitions) != len(parts) {
+			t.Fatalf("%s: manifest = %+v, %v", tt.name, m, err)
+		}
+		for i, p := range m.Partitions {
+			if p.Key != parts[i].Key || p.SHA256 != parts[i].SHA256 {
+				t.Errorf("%s: manifest lists %+v, want %+v", tt.name, p, parts[i])
+			}
+		}
+		for _, p := range before {
+			if _, err := store.Get(ctx, p.Key); err == nil && p.App != tt.app && tt.app != "" {
+				continue
+			} else if err == nil && slices.IndexFunc(parts, func(q models.ArchivePartition) bool { return q.Key == p.Key }) < 0 {
+				t.Errorf("%s: replaced version %s still stored", tt.name, p.Key)
+			}
+		}
+	}
+}
+
+func TestImportResolvesAliases(t *testing.T) {
+	ctx := context.Background()
+	db := openTestDB(t)
+	store := &LocalStore{Dir: t.TempDir()}
+	seedEvents(t, db, event("default", "device", day.Add(time.Hour)), event("default", "gone-device", day.Add(time.Hour)))
+	p, err := NewArchiver(db, store, 30, time.Hour).ArchiveDay(ctx, "default", day)
+	if err != nil {
+		t.Fatalf("ArchiveDay: %v", err)
+	}
+	db.Where("1 = 1").Delete(&models.UserEvent{})
+	// Both devices were linked to accounts after archiving; the second
+	// account was erased since.
+	db.Create(&[]models.UserAlias{{AliasID: "device", UserID: "account"}, {AliasID: "gone-device", UserID: "gone"}})
+	db.Create(&models.PrivacyAudit{Action: models.PrivacyDelete, UserID: "gone"})
+
+	if n, err := Import(ctx, db, store, *p); err != nil || n != 1 {
+		t.Fatalf("Import = %d, %v; want 1, nil", n, err)
+	}
+	var users []string
+	db.Model(&models.UserEvent{}).Pluck("user_id", &users)
+	if strings.Join(users, ",") != "account" {
+		t.Errorf("imported users = %v, want [account]", users)
+	}
+}
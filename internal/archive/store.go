@@ -0,0 +1,178 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"appstats/internal/config"
+)
+
+// ErrNotFound is returned by Store.Get for missing objects.
+var ErrNotFound = errors.New("archive object not found")
+
+// Store holds archive files under slash separated keys.
+type Store interface {
+	// Put stores size bytes read from r under key, replacing any previous
+	// object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object stored under key.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object stored under key, if any.
+	Delete(ctx context.Context, key string) error
+	// String describes the location for logs.
+	String() string
+}
+
+// Config selects the archive store. Dir selects a local directory, S3Endpoint
+// an S3-compatible service such as MinIO; archiving is disabled when neither
+// is set.
+type Config struct {
+	Dir string
+
+	S3Endpoint  string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	// S3Prefix is prepended to every key, e.g. "appstats/".
+	S3Prefix string
+	S3UseSSL bool
+}
+
+// ConfigFrom returns the archive settings of cfg.
+func ConfigFrom(cfg *config.Config) Config {
+	return Config{
+		Dir:         cfg.ArchiveDir,
+		S3Endpoint:  cfg.ArchiveS3Endpoint,
+		S3Bucket:    cfg.ArchiveS3Bucket,
+		S3AccessKey: cfg.ArchiveS3AccessKey,
+		S3SecretKey: cfg.ArchiveS3SecretKey,
+		S3Prefix:    cfg.ArchiveS3Prefix,
+		S3UseSSL:    cfg.ArchiveS3UseSSL,
+	}
+}
+
+// OpenStore returns the store selected by c, or nil when archiving is
+// disabled.
+func OpenStore(c Config) (Store, error) {
+	switch {
+	case c.Dir != "" && c.S3Endpoint != "":
+		return nil, errors.New("configure either an archive directory or an S3 endpoint, not both")
+	case c.Dir != "":
+		if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		return &LocalStore{Dir: c.Dir}, nil
+	case c.S3Endpoint != "":
+		if c.S3Bucket == "" {
+			return nil, errors.New("archive S3 bucket is required")
+		}
+		client, err := minio.New(c.S3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(c.S3AccessKey, c.S3SecretKey, ""),
+			Secure: c.S3UseSSL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &S3Store{client: client, bucket: c.S3Bucket, prefix: c.S3Prefix}, nil
+	}
+	return nil, nil
+}
+
+// LocalStore keeps archive files in a local directory.
+type LocalStore struct {
+	Dir string
+}
+
+// Put writes the object to a temporary file first, so readers never see a
+// partial file.
+func (s *LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("wrote %d bytes, want %d", n, size)
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Get opens the file stored under key.
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return f, err
+}
+
+// Delete removes the file stored under key.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(s.Dir, filepath.FromSlash(key)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStore) String() string {
+	return "dir:" + s.Dir
+}
+
+// S3Store keeps archive files in a bucket of an S3-compatible service.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// Put uploads the object.
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, path.Join(s.prefix, key), r, size, minio.PutObjectOptions{})
+	return err
+}
+
+// Get downloads the object. The download starts with the first read.
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, path.Join(s.prefix, key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; Stat surfaces missing objects right away.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Delete removes the object; removing a missing object succeeds.
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, path.Join(s.prefix, key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Store) String() string {
+	return "s3:" + s.bucket + "/" + s.prefix
+}
@@ -0,0 +1,258 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	s := &LocalStore{Dir: t.TempDir()}
+	key := PartitionKey("my app", "2024-03-01", strings.Repeat("ab", 32))
+	body := []byte("{\"id\":1}\n{\"id\":2}\n")
+
+	if err := s.Put(ctx, key, bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := readObject(t, s, key); !bytes.Equal(got, body) {
+		t.Errorf("Get = %q, want %q", got, body)
+	}
+
+	// Put replaces the object.
+	if err := s.Put(ctx, key, strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Put again: %v", err)
+	}
+	if got := readObject(t, s, key); string(got) != "x" {
+		t.Errorf("Get after replace = %q, want %q", got, "x")
+	}
+
+	if _, err := s.Get(ctx, "events/missing.ndjson.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get missing: err = %v, want ErrNotFound", err)
+	}
+	testDelete(t, s, key)
+}
+
+// testDelete deletes the object stored under key twice; deleting a missing
+// object succeeds.
+func testDelete(t *testing.T, s Store, key string) {
+	t.Helper()
+	for range 2 {
+		if err := s.Delete(context.Background(), key); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+	if _, err := s.Get(context.Background(), key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLocalStorePutShortBody(t *testing.T) {
+	s := &LocalStore{Dir: t.TempDir()}
+	if err := s.Put(context.Background(), "a/b", strings.NewReader("abc"), 10); err == nil {
+		t.Fatal("Put with a short body succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(s.Dir, "a", "b")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial object left behind: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Join(s.Dir, "a"))
+	if len(entries) != 0 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	srv := newFakeS3(t, "archive")
+	s, err := OpenStore(Config{
+		S3Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		S3Bucket:    "archive",
+		S3AccessKey: "access",
+		S3SecretKey: "secret",
+		S3Prefix:    "appstats/",
+	})
+	if err != nil {
+		t.Fatalf("OpenStore: %v", err)
+	}
+	if _, ok := s.(*S3Store); !ok {
+		t.Fatalf("OpenStore returned %T, want *S3Store", s)
+	}
+
+	key := PartitionKey("default", "2024-03-01", strings.Repeat("ab", 32))
+	body := bytes.Repeat([]byte("{\"id\":1}\n"), 1000)
+	if err := s.Put(ctx, key, bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := srv.object("appstats/" + key); !ok {
+		t.Errorf("object not stored under the prefix, have %v", srv.keys())
+	}
+	if got := readObject(t, s, key); !bytes.Equal(got, body) {
+		t.Errorf("Get returned %d bytes, want %d", len(got), len(body))
+	}
+	if _, err := s.Get(ctx, "events/missing.ndjson.gz"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get missing: err = %v, want ErrNotFound", err)
+	}
+	testDelete(t, s, key)
+}
+
+func TestOpenStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "disabled", wantNil: true},
+		{name: "dir", c: Config{Dir: t.TempDir()}},
+		{name: "both", c: Config{Dir: t.TempDir(), S3Endpoint: "localhost:9000", S3Bucket: "b"}, wantErr: true},
+		{name: "s3 without bucket", c: Config{S3Endpoint: "localhost:9000"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := OpenStore(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (s == nil) != tt.wantNil {
+				t.Errorf("store = %v, wantNil %v", s, tt.wantNil)
+			}
+		})
+	}
+}
+
+func readObject(t *testing.T, s Store, key string) []byte {
+	t.Helper()
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get %s: %v", key, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", key, err)
+	}
+	return b
+}
+
+// fakeS3 is a stand-in for an S3-compatible service holding one bucket. It
+// implements just the requests S3Store makes and does not check signatures.
+type fakeS3 struct {
+	*httptest.Server
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T, bucket string) *fakeS3 {
+	f := &fakeS3{bucket: bucket, objects: make(map[string][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.objects[key]
+	return b, ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if _, ok := r.URL.Query()["location"]; ok {
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, err := readS3Body(r)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.mu.Lock()
+		f.objects[key] = body
+		f.mu.Unlock()
+		w.Header().Set("ETag", `"fake"`)
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.object(key)
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"fake"`)
+		w.Header().Set("Last-Modified", "Mon, 04 Mar 2024 00:00:00 GMT")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	case http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// readS3Body reads a PUT body, decoding the aws-chunked encoding used for
+// streaming signatures over plain HTTP.
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return out.Bytes(), nil
+		}
+		if _, err := io.CopyN(&out, br, size); err != nil {
+			return nil, err
+		}
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`+code+`</Code><Message>`+code+`</Message></Error>`)
+}
@@ -1,16 +1,125 @@
 package config
 
+import (
+	"os"
+	"strconv"
+)
+
 // Config holds basic configuration such as database DSN.
 type Config struct {
-	DSN string
+	DSN  string
+	Addr string
+
+	// LogLevel is one of debug/info/warn/error.
+	LogLevel string
+	// IngestLogSampleEvery logs one of every N successful ingest requests.
+	// Failed requests are always logged. Values <= 1 log every request.
+	IngestLogSampleEvery int
+
+	// SMTP settings used by email notifications. Mail is disabled when
+	// SMTPAddr is empty.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	// AlertTickSeconds is how often alert rules are checked for being due.
+	AlertTickSeconds int
+	// ReportTickSeconds is how often report schedules are checked for being due.
+	ReportTickSeconds int
+	// RollupTickSeconds is how often daily rollups are brought up to date.
+	RollupTickSeconds int
+	// RetentionTickSeconds is how often retention policies are enforced, and
+	// RetentionBatchSize how many rows each delete statement removes.
+	RetentionTickSeconds int
+	RetentionBatchSize   int
+
+	// Archive store: a local directory or an S3-compatible service. Events
+	// older than ArchiveAfterDays days are archived when either is set.
+	ArchiveDir         string
+	ArchiveS3Endpoint  string
+	ArchiveS3Bucket    string
+	ArchiveS3AccessKey string
+	ArchiveS3SecretKey string
+	ArchiveS3Prefix    string
+	ArchiveS3UseSSL    bool
+	ArchiveAfterDays   int
+	// ArchiveTickSeconds is how often events are checked for archiving.
+	ArchiveTickSeconds int
+
+	// PIIAction is what happens to user IDs that look like an email address
+	// or phone number for apps without privacy settings: allow, hash or
+	// reject.
+	PIIAction string
+	// ConsentTickSeconds is how often the data of users who opted out is
+	// purged.
+	ConsentTickSeconds int
+	// EventMaxAgeHours and EventMaxFutureSeconds bound how far client event
+	// times may lie in the past and future of the receive time, after clock
+	// skew correction; 0 hours disables the past bound. EventTimeAction is
+	// what happens to times outside: clamp or reject.
+	EventMaxAgeHours      int
+	EventMaxFutureSeconds int
+	EventTimeAction       string
+	// DeadLetterDays is how long rejected event payloads are kept.
+	DeadLetterDays int
+	// MaxBodyBytes bounds the size of ingestion request bodies after
+	// decompression, and MaxDecompressionRatio how many times larger than
+	// the compressed body they may grow.
+	MaxBodyBytes          int
+	MaxDecompressionRatio int
 }
 
-// Load loads configuration. For this demo we hardcode values.
-// You can switch to env vars or config files as needed.
+// Load loads configuration from environment variables, falling back to
+// defaults suitable for local development.
 func Load() *Config {
 	return &Config{
 		// Adjust DSN to match your local MySQL settings.
 		// Format: username:password@tcp(host:port)/dbname?parseTime=true&loc=Local
-		DSN: "root:root@tcp(127.0.0.1:3306)/appstats?parseTime=true&loc=Local",
+		DSN:                   getenv("APPSTATS_DSN", "root:root@tcp(127.0.0.1:3306)/appstats?parseTime=true&loc=Local"),
+		Addr:                  getenv("APPSTATS_ADDR", ":8080"),
+		LogLevel:              getenv("APPSTATS_LOG_LEVEL", "info"),
+		IngestLogSampleEvery:  getenvInt("APPSTATS_INGEST_LOG_SAMPLE_EVERY", 1),
+		SMTPAddr:              getenv("APPSTATS_SMTP_ADDR", ""),
+		SMTPUsername:          getenv("APPSTATS_SMTP_USERNAME", ""),
+		SMTPPassword:          getenv("APPSTATS_SMTP_PASSWORD", ""),
+		SMTPFrom:              getenv("APPSTATS_SMTP_FROM", "appstats@localhost"),
+		AlertTickSeconds:      getenvInt("APPSTATS_ALERT_TICK_SECONDS", 60),
+		ReportTickSeconds:     getenvInt("APPSTATS_REPORT_TICK_SECONDS", 30),
+		RollupTickSeconds:     getenvInt("APPSTATS_ROLLUP_TICK_SECONDS", 3600),
+		RetentionTickSeconds:  getenvInt("APPSTATS_RETENTION_TICK_SECONDS", 3600),
+		RetentionBatchSize:    getenvInt("APPSTATS_RETENTION_BATCH_SIZE", 1000),
+		ArchiveDir:            getenv("APPSTATS_ARCHIVE_DIR", ""),
+		ArchiveS3Endpoint:     getenv("APPSTATS_ARCHIVE_S3_ENDPOINT", ""),
+		ArchiveS3Bucket:       getenv("APPSTATS_ARCHIVE_S3_BUCKET", ""),
+		ArchiveS3AccessKey:    getenv("APPSTATS_ARCHIVE_S3_ACCESS_KEY", ""),
+		ArchiveS3SecretKey:    getenv("APPSTATS_ARCHIVE_S3_SECRET_KEY", ""),
+		ArchiveS3Prefix:       getenv("APPSTATS_ARCHIVE_S3_PREFIX", ""),
+		ArchiveS3UseSSL:       getenv("APPSTATS_ARCHIVE_S3_USE_SSL", "true") == "true",
+		ArchiveAfterDays:      getenvInt("APPSTATS_ARCHIVE_AFTER_DAYS", 30),
+		ArchiveTickSeconds:    getenvInt("APPSTATS_ARCHIVE_TICK_SECONDS", 3600),
+		PIIAction:             getenv("APPSTATS_PII_ACTION", "allow"),
+		ConsentTickSeconds:    getenvInt("APPSTATS_CONSENT_TICK_SECONDS", 60),
+		EventMaxAgeHours:      getenvInt("APPSTATS_EVENT_MAX_AGE_HOURS", 720),
+		EventMaxFutureSeconds: getenvInt("APPSTATS_EVENT_MAX_FUTURE_SECONDS", 300),
+		EventTimeAction:       getenv("APPSTATS_EVENT_TIME_ACTION", "clamp"),
+		DeadLetterDays:        getenvInt("APPSTATS_DEAD_LETTER_DAYS", 7),
+		MaxBodyBytes:          getenvInt("APPSTATS_MAX_BODY_BYTES", 32<<20),
+		MaxDecompressionRatio: getenvInt("APPSTATS_MAX_DECOMPRESSION_RATIO", 100),
+	}
+}
+
+func getenv(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
 	}
+	return v
 }
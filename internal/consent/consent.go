@@ -0,0 +1,294 @@
+package consent
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"appstats/internal/archive"
+	"appstats/internal/models"
+	"appstats/internal/privacy"
+)
+
+// Consent values reported by clients.
+const (
+	Granted = "granted"
+	Denied  = "denied"
+)
+
+// Opt-out sources.
+const (
+	SourceClient = "client"
+	SourceAdmin  = "admin"
+)
+
+const (
+	// cacheTTL bounds how long opt-outs made on other instances take to
+	// apply.
+	cacheTTL = 30 * time.Second
+	// maxCacheEntries bounds the lookup cache; it is simply cleared when
+	// full.
+	maxCacheEntries = 100000
+	// purgeDelay lets every instance see an opt-out before the user's data
+	// is purged, so no event slips in afterwards.
+	purgeDelay = 2 * cacheTTL
+	// maxPurgesPerRun bounds the work of a single purger run.
+	maxPurgesPerRun = 100
+)
+
+// Registry keeps the per-app opt-out lists, with a cache of lookups for
+// ingestion.
+type Registry struct {
+	db *gorm.DB
+
+	mu       sync.Mutex
+	cache    map[string]bool
+	loadedAt time.Time
+}
+
+// NewRegistry returns a registry backed by db.
+func NewRegistry(db *gorm.DB) *Registry {
+	return &Registry{db: db, cache: make(map[string]bool)}
+}
+
+// Invalidate drops the cached lookups, e.g. after the lists changed.
+func (r *Registry) Invalidate() {
+	r.mu.Lock()
+	clear(r.cache)
+	r.mu.Unlock()
+}
+
+// OptedOut reports whether any of userIDs opted out of app.
+func (r *Registry) OptedOut(app string, userIDs ...string) (bool, error) {
+	states, err := r.lookup(app, userIDs)
+	if err != nil {
+		return false, err
+	}
+	for _, out := range states {
+		if out {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// lookup returns whether each of userIDs opted out of app, loading the
+// lookups missing from the cache.
+func (r *Registry) lookup(app string, userIDs []string) (map[string]bool, error) {
+	states := make(map[string]bool, len(userIDs))
+	var missing []string
+	r.mu.Lock()
+	if time.Since(r.loadedAt) > cacheTTL || len(r.cache) >= maxCacheEntries {
+		clear(r.cache)
+		r.loadedAt = time.Now()
+	}
+	for _, id := range dedupe(userIDs) {
+		out, ok := r.cache[cacheKey(app, id)]
+		if !ok {
+			missing = append(missing, id)
+		}
+		states[id] = out
+	}
+	r.mu.Unlock()
+	if len(missing) == 0 {
+		return states, nil
+	}
+
+	var found []string
+	if err := r.db.Model(&models.ConsentOptOut{}).Where("app = ? AND user_id IN ?", app, missing).
+		Pluck("user_id", &found).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range found {
+		states[id] = true
+	}
+	r.mu.Lock()
+	for _, id := range missing {
+		r.cache[cacheKey(app, id)] = states[id]
+	}
+	r.mu.Unlock()
+	return states, nil
+}
+
+// remember caches that userIDs did or did not opt out of app.
+func (r *Registry) remember(app string, out bool, userIDs []string) {
+	r.mu.Lock()
+	for _, id := range userIDs {
+		r.cache[cacheKey(app, id)] = out
+	}
+	r.mu.Unlock()
+}
+
+// OptOut adds userIDs to the opt-out list of app. Their data is purged in
+// the background by a Purger.
+func (r *Registry) OptOut(app, source string, userIDs ...string) error {
+	ids := dedupe(userIDs)
+	rows := make([]models.ConsentOptOut, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, models.ConsentOptOut{App: app, UserID: id, Source: source})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+		return err
+	}
+	r.remember(app, true, ids)
+	return nil
+}
+
+// OptIn removes userIDs from the opt-out list of app. Data already purged
+// is not restored.
+func (r *Registry) OptIn(app string, userIDs ...string) error {
+	ids := dedupe(userIDs)
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := r.db.Where("app = ? AND user_id IN ?", app, ids).Delete(&models.ConsentOptOut{}).Error; err != nil {
+		return err
+	}
+	r.remember(app, false, ids)
+	return nil
+}
+
+// Report applies the consent value reported with an event for userIDs and
+// reports whether they are opted out afterwards and whether their state
+// changed. SDKs may report consent with every event, so the lists are only
+// written for the IDs whose cached state differs; a change made on another
+// instance may thus take up to the cache TTL to be overridden. An empty
+// value only looks the state up.
+func (r *Registry) Report(app, value string, userIDs ...string) (optedOut, changed bool, err error) {
+	states, err := r.lookup(app, userIDs)
+	if err != nil {
+		return false, false, err
+	}
+	var stale []string
+	for id, out := range states {
+		optedOut = optedOut || out
+		if (value == Denied && !out) || (value == Granted && out) {
+			stale = append(stale, id)
+		}
+	}
+	switch {
+	case value == Denied && len(stale) > 0:
+		err = r.OptOut(app, SourceClient, stale...)
+	case value == Granted && len(stale) > 0:
+		err = r.OptIn(app, stale...)
+	}
+	if err != nil {
+		return false, false, err
+	}
+	switch value {
+	case Denied:
+		optedOut = true
+	case Granted:
+		optedOut = false
+	}
+	return optedOut, len(stale) > 0, nil
+}
+
+func cacheKey(app, userID string) string {
+	return app + "\x00" + userID
+}
+
+func dedupe(ids []string) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" && !slices.Contains(res, id) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// CountAnonymously adds an event of an opted-out user to the anonymous
+// counts of its UTC day.
+func CountAnonymously(db *gorm.DB, app, eventType, platform string, t time.Time) error {
+	return db.Exec("INSERT INTO anonymous_event_counts (day, app, event_type, platform, events) VALUES (?, ?, ?, ?, 1)"+
+		" ON DUPLICATE KEY UPDATE events = events + 1",
+		t.UTC().Format("2006-01-02"), app, eventType, platform).Error
+}
+
+// Purger deletes the data of opted-out users in the background.
+//
+// Only one instance should run per database.
+type Purger struct {
+	// Archive, when set, is the archive store whose partitions are purged
+	// as well.
+	Archive archive.Store
+
+	db   *gorm.DB
+	tick time.Duration
+	now  func() time.Time
+}
+
+// NewPurger returns a purger checking for new opt-outs every tick.
+func NewPurger(db *gorm.DB, tick time.Duration) *Purger {
+	return &Purger{db: db, tick: tick, now: time.Now}
+}
+
+// Run purges data until ctx is cancelled.
+func (p *Purger) Run(ctx context.Context) {
+	t := time.NewTicker(p.tick)
+	defer t.Stop()
+	for {
+		if err := p.RunDue(ctx); err != nil {
+			slog.Error("purge opted-out users failed", slog.Any("error", err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue deletes the events of every opted-out user not purged yet from the
+// app they opted out of, recording each purge in the privacy audit log.
+// Failed purges are retried on the next run.
+func (p *Purger) RunDue(ctx context.Context) error {
+	var pending []models.ConsentOptOut
+	if err := p.db.Where("purged_at IS NULL AND created_at <= ?", p.now().Add(-purgeDelay)).
+		Order("id").Limit(maxPurgesPerRun).Find(&pending).Error; err != nil {
+		return err
+	}
+	for i := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.purge(ctx, &pending[i])
+	}
+	return nil
+}
+
+func (p *Purger) purge(ctx context.Context, o *models.ConsentOptOut) {
+	res, err := privacy.EraseApp(ctx, p.db, p.Archive, o.UserID, o.App)
+	audit := &models.PrivacyAudit{
+		Action:   models.PrivacyDelete,
+		UserID:   o.UserID,
+		Operator: "consent",
+		Reason:   "opted out of " + o.App,
+	}
+	updates := map[string]any{"purge_error": ""}
+	if res != nil {
+		audit.Rows = res.Rows
+	}
+	if err != nil {
+		audit.Error = models.Truncate(err.Error(), 512)
+		updates["purge_error"] = audit.Error
+		slog.Error("purge opted-out user failed", slog.String("app", o.App), slog.String("user_id", o.UserID), slog.Any("error", err))
+	} else {
+		updates["purged_at"] = p.now()
+	}
+	if err := privacy.Record(p.db, audit); err != nil {
+		slog.Error("record privacy audit failed", slog.String("user_id", o.UserID), slog.Any("error", err))
+	}
+	if err := p.db.Model(o).Updates(updates).Error; err != nil {
+		slog.Error("update opt-out failed", slog.String("user_id", o.UserID), slog.Any("error", err))
+	}
+}
@@ -0,0 +1,91 @@
+package consent
+
+import (
+	"testing"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t, &models.ConsentOptOut{})
+}
+
+// countQueries counts the statements run on db.
+func countQueries(t *testing.T, db *gorm.DB) *int {
+	t.Helper()
+	var n int
+	count := func(*gorm.DB) { n++ }
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Query().After("gorm:query").Register("test:count_query", count),
+		cb.Create().After("gorm:create").Register("test:count_create", count),
+		cb.Delete().After("gorm:delete").Register("test:count_delete", count),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &n
+}
+
+func TestReport(t *testing.T) {
+	db := openTestDB(t)
+	queries := countQueries(t, db)
+	r := NewRegistry(db)
+
+	steps := []struct {
+		value       string
+		wantOut     bool
+		wantChanged bool
+		wantQueries int
+	}{
+		{value: "", wantOut: false, wantQueries: 1},      // loads the state
+		{value: Granted, wantOut: false, wantQueries: 0}, // already opted in
+		{value: Denied, wantOut: true, wantChanged: true, wantQueries: 1},
+		{value: Denied, wantOut: true, wantQueries: 0},
+		{value: "", wantOut: true, wantQueries: 0},
+		{value: Granted, wantOut: false, wantChanged: true, wantQueries: 1},
+		{value: Granted, wantOut: false, wantQueries: 0},
+	}
+	for i, s := range steps {
+		*queries = 0
+		out, changed, err := r.Report("shop", s.value, "alias", "user")
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if out != s.wantOut || changed != s.wantChanged || *queries != s.wantQueries {
+			t.Errorf("step %d (%q): got out %v changed %v after %d queries, want %v %v %d",
+				i, s.value, out, changed, *queries, s.wantOut, s.wantChanged, s.wantQueries)
+		}
+	}
+}
+
+func TestReportWritesOnlyChangedIDs(t *testing.T) {
+	db := openTestDB(t)
+	r := NewRegistry(db)
+	if err := r.OptOut("shop", SourceAdmin, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, changed, err := r.Report("shop", Denied, "alias", "user"); err != nil || !changed {
+		t.Fatalf("Report = %v, %v", changed, err)
+	}
+	var rows []models.ConsentOptOut
+	db.Order("user_id").Find(&rows)
+	if len(rows) != 2 || rows[0].UserID != "alias" || rows[0].Source != SourceClient || rows[1].Source != SourceAdmin {
+		t.Errorf("opt-outs = %+v", rows)
+	}
+
+	// Other apps and users keep their cached state.
+	if out, err := r.OptedOut("other", "user"); err != nil || out {
+		t.Errorf("OptedOut(other) = %v, %v", out, err)
+	}
+	if err := r.OptIn("shop", "alias", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := r.OptedOut("shop", "alias", "user"); err != nil || out {
+		t.Errorf("OptedOut after OptIn = %v, %v", out, err)
+	}
+}
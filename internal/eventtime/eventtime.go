@@ -0,0 +1,100 @@
+package eventtime
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Actions for event times outside the acceptance window.
+const (
+	ActionClamp  = "clamp"
+	ActionReject = "reject"
+)
+
+// skewTolerance is the clock difference below which sent_at is not used to
+// correct event times; smaller differences are mostly network latency.
+const skewTolerance = time.Minute
+
+// ErrOutOfRange is returned for event times outside the acceptance window
+// when the policy rejects them.
+var ErrOutOfRange = errors.New("event_time is outside the accepted window")
+
+// Policy decides which client event times are accepted.
+type Policy struct {
+	// MaxAge is how far in the past an event time may be; 0 disables the
+	// bound.
+	MaxAge time.Duration
+	// MaxFuture is how far in the future an event time may be.
+	MaxFuture time.Duration
+	// Action is clamp or reject.
+	Action string
+}
+
+// Validate checks the policy read from the configuration.
+func (p Policy) Validate() error {
+	switch p.Action {
+	case ActionClamp, ActionReject:
+	default:
+		return fmt.Errorf("unknown event time action %q, want clamp or reject", p.Action)
+	}
+	if p.MaxAge < 0 || p.MaxFuture < 0 {
+		return errors.New("event time window must not be negative")
+	}
+	return nil
+}
+
+// Result is an event time resolved by a policy.
+type Result struct {
+	// Time is the event time to store.
+	Time time.Time
+	// Skew is the correction added to the client event time, when its clock
+	// was off by more than skewTolerance.
+	Skew time.Duration
+	// Outside is "past" or "future" when the corrected time was outside the
+	// window, otherwise empty. Time is then the receive time, unless the
+	// policy rejected it.
+	Outside string
+}
+
+// Resolve returns the event time to store for an event received at received.
+// eventTime and sentAt are the event time and send time reported by the
+// client, both by its own clock; either may be nil. When sentAt differs from
+// received by more than skewTolerance, the difference is taken as the skew of
+// the client clock and added to eventTime. The corrected time must lie within
+// the window around received; otherwise it is replaced by received, or
+// ErrOutOfRange is returned, depending on the action.
+func (p Policy) Resolve(received time.Time, eventTime, sentAt *time.Time) (Result, error) {
+	received = received.UTC()
+	if eventTime == nil {
+		return Result{Time: received}, nil
+	}
+	res := Result{Time: eventTime.UTC()}
+	if sentAt != nil {
+		if skew := received.Sub(*sentAt); skew.Abs() > skewTolerance {
+			res.Skew = skew
+			res.Time = res.Time.Add(skew)
+		}
+	}
+
+	switch {
+	case p.MaxAge > 0 && res.Time.Before(received.Add(-p.MaxAge)):
+		res.Outside = "past"
+	case res.Time.After(received.Add(p.MaxFuture)):
+		res.Outside = "future"
+	default:
+		return res, nil
+	}
+	if p.Action == ActionReject {
+		return res, fmt.Errorf("%w: %s is more than %s in the %s", ErrOutOfRange, res.Time.Format(time.RFC3339), p.window(res.Outside), res.Outside)
+	}
+	res.Time = received
+	return res, nil
+}
+
+func (p Policy) window(side string) time.Duration {
+	if side == "past" {
+		return p.MaxAge
+	}
+	return p.MaxFuture
+}
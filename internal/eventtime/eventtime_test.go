@@ -0,0 +1,85 @@
+package eventtime
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	received := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := received.Add(d)
+		return &t
+	}
+	clamp := Policy{MaxAge: 7 * 24 * time.Hour, MaxFuture: time.Hour, Action: ActionClamp}
+	reject := clamp
+	reject.Action = ActionReject
+	unbounded := Policy{MaxFuture: time.Hour, Action: ActionReject}
+
+	tests := []struct {
+		name              string
+		p                 Policy
+		eventTime, sentAt *time.Time
+		want              Result
+		wantErr           bool
+	}{
+		{name: "no event time", p: reject, want: Result{Time: received}},
+		{name: "within window", p: reject, eventTime: at(-time.Hour), want: Result{Time: received.Add(-time.Hour)}},
+		{name: "small skew ignored", p: reject, eventTime: at(-time.Hour), sentAt: at(-30 * time.Second),
+			want: Result{Time: received.Add(-time.Hour)}},
+		// The client clock is two hours ahead: its times move back.
+		{name: "clock ahead", p: reject, eventTime: at(90 * time.Minute), sentAt: at(2 * time.Hour),
+			want: Result{Time: received.Add(-30 * time.Minute), Skew: -2 * time.Hour}},
+		{name: "clock behind", p: reject, eventTime: at(-25 * time.Hour), sentAt: at(-24 * time.Hour),
+			want: Result{Time: received.Add(-time.Hour), Skew: 24 * time.Hour}},
+		{name: "future clamped", p: clamp, eventTime: at(2 * time.Hour),
+			want: Result{Time: received, Outside: "future"}},
+		{name: "future rejected", p: reject, eventTime: at(2 * time.Hour), wantErr: true,
+			want: Result{Time: received.Add(2 * time.Hour), Outside: "future"}},
+		{name: "future edge", p: reject, eventTime: at(time.Hour), want: Result{Time: received.Add(time.Hour)}},
+		{name: "past clamped", p: clamp, eventTime: at(-8 * 24 * time.Hour),
+			want: Result{Time: received, Outside: "past"}},
+		{name: "past rejected", p: reject, eventTime: at(-8 * 24 * time.Hour), wantErr: true,
+			want: Result{Time: received.Add(-8 * 24 * time.Hour), Outside: "past"}},
+		{name: "no max age", p: unbounded, eventTime: at(-365 * 24 * time.Hour),
+			want: Result{Time: received.Add(-365 * 24 * time.Hour)}},
+		// Skew correction brings an old backlog into the window.
+		{name: "corrected into window", p: reject, eventTime: at(-8 * 24 * time.Hour), sentAt: at(-2 * 24 * time.Hour),
+			want: Result{Time: received.Add(-6 * 24 * time.Hour), Skew: 2 * 24 * time.Hour}},
+	}
+	for _, tt := range tests {
+		got, err := tt.p.Resolve(received, tt.eventTime, tt.sentAt)
+		if tt.wantErr != (err != nil) || err != nil && !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if !got.Time.Equal(tt.want.Time) || got.Skew != tt.want.Skew || got.Outside != tt.want.Outside {
+			t.Errorf("%s: Resolve = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	// Times are stored in UTC.
+	shanghai := time.FixedZone("CST", 8*3600)
+	local := received.In(shanghai)
+	if got, _ := clamp.Resolve(local, &local, nil); got.Time.Location() != time.UTC {
+		t.Errorf("Resolve returned a time in %v", got.Time.Location())
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		p     Policy
+		valid bool
+	}{
+		{Policy{MaxAge: time.Hour, MaxFuture: time.Hour, Action: ActionClamp}, true},
+		{Policy{Action: ActionReject}, true},
+		{Policy{Action: "drop"}, false},
+		{Policy{MaxAge: -time.Hour, Action: ActionClamp}, false},
+		{Policy{MaxFuture: -time.Hour, Action: ActionClamp}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.p.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v", tt.p, err)
+		}
+	}
+}
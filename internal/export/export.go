@@ -0,0 +1,143 @@
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the file format of an export.
+type Format string
+
+const (
+	FormatCSV  Format = "csv"
+	FormatXLSX Format = "xlsx"
+)
+
+// ParseFormat validates a format name taken from the request.
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FormatCSV, FormatXLSX:
+		return Format(s), nil
+	}
+	return "", fmt.Errorf("unsupported export format %q", s)
+}
+
+// ContentType returns the MIME type used when serving the format.
+func (f Format) ContentType() string {
+	if f == FormatXLSX {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// RowWriter writes tabular data row by row without buffering the whole table.
+type RowWriter interface {
+	WriteRow(values ...any) error
+	// Close flushes pending data and finalizes the file.
+	Close() error
+}
+
+// NewWriter returns a RowWriter for the format writing to w. Header is written
+// as the first row.
+func NewWriter(f Format, w io.Writer, sheet string, header ...string) (RowWriter, error) {
+	var rw RowWriter
+	var err error
+	if f == FormatXLSX {
+		rw, err = newXLSXWriter(w, sheet)
+	} else {
+		rw, err = newCSVWriter(w)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, len(header))
+	for i, h := range header {
+		values[i] = h
+	}
+	if err := rw.WriteRow(values...); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// csvFlushEvery controls how often buffered CSV rows are pushed to the client.
+const csvFlushEvery = 500
+
+type csvWriter struct {
+	w    *csv.Writer
+	dst  io.Writer
+	rows int
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	// UTF-8 BOM so that Excel detects the encoding of non-ASCII region names.
+	if _, err := w.Write([]byte("\xEF\xBB\xBF")); err != nil {
+		return nil, err
+	}
+	return &csvWriter{w: csv.NewWriter(w), dst: w}, nil
+}
+
+func (c *csvWriter) WriteRow(values ...any) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = formatValue(v)
+		if _, ok := v.(string); ok {
+			record[i] = escapeFormula(record[i])
+		}
+	}
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	c.rows++
+	if c.rows%csvFlushEvery == 0 {
+		return c.flush()
+	}
+	return nil
+}
+
+func (c *csvWriter) Close() error {
+	return c.flush()
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	if f, ok := c.dst.(http.Flusher); ok {
+		f.Flush()
+	}
+	return c.w.Error()
+}
+
+// escapeFormula prefixes text that spreadsheets would evaluate as a formula
+// with a quote, so a reported value such as a region cannot run one when
+// the CSV is opened. Numbers are written as they are.
+func escapeFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func formatValue(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case int:
+		return strconv.Itoa(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case time.Time:
+		return x.Format("2006-01-02")
+	default:
+		return fmt.Sprint(x)
+	}
+}
@@ -0,0 +1,173 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestColumnName(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "A"}, {1, "B"}, {25, "Z"}, {26, "AA"}, {27, "AB"}, {51, "AZ"}, {52, "BA"}, {701, "ZZ"}, {702, "AAA"},
+	}
+	for _, tt := range tests {
+		if got := columnName(tt.i); got != tt.want {
+			t.Errorf("columnName(%d) = %q, want %q", tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for _, s := range []string{"csv", "xlsx"} {
+		if f, err := ParseFormat(s); err != nil || string(f) != s {
+			t.Errorf("ParseFormat(%q) = %q, %v", s, f, err)
+		}
+	}
+	for _, s := range []string{"", "xls", "CSV"} {
+		if _, err := ParseFormat(s); err == nil {
+			t.Errorf("ParseFormat(%q) succeeded", s)
+		}
+	}
+}
+
+var day = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+func writeTable(t *testing.T, f Format) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(f, &buf, "新增 & 活跃", "日期", "地区", "用户数", "占比")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	for _, row := range [][]any{
+		{day, "上海", int64(12), 0.25},
+		{day.AddDate(0, 0, 1), `<a "b">`, 3, nil},
+	} {
+		if err := w.WriteRow(row...); err != nil {
+			t.Fatalf("WriteRow: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSVWriter(t *testing.T) {
+	got := string(writeTable(t, FormatCSV))
+	want := "\xEF\xBB\xBF" + "日期,地区,用户数,占比\n" +
+		"2024-03-01,上海,12,0.25\n" +
+		"2024-03-02,\"<a \"\"b\"\">\",3,\n"
+	if got != want {
+		t.Errorf("csv = %q, want %q", got, want)
+	}
+}
+
+func TestCSVWriterFormulas(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatCSV, &buf, "", "a", "b", "c", "d", "e", "f", "g")
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := w.WriteRow("=1+2", "+86", "-x", "@SUM(A1)", "\tx", int64(-5), "a=b"); err != nil {
+		t.Fatalf("WriteRow: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := "\xEF\xBB\xBF" + "a,b,c,d,e,f,g\n" + "'=1+2,'+86,'-x,'@SUM(A1),'\tx,-5,a=b\n"
+	if got := buf.String(); got != want {
+		t.Errorf("csv = %q, want %q", got, want)
+	}
+}
+
+// xlsxCell is a cell of the worksheet as the writer produces it.
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline string `xml:"is>t"`
+}
+
+func TestXLSXWriter(t *testing.T) {
+	data := writeTable(t, FormatXLSX)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = b
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing part %s", name)
+			continue
+		}
+		// Every part must be well-formed.
+		var v struct{}
+		if err := xml.Unmarshal(files[name], &v); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	var wb struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(files["xl/workbook.xml"], &wb); err != nil || len(wb.Sheets) != 1 || wb.Sheets[0].Name != "新增 & 活跃" {
+		t.Errorf("sheets = %+v, %v", wb.Sheets, err)
+	}
+
+	var ws struct {
+		Rows []struct {
+			Ref   string     `xml:"r,attr"`
+			Cells []xlsxCell `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal(files["xl/worksheets/sheet1.xml"], &ws); err != nil {
+		t.Fatalf("parse worksheet: %v", err)
+	}
+	want := [][]xlsxCell{
+		{{Ref: "A1", Type: "inlineStr", Inline: "日期"}, {Ref: "B1", Type: "inlineStr", Inline: "地区"},
+			{Ref: "C1", Type: "inlineStr", Inline: "用户数"}, {Ref: "D1", Type: "inlineStr", Inline: "占比"}},
+		{{Ref: "A2", Type: "inlineStr", Inline: "2024-03-01"}, {Ref: "B2", Type: "inlineStr", Inline: "上海"},
+			{Ref: "C2", Value: "12"}, {Ref: "D2", Value: "0.25"}},
+		{{Ref: "A3", Type: "inlineStr", Inline: "2024-03-02"}, {Ref: "B3", Type: "inlineStr", Inline: `<a "b">`},
+			{Ref: "C3", Value: "3"}, {Ref: "D3", Type: "inlineStr"}},
+	}
+	if len(ws.Rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(ws.Rows), len(want))
+	}
+	for i, row := range ws.Rows {
+		if row.Ref != strings.TrimLeft(want[i][0].Ref, "A") {
+			t.Errorf("row %d has r=%q", i, row.Ref)
+		}
+		if len(row.Cells) != len(want[i]) {
+			t.Errorf("row %d = %+v, want %+v", i, row.Cells, want[i])
+			continue
+		}
+		for j, c := range row.Cells {
+			if c != want[i][j] {
+				t.Errorf("cell %s = %+v, want %+v", want[i][j].Ref, c, want[i][j])
+			}
+		}
+	}
+}
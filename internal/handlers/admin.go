@@ -2,20 +2,49 @@ package handlers
 
 import (
 	"encoding/json"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
+	"appstats/internal/annotations"
+	"appstats/internal/logging"
 	"appstats/internal/stats"
 )
 
 // AdminPageHandler renders the admin dashboard with embedded stats data for charts.
 func AdminPageHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		data, err := stats.GetLastNDaysSummary(db, 7)
+		start, days, err := parseDateRange(c, 7, 366)
 		if err != nil {
+			c.String(http.StatusBadRequest, "invalid range: %v", err)
+			return
+		}
+
+		filter, err := parseFilter(c, db)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid filter: %v", err)
+			return
+		}
+
+		mode, err := stats.ParseCompareMode(c.Query("compare"))
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid compare: %v", err)
+			return
+		}
+
+		inactiveDays, err := parseInactiveDays(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, "invalid inactive_days: %v", err)
+			return
+		}
+
+		data, err := stats.GetSummary(db, start, days, filter)
+		if err != nil {
+			logging.FromContext(c).Error("load stats failed", slog.Any("error", err))
 			c.String(http.StatusInternalServerError, "load stats error: %v", err)
 			return
 		}
@@ -26,12 +55,137 @@ func AdminPageHandler(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		var cmp *stats.Comparison
+		if mode != stats.CompareNone {
+			if cmp, err = stats.Compare(db, start, days, filter, mode); err != nil {
+				logging.FromContext(c).Error("load comparison failed", slog.Any("error", err))
+				c.String(http.StatusInternalServerError, "load comparison error: %v", err)
+				return
+			}
+		}
+		cmpJSON, err := json.Marshal(cmp)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "json error: %v", err)
+			return
+		}
+
+		engagement, err := stats.GetEngagement(db, start, days, inactiveDays, filter, "")
+		if err != nil {
+			logging.FromContext(c).Error("load engagement failed", slog.Any("error", err))
+			c.String(http.StatusInternalServerError, "load engagement error: %v", err)
+			return
+		}
+		engJSON, err := json.Marshal(engagement)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "json error: %v", err)
+			return
+		}
+
+		anns, err := annotations.List(db, start, start.AddDate(0, 0, days), "")
+		if err != nil {
+			logging.FromContext(c).Error("load annotations failed", slog.Any("error", err))
+			c.String(http.StatusInternalServerError, "load annotations error: %v", err)
+			return
+		}
+		annJSON, err := json.Marshal(anns)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "json error: %v", err)
+			return
+		}
+
 		// Use a simple placeholder replacement to avoid fmt.Sprintf issues with '%' in JS.
-		html := strings.Replace(adminHTMLTemplate, "__DAILY_STATS__", string(b), 1)
+		html := strings.NewReplacer(
+			"__DAILY_STATS__", string(b),
+			"__ANNOTATIONS__", string(annJSON),
+			"__COMPARE__", string(cmpJSON),
+			"__COMPARE_MODE__", string(mode),
+			"__ENGAGEMENT__", string(engJSON),
+			"__INACTIVE_DAYS__", strconv.Itoa(inactiveDays),
+			"__FROM__", start.Format(dateLayout),
+			"__TO__", start.AddDate(0, 0, days-1).Format(dateLayout),
+		).Replace(adminHTMLTemplate)
 		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
 	}
 }
 
+// SummaryHandler returns the daily summary of a date range as JSON, with
+// ?compare=previous|week|year adding the comparison with a baseline period.
+func SummaryHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start, days, err := parseDateRange(c, 7, 366)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter, err := parseFilter(c, db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		mode, err := stats.ParseCompareMode(c.Query("compare"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		data, err := stats.GetSummary(db, start, days, filter)
+		if err != nil {
+			logging.FromContext(c).Error("load stats failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		res := gin.H{"days": data}
+		if mode != stats.CompareNone {
+			cmp, err := stats.Compare(db, start, days, filter, mode)
+			if err != nil {
+				logging.FromContext(c).Error("load comparison failed", slog.Any("error", err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+				return
+			}
+			res["comparison"] = cmp
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// EngagementHandler returns stickiness, new vs returning, churned and
+// resurrected users per day, optionally broken down by ?breakdown=platform,
+// app_version or region. ?inactive_days sets the inactivity period.
+func EngagementHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start, days, err := parseDateRange(c, 7, 366)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter, err := parseFilter(c, db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		inactiveDays, err := parseInactiveDays(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		dim := stats.Dimension(c.Query("breakdown"))
+		switch dim {
+		case "", stats.DimensionPlatform, stats.DimensionVersion, stats.DimensionRegion:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported breakdown " + strconv.Quote(string(dim))})
+			return
+		}
+
+		res, err := stats.GetEngagement(db, start, days, inactiveDays, filter, dim)
+		if err != nil {
+			logging.FromContext(c).Error("load engagement failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
 // adminHTMLTemplate is the HTML template for the admin dashboard.
 const adminHTMLTemplate = `
 <!DOCTYPE html>
@@ -43,10 +197,62 @@ const adminHTMLTemplate = `
   <style>
     body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
     .chart-container { width: 100%%; max-width: 900px; margin-bottom: 40px; }
+    .chip { display: inline-block; background: #e8f0fe; border-radius: 12px; padding: 2px 10px; margin-right: 6px; font-size: 13px; }
+    .chip a { margin-left: 6px; color: #666; text-decoration: none; cursor: pointer; }
+    .cards { display: flex; flex-wrap: wrap; gap: 12px; margin-bottom: 24px; }
+    .card { border: 1px solid #ddd; border-radius: 6px; padding: 8px 16px; min-width: 160px; }
+    .card .value { font-size: 22px; font-weight: bold; }
+    .card .prev { color: #888; font-size: 12px; }
+    .badge { display: inline-block; border-radius: 10px; padding: 0 8px; font-size: 12px; margin-left: 6px; background: #eee; color: #666; }
+    .badge.up { background: #e6f4ea; color: #1a7f37; }
+    .badge.down { background: #fdecea; color: #c00; }
+    .delta-tables { display: flex; flex-wrap: wrap; gap: 24px; max-width: 1100px; margin-bottom: 40px; }
+    .delta-tables table { border-collapse: collapse; }
+    .delta-tables th, .delta-tables td { border: 1px solid #ddd; padding: 3px 8px; text-align: left; font-size: 13px; }
+    .delta-tables th { background: #f5f5f5; }
   </style>
 </head>
 <body>
-  <h2>APP 运营统计（最近 7 天）</h2>
+  <h2>APP 运营统计（__FROM__ ~ __TO__）</h2>
+  <p><a href="/admin/users">用户查询</a> | <a href="/admin/events">事件浏览</a> | <a href="/admin/funnel">漏斗分析</a> | <a href="/admin/versions">版本采用</a> | <a href="/admin/annotations">图表标注</a> | <a href="/admin/alerts">告警规则</a> | <a href="/admin/webhooks">Webhook</a> | <a href="/admin/reports">邮件报表</a> | <a href="/admin/privacy">数据导出与删除</a> | <a href="/admin/retention">数据保留</a> | <a href="/admin/app-privacy">应用隐私设置</a> | <a href="/admin/traffic">内部流量</a> | <a href="/admin/schemas">事件结构</a></p>
+
+  <form id="rangeForm" style="margin-bottom: 16px;">
+    <label for="from">开始日期：</label>
+    <input type="date" id="from" name="from" value="__FROM__">
+    <label for="to">结束日期：</label>
+    <input type="date" id="to" name="to" value="__TO__">
+    <label for="compare">对比：</label>
+    <select id="compare" name="compare">
+      <option value="">不对比</option>
+      <option value="previous">上一周期</option>
+      <option value="week">上周同期</option>
+      <option value="year">去年同期</option>
+    </select>
+    <button type="submit">查询</button>
+  </form>
+
+  <div style="margin-bottom: 16px;">
+    <span>筛选：</span>
+    <span id="filterChips"></span>
+    <select id="filterField">
+      <option value="app">应用</option>
+      <option value="platform">平台</option>
+      <option value="app_version">版本</option>
+      <option value="region">地区</option>
+      <option value="event_type">事件类型</option>
+      <option value="cohort">首次出现日期</option>
+      <option value="user.">用户属性</option>
+    </select>
+    <input type="text" id="filterProperty" size="12" placeholder="属性名" style="display: none;">
+    <select id="filterOp">
+      <option value="eq">等于</option>
+      <option value="in">属于（逗号分隔）</option>
+      <option value="prefix">前缀</option>
+    </select>
+    <input type="text" id="filterValue" size="20">
+    <button type="button" id="addFilter">添加</button>
+    <label style="margin-left: 16px;"><input type="checkbox" id="includeInternal"> 包含内部流量</label>
+  </div>
 
   <div style="margin-bottom: 16px;">
     <label for="viewMode">时间维度：</label>
@@ -57,10 +263,34 @@ const adminHTMLTemplate = `
     </select>
   </div>
 
+  <div class="export-bar" style="margin-bottom: 24px;">
+    <span>导出：</span>
+    <select id="exportReport">
+      <option value="summary">汇总</option>
+      <option value="platform">平台</option>
+      <option value="version">版本</option>
+      <option value="region">地区</option>
+    </select>
+    <button type="button" data-format="csv">下载 CSV</button>
+    <button type="button" data-format="xlsx">下载 Excel</button>
+  </div>
+
+  <div id="deltaCards" class="cards"></div>
+
   <div class="chart-container">
     <canvas id="dailyChart"></canvas>
   </div>
 
+  <h3>用户参与度</h3>
+  <form id="engagementForm" style="margin-bottom: 12px;">
+    <label>流失/回流判定：连续 <input type="number" id="inactiveDays" min="1" max="90" value="__INACTIVE_DAYS__" style="width: 50px;"> 天无活动</label>
+    <button type="submit">应用</button>
+  </form>
+  <div id="engagementCards" class="cards"></div>
+  <div class="chart-container">
+    <canvas id="engagementChart"></canvas>
+  </div>
+
   <div class="chart-container">
     <canvas id="platformChart"></canvas>
   </div>
@@ -73,9 +303,14 @@ const adminHTMLTemplate = `
     <canvas id="regionChart"></canvas>
   </div>
 
+  <div id="dimensionDeltas" class="delta-tables"></div>
+
   <!-- Server-embedded statistics data -->
   <script>
     const DAILY_STATS = __DAILY_STATS__;
+    const ANNOTATIONS = __ANNOTATIONS__;
+    const COMPARISON = __COMPARE__;
+    const ENGAGEMENT = __ENGAGEMENT__;
   </script>
 
   <script>
@@ -85,31 +320,40 @@ const adminHTMLTemplate = `
     let regionChartInstance = null;
     let versionChartInstance = null;
 
-    function aggregateStats(mode) {
-      if (mode === 'day') {
-        return rawStats;
+    function periodKey(date, mode) {
+      const dateObj = new Date(date);
+
+      if (mode === 'week') {
+        // ISO 周，与导出一致：周一开始，所在周的周四决定年份
+        const thursday = new Date(Date.UTC(dateObj.getUTCFullYear(), dateObj.getUTCMonth(), dateObj.getUTCDate()));
+        thursday.setUTCDate(thursday.getUTCDate() + 3 - (thursday.getUTCDay() + 6) % 7);
+        const year = thursday.getUTCFullYear();
+        const week = Math.floor((thursday - Date.UTC(year, 0, 1)) / 86400000 / 7) + 1;
+        const weekStr = week < 10 ? '0' + week : '' + week;
+        return year + '-W' + weekStr;
+      } else if (mode === 'month') {
+        const year = dateObj.getFullYear();
+        const month = dateObj.getMonth() + 1;
+        const monthStr = month < 10 ? '0' + month : '' + month;
+        return year + '-' + monthStr;
+      }
+      return date;
+    }
+
+    // 对比期数据按下标与当前日期对齐，使用当前日期作为键以便同样聚合
+    function baselineStats() {
+      if (!COMPARISON) return null;
+      return rawStats.map((d, i) => Object.assign({}, COMPARISON.baseline[i] || {}, { date: d.date }));
+    }
+
+    function aggregateStats(rows, mode) {
+      if (!rows || mode === 'day') {
+        return rows;
       }
 
       const map = {};
-      for (const d of rawStats) {
-        const dateObj = new Date(d.date);
-        let key;
-
-        if (mode === 'week') {
-          const year = dateObj.getFullYear();
-          const firstDay = new Date(year, 0, 1);
-          const diff = (dateObj - firstDay) / 86400000;
-          const week = Math.ceil((diff + firstDay.getDay() + 1) / 7);
-          const weekStr = week < 10 ? '0' + week : '' + week;
-          key = year + '-W' + weekStr;
-        } else if (mode === 'month') {
-          const year = dateObj.getFullYear();
-          const month = dateObj.getMonth() + 1;
-          const monthStr = month < 10 ? '0' + month : '' + month;
-          key = year + '-' + monthStr;
-        } else {
-          key = d.date;
-        }
+      for (const d of rows) {
+        const key = periodKey(d.date, mode);
 
         let agg = map[key];
         if (!agg) {
@@ -152,40 +396,106 @@ const adminHTMLTemplate = `
       return keys.map(k => map[k]);
     }
 
-    function renderDailyChart(data) {
+    // 在折线图上以竖线标出发布、活动等标注
+    const annotationColors = {
+      release: 'rgba(153, 102, 255, 0.9)',
+      campaign: 'rgba(46, 204, 113, 0.9)',
+      incident: 'rgba(231, 76, 60, 0.9)',
+      other: 'rgba(127, 140, 141, 0.9)'
+    };
+
+    function annotationPlugin(mode) {
+      return {
+        id: 'annotations',
+        afterDatasetsDraw(chart) {
+          const xScale = chart.scales.x;
+          const area = chart.chartArea;
+          const ctx = chart.ctx;
+          const stacked = {};
+
+          for (const a of ANNOTATIONS || []) {
+            const key = periodKey(a.date.slice(0, 10), mode);
+            const index = chart.data.labels.indexOf(key);
+            if (index < 0) continue;
+            const x = xScale.getPixelForValue(index);
+            const row = stacked[key] = (stacked[key] || 0) + 1;
+
+            ctx.save();
+            ctx.strokeStyle = annotationColors[a.category] || annotationColors.other;
+            ctx.fillStyle = ctx.strokeStyle;
+            ctx.setLineDash([4, 4]);
+            ctx.beginPath();
+            ctx.moveTo(x, area.top);
+            ctx.lineTo(x, area.bottom);
+            ctx.stroke();
+            ctx.setLineDash([]);
+            ctx.font = '12px sans-serif';
+            ctx.fillText(a.label, x + 4, area.top + 12 * row);
+            ctx.restore();
+          }
+        }
+      };
+    }
+
+    function renderDailyChart(data, baseline, mode) {
       const labels = data.map(d => d.date);
       const newUsers = data.map(d => d.new_users);
       const activeUsers = data.map(d => d.active_users);
       const onlineUsers = data.map(d => d.online_users);
+      const datasets = [
+        {
+          label: '新增用户',
+          data: newUsers,
+          borderColor: 'rgba(75, 192, 192, 1)',
+          backgroundColor: 'rgba(75, 192, 192, 0.2)',
+          tension: 0.2,
+        },
+        {
+          label: '活跃用户',
+          data: activeUsers,
+          borderColor: 'rgba(54, 162, 235, 1)',
+          backgroundColor: 'rgba(54, 162, 235, 0.2)',
+          tension: 0.2,
+        },
+        {
+          label: '在线用户',
+          data: onlineUsers,
+          borderColor: 'rgba(255, 159, 64, 1)',
+          backgroundColor: 'rgba(255, 159, 64, 0.2)',
+          tension: 0.2,
+        }
+      ];
+      if (baseline) {
+        // 对比期以虚线叠加在同一坐标上
+        datasets.push(
+          {
+            label: '新增用户（' + compareLabel() + '）',
+            data: baseline.map(d => d.new_users || 0),
+            borderColor: 'rgba(75, 192, 192, 0.6)',
+            borderDash: [6, 4],
+            pointRadius: 0,
+            fill: false,
+            tension: 0.2,
+          },
+          {
+            label: '活跃用户（' + compareLabel() + '）',
+            data: baseline.map(d => d.active_users || 0),
+            borderColor: 'rgba(54, 162, 235, 0.6)',
+            borderDash: [6, 4],
+            pointRadius: 0,
+            fill: false,
+            tension: 0.2,
+          }
+        );
+      }
 
       const ctx = document.getElementById('dailyChart').getContext('2d');
       return new Chart(ctx, {
         type: 'line',
+        plugins: [annotationPlugin(mode)],
         data: {
           labels,
-          datasets: [
-            {
-              label: '新增用户',
-              data: newUsers,
-              borderColor: 'rgba(75, 192, 192, 1)',
-              backgroundColor: 'rgba(75, 192, 192, 0.2)',
-              tension: 0.2,
-            },
-            {
-              label: '活跃用户',
-              data: activeUsers,
-              borderColor: 'rgba(54, 162, 235, 1)',
-              backgroundColor: 'rgba(54, 162, 235, 0.2)',
-              tension: 0.2,
-            },
-            {
-              label: '在线用户',
-              data: onlineUsers,
-              borderColor: 'rgba(255, 159, 64, 1)',
-              backgroundColor: 'rgba(255, 159, 64, 0.2)',
-              tension: 0.2,
-            }
-          ]
+          datasets
         },
         options: {
           responsive: true,
@@ -196,7 +506,7 @@ const adminHTMLTemplate = `
       });
     }
 
-    function renderPlatformChart(data) {
+    function renderPlatformChart(data, baseline) {
       const labels = data.map(d => d.date);
 
       // 标准平台列表，其他平台统一归为 "other"
@@ -268,6 +578,19 @@ const adminHTMLTemplate = `
         };
       }).filter(ds => ds !== null);
 
+      if (baseline) {
+        datasets.push({
+          type: 'line',
+          label: '合计（' + compareLabel() + '）',
+          data: baseline.map(d => Object.values(d.platform_active || {}).reduce((sum, v) => sum + (v || 0), 0)),
+          borderColor: 'rgba(100, 100, 100, 0.8)',
+          borderDash: [6, 4],
+          pointRadius: 0,
+          fill: false,
+          stack: 'baseline'
+        });
+      }
+
       const ctx = document.getElementById('platformChart').getContext('2d');
       return new Chart(ctx, {
         type: 'bar',
@@ -422,8 +745,141 @@ const adminHTMLTemplate = `
       });
     }
 
+    // 筛选条件保存在 URL 的 f 参数中（field:op:value），便于分享当前视图
+    function renderFilterChips() {
+      const fieldLabels = { app: '应用', platform: '平台', app_version: '版本', region: '地区', event_type: '事件类型', cohort: '首次出现日期' };
+      const opLabels = { eq: '=', in: '∈', prefix: '前缀' };
+      const container = document.getElementById('filterChips');
+      const filters = new URLSearchParams(location.search).getAll('f');
+
+      container.innerHTML = '';
+      filters.forEach(function (f, i) {
+        const parts = f.split(':');
+        const chip = document.createElement('span');
+        chip.className = 'chip';
+        const field = parts[0].startsWith('user.') ? '用户属性 ' + parts[0].slice(5) : (fieldLabels[parts[0]] || parts[0]);
+        chip.textContent = field + ' ' + (opLabels[parts[1]] || parts[1]) + ' ' + parts.slice(2).join(':');
+
+        const remove = document.createElement('a');
+        remove.textContent = '×';
+        remove.addEventListener('click', function () {
+          const params = new URLSearchParams(location.search);
+          const rest = params.getAll('f').filter((_, j) => j !== i);
+          params.delete('f');
+          rest.forEach(v => params.append('f', v));
+          location.search = params.toString();
+        });
+        chip.appendChild(remove);
+        container.appendChild(chip);
+      });
+    }
+
+    const compareLabels = { previous: '上一周期', week: '上周同期', year: '去年同期' };
+
+    function compareLabel() {
+      return COMPARISON ? compareLabels[COMPARISON.mode] || COMPARISON.mode : '';
+    }
+
+    function deltaBadge(d) {
+      if (!d) return '';
+      if (d.percent == null) {
+        return '<span class="badge">' + (d.previous === 0 && d.current > 0 ? '新增' : '-') + '</span>';
+      }
+      const cls = d.change > 0 ? 'up' : (d.change < 0 ? 'down' : '');
+      const arrow = d.change > 0 ? '▲' : (d.change < 0 ? '▼' : '');
+      return '<span class="badge ' + cls + '">' + arrow + ' ' + (d.percent > 0 ? '+' : '') + d.percent.toFixed(1) + '%</span>';
+    }
+
+    // 对比模式下显示整段时间的汇总卡片（用户在各自周期内去重）及各维度变化
+    function renderDeltas() {
+      const cards = document.getElementById('deltaCards');
+      const tables = document.getElementById('dimensionDeltas');
+      if (!COMPARISON) {
+        cards.style.display = 'none';
+        return;
+      }
+      const metricLabels = { new_users: '新增用户', active_users: '活跃用户', events: '事件数' };
+      cards.innerHTML = Object.keys(metricLabels).map(k => {
+        const d = COMPARISON.totals[k];
+        return '<div class="card"><div>' + metricLabels[k] + deltaBadge(d) + '</div><div class="value">' + d.current +
+          '</div><div class="prev">' + esc(compareLabel()) + '（' + esc(COMPARISON.baseline_from) + ' ~ ' +
+          esc(COMPARISON.baseline_to) + '）：' + d.previous + '</div></div>';
+      }).join('');
+
+      const dimLabels = { platform: '平台', app_version: '版本', region: '地区' };
+      tables.innerHTML = Object.keys(dimLabels).map(dim => {
+        // 按变化量绝对值排序，取前 10
+        const rows = Object.entries(COMPARISON.dimensions[dim] || {})
+          .sort((a, b) => Math.abs(b[1].change) - Math.abs(a[1].change))
+          .slice(0, 10);
+        return '<div><h4>' + dimLabels[dim] + '活跃用户变化</h4><table><tr><th>' + dimLabels[dim] +
+          '</th><th>当前</th><th>' + esc(compareLabel()) + '</th><th>变化</th></tr>' +
+          rows.map(([v, d]) => '<tr><td>' + esc(v || '未知') + '</td><td>' + d.current + '</td><td>' + d.previous +
+            '</td><td>' + (d.change > 0 ? '+' : '') + d.change + deltaBadge(d) + '</td></tr>').join('') +
+          '</table></div>';
+      }).join('');
+    }
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    // 参与度卡片：展示所选范围最后一天的值，以及范围内的平均/合计
+    function renderEngagement() {
+      const days = (ENGAGEMENT && ENGAGEMENT.days) || [];
+      if (!days.length) return;
+      const last = days[days.length - 1];
+      const sum = k => days.reduce((s, d) => s + (d[k] || 0), 0);
+      const pct = v => (v * 100).toFixed(1) + '%';
+      const avgStickiness = days.reduce((s, d) => s + d.stickiness, 0) / days.length;
+      const totalActive = sum('dau');
+      const cards = [
+        ['粘性（DAU/MAU）', pct(last.stickiness), '区间平均 ' + pct(avgStickiness)],
+        ['新用户 / 老用户', last.new_users + ' / ' + last.returning_users,
+          '区间新用户占比 ' + (totalActive ? pct(sum('new_users') / totalActive) : '-')],
+        ['流失用户', last.churned, '区间合计 ' + sum('churned')],
+        ['回流用户', last.resurrected, '区间合计 ' + sum('resurrected')]
+      ];
+      document.getElementById('engagementCards').innerHTML = cards.map(c =>
+        '<div class="card"><div>' + c[0] + '</div><div class="value">' + esc(c[1]) + '</div><div class="prev">' +
+        esc(last.date) + '；' + esc(c[2]) + '</div></div>'
+      ).join('');
+
+      const ctx = document.getElementById('engagementChart').getContext('2d');
+      new Chart(ctx, {
+        type: 'bar',
+        data: {
+          labels: days.map(d => d.date),
+          datasets: [
+            { label: '新用户', data: days.map(d => d.new_users), backgroundColor: 'rgba(75, 192, 192, 0.7)', stack: 'active' },
+            { label: '老用户', data: days.map(d => d.returning_users), backgroundColor: 'rgba(54, 162, 235, 0.7)', stack: 'active' },
+            { type: 'line', label: '流失', data: days.map(d => d.churned), borderColor: 'rgba(231, 76, 60, 1)', fill: false, tension: 0.2 },
+            { type: 'line', label: '回流', data: days.map(d => d.resurrected), borderColor: 'rgba(46, 204, 113, 1)', fill: false, tension: 0.2 },
+            {
+              type: 'line', label: '粘性 DAU/MAU', data: days.map(d => +(d.stickiness * 100).toFixed(2)),
+              borderColor: 'rgba(153, 102, 255, 1)', borderDash: [2, 2], fill: false, yAxisID: 'y1'
+            }
+          ]
+        },
+        options: {
+          responsive: true,
+          plugins: {
+            title: { display: true, text: '每日新老用户、流失与回流（连续 ' + ENGAGEMENT.inactive_days + ' 天无活动）' }
+          },
+          scales: {
+            x: { stacked: true },
+            y: { stacked: true, beginAtZero: true, ticks: { precision: 0 } },
+            y1: { position: 'right', beginAtZero: true, max: 100, grid: { drawOnChartArea: false }, ticks: { callback: v => v + '%' } }
+          }
+        }
+      });
+    }
+
     function redrawCharts(mode) {
-      const data = aggregateStats(mode);
+      const data = aggregateStats(rawStats, mode);
+      const baseline = aggregateStats(baselineStats(), mode);
 
       if (dailyChartInstance) {
         dailyChartInstance.destroy();
@@ -438,8 +894,8 @@ const adminHTMLTemplate = `
         versionChartInstance.destroy();
       }
 
-      dailyChartInstance = renderDailyChart(data);
-      platformChartInstance = renderPlatformChart(data);
+      dailyChartInstance = renderDailyChart(data, baseline, mode);
+      platformChartInstance = renderPlatformChart(data, baseline);
       regionChartInstance = renderRegionChart(data);
       versionChartInstance = renderVersionChart(data);
     }
@@ -450,6 +906,75 @@ const adminHTMLTemplate = `
         redrawCharts(this.value);
       });
 
+      // 日期范围与对比方式：保留当前筛选条件
+      const compare = document.getElementById('compare');
+      compare.value = '__COMPARE_MODE__';
+      document.getElementById('rangeForm').addEventListener('submit', function (e) {
+        e.preventDefault();
+        const params = new URLSearchParams(location.search);
+        params.set('from', document.getElementById('from').value);
+        params.set('to', document.getElementById('to').value);
+        if (compare.value) {
+          params.set('compare', compare.value);
+        } else {
+          params.delete('compare');
+        }
+        location.search = params.toString();
+      });
+
+      renderDeltas();
+      renderEngagement();
+      document.getElementById('engagementForm').addEventListener('submit', function (e) {
+        e.preventDefault();
+        const params = new URLSearchParams(location.search);
+        params.set('inactive_days', document.getElementById('inactiveDays').value);
+        location.search = params.toString();
+      });
+
+      renderFilterChips();
+      const includeInternal = document.getElementById('includeInternal');
+      includeInternal.checked = ['1', 'true'].includes(new URLSearchParams(location.search).get('include_internal'));
+      includeInternal.addEventListener('change', function () {
+        const params = new URLSearchParams(location.search);
+        if (includeInternal.checked) {
+          params.set('include_internal', '1');
+        } else {
+          params.delete('include_internal');
+        }
+        location.search = params.toString();
+      });
+      const filterField = document.getElementById('filterField');
+      const filterProperty = document.getElementById('filterProperty');
+      filterField.addEventListener('change', function () {
+        filterProperty.style.display = filterField.value === 'user.' ? '' : 'none';
+      });
+      document.getElementById('addFilter').addEventListener('click', function () {
+        const value = document.getElementById('filterValue').value.trim();
+        if (!value) return;
+        let field = filterField.value;
+        if (field === 'user.') {
+          const name = filterProperty.value.trim();
+          if (!name) return;
+          field += name;
+        }
+        const params = new URLSearchParams(location.search);
+        params.append('f', field + ':' + document.getElementById('filterOp').value + ':' + value);
+        location.search = params.toString();
+      });
+
+      // 导出按钮：使用当前日期范围、筛选条件与时间维度
+      document.querySelectorAll('.export-bar button').forEach(function (btn) {
+        btn.addEventListener('click', function () {
+          const params = new URLSearchParams(location.search);
+          params.set('format', this.dataset.format);
+          params.set('from', '__FROM__');
+          params.set('to', '__TO__');
+          params.set('granularity', select.value);
+          const report = document.getElementById('exportReport').value;
+          window.location.href = '/admin/export/' + report + '?' + params.toString();
+        });
+      });
+
       // 默认“按日”视图
       redrawCharts('day');
     })();
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/alerts"
+	"appstats/internal/logging"
+	"appstats/internal/models"
+)
+
+// AlertPageHandler renders the alert rules and history page.
+func AlertPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(alertHTMLTemplate))
+	}
+}
+
+// ListAlertRulesHandler lists all alert rules.
+func ListAlertRulesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rules []models.AlertRule
+		if err := db.Order("id").Find(&rules).Error; err != nil {
+			logging.FromContext(c).Error("list alert rules failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"rules": rules})
+	}
+}
+
+// CreateAlertRuleHandler creates an alert rule.
+func CreateAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rule models.AlertRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rule.ID = 0
+		rule.State, rule.LastEvaluatedAt = "", nil
+		if err := alerts.Validate(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Create(&rule).Error; err != nil {
+			logging.FromContext(c).Error("create alert rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create rule"})
+			return
+		}
+		c.JSON(http.StatusCreated, rule)
+	}
+}
+
+// UpdateAlertRuleHandler replaces the configuration of an alert rule while
+// keeping its evaluation state.
+func UpdateAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadAlertRule(c, db)
+		if !ok {
+			return
+		}
+		var rule models.AlertRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rule.ID = existing.ID
+		rule.CreatedAt = existing.CreatedAt
+		rule.State, rule.LastValue, rule.LastEvaluatedAt = existing.State, existing.LastValue, existing.LastEvaluatedAt
+		if err := alerts.Validate(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Save(&rule).Error; err != nil {
+			logging.FromContext(c).Error("update alert rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update rule"})
+			return
+		}
+		c.JSON(http.StatusOK, rule)
+	}
+}
+
+// DeleteAlertRuleHandler deletes an alert rule. Its history is kept.
+func DeleteAlertRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule, ok := loadAlertRule(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(rule).Error; err != nil {
+			logging.FromContext(c).Error("delete alert rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete rule"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// EvaluateAlertRuleHandler evaluates a rule immediately. With ?dry_run=1 the
+// result is only returned, without updating state or sending notifications.
+func EvaluateAlertRuleHandler(db *gorm.DB, engine *alerts.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule, ok := loadAlertRule(c, db)
+		if !ok {
+			return
+		}
+		var res *alerts.Result
+		var err error
+		if c.Query("dry_run") == "1" {
+			res, err = engine.Check(rule)
+		} else {
+			res, err = engine.Evaluate(c.Request.Context(), rule)
+		}
+		if err != nil {
+			logging.FromContext(c).Error("evaluate alert rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "evaluation failed"})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// ListAlertEventsHandler returns the latest alert history, optionally for one rule.
+func ListAlertEventsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("id DESC").Limit(200)
+		if v := c.Query("rule_id"); v != "" {
+			q = q.Where("rule_id = ?", v)
+		}
+		var events []models.AlertEvent
+		if err := q.Find(&events).Error; err != nil {
+			logging.FromContext(c).Error("list alert events failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"events": events})
+	}
+}
+
+// loadAlertRule fetches the rule named by the :id parameter, writing an
+// error response and returning false when it cannot.
+func loadAlertRule(c *gin.Context, db *gorm.DB) (*models.AlertRule, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var rule models.AlertRule
+	if err := db.First(&rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load alert rule failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &rule, true
+}
+
+// alertHTMLTemplate is the HTML template for the alert rules page.
+const alertHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>告警规则</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    form { display: flex; flex-wrap: wrap; gap: 8px 16px; max-width: 1100px; margin-bottom: 16px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 13px; }
+    th { background: #f5f5f5; }
+    .firing { color: #c00; font-weight: bold; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>告警规则</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="ruleForm">
+    <input type="hidden" name="id">
+    <label>名称：<input type="text" name="name" required></label>
+    <label>应用：<input type="text" name="app" placeholder="全部" size="10"></label>
+    <label>指标：
+      <select name="metric">
+        <option value="active_users">活跃用户</option>
+        <option value="new_users">新增用户</option>
+        <option value="events">事件数</option>
+        <option value="ingest_error_rate">上报错误率</option>
+      </select>
+    </label>
+    <label>事件类型：<input type="text" name="event_type" size="10" placeholder="仅事件数"></label>
+    <label>统计窗口（分钟）：<input type="number" name="window_minutes" value="1440" min="1" style="width: 80px;"></label>
+    <label>类型：
+      <select name="kind">
+        <option value="anomaly">异常检测（同比前 N 周）</option>
+        <option value="threshold">阈值</option>
+      </select>
+    </label>
+    <label>条件：
+      <select name="operator">
+        <option value="drop">下降</option>
+        <option value="rise">上升</option>
+        <option value="both">双向</option>
+        <option value="<">&lt; 阈值</option>
+        <option value=">">&gt; 阈值</option>
+      </select>
+    </label>
+    <label>阈值/偏离比例：<input type="number" name="threshold" step="any" value="0.3" style="width: 80px;"></label>
+    <label>基线周数：<input type="number" name="baseline_weeks" value="4" min="1" style="width: 60px;"></label>
+    <label>检查间隔（分钟）：<input type="number" name="interval_minutes" value="60" min="1" style="width: 60px;"></label>
+    <label>Webhook：<input type="text" name="webhook" size="30"></label>
+    <label>邮件（逗号分隔）：<input type="text" name="emails" size="30"></label>
+    <label><input type="checkbox" name="enabled" checked> 启用</label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+
+  <div id="status"></div>
+  <h3>规则</h3>
+  <table>
+    <thead>
+      <tr><th>名称</th><th>应用</th><th>指标</th><th>条件</th><th>状态</th><th>最新值</th><th>最近检查</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rules"></tbody>
+  </table>
+
+  <h3>告警历史</h3>
+  <table>
+    <thead>
+      <tr><th>时间</th><th>规则</th><th>状态</th><th>值</th><th>基线</th><th>说明</th><th>通知错误</th></tr>
+    </thead>
+    <tbody id="history"></tbody>
+  </table>
+
+  <script>
+    let rules = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    function describe(r) {
+      if (r.kind === 'threshold') return r.operator + ' ' + r.threshold;
+      const dir = { drop: '下降', rise: '上升', both: '偏离' }[r.operator] || r.operator;
+      return '较前 ' + r.baseline_weeks + ' 周同期' + dir + ' ≥ ' + (r.threshold * 100) + '%';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function load() {
+      try {
+        rules = (await api('GET', '/admin/api/alerts/rules')).rules || [];
+        document.getElementById('rules').innerHTML = rules.map(r =>
+          '<tr><td>' + esc(r.name) + (r.enabled ? '' : '（停用）') + '</td><td>' + esc(r.app || '全部') + '</td><td>' +
+          esc(r.metric) + (r.event_type ? ' / ' + esc(r.event_type) : '') + '</td><td>' + esc(describe(r)) + '</td><td' +
+          (r.state === 'firing' ? ' class="firing"' : '') + '>' + esc(r.state) + '</td><td>' + r.last_value + '</td><td>' +
+          esc(fmtTime(r.last_evaluated_at)) + '</td><td><button onclick="test(' + r.id + ')">试运行</button> ' +
+          '<button onclick="edit(' + r.id + ')">编辑</button> <button onclick="removeRule(' + r.id + ')">删除</button></td></tr>'
+        ).join('');
+
+        const events = (await api('GET', '/admin/api/alerts/events')).events || [];
+        document.getElementById('history').innerHTML = events.map(e =>
+          '<tr><td>' + esc(fmtTime(e.created_at)) + '</td><td>' + esc(e.rule_name) + '</td><td' +
+          (e.status === 'firing' ? ' class="firing"' : '') + '>' + esc(e.status) + '</td><td>' + e.value + '</td><td>' +
+          (e.baseline == null ? '-' : e.baseline.toFixed(2)) + '</td><td>' + esc(e.message) + '</td><td>' +
+          esc(e.notify_error) + '</td></tr>'
+        ).join('');
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    function formToRule(form) {
+      const channels = [];
+      const webhook = form.elements.webhook.value.trim();
+      if (webhook) channels.push({ type: 'webhook', url: webhook });
+      const emails = form.elements.emails.value.split(',').map(s => s.trim()).filter(Boolean);
+      if (emails.length) channels.push({ type: 'email', to: emails });
+      return {
+        name: form.elements.name.value.trim(),
+        app: form.elements.app.value.trim(),
+        metric: form.elements.metric.value,
+        event_type: form.elements.event_type.value.trim(),
+        window_minutes: parseInt(form.elements.window_minutes.value, 10),
+        kind: form.elements.kind.value,
+        operator: form.elements.operator.value,
+        threshold: parseFloat(form.elements.threshold.value),
+        baseline_weeks: parseInt(form.elements.baseline_weeks.value, 10),
+        interval_minutes: parseInt(form.elements.interval_minutes.value, 10),
+        enabled: form.elements.enabled.checked,
+        channels
+      };
+    }
+
+    function edit(id) {
+      const r = rules.find(x => x.id === id);
+      if (!r) return;
+      const form = document.getElementById('ruleForm');
+      for (const k of ['id', 'name', 'app', 'metric', 'event_type', 'window_minutes', 'kind', 'operator', 'threshold', 'baseline_weeks', 'interval_minutes']) {
+        form.elements[k].value = r[k];
+      }
+      form.elements.enabled.checked = r.enabled;
+      const channels = r.channels || [];
+      form.elements.webhook.value = (channels.find(c => c.type === 'webhook') || {}).url || '';
+      form.elements.emails.value = ((channels.find(c => c.type === 'email') || {}).to || []).join(', ');
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    function resetForm() {
+      const form = document.getElementById('ruleForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    async function test(id) {
+      try {
+        const res = await api('POST', '/admin/api/alerts/rules/' + id + '/evaluate?dry_run=1');
+        alert((res.firing ? '会触发：' : '不会触发：') + res.message);
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    async function removeRule(id) {
+      if (!confirm('确定删除该规则？')) return;
+      try {
+        await api('DELETE', '/admin/api/alerts/rules/' + id);
+        load();
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    (function init() {
+      const form = document.getElementById('ruleForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        try {
+          await api(id ? 'PUT' : 'POST', '/admin/api/alerts/rules' + (id ? '/' + id : ''), formToRule(form));
+          showError('');
+          resetForm();
+          load();
+        } catch (err) {
+          showError(err.message);
+        }
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/annotations"
+	"appstats/internal/logging"
+	"appstats/internal/models"
+)
+
+// AnnotationRequest is the payload for creating or updating an annotation.
+type AnnotationRequest struct {
+	Date     string `json:"date" binding:"required"` // YYYY-MM-DD
+	App      string `json:"app"`
+	Label    string `json:"label" binding:"required,max=128"`
+	Category string `json:"category" binding:"omitempty,oneof=release campaign incident other"`
+}
+
+func (r AnnotationRequest) apply(a *models.Annotation) error {
+	date, err := time.Parse(dateLayout, r.Date)
+	if err != nil {
+		return errors.New("invalid date, want YYYY-MM-DD")
+	}
+	a.Date = date
+	a.App = r.App
+	if a.App == "" {
+		a.App = models.DefaultApp
+	}
+	a.Label = r.Label
+	a.Category = r.Category
+	if a.Category == "" {
+		a.Category = models.AnnotationOther
+	}
+	return nil
+}
+
+// AnnotationPageHandler renders the annotation management page.
+func AnnotationPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(annotationHTMLTemplate))
+	}
+}
+
+// ListAnnotationsHandler lists annotations in a date range (default last 90 days).
+func ListAnnotationsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start, days, err := parseDateRange(c, 90, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		res, err := annotations.List(db, start, start.AddDate(0, 0, days), c.Query("app"))
+		if err != nil {
+			logging.FromContext(c).Error("list annotations failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"annotations": res})
+	}
+}
+
+// CreateAnnotationHandler creates a manual annotation.
+func CreateAnnotationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req AnnotationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		a := models.Annotation{Source: models.AnnotationSourceManual}
+		if err := req.apply(&a); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Create(&a).Error; err != nil {
+			logging.FromContext(c).Error("create annotation failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create annotation"})
+			return
+		}
+		c.JSON(http.StatusCreated, a)
+	}
+}
+
+// UpdateAnnotationHandler updates an annotation by id.
+func UpdateAnnotationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := loadAnnotation(c, db)
+		if !ok {
+			return
+		}
+		var req AnnotationRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := req.apply(a); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Save(a).Error; err != nil {
+			logging.FromContext(c).Error("update annotation failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update annotation"})
+			return
+		}
+		c.JSON(http.StatusOK, a)
+	}
+}
+
+// DeleteAnnotationHandler deletes an annotation by id.
+func DeleteAnnotationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, ok := loadAnnotation(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(a).Error; err != nil {
+			logging.FromContext(c).Error("delete annotation failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete annotation"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// loadAnnotation fetches the annotation named by the :id parameter, writing
+// an error response and returning false when it cannot.
+func loadAnnotation(c *gin.Context, db *gorm.DB) (*models.Annotation, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var a models.Annotation
+	if err := db.First(&a, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "annotation not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load annotation failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &a, true
+}
+
+// annotationHTMLTemplate is the HTML template for the annotation management page.
+const annotationHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>图表标注</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>图表标注</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="annForm">
+    <input type="hidden" name="id">
+    <label>日期：<input type="date" name="date" required></label>
+    <label>应用：<input type="text" name="app" placeholder="default" size="12"></label>
+    <label>名称：<input type="text" name="label" required maxlength="128" size="30"></label>
+    <label>类别：
+      <select name="category">
+        <option value="release">发布</option>
+        <option value="campaign">活动</option>
+        <option value="incident">故障</option>
+        <option value="other">其它</option>
+      </select>
+    </label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>日期</th><th>应用</th><th>名称</th><th>类别</th><th>来源</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <script>
+    const CATEGORY_LABELS = { release: '发布', campaign: '活动', incident: '故障', other: '其它' };
+    let items = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    async function load() {
+      const resp = await fetch('/admin/api/annotations' + location.search);
+      const data = await resp.json();
+      if (!resp.ok) {
+        showError(data.error);
+        return;
+      }
+      items = data.annotations || [];
+      document.getElementById('rows').innerHTML = items.map(a =>
+        '<tr><td>' + esc(a.date.slice(0, 10)) + '</td><td>' + esc(a.app) + '</td><td>' + esc(a.label) +
+        '</td><td>' + esc(CATEGORY_LABELS[a.category] || a.category) + '</td><td>' + esc(a.source) +
+        '</td><td><button onclick="edit(' + a.id + ')">编辑</button> <button onclick="remove(' + a.id + ')">删除</button></td></tr>'
+      ).join('');
+    }
+
+    function resetForm() {
+      const form = document.getElementById('annForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    function edit(id) {
+      const a = items.find(x => x.id === id);
+      if (!a) return;
+      const form = document.getElementById('annForm');
+      form.elements.id.value = a.id;
+      form.elements.date.value = a.date.slice(0, 10);
+      form.elements.app.value = a.app;
+      form.elements.label.value = a.label;
+      form.elements.category.value = a.category;
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    async function remove(id) {
+      if (!confirm('确定删除该标注？')) return;
+      const resp = await fetch('/admin/api/annotations/' + id, { method: 'DELETE' });
+      if (!resp.ok) {
+        showError((await resp.json()).error);
+        return;
+      }
+      load();
+    }
+
+    (function init() {
+      const form = document.getElementById('annForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        const body = {
+          date: form.elements.date.value,
+          app: form.elements.app.value.trim(),
+          label: form.elements.label.value.trim(),
+          category: form.elements.category.value
+        };
+        const resp = await fetch('/admin/api/annotations' + (id ? '/' + id : ''), {
+          method: id ? 'PUT' : 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify(body)
+        });
+        if (!resp.ok) {
+          showError((await resp.json()).error);
+          return;
+        }
+        showError('');
+        resetForm();
+        load();
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,510 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/pseudonym"
+)
+
+// RotateSaltRequest is the payload of the salt rotation API.
+type RotateSaltRequest struct {
+	App string `json:"app" binding:"required,max=64"`
+}
+
+// LookupPseudonymRequest is the payload of the pseudonym lookup API.
+type LookupPseudonymRequest struct {
+	App    string `json:"app" binding:"required,max=64"`
+	UserID string `json:"user_id" binding:"required,max=64"`
+}
+
+// AppPrivacyPageHandler renders the app privacy settings page.
+func AppPrivacyPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(appPrivacyHTMLTemplate))
+	}
+}
+
+// ListAppPrivacyHandler lists the privacy settings of all apps.
+func ListAppPrivacyHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var settings []models.AppPrivacy
+		if err := db.Order("app").Find(&settings).Error; err != nil {
+			logging.FromContext(c).Error("list app privacy settings failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"settings": settings})
+	}
+}
+
+// CreateAppPrivacyHandler creates the privacy settings of an app. Each app
+// has at most one.
+func CreateAppPrivacyHandler(db *gorm.DB, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var s models.AppPrivacy
+		if err := c.ShouldBindJSON(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		s.ID = 0
+		if !validateAppPrivacy(c, db, &s) {
+			return
+		}
+		if err := db.Create(&s).Error; err != nil {
+			logging.FromContext(c).Error("create app privacy settings failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create settings"})
+			return
+		}
+		pseudo.Invalidate()
+		c.JSON(http.StatusCreated, s)
+	}
+}
+
+// UpdateAppPrivacyHandler replaces the privacy settings of an app.
+func UpdateAppPrivacyHandler(db *gorm.DB, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadAppPrivacy(c, db)
+		if !ok {
+			return
+		}
+		var s models.AppPrivacy
+		if err := c.ShouldBindJSON(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		s.ID = existing.ID
+		s.CreatedAt = existing.CreatedAt
+		if !validateAppPrivacy(c, db, &s) {
+			return
+		}
+		if err := db.Save(&s).Error; err != nil {
+			logging.FromContext(c).Error("update app privacy settings failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update settings"})
+			return
+		}
+		pseudo.Invalidate()
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// DeleteAppPrivacyHandler deletes the privacy settings of an app, which
+// then uses the defaults. Its salts are kept.
+func DeleteAppPrivacyHandler(db *gorm.DB, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := loadAppPrivacy(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(s).Error; err != nil {
+			logging.FromContext(c).Error("delete app privacy settings failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete settings"})
+			return
+		}
+		pseudo.Invalidate()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ListPseudonymSaltsHandler lists the salt versions of all apps, or of the
+// app given as query parameter. The salts themselves are never returned.
+func ListPseudonymSaltsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("app, version DESC")
+		if app := c.Query("app"); app != "" {
+			q = q.Where("app = ?", app)
+		}
+		var salts []models.PseudonymSalt
+		if err := q.Find(&salts).Error; err != nil {
+			logging.FromContext(c).Error("list pseudonym salts failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"salts": salts})
+	}
+}
+
+// RotatePseudonymSaltHandler creates a new salt version for an app. New
+// user IDs are pseudonymized with it; known IDs keep their pseudonyms until
+// the older salt is retired.
+func RotatePseudonymSaltHandler(db *gorm.DB, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RotateSaltRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		salt, err := pseudonym.Rotate(db, req.App)
+		if err != nil {
+			logging.FromContext(c).Error("rotate pseudonym salt failed", slog.String("app", req.App), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate salt"})
+			return
+		}
+		pseudo.Invalidate()
+		logging.FromContext(c).Info("pseudonym salt rotated", slog.String("app", req.App), slog.Int("version", salt.Version))
+		c.JSON(http.StatusCreated, salt)
+	}
+}
+
+// RetirePseudonymSaltHandler stops using a salt version.
+func RetirePseudonymSaltHandler(db *gorm.DB, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		if err := pseudonym.Retire(db, uint(id), time.Now()); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "active salt not found"})
+				return
+			}
+			logging.FromContext(c).Error("retire pseudonym salt failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retire salt"})
+			return
+		}
+		pseudo.Invalidate()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// LookupPseudonymHandler returns the pseudonyms of a raw user ID under the
+// active salts of an app, newest first, e.g. to export or erase the data of
+// a user who only knows their account ID.
+func LookupPseudonymHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LookupPseudonymRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ids, err := pseudonym.Lookup(db, req.App, req.UserID)
+		if err != nil {
+			logging.FromContext(c).Error("lookup pseudonym failed", slog.String("app", req.App), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"pseudonyms": ids})
+	}
+}
+
+// validateAppPrivacy validates s and checks that no other settings exist
+// for its app, writing an error response and returning false when they are
+// not valid.
+func validateAppPrivacy(c *gin.Context, db *gorm.DB, s *models.AppPrivacy) bool {
+	if err := pseudonym.Validate(s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	var n int64
+	if err := db.Model(&models.AppPrivacy{}).Where("app = ? AND id <> ?", s.App, s.ID).Count(&n).Error; err != nil {
+		logging.FromContext(c).Error("check app privacy settings failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return false
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "settings for this app already exist"})
+		return false
+	}
+	return true
+}
+
+func loadAppPrivacy(c *gin.Context, db *gorm.DB) (*models.AppPrivacy, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var s models.AppPrivacy
+	if err := db.First(&s, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "settings not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load app privacy settings failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &s, true
+}
+
+// appPrivacyHTMLTemplate is the HTML template for the app privacy settings page.
+const appPrivacyHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>应用隐私设置</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .error { color: #c00; }
+    code { font-size: 13px; }
+  </style>
+</head>
+<body>
+  <h2>应用隐私设置</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="settingsForm">
+    <input type="hidden" name="id">
+    <label>应用：<input type="text" name="app" required maxlength="64" size="12" placeholder="default"></label>
+    <label><input type="checkbox" name="pseudonymize"> 假名化 user_id</label>
+    <label>疑似个人信息：<select name="pii_action">
+      <option value="allow">允许</option>
+      <option value="hash">哈希后存储</option>
+      <option value="reject">拒绝（400）</option>
+    </select></label>
+    <label>拒绝统计的用户：<select name="opt_out_mode">
+      <option value="drop">丢弃事件</option>
+      <option value="count">仅匿名计数</option>
+    </select></label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+  <p>假名化后 user_id 以 HMAC-SHA256(应用盐值, user_id) 存储，形如 p1_…，同一 user_id 始终对应同一假名。疑似个人信息指邮箱或手机号形式的 user_id。</p>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>应用</th><th>假名化</th><th>疑似个人信息</th><th>拒绝统计的用户</th><th>更新时间</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <h3>盐值版本</h3>
+  <form id="rotateForm">
+    <label>应用：<input type="text" name="app" required maxlength="64" size="12" placeholder="default"></label>
+    <button type="submit">轮换盐值</button>
+  </form>
+  <p>轮换后新用户使用新盐值，已有用户保留原假名，直到旧盐值停用。停用后旧假名的用户再次上报时会被视为新用户。</p>
+  <table>
+    <thead>
+      <tr><th>应用</th><th>版本</th><th>创建时间</th><th>停用时间</th><th>操作</th></tr>
+    </thead>
+    <tbody id="saltRows"></tbody>
+  </table>
+
+  <h3>查询假名</h3>
+  <form id="lookupForm">
+    <label>应用：<input type="text" name="app" required maxlength="64" size="12" placeholder="default"></label>
+    <label>原始 user_id：<input type="text" name="user_id" required maxlength="64" size="30"></label>
+    <button type="submit">查询</button>
+  </form>
+  <div id="lookupResult"></div>
+
+  <h3>拒绝统计的用户</h3>
+  <form id="optOutForm">
+    <label>应用：<input type="text" name="app" required maxlength="64" size="12" placeholder="default"></label>
+    <label>user_id（已存储的标识）：<input type="text" name="user_id" required maxlength="64" size="40"></label>
+    <button type="submit">加入</button>
+  </form>
+  <p>客户端上报 consent=denied 或调用 /api/consent 时自动加入。加入后该用户在此应用的事件不再存储，约 1 分钟后后台删除其历史事件；移出后只恢复后续统计，已删除的数据无法恢复。</p>
+  <table>
+    <thead>
+      <tr><th>应用</th><th>user_id</th><th>来源</th><th>时间</th><th>已清理</th><th>错误</th><th>操作</th></tr>
+    </thead>
+    <tbody id="optOutRows"></tbody>
+  </table>
+
+  <script>
+    const PII_LABELS = { allow: '允许', hash: '哈希后存储', reject: '拒绝' };
+    const OPT_OUT_LABELS = { drop: '丢弃事件', count: '仅匿名计数' };
+    const SOURCE_LABELS = { client: '客户端', admin: '管理员' };
+    let items = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method: method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function load() {
+      let salts, optOuts;
+      try {
+        items = (await api('GET', '/admin/api/app-privacy/settings')).settings || [];
+        salts = (await api('GET', '/admin/api/app-privacy/salts')).salts || [];
+        optOuts = (await api('GET', '/admin/api/consent/opt-outs')).opt_outs || [];
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      document.getElementById('rows').innerHTML = items.map(s =>
+        '<tr><td>' + esc(s.app) + '</td><td>' + (s.pseudonymize ? '是' : '否') + '</td><td>' +
+        esc(PII_LABELS[s.pii_action] || s.pii_action) + '</td><td>' + esc(OPT_OUT_LABELS[s.opt_out_mode] || '丢弃事件') +
+        '</td><td>' + esc(fmtTime(s.updated_at)) +
+        '</td><td><button onclick="edit(' + s.id + ')">编辑</button> <button onclick="remove(' + s.id + ')">删除</button></td></tr>'
+      ).join('');
+      document.getElementById('saltRows').innerHTML = salts.map(s =>
+        '<tr><td>' + esc(s.app) + '</td><td>' + s.version + '</td><td>' + esc(fmtTime(s.created_at)) +
+        '</td><td>' + esc(fmtTime(s.retired_at)) + '</td><td>' +
+        (s.retired_at ? '' : '<button onclick="retire(' + s.id + ')">停用</button>') + '</td></tr>'
+      ).join('');
+      document.getElementById('optOutRows').innerHTML = optOuts.map(o =>
+        '<tr><td>' + esc(o.app) + '</td><td>' + esc(o.user_id) + '</td><td>' + esc(SOURCE_LABELS[o.source] || o.source) +
+        '</td><td>' + esc(fmtTime(o.created_at)) + '</td><td>' + esc(fmtTime(o.purged_at)) +
+        '</td><td class="error">' + esc(o.purge_error) + '</td><td><button onclick="optIn(' + o.id + ')">移出</button></td></tr>'
+      ).join('');
+    }
+
+    function resetForm() {
+      const form = document.getElementById('settingsForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    function edit(id) {
+      const s = items.find(x => x.id === id);
+      if (!s) return;
+      const form = document.getElementById('settingsForm');
+      form.elements.id.value = s.id;
+      form.elements.app.value = s.app;
+      form.elements.pseudonymize.checked = s.pseudonymize;
+      form.elements.pii_action.value = s.pii_action;
+      form.elements.opt_out_mode.value = s.opt_out_mode || 'drop';
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    async function remove(id) {
+      if (!confirm('确定删除该设置？删除后该应用使用默认设置。')) return;
+      try {
+        await api('DELETE', '/admin/api/app-privacy/settings/' + id);
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function retire(id) {
+      if (!confirm('确定停用该盐值？使用该盐值假名的用户再次上报时将被视为新用户。')) return;
+      try {
+        await api('POST', '/admin/api/app-privacy/salts/' + id + '/retire');
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function optIn(id) {
+      if (!confirm('确定将该用户移出？之后其事件会重新被统计。')) return;
+      try {
+        await api('DELETE', '/admin/api/consent/opt-outs/' + id);
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    (function init() {
+      const form = document.getElementById('settingsForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        const body = {
+          app: form.elements.app.value.trim(),
+          pseudonymize: form.elements.pseudonymize.checked,
+          pii_action: form.elements.pii_action.value,
+          opt_out_mode: form.elements.opt_out_mode.value
+        };
+        try {
+          await api(id ? 'PUT' : 'POST', '/admin/api/app-privacy/settings' + (id ? '/' + id : ''), body);
+        } catch (e) {
+          showError(e.message);
+          return;
+        }
+        showError('');
+        resetForm();
+        load();
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+
+      const rotateForm = document.getElementById('rotateForm');
+      rotateForm.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        if (!confirm('确定轮换盐值？')) return;
+        try {
+          await api('POST', '/admin/api/app-privacy/salts', { app: rotateForm.elements.app.value.trim() });
+        } catch (e) {
+          showError(e.message);
+          return;
+        }
+        showError('');
+        rotateForm.reset();
+        load();
+      });
+
+      const optOutForm = document.getElementById('optOutForm');
+      optOutForm.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        if (!confirm('确定加入？该用户在此应用的历史事件将被删除且不可恢复。')) return;
+        try {
+          await api('POST', '/admin/api/consent/opt-outs', {
+            app: optOutForm.elements.app.value.trim(),
+            user_id: optOutForm.elements.user_id.value.trim()
+          });
+        } catch (e) {
+          showError(e.message);
+          return;
+        }
+        showError('');
+        optOutForm.reset();
+        load();
+      });
+
+      const lookupForm = document.getElementById('lookupForm');
+      lookupForm.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const result = document.getElementById('lookupResult');
+        try {
+          const data = await api('POST', '/admin/api/app-privacy/lookup', {
+            app: lookupForm.elements.app.value.trim(),
+            user_id: lookupForm.elements.user_id.value.trim()
+          });
+          const ids = data.pseudonyms || [];
+          result.innerHTML = ids.length ? '<p>' + ids.map(id => '<code>' + esc(id) + '</code>').join('<br>') + '</p>' :
+            '<p>该应用尚无盐值，user_id 未被假名化。</p>';
+        } catch (e) {
+          result.innerHTML = '<p class="error">' + esc(e.message) + '</p>';
+        }
+      });
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+)
+
+// ListArchivePartitionsHandler lists the archived partitions, optionally for
+// one app.
+func ListArchivePartitionsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("app, day")
+		if v := c.Query("app"); v != "" {
+			q = q.Where("app = ?", v)
+		}
+		var partitions []models.ArchivePartition
+		if err := q.Find(&partitions).Error; err != nil {
+			logging.FromContext(c).Error("list archive partitions failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"partitions": partitions})
+	}
+}
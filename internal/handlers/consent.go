@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/consent"
+	"appstats/internal/identity"
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/pseudonym"
+)
+
+// maxAnonymousCountDays bounds the date range of an anonymous counts query.
+const maxAnonymousCountDays = 366
+
+// ConsentRequest is the payload of the consent API.
+type ConsentRequest struct {
+	App    string `json:"app" form:"app"` // 可选，默认 default
+	UserID string `json:"user_id" form:"user_id" binding:"required,max=64"`
+	// Consent is "granted" or "denied"; only used when setting consent.
+	Consent string `json:"consent" form:"-" binding:"omitempty,oneof=granted denied"`
+}
+
+// ConsentStatus is the response of the consent API.
+type ConsentStatus struct {
+	App     string `json:"app"`
+	Consent string `json:"consent"`
+}
+
+// OptOutRequest is the payload of the admin opt-out API.
+type OptOutRequest struct {
+	App    string `json:"app" binding:"required,max=64"`
+	UserID string `json:"user_id" binding:"required,max=64"`
+}
+
+// GetConsentHandler tells a client whether a user opted out of an app. The
+// user ID is pseudonymized like reported events and may be an alias.
+func GetConsentHandler(ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer, optOuts *consent.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ConsentRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userIDs, ok := consentUserIDs(c, ids, pseudo, &req)
+		if !ok {
+			return
+		}
+		out, err := optOuts.OptedOut(req.App, userIDs...)
+		if err != nil {
+			logging.FromContext(c).Error("load consent failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		status := ConsentStatus{App: req.App, Consent: consent.Granted}
+		if out {
+			status.Consent = consent.Denied
+		}
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// SetConsentHandler records the consent of a user without reporting an
+// event. Denying adds the user to the opt-out list of the app and purges
+// their data; granting removes them from it.
+func SetConsentHandler(ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer, optOuts *consent.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ConsentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Consent == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "consent is required"})
+			return
+		}
+		userIDs, ok := consentUserIDs(c, ids, pseudo, &req)
+		if !ok {
+			return
+		}
+		log := logging.FromContext(c)
+		var err error
+		if req.Consent == consent.Denied {
+			err = optOuts.OptOut(req.App, consent.SourceClient, userIDs...)
+		} else {
+			err = optOuts.OptIn(req.App, userIDs...)
+		}
+		if err != nil {
+			log.Error("record consent failed", slog.String("app", req.App), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record consent"})
+			return
+		}
+		if req.Consent == consent.Denied {
+			log.Info("user opted out", slog.String("app", req.App), slog.String("user_id", userIDs[len(userIDs)-1]))
+		}
+		c.JSON(http.StatusOK, ConsentStatus{App: req.App, Consent: req.Consent})
+	}
+}
+
+// consentUserIDs pseudonymizes the user ID of req and returns it together
+// with the user it is an alias of, writing the error response and returning
+// false on failure.
+func consentUserIDs(c *gin.Context, ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer, req *ConsentRequest) ([]string, bool) {
+	if req.App == "" {
+		req.App = models.DefaultApp
+	}
+	if !pseudonymizeUserIDs(c, pseudo, req.App, &req.UserID) {
+		return nil, false
+	}
+	userID, err := ids.Resolve(req.UserID)
+	if err != nil {
+		logging.FromContext(c).Error("resolve user alias failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return []string{req.UserID, userID}, true
+}
+
+// consentDropsEvent applies the consent reported with an event for userIDs,
+// which are the reported user ID and the user it is an alias of, and
+// reports whether the event must be dropped because the user opted out.
+// Errors are logged.
+func consentDropsEvent(c *gin.Context, optOuts *consent.Registry, app, value string, userIDs ...string) (bool, error) {
+	out, changed, err := optOuts.Report(app, value, userIDs...)
+	if err != nil {
+		logging.FromContext(c).Error("apply consent failed", slog.String("app", app), slog.String("consent", value), slog.Any("error", err))
+		return false, err
+	}
+	if changed && value == consent.Denied {
+		logging.FromContext(c).Info("user opted out", slog.String("app", app), slog.String("user_id", userIDs[len(userIDs)-1]))
+	}
+	return out, nil
+}
+
+// ListOptOutsHandler returns the latest opt-outs, optionally of one app or
+// user.
+func ListOptOutsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("id DESC").Limit(200)
+		if v := c.Query("app"); v != "" {
+			q = q.Where("app = ?", v)
+		}
+		if v := c.Query("user_id"); v != "" {
+			q = q.Where("user_id = ?", v)
+		}
+		var optOuts []models.ConsentOptOut
+		if err := q.Find(&optOuts).Error; err != nil {
+			logging.FromContext(c).Error("list opt-outs failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"opt_outs": optOuts})
+	}
+}
+
+// CreateOptOutHandler opts a user out of an app on their behalf, e.g. after
+// a request by mail. The user ID is the stored one and may be an alias.
+func CreateOptOutHandler(ids *identity.Resolver, optOuts *consent.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OptOutRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, err := ids.Resolve(req.UserID)
+		if err != nil {
+			logging.FromContext(c).Error("resolve user alias failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if err := optOuts.OptOut(req.App, consent.SourceAdmin, req.UserID, userID); err != nil {
+			logging.FromContext(c).Error("create opt-out failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create opt-out"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"status": "ok"})
+	}
+}
+
+// DeleteOptOutHandler removes an opt-out, so the user's events are stored
+// again. Data already purged is not restored.
+func DeleteOptOutHandler(db *gorm.DB, optOuts *consent.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		var o models.ConsentOptOut
+		if err := db.First(&o, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "opt-out not found"})
+				return
+			}
+			logging.FromContext(c).Error("load opt-out failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if err := optOuts.OptIn(o.App, o.UserID); err != nil {
+			logging.FromContext(c).Error("delete opt-out failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete opt-out"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ListAnonymousCountsHandler returns the anonymous event counts of
+// opted-out users in a date range.
+func ListAnonymousCountsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, days, err := parseDateRange(c, 30, maxAnonymousCountDays)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		q := db.Model(&models.AnonymousEventCount{}).
+			Select("DATE_FORMAT(day, '%Y-%m-%d') AS day, app, event_type, platform, events").
+			Where("day >= ? AND day < ?", from.Format(dateLayout), from.AddDate(0, 0, days).Format(dateLayout)).
+			Order("day, app, event_type, platform")
+		if v := c.Query("app"); v != "" {
+			q = q.Where("app = ?", v)
+		}
+		var rows []struct {
+			Day       string `json:"day"`
+			App       string `json:"app"`
+			EventType string `json:"event_type"`
+			Platform  string `json:"platform"`
+			Events    int64  `json:"events"`
+		}
+		if err := q.Scan(&rows).Error; err != nil {
+			logging.FromContext(c).Error("load anonymous counts failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"counts": rows})
+	}
+}
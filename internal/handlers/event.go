@@ -1,84 +1,556 @@
 package handlers
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/netip"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 	"gorm.io/gorm"
 
+	"appstats/internal/annotations"
+	"appstats/internal/consent"
+	"appstats/internal/eventtime"
+	"appstats/internal/identity"
+	"appstats/internal/ingest"
+	"appstats/internal/logging"
+	"appstats/internal/metrics"
 	"appstats/internal/models"
+	"appstats/internal/profiles"
+	"appstats/internal/pseudonym"
+	"appstats/internal/rollups"
+	"appstats/internal/schema"
+	"appstats/internal/traffic"
+	"appstats/internal/webhooks"
+)
+
+const (
+	// maxDeadLetterPayload bounds the stored payload of a dead letter, in
+	// bytes.
+	maxDeadLetterPayload = 60000
+	// maxEventBytes bounds the size of one reported event, in bytes.
+	maxEventBytes = 1 << 20
+	// maxStreamErrors bounds the rejected lines listed in the response to
+	// a newline-delimited report.
+	maxStreamErrors = 100
+	// ndjsonContentType is the content type of newline-delimited reports.
+	ndjsonContentType = "application/x-ndjson"
 )
 
 // ReportEventRequest is the payload for the write-only event reporting API.
 type ReportEventRequest struct {
-	UserID     string     `json:"user_id" binding:"required"`
-	Platform   string     `json:"platform" binding:"required"` // ios/android/web
-	Region     string     `json:"region"`
-	AppVersion string     `json:"app_version"` // 可选，用于统计 app 版本分布
-	EventTime  *time.Time `json:"event_time"`
+	App        string         `json:"app" binding:"max=64"` // 可选，默认 default
+	UserID     string         `json:"user_id" binding:"required,max=64"`
+	EventType  string         `json:"event_type" binding:"max=32"`        // login/heartbeat/action...，可选
+	Platform   string         `json:"platform" binding:"required,max=32"` // ios/android/web
+	Region     string         `json:"region" binding:"max=64"`
+	AppVersion string         `json:"app_version" binding:"max=32"` // 可选，用于统计 app 版本分布
+	EventTime  *time.Time     `json:"event_time"`
+	Properties map[string]any `json:"properties"` // 可选，事件属性
+	// SentAt is when the client sent the event, by its own clock; it is
+	// used to correct the event time of clients whose clock is off. 可选
+	SentAt *time.Time `json:"sent_at"`
+	// Consent is "granted" or "denied"; denied adds the user to the opt-out
+	// list of the app. 可选
+	Consent string `json:"consent" binding:"omitempty,oneof=granted denied"`
 }
 
 // ReportEventHandler accepts event reports and writes them into the database.
-func ReportEventHandler(db *gorm.DB) gin.HandlerFunc {
+// User IDs are resolved through ids, so events reported under an alias are
+// attributed to the linked user. New app versions are passed to versions so
+// that release annotations are created automatically, and new users are
+// published to hooks. User IDs are pseudonymized by pseudo according to the
+// privacy settings of the app before anything else, and events of users who
+// opted out of the app are dropped or only counted anonymously. Events
+// matching a traffic rule are dropped or flagged as internal traffic;
+// internal events create no release annotations or webhooks. Client event
+// times are corrected for clock skew and checked against the acceptance
+// window of times; events reported late mark their rollups stale. Payloads
+// are checked against the column sizes and the active schema of their event
+// type in schemas; rejected payloads are kept as dead letters.
+func ReportEventHandler(db *gorm.DB, ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer, optOuts *consent.Registry, rules *traffic.Filter, times eventtime.Policy, schemas *schema.Registry, versions *annotations.VersionWatcher, hooks *webhooks.Dispatcher) gin.HandlerFunc {
+	r := &eventReporter{db: db, ids: ids, pseudo: pseudo, optOuts: optOuts, rules: rules, times: times, schemas: schemas, versions: versions, hooks: hooks}
 	return func(c *gin.Context) {
-		var req ReportEventRequest
-		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if c.ContentType() == ndjsonContentType {
+			r.reportStream(c)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxEventBytes+1))
+		if err != nil {
+			c.JSON(bodyError(err))
 			return
 		}
+		if len(body) > maxEventBytes {
+			c.JSON(bodyError(ingest.ErrBodyTooLarge))
+			return
+		}
+		c.JSON(r.report(c, body))
+	}
+}
+
+// eventReporter holds what reporting an event needs.
+type eventReporter struct {
+	db       *gorm.DB
+	ids      *identity.Resolver
+	pseudo   *pseudonym.Pseudonymizer
+	optOuts  *consent.Registry
+	rules    *traffic.Filter
+	times    eventtime.Policy
+	schemas  *schema.Registry
+	versions *annotations.VersionWatcher
+	hooks    *webhooks.Dispatcher
+}
+
+// report handles one reported event and returns the status and response of
+// a single report.
+func (r *eventReporter) report(c *gin.Context, body []byte) (int, gin.H) {
+	log := logging.FromContext(c)
+
+	var req ReportEventRequest
+	if err := binding.JSON.BindBody(body, &req); err != nil {
+		return r.reject(c, metrics.ReasonInvalidPayload, &req, body, payloadErrors(&req, err), 0)
+	}
+
+	receivedAt := time.Now().UTC()
+	resolved, err := r.times.Resolve(receivedAt, req.EventTime, req.SentAt)
+	if err != nil {
+		return r.reject(c, metrics.ReasonEventTime, &req, body, map[string]string{"event_time": err.Error()}, 0)
+	}
+	eventTime := resolved.Time
+
+	if req.App == "" {
+		req.App = models.DefaultApp
+	}
 
-		eventTime := time.Now().UTC()
-		if req.EventTime != nil {
-			eventTime = req.EventTime.UTC()
+	fieldErrs, version, err := r.schemas.Check(schema.Event{
+		App:       req.App,
+		EventType: req.EventType,
+		Fields: map[string]bool{
+			"region":      req.Region != "",
+			"app_version": req.AppVersion != "",
+			"event_time":  req.EventTime != nil,
+			"sent_at":     req.SentAt != nil,
+		},
+		Properties: req.Properties,
+	})
+	if err != nil {
+		metrics.RecordRejected(metrics.ReasonDBError, metrics.PlatformLabel(req.Platform))
+		log.Error("failed to load event schema", slog.String("app", req.App), slog.Any("error", err))
+		return http.StatusInternalServerError, gin.H{"error": "db error"}
+	}
+	if len(fieldErrs) > 0 {
+		return r.reject(c, metrics.ReasonSchema, &req, body, fieldErrs, version)
+	}
+
+	rawID := req.UserID
+	userID, err := r.pseudo.Apply(req.App, req.UserID)
+	if err != nil {
+		if errors.Is(err, pseudonym.ErrPII) {
+			metrics.RecordRejected(metrics.ReasonPII, metrics.PlatformLabel(req.Platform))
+			return http.StatusBadRequest, gin.H{"error": err.Error()}
 		}
+		metrics.RecordRejected(metrics.ReasonDBError, metrics.PlatformLabel(req.Platform))
+		log.Error("failed to pseudonymize user id", slog.String("app", req.App), slog.Any("error", err))
+		return http.StatusInternalServerError, gin.H{"error": "db error"}
+	}
+	req.UserID = userID
 
-		// Insert event
-		evt := models.UserEvent{
-			UserID:     req.UserID,
-			AppVersion: req.AppVersion,
-			Platform:   req.Platform,
-			Region:     req.Region,
-			EventTime:  eventTime,
+	reportedID := req.UserID
+	if userID, err := r.ids.Resolve(req.UserID); err != nil {
+		log.Warn("failed to resolve user alias", slog.String("user_id", req.UserID), slog.Any("error", err))
+	} else {
+		req.UserID = userID
+	}
+
+	drop, err := consentDropsEvent(c, r.optOuts, req.App, req.Consent, reportedID, req.UserID)
+	if err != nil {
+		metrics.RecordRejected(metrics.ReasonDBError, metrics.PlatformLabel(req.Platform))
+		return http.StatusInternalServerError, gin.H{"error": "failed to record consent"}
+	}
+	if drop {
+		if settings, err := r.pseudo.Settings(req.App); err == nil && settings.OptOutMode == models.OptOutCount {
+			if err := consent.CountAnonymously(r.db, req.App, req.EventType, req.Platform, eventTime); err != nil {
+				log.Warn("failed to count anonymous event", slog.Any("error", err))
+			}
 		}
-		if err := db.Create(&evt).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create event"})
-			return
+		metrics.EventsDropped.WithLabelValues(metrics.DropOptedOut).Inc()
+		return http.StatusOK, gin.H{"status": "ok", "dropped": true}
+	}
+
+	ip, _ := netip.ParseAddr(c.ClientIP())
+	match, err := r.rules.Match(traffic.Event{
+		App:        req.App,
+		UserIDs:    []string{rawID, reportedID, req.UserID},
+		AppVersion: req.AppVersion,
+		IP:         ip,
+	})
+	if err != nil {
+		// Better to count test traffic than to lose real events.
+		log.Warn("failed to match traffic rules", slog.Any("error", err))
+	}
+	if match.Action != "" {
+		metrics.TrafficMatched.WithLabelValues(match.Action, match.Rule).Inc()
+	}
+	if match.Action == models.TrafficDrop {
+		metrics.EventsDropped.WithLabelValues(metrics.DropInternalTraffic).Inc()
+		return http.StatusOK, gin.H{"status": "ok", "dropped": true}
+	}
+	internal := match.Action == models.TrafficFlag
+
+	// Insert event
+	evt := models.UserEvent{
+		App:        req.App,
+		UserID:     req.UserID,
+		EventType:  req.EventType,
+		AppVersion: req.AppVersion,
+		Platform:   req.Platform,
+		Region:     req.Region,
+		EventTime:  eventTime,
+		Properties: req.Properties,
+		Internal:   internal,
+		ReceivedAt: &receivedAt,
+	}
+	platform := metrics.PlatformLabel(req.Platform)
+	if err := r.db.Create(&evt).Error; err != nil {
+		metrics.RecordRejected(metrics.ReasonDBError, platform)
+		log.Error("failed to create event", slog.String("user_id", req.UserID), slog.Any("error", err))
+		return http.StatusInternalServerError, gin.H{"error": "failed to create event"}
+	}
+	metrics.RecordAccepted(platform)
+	resp := gin.H{"status": "ok"}
+	if resolved.Skew != 0 {
+		metrics.EventTimeAdjusted.WithLabelValues(metrics.AdjustSkewCorrected).Inc()
+		resp["skew_seconds"] = int64(resolved.Skew.Seconds())
+	}
+	if resolved.Outside != "" {
+		metrics.EventTimeAdjusted.WithLabelValues(clampAdjustment(resolved.Outside)).Inc()
+		resp["clamped"] = resolved.Outside
+	}
+	if resolved.Skew != 0 || resolved.Outside != "" {
+		resp["event_time"] = eventTime
+	}
+
+	if internal {
+		traffic.MarkInternal()
+	} else {
+		if _, err := r.versions.Observe(req.App, req.AppVersion); err != nil {
+			log.Warn("failed to record version annotation", slog.String("app_version", req.AppVersion), slog.Any("error", err))
+		}
+		if err := rollups.InvalidateLate(r.db, eventTime, receivedAt); err != nil {
+			log.Warn("failed to mark rollup stale", slog.Time("event_time", eventTime), slog.Any("error", err))
 		}
+	}
 
-		// Ensure user exists; create if new to track "new users".
-		var user models.User
-		if err := db.Where("user_id = ?", req.UserID).First(&user).Error; err != nil {
-			if err == gorm.ErrRecordNotFound {
-				user = models.User{
-					UserID:    req.UserID,
-					FirstSeen: eventTime,
-					Platform:  req.Platform,
-					Region:    req.Region,
-				}
-				if err := db.Create(&user).Error; err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
-					return
+	// Ensure user exists; create if new to track "new users".
+	var user models.User
+	if err := r.db.Where("user_id = ?", req.UserID).First(&user).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			user = models.User{
+				UserID:    req.UserID,
+				FirstSeen: eventTime,
+				Platform:  req.Platform,
+				Region:    req.Region,
+			}
+			if err := r.db.Create(&user).Error; err != nil {
+				log.Error("failed to create user", slog.String("user_id", req.UserID), slog.Any("error", err))
+				return http.StatusInternalServerError, gin.H{"error": "failed to create user"}
+			}
+			metrics.UsersCreated.WithLabelValues(platform).Inc()
+			if !internal {
+				if err := r.hooks.Publish(webhooks.EventUserCreated, gin.H{
+					"app":        req.App,
+					"user_id":    user.UserID,
+					"first_seen": user.FirstSeen,
+					"platform":   user.Platform,
+					"region":     user.Region,
+				}); err != nil {
+					log.Warn("failed to publish webhook", slog.String("event", webhooks.EventUserCreated), slog.Any("error", err))
 				}
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
-				return
 			}
 		} else {
-			updates := map[string]interface{}{}
-			if req.Platform != "" && user.Platform != req.Platform {
-				updates["platform"] = req.Platform
+			log.Error("failed to load user", slog.String("user_id", req.UserID), slog.Any("error", err))
+			return http.StatusInternalServerError, gin.H{"error": "db error"}
+		}
+	} else {
+		// Events reported late, e.g. from an offline queue, move the
+		// first seen time back.
+		if eventTime.Before(user.FirstSeen) {
+			firstSeen := user.FirstSeen
+			if err := r.db.Model(&user).Update("first_seen", eventTime).Error; err != nil {
+				log.Warn("failed to update first seen", slog.String("user_id", req.UserID), slog.Any("error", err))
+			} else if err := rollups.InvalidateLate(r.db, firstSeen, receivedAt); err != nil {
+				log.Warn("failed to mark rollup stale", slog.Time("event_time", firstSeen), slog.Any("error", err))
 			}
-			if req.Region != "" && user.Region != req.Region {
-				updates["region"] = req.Region
+		}
+		// The user row keeps the latest platform and region; earlier
+		// values are kept in the property history.
+		updates := map[string]interface{}{}
+		if req.Platform != "" && user.Platform != req.Platform {
+			updates["platform"] = req.Platform
+		}
+		if req.Region != "" && user.Region != req.Region {
+			updates["region"] = req.Region
+		}
+		if len(updates) > 0 {
+			old := map[string]string{"platform": user.Platform, "region": user.Region}
+			err := r.db.Transaction(func(tx *gorm.DB) error {
+				if err := tx.Model(&user).Updates(updates).Error; err != nil {
+					return err
+				}
+				for name, v := range updates {
+					var oldValue *string
+					if o := old[name]; o != "" {
+						oldValue = &o
+					}
+					newValue := v.(string)
+					if err := profiles.RecordChange(tx, user.UserID, name, oldValue, &newValue, eventTime); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Warn("failed to update user", slog.String("user_id", req.UserID), slog.Any("error", err))
+			}
+		}
+	}
+
+	return http.StatusOK, resp
+}
+
+// reject keeps a payload rejected for reason as a dead letter and returns a
+// 400 listing what is wrong per field. The reported user ID is
+// pseudonymized like for a stored event before the payload is kept.
+func (r *eventReporter) reject(c *gin.Context, reason string, req *ReportEventRequest, body []byte, fieldErrs map[string]string, schemaVersion int) (int, gin.H) {
+	log := logging.FromContext(c)
+	metrics.RecordRejected(reason, metrics.PlatformLabel(req.Platform))
+	log.Debug("event rejected", slog.String("reason", reason), slog.Any("fields", fieldErrs))
+
+	app := req.App
+	if app == "" {
+		app = models.DefaultApp
+	}
+	var userID string
+	if _, invalid := fieldErrs["user_id"]; req.UserID != "" && !invalid {
+		// A user ID that cannot be pseudonymized, e.g. PII to reject, is
+		// left out.
+		if id, err := r.pseudo.Apply(app, req.UserID); err == nil {
+			userID = id
+		}
+	}
+	dl := models.DeadLetter{
+		App:           models.Truncate(app, 64),
+		UserID:        userID,
+		Reason:        reason,
+		Errors:        fieldErrs,
+		SchemaVersion: schemaVersion,
+		Payload:       deadLetterPayload(body, userID),
+	}
+	if err := r.db.Create(&dl).Error; err != nil {
+		log.Warn("failed to record dead letter", slog.Any("error", err))
+	}
+
+	resp := gin.H{"error": "invalid event", "fields": fieldErrs}
+	if schemaVersion > 0 {
+		resp["schema_version"] = schemaVersion
+	}
+	return http.StatusBadRequest, resp
+}
+
+// deadLetterPayload returns body with its user_id replaced by userID, or
+// removed when userID is empty, truncated to maxDeadLetterPayload bytes.
+// Bodies that are not a JSON object are not kept, as the user ID cannot be
+// told apart in them.
+func deadLetterPayload(body []byte, userID string) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var payload map[string]any
+	if err := dec.Decode(&payload); err != nil || payload == nil {
+		return ""
+	}
+	if _, ok := payload["user_id"]; ok {
+		if userID == "" {
+			delete(payload, "user_id")
+		} else {
+			payload["user_id"] = userID
+		}
+	}
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	return models.Truncate(string(out), maxDeadLetterPayload)
+}
+
+// StreamLineError describes a line of a newline-delimited report that was
+// not stored.
+type StreamLineError struct {
+	Line   int               `json:"line"`
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// reportStream handles a newline-delimited JSON body, one event per line,
+// reading it line by line. Lines are handled like single reports and the
+// response counts their outcomes. A server error stops the stream; the
+// response then names the failed line, from which on nothing was handled.
+func (r *eventReporter) reportStream(c *gin.Context) {
+	counts := map[string]int{"accepted": 0, "dropped": 0, "rejected": 0, "clamped": 0, "skew_corrected": 0}
+	var errs []StreamLineError
+	respond := func(status int, extra gin.H) {
+		resp := gin.H{}
+		if status == http.StatusOK {
+			resp["status"] = "ok"
+		}
+		for k, v := range counts {
+			resp[k] = v
+		}
+		for k, v := range extra {
+			resp[k] = v
+		}
+		if len(errs) > 0 {
+			resp["errors"] = errs
+		}
+		c.JSON(status, resp)
+	}
+	reject := func(line int, resp gin.H) {
+		counts["rejected"]++
+		if len(errs) < maxStreamErrors {
+			e := StreamLineError{Line: line}
+			e.Error, _ = resp["error"].(string)
+			e.Fields, _ = resp["fields"].(map[string]string)
+			errs = append(errs, e)
+		}
+	}
+
+	br := bufio.NewReaderSize(c.Request.Body, 64<<10)
+	for line := 1; ; line++ {
+		data, tooLong, err := readLine(br, maxEventBytes)
+		switch {
+		case tooLong:
+			metrics.RecordRejected(metrics.ReasonTooLarge, metrics.PlatformLabel(""))
+			reject(line, gin.H{"error": fmt.Sprintf("event exceeds %d bytes", maxEventBytes)})
+		case len(bytes.TrimSpace(data)) > 0:
+			status, resp := r.report(c, data)
+			switch {
+			case status >= http.StatusInternalServerError:
+				respond(status, gin.H{"error": resp["error"], "failed_line": line})
+				return
+			case status != http.StatusOK:
+				reject(line, resp)
+			case resp["dropped"] == true:
+				counts["dropped"]++
+			default:
+				counts["accepted"]++
+				if _, ok := resp["clamped"]; ok {
+					counts["clamped"]++
+				}
+				if _, ok := resp["skew_seconds"]; ok {
+					counts["skew_corrected"]++
+				}
 			}
-			if len(updates) > 0 {
-				db.Model(&user).Updates(updates)
+		}
+		if err == io.EOF {
+			respond(http.StatusOK, nil)
+			return
+		}
+		if err != nil {
+			status, resp := bodyError(err)
+			resp["failed_line"] = line
+			respond(status, resp)
+			return
+		}
+	}
+}
+
+// readLine reads a line without its line ending. Lines longer than max
+// bytes are skipped and reported as too long, so a stream never buffers
+// more than max bytes.
+func readLine(br *bufio.Reader, max int) (line []byte, tooLong bool, err error) {
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > max+2 {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
 			}
 		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// The bound above leaves room for the line ending only.
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > max {
+			tooLong, line = true, nil
+		}
+		return line, tooLong, err
+	}
+}
 
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+// bodyError returns the status and response of a request whose body could
+// not be read.
+func bodyError(err error) (int, gin.H) {
+	if errors.Is(err, ingest.ErrBodyTooLarge) {
+		metrics.RecordRejected(metrics.ReasonTooLarge, metrics.PlatformLabel(""))
+		return http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()}
 	}
+	metrics.RecordRejected(metrics.ReasonInvalidPayload, metrics.PlatformLabel(""))
+	return http.StatusBadRequest, gin.H{"error": "failed to read body: " + err.Error()}
 }
 
+// payloadErrors returns what is wrong per field of req after binding it
+// failed with err, naming the fields as in JSON.
+func payloadErrors(req any, err error) map[string]string {
+	var verrs validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &verrs):
+		t := reflect.TypeOf(req).Elem()
+		errs := make(map[string]string, len(verrs))
+		for _, fe := range verrs {
+			name := fe.Field()
+			if f, ok := t.FieldByName(fe.StructField()); ok {
+				if tag, _, _ := strings.Cut(f.Tag.Get("json"), ","); tag != "" {
+					name = tag
+				}
+			}
+			errs[name] = validationMessage(fe)
+		}
+		return errs
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return map[string]string{typeErr.Field: "must not be a JSON " + typeErr.Value}
+	}
+	return map[string]string{"body": err.Error()}
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "max":
+		return "must be at most " + fe.Param() + " characters"
+	case "oneof":
+		return "must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	}
+	return "failed the " + fe.Tag() + " check"
+}
 
+// clampAdjustment returns the EventTimeAdjusted label of an event time
+// clamped on side.
+func clampAdjustment(side string) string {
+	if side == "past" {
+		return metrics.AdjustClampedPast
+	}
+	return metrics.AdjustClampedFuture
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadLine(t *testing.T) {
+	type line struct {
+		text    string
+		tooLong bool
+	}
+	tests := []struct {
+		name  string
+		input string
+		max   int
+		want  []line
+	}{
+		{name: "lines", input: "a\nbc\r\n\nd", max: 8, want: []line{{"a", false}, {"bc", false}, {"", false}, {"d", false}}},
+		{name: "at max", input: "12345678\r\nx\n", max: 8, want: []line{{"12345678", false}, {"x", false}}},
+		{name: "over max", input: "123456789\n", max: 8, want: []line{{"", true}}},
+		{name: "over max at end", input: "1234567890", max: 8, want: []line{{"", true}}},
+		// Lines longer than the reader buffer are read in chunks.
+		{name: "over buffer", input: strings.Repeat("x", 40) + "\nok\n", max: 64, want: []line{{strings.Repeat("x", 40), false}, {"ok", false}}},
+		{name: "skipped past buffer", input: strings.Repeat("x", 100) + "\nok", max: 20, want: []line{{"", true}, {"ok", false}}},
+		{name: "last line too long", input: "ok\n" + strings.Repeat("x", 30), max: 20, want: []line{{"ok", false}, {"", true}}},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReaderSize(strings.NewReader(tt.input), 16)
+		var got []line
+		for {
+			text, tooLong, err := readLine(br, tt.max)
+			if err != nil && err != io.EOF {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if err == nil || len(text) > 0 || tooLong {
+				got = append(got, line{string(text), tooLong})
+			}
+			if err == io.EOF {
+				break
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: lines %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/stats"
+)
+
+// EventExplorerPageHandler renders the raw event explorer page.
+func EventExplorerPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(explorerHTMLTemplate))
+	}
+}
+
+// ListEventsHandler lists raw events with filters and keyset pagination.
+//
+// Query: from, to (RFC3339 or YYYY-MM-DDTHH:MM, UTC), app, user_id, platform,
+// app_version, region, event_type, before_id, after_id, limit.
+func ListEventsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := stats.EventQuery{
+			App:        c.Query("app"),
+			UserID:     c.Query("user_id"),
+			Platform:   c.Query("platform"),
+			AppVersion: c.Query("app_version"),
+			Region:     c.Query("region"),
+			EventType:  c.Query("event_type"),
+			Limit:      100,
+		}
+
+		var err error
+		if q.From, err = parseTimeParam(c, "from"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if q.To, err = parseTimeParam(c, "to"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if v := c.Query("before_id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before_id"})
+				return
+			}
+			q.BeforeID = uint(id)
+		}
+		if v := c.Query("after_id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid after_id"})
+				return
+			}
+			q.AfterID = uint(id)
+		}
+		if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 1000 {
+			q.Limit = v
+		}
+
+		res, err := stats.ListEvents(db, q)
+		if err != nil {
+			logging.FromContext(c).Error("list events failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// parseTimeParam parses an optional timestamp query parameter. Values
+// without a zone, as sent by datetime-local inputs, are taken as UTC.
+func parseTimeParam(c *gin.Context, name string) (*time.Time, error) {
+	v := c.Query(name)
+	if v == "" {
+		return nil, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", dateLayout} {
+		if t, err := time.ParseInLocation(layout, v, time.UTC); err == nil {
+			t = t.UTC()
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid %s time %q", name, v)
+}
+
+// explorerHTMLTemplate is the HTML template for the raw event explorer.
+const explorerHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>事件浏览</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    form { display: flex; flex-wrap: wrap; gap: 8px 16px; margin-bottom: 16px; max-width: 1100px; }
+    table { border-collapse: collapse; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 13px; }
+    th { background: #f5f5f5; }
+    tr.new { background: #fff8d6; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>事件浏览</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="filterForm">
+    <label>开始（UTC）：<input type="datetime-local" name="from"></label>
+    <label>结束（UTC）：<input type="datetime-local" name="to"></label>
+    <label>应用：<input type="text" name="app" size="10"></label>
+    <label>user_id：<input type="text" name="user_id"></label>
+    <label>平台：<input type="text" name="platform" size="10"></label>
+    <label>版本：<input type="text" name="app_version" size="10"></label>
+    <label>地区：<input type="text" name="region"></label>
+    <label>事件类型：<input type="text" name="event_type" size="12"></label>
+    <button type="submit">查询</button>
+    <label><input type="checkbox" id="liveTail"> 实时追踪</label>
+  </form>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>ID</th><th>时间（UTC）</th><th>应用</th><th>user_id</th><th>事件类型</th><th>平台</th><th>版本</th><th>地区</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+  <p><button id="moreBtn" style="display: none;">加载更多</button></p>
+
+  <script>
+    const PAGE_LIMIT = 100;
+    const TAIL_INTERVAL_MS = 2000;
+    let nextCursor = 0;
+    let latestId = 0;
+    let tailTimer = null;
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function filterParams() {
+      const params = new URLSearchParams();
+      for (const [k, v] of new FormData(document.getElementById('filterForm'))) {
+        if (v) params.set(k, v);
+      }
+      return params;
+    }
+
+    function rowHTML(e, isNew) {
+      return '<tr' + (isNew ? ' class="new"' : '') + '><td>' + e.id + '</td><td>' +
+        esc(new Date(e.event_time).toISOString().replace('T', ' ').slice(0, 19)) + '</td><td>' + esc(e.app) + '</td><td>' +
+        '<a href="/admin/users?user_id=' + encodeURIComponent(e.user_id) + '">' + esc(e.user_id) + '</a></td><td>' +
+        esc(e.event_type) + '</td><td>' + esc(e.platform) + '</td><td>' + esc(e.app_version) + '</td><td>' +
+        esc(e.region) + '</td></tr>';
+    }
+
+    async function fetchEvents(extra) {
+      const params = filterParams();
+      params.set('limit', PAGE_LIMIT);
+      for (const k in extra) params.set(k, extra[k]);
+      const resp = await fetch('/admin/api/events?' + params.toString());
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function load(append) {
+      const status = document.getElementById('status');
+      try {
+        const data = await fetchEvents(append && nextCursor ? { before_id: nextCursor } : {});
+        const html = (data.events || []).map(e => rowHTML(e, false)).join('');
+        const tbody = document.getElementById('rows');
+        if (append) {
+          tbody.insertAdjacentHTML('beforeend', html);
+        } else {
+          tbody.innerHTML = html;
+          latestId = data.latest_id;
+        }
+        nextCursor = data.next_cursor;
+        document.getElementById('moreBtn').style.display = nextCursor ? '' : 'none';
+        status.textContent = '';
+      } catch (err) {
+        status.innerHTML = '<p class="error">' + esc(err.message) + '</p>';
+      }
+    }
+
+    async function tail() {
+      try {
+        const data = await fetchEvents({ after_id: latestId });
+        latestId = data.latest_id;
+        const events = (data.events || []).slice().sort((a, b) => b.id - a.id);
+        if (events.length > 0) {
+          document.getElementById('rows').insertAdjacentHTML('afterbegin', events.map(e => rowHTML(e, true)).join(''));
+        }
+      } catch (err) {
+        document.getElementById('status').innerHTML = '<p class="error">' + esc(err.message) + '</p>';
+      }
+    }
+
+    (function init() {
+      const form = document.getElementById('filterForm');
+      const params = new URLSearchParams(location.search);
+      for (const [k, v] of params) {
+        if (form.elements[k]) form.elements[k].value = v;
+      }
+
+      form.addEventListener('submit', function (e) {
+        e.preventDefault();
+        history.replaceState(null, '', '?' + filterParams().toString());
+        load(false);
+      });
+      document.getElementById('moreBtn').addEventListener('click', () => load(true));
+      document.getElementById('liveTail').addEventListener('change', function () {
+        if (this.checked) {
+          tailTimer = setInterval(tail, TAIL_INTERVAL_MS);
+        } else {
+          clearInterval(tailTimer);
+          tailTimer = null;
+        }
+      });
+
+      load(false);
+    })();
+  </script>
+</body>
+</html>
+`
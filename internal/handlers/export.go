@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/export"
+	"appstats/internal/logging"
+	"appstats/internal/stats"
+)
+
+// ExportHandler streams dashboard data as CSV or XLSX.
+//
+// Route: /admin/export/:report?format=csv|xlsx&from=YYYY-MM-DD&to=YYYY-MM-DD&granularity=day|week|month&f=...
+// where report is one of summary, platform, version, region and f are
+// optional dimension filters.
+func ExportHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := c.Param("report")
+		var dim stats.Dimension
+		switch report {
+		case "summary":
+		case "platform":
+			dim = stats.DimensionPlatform
+		case "version":
+			dim = stats.DimensionVersion
+		case "region":
+			dim = stats.DimensionRegion
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown report"})
+			return
+		}
+
+		format, err := export.ParseFormat(c.DefaultQuery("format", "csv"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		granularity, err := stats.ParseGranularity(c.Query("granularity"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		start, days, err := parseDateRange(c, 7, 0)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		end := start.AddDate(0, 0, days)
+		filter, err := parseFilter(c, db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		filename := fmt.Sprintf("%s_%s_%s_%s.%s", report, start.Format(dateLayout),
+			end.AddDate(0, 0, -1).Format(dateLayout), granularity, format)
+		c.Header("Content-Type", format.ContentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Status(http.StatusOK)
+
+		// Once streaming has started the status can no longer change, so
+		// errors are only logged and the download ends truncated.
+		if err := writeExport(c, db, dim, format, start, end, granularity, filter); err != nil {
+			logging.FromContext(c).Error("export failed", slog.String("report", report), slog.Any("error", err))
+		}
+	}
+}
+
+func writeExport(c *gin.Context, db *gorm.DB, dim stats.Dimension, format export.Format, start, end time.Time, g stats.Granularity, f stats.Filter) error {
+	if dim == "" {
+		w, err := export.NewWriter(format, c.Writer, "summary", "period", "new_users", "active_users")
+		if err != nil {
+			return err
+		}
+		if err := stats.StreamSummary(db, start, end, g, f, func(r stats.SummaryRow) error {
+			return w.WriteRow(r.Period, r.NewUsers, r.ActiveUsers)
+		}); err != nil {
+			return err
+		}
+		return w.Close()
+	}
+
+	w, err := export.NewWriter(format, c.Writer, string(dim), "period", string(dim), "active_users")
+	if err != nil {
+		return err
+	}
+	if err := stats.StreamBreakdown(db, dim, start, end, g, f, func(r stats.BreakdownRow) error {
+		return w.WriteRow(r.Period, r.Value, r.ActiveUsers)
+	}); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/stats"
+	"appstats/internal/traffic"
+)
+
+// FunnelRequest is the payload of the funnel API.
+type FunnelRequest struct {
+	Steps      []stats.FunnelStep `json:"steps" binding:"required"`
+	From       string             `json:"from"` // YYYY-MM-DD，默认最近 7 天
+	To         string             `json:"to"`
+	WindowDays int                `json:"window_days"` // 转化窗口（天），默认 7
+	Breakdown  string             `json:"breakdown"`   // platform/app_version，可选
+	Filters    []string           `json:"filters"`     // 与 /admin 的 f 参数格式相同
+	// IncludeInternal counts internal traffic as well. 可选
+	IncludeInternal bool `json:"include_internal"`
+}
+
+// FunnelPageHandler renders the funnel analysis page.
+func FunnelPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(funnelHTMLTemplate))
+	}
+}
+
+// FunnelHandler computes a conversion funnel over event types.
+func FunnelHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req FunnelRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		to := stats.Today()
+		if req.To != "" {
+			t, err := time.Parse(dateLayout, req.To)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to date"})
+				return
+			}
+			to = t
+		}
+		from := to.AddDate(0, 0, -6)
+		if req.From != "" {
+			t, err := time.Parse(dateLayout, req.From)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from date"})
+				return
+			}
+			from = t
+		}
+		if req.WindowDays <= 0 {
+			req.WindowDays = 7
+		}
+		filter, err := stats.ParseFilter(req.Filters)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !req.IncludeInternal {
+			filter = traffic.ExcludeInternal(db, filter)
+		}
+
+		q := stats.FunnelQuery{
+			Steps:       req.Steps,
+			Start:       from,
+			End:         to.AddDate(0, 0, 1),
+			Window:      time.Duration(req.WindowDays) * 24 * time.Hour,
+			BreakdownBy: stats.Dimension(req.Breakdown),
+			Filter:      filter,
+		}
+		if err := q.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		res, err := stats.RunFunnel(db, q)
+		if err != nil {
+			logging.FromContext(c).Error("funnel query failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// funnelHTMLTemplate is the HTML template for the funnel analysis page.
+const funnelHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>漏斗分析</title>
+  <script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    .chart-container { width: 100%; max-width: 900px; margin-bottom: 40px; }
+    .step { margin-bottom: 8px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>漏斗分析</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <div id="steps"></div>
+  <p><button type="button" id="addStep">添加步骤</button></p>
+
+  <div style="margin-bottom: 16px;">
+    <label>开始日期：<input type="date" id="from"></label>
+    <label>结束日期：<input type="date" id="to"></label>
+    <label>转化窗口（天）：<input type="number" id="windowDays" value="7" min="1" style="width: 60px;"></label>
+    <label>拆分：
+      <select id="breakdown">
+        <option value="">不拆分</option>
+        <option value="platform">平台</option>
+        <option value="app_version">版本</option>
+      </select>
+    </label>
+    <label><input type="checkbox" id="includeInternal"> 包含内部流量</label>
+    <button type="button" id="run">计算</button>
+  </div>
+
+  <div id="status"></div>
+  <div class="chart-container">
+    <canvas id="funnelChart"></canvas>
+  </div>
+  <div id="tables"></div>
+
+  <script>
+    let chartInstance = null;
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    // 每个步骤：事件类型 + 可选属性条件（格式 属性:操作:值，如 platform:eq:android）
+    function addStep(eventType, cond) {
+      const div = document.createElement('div');
+      div.className = 'step';
+      div.innerHTML = '步骤 <span class="idx"></span>：' +
+        '<input type="text" class="eventType" placeholder="事件类型，如 install" size="20"> ' +
+        '<input type="text" class="cond" placeholder="属性条件（可选），如 channel:eq:appstore" size="36"> ' +
+        '<button type="button">删除</button>';
+      div.querySelector('.eventType').value = eventType || '';
+      div.querySelector('.cond').value = cond || '';
+      div.querySelector('button').addEventListener('click', () => { div.remove(); renumber(); });
+      document.getElementById('steps').appendChild(div);
+      renumber();
+    }
+
+    function renumber() {
+      document.querySelectorAll('#steps .idx').forEach((el, i) => el.textContent = i + 1);
+    }
+
+    function collectSteps() {
+      return Array.from(document.querySelectorAll('#steps .step')).map(div => {
+        const step = { event_type: div.querySelector('.eventType').value.trim(), conditions: [] };
+        const cond = div.querySelector('.cond').value.trim();
+        if (cond) {
+          for (const part of cond.split(';')) {
+            const p = part.trim().split(':');
+            if (p.length < 3) continue;
+            const values = p.slice(2).join(':');
+            step.conditions.push({ property: p[0], op: p[1], values: p[1] === 'in' ? values.split(',') : [values] });
+          }
+        }
+        return step;
+      });
+    }
+
+    function pct(v) {
+      return (v * 100).toFixed(1) + '%';
+    }
+
+    function tableHTML(title, steps) {
+      let html = '<h3>' + esc(title) + '</h3><table><tr><th>步骤</th><th>事件类型</th><th>用户数</th><th>总转化率</th><th>流失</th></tr>';
+      steps.forEach((s, i) => {
+        html += '<tr><td>' + (i + 1) + '</td><td>' + esc(s.event_type) + '</td><td>' + s.users +
+          '</td><td>' + pct(s.conversion) + '</td><td>' + (i === 0 ? '-' : s.drop_off) + '</td></tr>';
+      });
+      return html + '</table>';
+    }
+
+    async function run() {
+      const status = document.getElementById('status');
+      status.textContent = '计算中...';
+      const body = {
+        steps: collectSteps(),
+        from: document.getElementById('from').value,
+        to: document.getElementById('to').value,
+        window_days: parseInt(document.getElementById('windowDays').value, 10) || 7,
+        breakdown: document.getElementById('breakdown').value,
+        filters: new URLSearchParams(location.search).getAll('f'),
+        include_internal: document.getElementById('includeInternal').checked
+      };
+      const resp = await fetch('/admin/api/funnel', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+      });
+      const data = await resp.json();
+      if (!resp.ok) {
+        status.innerHTML = '<p class="error">' + esc(data.error) + '</p>';
+        return;
+      }
+      status.textContent = '';
+
+      if (chartInstance) chartInstance.destroy();
+      const ctx = document.getElementById('funnelChart').getContext('2d');
+      chartInstance = new Chart(ctx, {
+        type: 'bar',
+        data: {
+          labels: data.steps.map((s, i) => (i + 1) + '. ' + s.event_type),
+          datasets: [{
+            label: '用户数',
+            data: data.steps.map(s => s.users),
+            backgroundColor: 'rgba(54, 162, 235, 0.7)',
+            borderColor: 'rgba(54, 162, 235, 1)',
+            borderWidth: 1
+          }]
+        },
+        options: {
+          indexAxis: 'y',
+          responsive: true,
+          plugins: {
+            title: { display: true, text: '漏斗转化' },
+            tooltip: {
+              callbacks: {
+                afterLabel: c => '转化率：' + pct(data.steps[c.dataIndex].conversion)
+              }
+            }
+          },
+          scales: { x: { beginAtZero: true, ticks: { precision: 0 } } }
+        }
+      });
+
+      let html = tableHTML('总体', data.steps);
+      const keys = Object.keys(data.breakdown || {}).sort();
+      for (const k of keys) {
+        html += tableHTML(k || '未知', data.breakdown[k]);
+      }
+      document.getElementById('tables').innerHTML = html;
+    }
+
+    (function init() {
+      addStep('install');
+      addStep('register');
+      document.getElementById('includeInternal').checked =
+        ['1', 'true'].includes(new URLSearchParams(location.search).get('include_internal'));
+      document.getElementById('addStep').addEventListener('click', () => addStep());
+      document.getElementById('run').addEventListener('click', run);
+    })();
+  </script>
+</body>
+</html>
+`
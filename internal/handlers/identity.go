@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"appstats/internal/identity"
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/pseudonym"
+)
+
+// IdentifyRequest links an anonymous identifier to a user ID.
+type IdentifyRequest struct {
+	// AnonymousID is the identifier reported so far, e.g. a device ID.
+	AnonymousID string `json:"anonymous_id" binding:"required,max=64"`
+	// UserID is the identifier to report from now on, e.g. an account ID.
+	UserID string `json:"user_id" binding:"required,max=64"`
+	// App selects the privacy settings both IDs are pseudonymized with;
+	// optional, default "default".
+	App string `json:"app"`
+}
+
+// IdentifyHandler links an anonymous identifier to a user ID. Events already
+// reported under the anonymous ID are reattributed, and later events using
+// it are stored under the user ID. Linking the same pair again is a no-op.
+// Both IDs are pseudonymized like reported events.
+func IdentifyHandler(ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req IdentifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !pseudonymizeUserIDs(c, pseudo, req.App, &req.AnonymousID, &req.UserID) {
+			return
+		}
+		res, err := ids.Link(req.AnonymousID, req.UserID)
+		switch {
+		case errors.Is(err, identity.ErrSameID):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		case errors.Is(err, identity.ErrAlreadyLinked):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			logging.FromContext(c).Error("link user alias failed", slog.String("user_id", req.UserID), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link user"})
+			return
+		}
+		if res.Created {
+			logging.FromContext(c).Info("user alias linked", slog.String("alias_id", res.AliasID),
+				slog.String("user_id", res.UserID), slog.Int64("merged_events", res.MergedEvents))
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// pseudonymizeUserIDs replaces each of userIDs with the ID to store for app.
+// It writes the error response and returns false when an ID is rejected or
+// the privacy settings cannot be loaded.
+func pseudonymizeUserIDs(c *gin.Context, pseudo *pseudonym.Pseudonymizer, app string, userIDs ...*string) bool {
+	if app == "" {
+		app = models.DefaultApp
+	}
+	for _, userID := range userIDs {
+		id, err := pseudo.Apply(app, *userID)
+		switch {
+		case errors.Is(err, pseudonym.ErrPII):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		case err != nil:
+			logging.FromContext(c).Error("pseudonymize user id failed", slog.String("app", app), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return false
+		}
+		*userID = id
+	}
+	return true
+}
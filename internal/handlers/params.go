@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/stats"
+	"appstats/internal/traffic"
+)
+
+const dateLayout = "2006-01-02"
+
+// parseDateRange reads the inclusive from/to query parameters (YYYY-MM-DD)
+// and returns the start and number of days. Missing values default to the
+// last defaultDays days ending today.
+func parseDateRange(c *gin.Context, defaultDays, maxDays int) (time.Time, int, error) {
+	to := stats.Today()
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid to date %q", v)
+		}
+		to = t
+	}
+
+	from := to.AddDate(0, 0, -defaultDays+1)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(dateLayout, v)
+		if err != nil {
+			return time.Time{}, 0, fmt.Errorf("invalid from date %q", v)
+		}
+		from = t
+	}
+
+	if from.After(to) {
+		return time.Time{}, 0, fmt.Errorf("from must not be after to")
+	}
+	days := int(to.Sub(from).Hours()/24) + 1
+	if maxDays > 0 && days > maxDays {
+		return time.Time{}, 0, fmt.Errorf("date range exceeds %d days", maxDays)
+	}
+	return from, days, nil
+}
+
+// parseFilter reads the repeated f query parameter (field:op:value).
+// Internal traffic is excluded unless include_internal=1 is given.
+func parseFilter(c *gin.Context, db *gorm.DB) (stats.Filter, error) {
+	f, err := stats.ParseFilter(c.QueryArray("f"))
+	if err != nil || includeInternal(c) {
+		return f, err
+	}
+	return traffic.ExcludeInternal(db, f), nil
+}
+
+// includeInternal reads the include_internal query parameter.
+func includeInternal(c *gin.Context) bool {
+	v := c.Query("include_internal")
+	return v == "1" || v == "true"
+}
+
+// parseInactiveDays reads the inactive_days query parameter used for churn
+// and resurrection, defaulting to stats.DefaultInactiveDays.
+func parseInactiveDays(c *gin.Context) (int, error) {
+	v := c.Query("inactive_days")
+	if v == "" {
+		return stats.DefaultInactiveDays, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > stats.MaxInactiveDays {
+		return 0, fmt.Errorf("inactive_days must be between 1 and %d", stats.MaxInactiveDays)
+	}
+	return n, nil
+}
@@ -0,0 +1,290 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/archive"
+	"appstats/internal/identity"
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/privacy"
+)
+
+// PrivacyRequest identifies who asked for an export or erasure and why; it
+// is kept in the audit log.
+type PrivacyRequest struct {
+	Operator string `json:"operator" form:"operator" binding:"required,max=128"`
+	Reason   string `json:"reason" form:"reason" binding:"max=512"`
+}
+
+// EraseRequest is the payload of the erase API.
+type EraseRequest struct {
+	PrivacyRequest
+	// Action is "delete" or "anonymize".
+	Action string `json:"action" binding:"required,oneof=delete anonymize"`
+}
+
+// PrivacyPageHandler renders the data export and erasure page.
+func PrivacyPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(privacyHTMLTemplate))
+	}
+}
+
+// ExportUserDataHandler returns everything stored about a user as a JSON
+// download and records the export in the audit log. An alias is resolved to
+// the user it is linked to.
+func ExportUserDataHandler(db *gorm.DB, ids *identity.Resolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.FromContext(c)
+
+		var req PrivacyRequest
+		if err := c.ShouldBindQuery(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, ok := resolveUserParam(c, ids)
+		if !ok {
+			return
+		}
+
+		data, err := privacy.Export(db, userID)
+		if err != nil {
+			log.Error("export user data failed", slog.String("user_id", userID), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if data.Empty() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		body, err := json.MarshalIndent(data, "", "  ")
+		if err != nil {
+			log.Error("encode user data failed", slog.String("user_id", userID), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encode export"})
+			return
+		}
+
+		if err := privacy.Record(db, &models.PrivacyAudit{
+			Action:   models.PrivacyExport,
+			UserID:   userID,
+			Operator: req.Operator,
+			Reason:   req.Reason,
+			Rows:     data.Rows(),
+		}); err != nil {
+			// The export must not happen without its audit record.
+			log.Error("record privacy audit failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record audit"})
+			return
+		}
+		log.Info("user data exported", slog.String("user_id", userID), slog.String("operator", req.Operator))
+
+		c.Header("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape("user-"+userID+".json"))
+		c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	}
+}
+
+// EraseUserDataHandler deletes or anonymizes the data of a user, recomputes
+// the affected rollups and records the outcome in the audit log. An alias is
+// resolved to the user it is linked to, and all of the user's aliases are
+// erased as well, along with their archived events when store is not nil.
+func EraseUserDataHandler(db *gorm.DB, ids *identity.Resolver, store archive.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.FromContext(c)
+
+		var req EraseRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, ok := resolveUserParam(c, ids)
+		if !ok {
+			return
+		}
+
+		res, err := privacy.Erase(c.Request.Context(), db, store, userID, req.Action)
+		ids.Invalidate()
+		audit := &models.PrivacyAudit{
+			Action:   req.Action,
+			UserID:   userID,
+			Operator: req.Operator,
+			Reason:   req.Reason,
+		}
+		if res != nil {
+			audit.Rows = res.Rows
+		}
+		if err != nil {
+			audit.Error = models.Truncate(err.Error(), 512)
+		}
+		if err := privacy.Record(db, audit); err != nil {
+			log.Error("record privacy audit failed", slog.String("user_id", userID), slog.Any("error", err))
+		}
+
+		if err != nil {
+			log.Error("erase user data failed", slog.String("user_id", userID), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to erase user data", "result": res})
+			return
+		}
+		log.Info("user data erased", slog.String("user_id", userID), slog.String("action", req.Action),
+			slog.String("operator", req.Operator))
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// ListPrivacyAuditHandler returns the latest audit records, optionally for
+// one user.
+func ListPrivacyAuditHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("id DESC").Limit(200)
+		if v := c.Query("user_id"); v != "" {
+			q = q.Where("user_id = ?", v)
+		}
+		var records []models.PrivacyAudit
+		if err := q.Find(&records).Error; err != nil {
+			logging.FromContext(c).Error("load privacy audit failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"records": records})
+	}
+}
+
+// privacyHTMLTemplate is the HTML template for the data export and erasure page.
+const privacyHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>用户数据导出与删除</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; vertical-align: top; }
+    th { background: #f5f5f5; }
+    form label { display: block; margin-bottom: 8px; }
+    .error { color: #c00; }
+    .ok { color: #080; }
+  </style>
+</head>
+<body>
+  <h2>用户数据导出与删除</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="privacyForm">
+    <label>user_id：<input type="text" name="user_id" required maxlength="64" size="40"></label>
+    <label>操作人：<input type="text" name="operator" required maxlength="128" size="20"></label>
+    <label>原因：<input type="text" name="reason" maxlength="512" size="60" placeholder="如：用户申请删除，工单号"></label>
+    <button type="button" id="exportBtn">导出 JSON</button>
+    <button type="button" id="anonymizeBtn">匿名化</button>
+    <button type="button" id="deleteBtn">删除</button>
+  </form>
+  <p>删除：移除该用户的全部事件、用户记录、关联标识、属性与 webhook 日志，统计中不再计入。匿名化：事件与用户记录改为随机标识并清空事件属性，统计数量不变。两者都会重算受影响日期的汇总数据，且不可撤销。</p>
+
+  <div id="status"></div>
+
+  <h3>审计记录</h3>
+  <table>
+    <thead>
+      <tr><th>时间</th><th>操作</th><th>user_id</th><th>操作人</th><th>原因</th><th>影响行数</th><th>错误</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <script>
+    const ACTION_LABELS = { export: '导出', delete: '删除', anonymize: '匿名化' };
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showStatus(msg, ok) {
+      document.getElementById('status').innerHTML = msg ? '<p class="' + (ok ? 'ok' : 'error') + '">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    function fmtRows(rows) {
+      return Object.keys(rows || {}).filter(k => rows[k] > 0).map(k => esc(k) + ': ' + rows[k]).join('<br>');
+    }
+
+    async function load() {
+      const resp = await fetch('/admin/api/privacy/audit');
+      const data = await resp.json();
+      if (!resp.ok) {
+        showStatus(data.error);
+        return;
+      }
+      document.getElementById('rows').innerHTML = (data.records || []).map(r =>
+        '<tr><td>' + esc(fmtTime(r.created_at)) + '</td><td>' + esc(ACTION_LABELS[r.action] || r.action) +
+        '</td><td>' + esc(r.user_id) + '</td><td>' + esc(r.operator) + '</td><td>' + esc(r.reason) +
+        '</td><td>' + fmtRows(r.rows) + '</td><td class="error">' + esc(r.error) + '</td></tr>'
+      ).join('');
+    }
+
+    function formValues() {
+      const form = document.getElementById('privacyForm');
+      if (!form.reportValidity()) return null;
+      return {
+        userId: form.elements.user_id.value.trim(),
+        operator: form.elements.operator.value.trim(),
+        reason: form.elements.reason.value.trim()
+      };
+    }
+
+    async function exportData() {
+      const v = formValues();
+      if (!v) return;
+      const params = new URLSearchParams({ operator: v.operator, reason: v.reason });
+      const resp = await fetch('/admin/api/privacy/users/' + encodeURIComponent(v.userId) + '/export?' + params);
+      if (!resp.ok) {
+        showStatus((await resp.json()).error);
+        return;
+      }
+      const link = document.createElement('a');
+      link.href = URL.createObjectURL(await resp.blob());
+      link.download = 'user-' + v.userId + '.json';
+      link.click();
+      URL.revokeObjectURL(link.href);
+      showStatus('已导出', true);
+      load();
+    }
+
+    async function erase(action) {
+      const v = formValues();
+      if (!v) return;
+      if (!confirm('确定' + ACTION_LABELS[action] + '用户 ' + v.userId + ' 的全部数据？此操作不可撤销。')) return;
+      const resp = await fetch('/admin/api/privacy/users/' + encodeURIComponent(v.userId) + '/erase', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ action: action, operator: v.operator, reason: v.reason })
+      });
+      const data = await resp.json();
+      if (!resp.ok) {
+        showStatus(data.error);
+      } else {
+        const total = Object.values(data.rows || {}).reduce((a, b) => a + b, 0);
+        showStatus('已' + ACTION_LABELS[action] + '，共影响 ' + total + ' 行，重算 ' + data.days + ' 天汇总数据', true);
+      }
+      load();
+    }
+
+    (function init() {
+      document.getElementById('exportBtn').addEventListener('click', exportData);
+      document.getElementById('anonymizeBtn').addEventListener('click', function () { erase('anonymize'); });
+      document.getElementById('deleteBtn').addEventListener('click', function () { erase('delete'); });
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/identity"
+	"appstats/internal/logging"
+	"appstats/internal/profiles"
+	"appstats/internal/pseudonym"
+)
+
+// UpdateProfileRequest is the payload of the profile update API.
+type UpdateProfileRequest struct {
+	UserID string `json:"user_id" binding:"required,max=64"`
+	// App selects the privacy settings the user ID is pseudonymized with;
+	// optional, default "default".
+	App string `json:"app"`
+	profiles.Update
+}
+
+// UpdateProfileHandler applies property operations to a user profile and
+// returns the resulting properties. The user ID may be an alias, and is
+// pseudonymized like reported events.
+func UpdateProfileHandler(db *gorm.DB, ids *identity.Resolver, pseudo *pseudonym.Pseudonymizer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		log := logging.FromContext(c)
+
+		var req UpdateProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := req.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !pseudonymizeUserIDs(c, pseudo, req.App, &req.UserID) {
+			return
+		}
+		userID, err := ids.Resolve(req.UserID)
+		if err != nil {
+			log.Error("resolve user alias failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+
+		props, err := profiles.Apply(db, userID, req.Update, time.Now().UTC())
+		switch {
+		case errors.Is(err, profiles.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			log.Error("update user profile failed", slog.String("user_id", userID), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update profile"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"user_id": userID, "properties": props})
+	}
+}
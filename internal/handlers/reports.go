@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/reports"
+)
+
+// ReportPageHandler renders the report schedules page.
+func ReportPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(reportHTMLTemplate))
+	}
+}
+
+// ListReportSchedulesHandler lists all report schedules and the sections
+// they can include.
+func ListReportSchedulesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var schedules []models.ReportSchedule
+		if err := db.Order("id").Find(&schedules).Error; err != nil {
+			logging.FromContext(c).Error("list report schedules failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"schedules": schedules, "metrics": reports.Sections})
+	}
+}
+
+// CreateReportScheduleHandler creates a report schedule.
+func CreateReportScheduleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sch models.ReportSchedule
+		if err := c.ShouldBindJSON(&sch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sch.ID = 0
+		sch.LastRunAt, sch.LastError = nil, ""
+		if !prepareReportSchedule(c, &sch) {
+			return
+		}
+		if err := db.Create(&sch).Error; err != nil {
+			logging.FromContext(c).Error("create report schedule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create schedule"})
+			return
+		}
+		c.JSON(http.StatusCreated, sch)
+	}
+}
+
+// UpdateReportScheduleHandler replaces the configuration of a schedule while
+// keeping its run history.
+func UpdateReportScheduleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadReportSchedule(c, db)
+		if !ok {
+			return
+		}
+		var sch models.ReportSchedule
+		if err := c.ShouldBindJSON(&sch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		sch.ID = existing.ID
+		sch.CreatedAt = existing.CreatedAt
+		sch.LastRunAt, sch.LastError = existing.LastRunAt, existing.LastError
+		if !prepareReportSchedule(c, &sch) {
+			return
+		}
+		if err := db.Save(&sch).Error; err != nil {
+			logging.FromContext(c).Error("update report schedule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update schedule"})
+			return
+		}
+		c.JSON(http.StatusOK, sch)
+	}
+}
+
+// DeleteReportScheduleHandler deletes a report schedule.
+func DeleteReportScheduleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sch, ok := loadReportSchedule(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(sch).Error; err != nil {
+			logging.FromContext(c).Error("delete report schedule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete schedule"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// PreviewReportScheduleHandler renders the report of a saved schedule as
+// HTML. The optional day parameter (YYYY-MM-DD) selects the report day,
+// which defaults to yesterday.
+func PreviewReportScheduleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sch, ok := loadReportSchedule(c, db)
+		if !ok {
+			return
+		}
+		writeReportPreview(c, db, sch)
+	}
+}
+
+// PreviewReportHandler renders the report of an unsaved schedule posted as
+// JSON, so a draft can be checked before it is scheduled.
+func PreviewReportHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sch models.ReportSchedule
+		if err := c.ShouldBindJSON(&sch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := reports.ValidateContent(&sch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		writeReportPreview(c, db, &sch)
+	}
+}
+
+// SendReportScheduleHandler sends the report of a schedule immediately,
+// without changing its next run time.
+func SendReportScheduleHandler(db *gorm.DB, scheduler *reports.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sch, ok := loadReportSchedule(c, db)
+		if !ok {
+			return
+		}
+		if err := scheduler.Send(c.Request.Context(), sch); err != nil {
+			logging.FromContext(c).Warn("send report failed", slog.Uint64("schedule_id", uint64(sch.ID)), slog.Any("error", err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, sch)
+	}
+}
+
+// prepareReportSchedule validates sch and computes its next run time,
+// writing an error response and returning false when it is invalid.
+func prepareReportSchedule(c *gin.Context, sch *models.ReportSchedule) bool {
+	if err := reports.Validate(sch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	next, err := reports.NextRun(sch, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	sch.NextRunAt = &next
+	return true
+}
+
+func writeReportPreview(c *gin.Context, db *gorm.DB, sch *models.ReportSchedule) {
+	now := time.Now()
+	if v := c.Query("day"); v != "" {
+		// The report day is in the time zone of the schedule.
+		loc, err := reports.Location(sch.Timezone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		day, err := time.ParseInLocation(dateLayout, v, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid day " + strconv.Quote(v)})
+			return
+		}
+		now = day.AddDate(0, 0, 1)
+	}
+	r, err := reports.Build(db, sch, now)
+	if err != nil {
+		logging.FromContext(c).Error("build report failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to build report"})
+		return
+	}
+	html, err := r.PreviewHTML()
+	if err != nil {
+		logging.FromContext(c).Error("render report failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to render report"})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(html))
+}
+
+// loadReportSchedule fetches the schedule named by the :id parameter,
+// writing an error response and returning false when it cannot.
+func loadReportSchedule(c *gin.Context, db *gorm.DB) (*models.ReportSchedule, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var sch models.ReportSchedule
+	if err := db.First(&sch, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "schedule not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load report schedule failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &sch, true
+}
+
+// reportHTMLTemplate is the HTML template for the report schedules page.
+const reportHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>邮件报表</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    form { display: flex; flex-wrap: wrap; gap: 8px 16px; max-width: 1100px; margin-bottom: 16px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 13px; }
+    th { background: #f5f5f5; }
+    iframe { width: 720px; height: 900px; border: 1px solid #ddd; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>邮件报表</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="scheduleForm">
+    <input type="hidden" name="id">
+    <label>名称：<input type="text" name="name" required></label>
+    <label>Cron：<input type="text" name="cron" value="0 9 * * *" size="14" required></label>
+    <label>时区：<input type="text" name="timezone" value="Asia/Shanghai" size="14" placeholder="服务器时区"></label>
+    <label>应用：<input type="text" name="app" placeholder="全部" size="10"></label>
+    <label>趋势天数：<input type="number" name="days" value="7" min="2" max="31" style="width: 60px;"></label>
+    <label>收件人（逗号分隔）：<input type="text" name="recipients" size="40"></label>
+    <span id="metricBoxes"></span>
+    <label><input type="checkbox" name="enabled" checked> 启用</label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="previewBtn">预览</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+
+  <div id="status"></div>
+  <h3>计划</h3>
+  <table>
+    <thead>
+      <tr><th>名称</th><th>Cron</th><th>应用</th><th>内容</th><th>收件人</th><th>下次发送</th><th>上次发送</th><th>错误</th><th>操作</th></tr>
+    </thead>
+    <tbody id="schedules"></tbody>
+  </table>
+
+  <iframe id="preview" style="display: none;"></iframe>
+
+  <script>
+    const metricNames = {
+      new_users: '新增用户', active_users: '活跃用户', events: '事件数',
+      top_versions: '版本分布', top_platforms: '平台分布', top_regions: '地区分布'
+    };
+    let schedules = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function load() {
+      try {
+        const data = await api('GET', '/admin/api/reports/schedules');
+        schedules = data.schedules || [];
+        const boxes = document.getElementById('metricBoxes');
+        if (!boxes.innerHTML) {
+          boxes.innerHTML = (data.metrics || []).map(m =>
+            '<label><input type="checkbox" name="metrics" value="' + esc(m) + '"' +
+            (['new_users', 'active_users', 'top_versions'].includes(m) ? ' checked' : '') + '> ' +
+            esc(metricNames[m] || m) + '</label> '
+          ).join('');
+        }
+        document.getElementById('schedules').innerHTML = schedules.map(s =>
+          '<tr><td>' + esc(s.name) + (s.enabled ? '' : '（停用）') + '</td><td>' + esc(s.cron) + (s.timezone ? ' ' + esc(s.timezone) : '') +
+          '</td><td>' + esc(s.app || '全部') + '</td><td>' + esc((s.metrics || []).map(m => metricNames[m] || m).join('、')) +
+          '</td><td>' + esc((s.recipients || []).join(', ')) + '</td><td>' + esc(fmtTime(s.next_run_at)) + '</td><td>' +
+          esc(fmtTime(s.last_run_at)) + '</td><td class="error">' + esc(s.last_error) + '</td><td>' +
+          '<button onclick="previewSaved(' + s.id + ')">预览</button> <button onclick="sendNow(' + s.id + ')">立即发送</button> ' +
+          '<button onclick="edit(' + s.id + ')">编辑</button> <button onclick="removeSchedule(' + s.id + ')">删除</button></td></tr>'
+        ).join('');
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    function formToSchedule(form) {
+      return {
+        name: form.elements.name.value.trim(),
+        cron: form.elements.cron.value.trim(),
+        timezone: form.elements.timezone.value.trim(),
+        app: form.elements.app.value.trim(),
+        days: parseInt(form.elements.days.value, 10) || 0,
+        recipients: form.elements.recipients.value.split(',').map(s => s.trim()).filter(Boolean),
+        metrics: Array.from(form.querySelectorAll('input[name=metrics]:checked')).map(el => el.value),
+        enabled: form.elements.enabled.checked
+      };
+    }
+
+    function showPreview(html) {
+      const frame = document.getElementById('preview');
+      frame.style.display = '';
+      frame.srcdoc = html;
+    }
+
+    async function fetchPreview(method, url, body) {
+      const resp = await fetch(url, {
+        method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      if (!resp.ok) {
+        const data = await resp.json();
+        throw new Error(data.error || resp.statusText);
+      }
+      return resp.text();
+    }
+
+    async function previewSaved(id) {
+      try {
+        showPreview(await fetchPreview('GET', '/admin/api/reports/schedules/' + id + '/preview'));
+        showError('');
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    async function sendNow(id) {
+      try {
+        await api('POST', '/admin/api/reports/schedules/' + id + '/send');
+        alert('已发送');
+      } catch (err) {
+        showError(err.message);
+      }
+      load();
+    }
+
+    function edit(id) {
+      const s = schedules.find(x => x.id === id);
+      if (!s) return;
+      const form = document.getElementById('scheduleForm');
+      for (const k of ['id', 'name', 'cron', 'timezone', 'app', 'days']) {
+        form.elements[k].value = s[k];
+      }
+      form.elements.recipients.value = (s.recipients || []).join(', ');
+      form.elements.enabled.checked = s.enabled;
+      form.querySelectorAll('input[name=metrics]').forEach(el => { el.checked = (s.metrics || []).includes(el.value); });
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    function resetForm() {
+      const form = document.getElementById('scheduleForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    async function removeSchedule(id) {
+      if (!confirm('确定删除该计划？')) return;
+      try {
+        await api('DELETE', '/admin/api/reports/schedules/' + id);
+        load();
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    (function init() {
+      const form = document.getElementById('scheduleForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        try {
+          await api(id ? 'PUT' : 'POST', '/admin/api/reports/schedules' + (id ? '/' + id : ''), formToSchedule(form));
+          showError('');
+          resetForm();
+          load();
+        } catch (err) {
+          showError(err.message);
+        }
+      });
+      document.getElementById('previewBtn').addEventListener('click', async function () {
+        try {
+          showPreview(await fetchPreview('POST', '/admin/api/reports/preview', formToSchedule(form)));
+          showError('');
+        } catch (err) {
+          showError(err.message);
+        }
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/retention"
+)
+
+// RetentionPageHandler renders the retention policies page.
+func RetentionPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(retentionHTMLTemplate))
+	}
+}
+
+// ListRetentionPoliciesHandler lists all retention policies with their progress.
+func ListRetentionPoliciesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var policies []models.RetentionPolicy
+		if err := db.Order("app").Find(&policies).Error; err != nil {
+			logging.FromContext(c).Error("list retention policies failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"policies": policies})
+	}
+}
+
+// CreateRetentionPolicyHandler creates a retention policy. Each app has at
+// most one policy.
+func CreateRetentionPolicyHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var pol models.RetentionPolicy
+		if err := c.ShouldBindJSON(&pol); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pol.ID = 0
+		resetRetentionProgress(&pol, nil)
+		if !validateRetentionPolicy(c, db, &pol) {
+			return
+		}
+		if err := db.Create(&pol).Error; err != nil {
+			logging.FromContext(c).Error("create retention policy failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create policy"})
+			return
+		}
+		c.JSON(http.StatusCreated, pol)
+	}
+}
+
+// UpdateRetentionPolicyHandler replaces the configuration of a retention
+// policy while keeping its progress.
+func UpdateRetentionPolicyHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadRetentionPolicy(c, db)
+		if !ok {
+			return
+		}
+		var pol models.RetentionPolicy
+		if err := c.ShouldBindJSON(&pol); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		pol.ID = existing.ID
+		pol.CreatedAt = existing.CreatedAt
+		resetRetentionProgress(&pol, existing)
+		if pol.App != existing.App {
+			// The progress belongs to the old app.
+			resetRetentionProgress(&pol, nil)
+		}
+		if !validateRetentionPolicy(c, db, &pol) {
+			return
+		}
+		if err := db.Save(&pol).Error; err != nil {
+			logging.FromContext(c).Error("update retention policy failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update policy"})
+			return
+		}
+		c.JSON(http.StatusOK, pol)
+	}
+}
+
+// DeleteRetentionPolicyHandler deletes a retention policy; the data of the
+// app is kept from then on.
+func DeleteRetentionPolicyHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pol, ok := loadRetentionPolicy(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(pol).Error; err != nil {
+			logging.FromContext(c).Error("delete retention policy failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete policy"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// RunRetentionPolicyHandler applies a policy immediately, whether or not it
+// is enabled, and returns what was purged.
+func RunRetentionPolicyHandler(db *gorm.DB, purger *retention.Purger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pol, ok := loadRetentionPolicy(c, db)
+		if !ok {
+			return
+		}
+		res, err := purger.Apply(c.Request.Context(), pol)
+		if err != nil {
+			logging.FromContext(c).Error("apply retention policy failed", slog.String("app", pol.App), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "purge failed", "result": res})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// resetRetentionProgress copies the progress fields of from, or clears them
+// when from is nil, so clients cannot set them.
+func resetRetentionProgress(pol, from *models.RetentionPolicy) {
+	if from == nil {
+		from = &models.RetentionPolicy{}
+	}
+	pol.PurgedBefore = from.PurgedBefore
+	pol.DeletedEvents, pol.DeletedRollups = from.DeletedEvents, from.DeletedRollups
+	pol.LastRunAt, pol.LastError = from.LastRunAt, from.LastError
+}
+
+// validateRetentionPolicy validates pol and checks that no other policy
+// exists for its app, writing an error response and returning false when
+// it is not valid.
+func validateRetentionPolicy(c *gin.Context, db *gorm.DB, pol *models.RetentionPolicy) bool {
+	if err := retention.Validate(pol); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	var n int64
+	if err := db.Model(&models.RetentionPolicy{}).Where("app = ? AND id <> ?", pol.App, pol.ID).Count(&n).Error; err != nil {
+		logging.FromContext(c).Error("check retention policy failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return false
+	}
+	if n > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "a policy for this app already exists"})
+		return false
+	}
+	return true
+}
+
+func loadRetentionPolicy(c *gin.Context, db *gorm.DB) (*models.RetentionPolicy, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var pol models.RetentionPolicy
+	if err := db.First(&pol, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "policy not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load retention policy failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &pol, true
+}
+
+// retentionHTMLTemplate is the HTML template for the retention policies page.
+const retentionHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>数据保留策略</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>数据保留策略</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="policyForm">
+    <input type="hidden" name="id">
+    <label>应用：<input type="text" name="app" required maxlength="64" size="12" placeholder="default"></label>
+    <label>原始事件保留（天）：<input type="number" name="raw_days" min="0" value="180" style="width: 80px;"></label>
+    <label>汇总数据保留（天）：<input type="number" name="rollup_days" min="0" value="0" style="width: 80px;"></label>
+    <label><input type="checkbox" name="enabled" checked> 启用</label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+  <p>0 表示永久保留。汇总数据尚未物化的日期不会被清理原始事件。</p>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>应用</th><th>原始事件</th><th>汇总数据</th><th>状态</th><th>已清理至</th><th>已删除事件</th><th>已删除汇总</th><th>最近执行</th><th>提示</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <script>
+    let items = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    function fmtDays(n) {
+      return n > 0 ? n + ' 天' : '永久';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method: method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function load() {
+      try {
+        const data = await api('GET', '/admin/api/retention/policies');
+        items = data.policies || [];
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      document.getElementById('rows').innerHTML = items.map(p =>
+        '<tr><td>' + esc(p.app) + '</td><td>' + fmtDays(p.raw_days) + '</td><td>' + fmtDays(p.rollup_days) +
+        '</td><td>' + (p.enabled ? '启用' : '停用') + '</td><td>' + esc(p.purged_before ? p.purged_before.slice(0, 10) : '-') +
+        '</td><td>' + p.deleted_events + '</td><td>' + p.deleted_rollups + '</td><td>' + esc(fmtTime(p.last_run_at)) +
+        '</td><td class="error">' + esc(p.last_error) + '</td><td><button onclick="run(' + p.id + ')">立即执行</button> ' +
+        '<button onclick="edit(' + p.id + ')">编辑</button> <button onclick="remove(' + p.id + ')">删除</button></td></tr>'
+      ).join('');
+    }
+
+    function resetForm() {
+      const form = document.getElementById('policyForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    function edit(id) {
+      const p = items.find(x => x.id === id);
+      if (!p) return;
+      const form = document.getElementById('policyForm');
+      form.elements.id.value = p.id;
+      form.elements.app.value = p.app;
+      form.elements.raw_days.value = p.raw_days;
+      form.elements.rollup_days.value = p.rollup_days;
+      form.elements.enabled.checked = p.enabled;
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    async function remove(id) {
+      if (!confirm('确定删除该策略？删除后该应用的数据将不再清理。')) return;
+      try {
+        await api('DELETE', '/admin/api/retention/policies/' + id);
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function run(id) {
+      if (!confirm('确定立即清理过期数据？删除的数据无法恢复。')) return;
+      showError('');
+      try {
+        const res = await api('POST', '/admin/api/retention/policies/' + id + '/run');
+        alert('已删除 ' + res.deleted_events + ' 条事件、' + res.deleted_rollups + ' 条汇总数据' +
+          (res.blocked ? '\n' + res.blocked : ''));
+      } catch (e) {
+        showError(e.message);
+      }
+      load();
+    }
+
+    (function init() {
+      const form = document.getElementById('policyForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        const body = {
+          app: form.elements.app.value.trim(),
+          raw_days: parseInt(form.elements.raw_days.value, 10) || 0,
+          rollup_days: parseInt(form.elements.rollup_days.value, 10) || 0,
+          enabled: form.elements.enabled.checked
+        };
+        try {
+          await api(id ? 'PUT' : 'POST', '/admin/api/retention/policies' + (id ? '/' + id : ''), body);
+        } catch (e) {
+          showError(e.message);
+          return;
+        }
+        showError('');
+        resetForm();
+        load();
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/rollups"
+	"appstats/internal/stats"
+)
+
+// maxRollupDays bounds the date range of a rollups query.
+const maxRollupDays = 3660
+
+// ListRollupsHandler returns the materialized daily rollups of a date range.
+// The dimension parameter selects the platform, app_version or region
+// breakdown instead of the app totals.
+func ListRollupsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, days, err := parseDateRange(c, 30, maxRollupDays)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		dim := c.Query("dimension")
+		switch stats.Dimension(dim) {
+		case "", stats.DimensionPlatform, stats.DimensionVersion, stats.DimensionRegion:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported dimension"})
+			return
+		}
+		rows, err := rollups.Query(db, from, from.AddDate(0, 0, days), c.Query("app"), dim)
+		if err != nil {
+			logging.FromContext(c).Error("load rollups failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"rollups": rows})
+	}
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/schema"
+)
+
+// SchemaPageHandler renders the event schema and dead letter page.
+func SchemaPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(schemaHTMLTemplate))
+	}
+}
+
+// ListEventSchemasHandler lists the schema versions, optionally of one app
+// or event type, newest first.
+func ListEventSchemasHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("app, event_type, version DESC")
+		if v := c.Query("app"); v != "" {
+			q = q.Where("app = ?", v)
+		}
+		if v, ok := c.GetQuery("event_type"); ok {
+			q = q.Where("event_type = ?", v)
+		}
+		var schemas []models.EventSchema
+		if err := q.Find(&schemas).Error; err != nil {
+			logging.FromContext(c).Error("list event schemas failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"schemas": schemas})
+	}
+}
+
+// CreateEventSchemaHandler saves a schema as the next version of its app
+// and event type and activates it.
+func CreateEventSchemaHandler(db *gorm.DB, schemas *schema.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var s models.EventSchema
+		if err := c.ShouldBindJSON(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		s.ID = 0
+		if err := schema.Validate(&s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := schema.Create(db, &s); err != nil {
+			logging.FromContext(c).Error("create event schema failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create schema"})
+			return
+		}
+		schemas.Invalidate()
+		c.JSON(http.StatusCreated, s)
+	}
+}
+
+// ActivateEventSchemaHandler makes a schema version the active one of its
+// app and event type.
+func ActivateEventSchemaHandler(db *gorm.DB, schemas *schema.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := loadEventSchema(c, db)
+		if !ok {
+			return
+		}
+		if err := schema.Activate(db, s); err != nil {
+			logging.FromContext(c).Error("activate event schema failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to activate schema"})
+			return
+		}
+		schemas.Invalidate()
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// DeleteEventSchemaHandler deletes a schema version. Without an active
+// version, events of the type are only checked against the column sizes.
+func DeleteEventSchemaHandler(db *gorm.DB, schemas *schema.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := loadEventSchema(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(s).Error; err != nil {
+			logging.FromContext(c).Error("delete event schema failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete schema"})
+			return
+		}
+		schemas.Invalidate()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+func loadEventSchema(c *gin.Context, db *gorm.DB) (*models.EventSchema, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var s models.EventSchema
+	if err := db.First(&s, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "schema not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load event schema failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &s, true
+}
+
+// ListDeadLettersHandler returns the latest rejected event payloads,
+// optionally of one app or rejection reason.
+func ListDeadLettersHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("id DESC").Limit(100)
+		if v := c.Query("app"); v != "" {
+			q = q.Where("app = ?", v)
+		}
+		if v := c.Query("reason"); v != "" {
+			q = q.Where("reason = ?", v)
+		}
+		if v := c.Query("before_id"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before_id"})
+				return
+			}
+			q = q.Where("id < ?", id)
+		}
+		var letters []models.DeadLetter
+		if err := q.Find(&letters).Error; err != nil {
+			logging.FromContext(c).Error("list dead letters failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"dead_letters": letters})
+	}
+}
+
+// schemaHTMLTemplate is the HTML template for the event schema page.
+const schemaHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>事件结构</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; vertical-align: top; }
+    th { background: #f5f5f5; }
+    form label { display: block; margin-bottom: 8px; }
+    .error { color: #c00; }
+    pre { margin: 0; max-width: 560px; white-space: pre-wrap; word-break: break-all; font-size: 12px; }
+  </style>
+</head>
+<body>
+  <h2>事件结构</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="schemaForm">
+    <label>应用：<input type="text" name="app" maxlength="64" size="12" placeholder="default"></label>
+    <label>事件类型：<input type="text" name="event_type" maxlength="32" size="20" placeholder="留空表示未填 event_type 的事件"></label>
+    <label>必填字段：
+      <label style="display: inline;"><input type="checkbox" name="required_fields" value="region"> region</label>
+      <label style="display: inline;"><input type="checkbox" name="required_fields" value="app_version"> app_version</label>
+      <label style="display: inline;"><input type="checkbox" name="required_fields" value="event_time"> event_time</label>
+      <label style="display: inline;"><input type="checkbox" name="required_fields" value="sent_at"> sent_at</label>
+    </label>
+    <label>属性（JSON 数组）：<br><textarea name="properties" rows="8" cols="80" placeholder='[{"name": "channel", "type": "string", "required": true, "max_length": 32, "enum": ["appstore", "googleplay"]}]'></textarea></label>
+    <p>type 可选 string、number、integer、boolean、object、array；max_length 只用于 string，enum 只用于 string 与数字。</p>
+    <label><input type="checkbox" name="additional_properties" checked> 允许未列出的属性</label>
+    <label>备注：<input type="text" name="note" maxlength="255" size="60"></label>
+    <button type="submit">保存为新版本</button>
+  </form>
+  <p>保存后成为该应用、事件类型的生效版本，旧版本保留并可重新启用；约 30 秒内在所有实例生效。</p>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>应用</th><th>事件类型</th><th>版本</th><th>必填字段</th><th>属性</th><th>备注</th><th>创建时间</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <h3>被拒绝的事件</h3>
+  <form id="deadLetterForm">
+    <label style="display: inline;">应用：<input type="text" name="app" size="12"></label>
+    <label style="display: inline;">原因：<select name="reason">
+      <option value="">全部</option>
+      <option value="invalid_payload">invalid_payload</option>
+      <option value="schema_violation">schema_violation</option>
+      <option value="event_time_out_of_range">event_time_out_of_range</option>
+    </select></label>
+    <button type="submit">查询</button>
+  </form>
+  <table>
+    <thead>
+      <tr><th>时间</th><th>应用</th><th>原因</th><th>结构版本</th><th>错误</th><th>请求内容</th></tr>
+    </thead>
+    <tbody id="deadLetters"></tbody>
+  </table>
+  <p><button type="button" id="moreBtn" style="display: none;">加载更多</button></p>
+
+  <script>
+    let items = [];
+    let lastDeadLetterID = 0;
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(s) {
+      return s ? new Date(s).toLocaleString() : '-';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method: method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    function propsText(props) {
+      return (props || []).map(p => {
+        let s = p.name + ': ' + p.type;
+        if (p.required) s += ' 必填';
+        if (p.max_length) s += ' ≤' + p.max_length;
+        if (p.enum && p.enum.length) s += ' [' + p.enum.join(', ') + ']';
+        return s;
+      }).join('\n');
+    }
+
+    async function load() {
+      try {
+        items = (await api('GET', '/admin/api/schemas')).schemas || [];
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      document.getElementById('rows').innerHTML = items.map(s =>
+        '<tr><td>' + esc(s.app) + '</td><td>' + esc(s.event_type || '（空）') + '</td><td>v' + s.version +
+        (s.active ? ' <b>生效中</b>' : '') + '</td><td>' + esc((s.required_fields || []).join(', ')) +
+        '</td><td><pre>' + esc(propsText(s.properties)) + (s.additional_properties ? '' : '\n（不允许其他属性）') +
+        '</pre></td><td>' + esc(s.note) + '</td><td>' + fmtTime(s.created_at) + '</td><td>' +
+        '<button onclick="edit(' + s.id + ')">基于此版本修改</button> ' +
+        (s.active ? '' : '<button onclick="activate(' + s.id + ')">启用</button> ') +
+        '<button onclick="remove(' + s.id + ')">删除</button></td></tr>'
+      ).join('');
+    }
+
+    function edit(id) {
+      const s = items.find(x => x.id === id);
+      if (!s) return;
+      const form = document.getElementById('schemaForm');
+      form.elements.app.value = s.app;
+      form.elements.event_type.value = s.event_type;
+      form.querySelectorAll('input[name=required_fields]').forEach(cb => {
+        cb.checked = (s.required_fields || []).includes(cb.value);
+      });
+      form.elements.properties.value = JSON.stringify(s.properties || [], null, 2);
+      form.elements.additional_properties.checked = s.additional_properties;
+      form.elements.note.value = '';
+      window.scrollTo(0, 0);
+    }
+
+    async function activate(id) {
+      try {
+        await api('POST', '/admin/api/schemas/' + id + '/activate');
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function remove(id) {
+      if (!confirm('确定删除该版本？删除生效版本后该事件类型不再按结构校验。')) return;
+      try {
+        await api('DELETE', '/admin/api/schemas/' + id);
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function loadDeadLetters(more) {
+      const form = document.getElementById('deadLetterForm');
+      const params = new URLSearchParams();
+      if (form.elements.app.value.trim()) params.set('app', form.elements.app.value.trim());
+      if (form.elements.reason.value) params.set('reason', form.elements.reason.value);
+      if (more) params.set('before_id', lastDeadLetterID);
+      let letters;
+      try {
+        letters = (await api('GET', '/admin/api/dead-letters?' + params.toString())).dead_letters || [];
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      const html = letters.map(d =>
+        '<tr><td>' + fmtTime(d.created_at) + '</td><td>' + esc(d.app) + '</td><td>' + esc(d.reason) +
+        '</td><td>' + (d.schema_version ? 'v' + d.schema_version : '-') + '</td><td><pre>' +
+        esc(Object.keys(d.errors || {}).sort().map(k => k + ': ' + d.errors[k]).join('\n')) +
+        '</pre></td><td><pre>' + esc(d.payload) + '</pre></td></tr>'
+      ).join('');
+      const tbody = document.getElementById('deadLetters');
+      tbody.innerHTML = more ? tbody.innerHTML + html : html;
+      if (letters.length) lastDeadLetterID = letters[letters.length - 1].id;
+      document.getElementById('moreBtn').style.display = letters.length === 100 ? '' : 'none';
+    }
+
+    (function init() {
+      const form = document.getElementById('schemaForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        let properties;
+        try {
+          properties = JSON.parse(form.elements.properties.value.trim() || '[]');
+        } catch (err) {
+          showError('属性不是合法的 JSON：' + err.message);
+          return;
+        }
+        const body = {
+          app: form.elements.app.value.trim(),
+          event_type: form.elements.event_type.value.trim(),
+          required_fields: Array.from(form.querySelectorAll('input[name=required_fields]:checked')).map(cb => cb.value),
+          properties: properties,
+          additional_properties: form.elements.additional_properties.checked,
+          note: form.elements.note.value.trim()
+        };
+        try {
+          await api('POST', '/admin/api/schemas', body);
+        } catch (err) {
+          showError(err.message);
+          return;
+        }
+        showError('');
+        form.reset();
+        load();
+      });
+      document.getElementById('deadLetterForm').addEventListener('submit', function (e) {
+        e.preventDefault();
+        loadDeadLetters(false);
+      });
+      document.getElementById('moreBtn').addEventListener('click', () => loadDeadLetters(true));
+      load();
+      loadDeadLetters(false);
+    })();
+  </script>
+</body>
+</html>
+`
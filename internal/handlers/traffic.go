@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/traffic"
+)
+
+// TrafficPageHandler renders the traffic rules page.
+func TrafficPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(trafficHTMLTemplate))
+	}
+}
+
+// ListTrafficRulesHandler lists all traffic rules.
+func ListTrafficRulesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rules []models.TrafficRule
+		if err := db.Order("id").Find(&rules).Error; err != nil {
+			logging.FromContext(c).Error("list traffic rules failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"rules": rules})
+	}
+}
+
+// CreateTrafficRuleHandler creates a traffic rule.
+func CreateTrafficRuleHandler(db *gorm.DB, rules *traffic.Filter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var r models.TrafficRule
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		r.ID = 0
+		if err := traffic.Validate(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Create(&r).Error; err != nil {
+			logging.FromContext(c).Error("create traffic rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create rule"})
+			return
+		}
+		rules.Invalidate()
+		c.JSON(http.StatusCreated, r)
+	}
+}
+
+// UpdateTrafficRuleHandler replaces a traffic rule.
+func UpdateTrafficRuleHandler(db *gorm.DB, rules *traffic.Filter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadTrafficRule(c, db)
+		if !ok {
+			return
+		}
+		var r models.TrafficRule
+		if err := c.ShouldBindJSON(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		r.ID = existing.ID
+		r.CreatedAt = existing.CreatedAt
+		if err := traffic.Validate(&r); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Save(&r).Error; err != nil {
+			logging.FromContext(c).Error("update traffic rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update rule"})
+			return
+		}
+		rules.Invalidate()
+		c.JSON(http.StatusOK, r)
+	}
+}
+
+// DeleteTrafficRuleHandler deletes a traffic rule. Events it flagged stay
+// flagged.
+func DeleteTrafficRuleHandler(db *gorm.DB, rules *traffic.Filter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, ok := loadTrafficRule(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(r).Error; err != nil {
+			logging.FromContext(c).Error("delete traffic rule failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete rule"})
+			return
+		}
+		rules.Invalidate()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ApplyTrafficRuleHandler flags the stored events matching a rule as
+// internal traffic, whatever the rule's action, and returns how many were
+// flagged.
+func ApplyTrafficRuleHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r, ok := loadTrafficRule(c, db)
+		if !ok {
+			return
+		}
+		switch r.Kind {
+		case models.TrafficIPRange, models.TrafficEventRate:
+			c.JSON(http.StatusBadRequest, gin.H{"error": r.Kind + " rules only apply to new events"})
+			return
+		}
+		n, err := traffic.ApplyToHistory(db, r)
+		if err != nil {
+			logging.FromContext(c).Error("apply traffic rule failed", slog.Uint64("id", uint64(r.ID)), slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply rule"})
+			return
+		}
+		logging.FromContext(c).Info("traffic rule applied to history", slog.Uint64("id", uint64(r.ID)), slog.Int64("flagged", n))
+		c.JSON(http.StatusOK, gin.H{"flagged": n})
+	}
+}
+
+func loadTrafficRule(c *gin.Context, db *gorm.DB) (*models.TrafficRule, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var r models.TrafficRule
+	if err := db.First(&r, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "rule not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load traffic rule failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &r, true
+}
+
+// trafficHTMLTemplate is the HTML template for the traffic rules page.
+const trafficHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>内部流量规则</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-top: 16px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; vertical-align: top; }
+    th { background: #f5f5f5; }
+    form label { display: block; margin-bottom: 8px; }
+    .error { color: #c00; }
+    .value { max-width: 360px; white-space: pre-wrap; word-break: break-all; }
+  </style>
+</head>
+<body>
+  <h2>内部流量规则</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="ruleForm">
+    <input type="hidden" name="id">
+    <label>名称：<input type="text" name="name" required maxlength="128" size="30"></label>
+    <label>应用：<input type="text" name="app" maxlength="64" size="12" placeholder="留空表示全部应用"></label>
+    <label>类型：<select name="kind">
+      <option value="user_id">user_id 列表</option>
+      <option value="user_id_pattern">user_id 正则</option>
+      <option value="ip_range">IP 段</option>
+      <option value="app_version_suffix">app_version 后缀</option>
+      <option value="event_rate">事件频率</option>
+    </select></label>
+    <label>值：<br><textarea name="value" rows="4" cols="60" required></textarea></label>
+    <p id="valueHint"></p>
+    <label>动作：<select name="action">
+      <option value="flag">标记为内部流量</option>
+      <option value="drop">丢弃</option>
+    </select></label>
+    <label><input type="checkbox" name="enabled" checked> 启用</label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+  <p>标记的事件照常存储，但默认不计入统计与汇总数据，/admin 上勾选「包含内部流量」可查看；丢弃的事件不存储。同时命中多条规则时丢弃优先。</p>
+
+  <div id="status"></div>
+  <table>
+    <thead>
+      <tr><th>名称</th><th>应用</th><th>类型</th><th>值</th><th>动作</th><th>状态</th><th>操作</th></tr>
+    </thead>
+    <tbody id="rows"></tbody>
+  </table>
+
+  <script>
+    const KIND_LABELS = {
+      user_id: 'user_id 列表', user_id_pattern: 'user_id 正则', ip_range: 'IP 段',
+      app_version_suffix: 'app_version 后缀', event_rate: '事件频率'
+    };
+    const KIND_HINTS = {
+      user_id: '多个 user_id 用逗号或换行分隔，匹配上报的原始标识、假名化后的标识及关联的主用户。',
+      user_id_pattern: '正则表达式，如 ^qa-|^loadtest-。',
+      ip_range: '多个 IP 或 CIDR 用逗号或换行分隔，如 10.0.0.0/8, 203.0.113.7；使用客户端 IP（信任 X-Forwarded-For）。',
+      app_version_suffix: '多个后缀用逗号或换行分隔，如 -debug, -qa。',
+      event_rate: '每个用户每分钟最多事件数，超过后的事件命中规则；每个服务实例分别计数。'
+    };
+    const ACTION_LABELS = { flag: '标记', drop: '丢弃' };
+    const HISTORY_KINDS = ['user_id', 'user_id_pattern', 'app_version_suffix'];
+    let items = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method: method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    function updateHint() {
+      const form = document.getElementById('ruleForm');
+      document.getElementById('valueHint').textContent = KIND_HINTS[form.elements.kind.value] || '';
+    }
+
+    async function load() {
+      try {
+        items = (await api('GET', '/admin/api/traffic/rules')).rules || [];
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      document.getElementById('rows').innerHTML = items.map(r =>
+        '<tr><td>' + esc(r.name) + '</td><td>' + esc(r.app || '全部') + '</td><td>' + esc(KIND_LABELS[r.kind] || r.kind) +
+        '</td><td class="value">' + esc(r.value) + '</td><td>' + esc(ACTION_LABELS[r.action] || r.action) +
+        '</td><td>' + (r.enabled ? '启用' : '停用') + '</td><td>' +
+        (HISTORY_KINDS.includes(r.kind) ? '<button onclick="applyHistory(' + r.id + ')">标记历史事件</button> ' : '') +
+        '<button onclick="edit(' + r.id + ')">编辑</button> <button onclick="remove(' + r.id + ')">删除</button></td></tr>'
+      ).join('');
+    }
+
+    function resetForm() {
+      const form = document.getElementById('ruleForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+      updateHint();
+    }
+
+    function edit(id) {
+      const r = items.find(x => x.id === id);
+      if (!r) return;
+      const form = document.getElementById('ruleForm');
+      form.elements.id.value = r.id;
+      form.elements.name.value = r.name;
+      form.elements.app.value = r.app;
+      form.elements.kind.value = r.kind;
+      form.elements.value.value = r.value;
+      form.elements.action.value = r.action;
+      form.elements.enabled.checked = r.enabled;
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+      updateHint();
+    }
+
+    async function remove(id) {
+      if (!confirm('确定删除该规则？已标记的事件保持标记。')) return;
+      try {
+        await api('DELETE', '/admin/api/traffic/rules/' + id);
+      } catch (e) {
+        showError(e.message);
+        return;
+      }
+      load();
+    }
+
+    async function applyHistory(id) {
+      if (!confirm('确定把已存储的匹配事件标记为内部流量？受影响日期的汇总数据会重新计算。')) return;
+      showError('');
+      try {
+        const res = await api('POST', '/admin/api/traffic/rules/' + id + '/apply');
+        alert('已标记 ' + res.flagged + ' 条事件');
+      } catch (e) {
+        showError(e.message);
+      }
+    }
+
+    (function init() {
+      const form = document.getElementById('ruleForm');
+      form.elements.kind.addEventListener('change', updateHint);
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        const body = {
+          name: form.elements.name.value.trim(),
+          app: form.elements.app.value.trim(),
+          kind: form.elements.kind.value,
+          value: form.elements.value.value.trim(),
+          action: form.elements.action.value,
+          enabled: form.elements.enabled.checked
+        };
+        try {
+          await api(id ? 'PUT' : 'POST', '/admin/api/traffic/rules' + (id ? '/' + id : ''), body);
+        } catch (e) {
+          showError(e.message);
+          return;
+        }
+        showError('');
+        resetForm();
+        load();
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      updateHint();
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/identity"
+	"appstats/internal/logging"
+	"appstats/internal/profiles"
+	"appstats/internal/stats"
+)
+
+// userCalendarDays is how far back the active days calendar goes.
+const userCalendarDays = 365
+
+// userHistoryLimit is the number of property changes shown on the profile.
+const userHistoryLimit = 100
+
+// UserPageHandler renders the user lookup page. Data is loaded by the page
+// from the JSON endpoints below.
+func UserPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(userHTMLTemplate))
+	}
+}
+
+// UserProfileHandler returns the user record, properties, versions used and
+// active days.
+// An alias is resolved to the user it is linked to.
+func UserProfileHandler(db *gorm.DB, ids *identity.Resolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := resolveUserParam(c, ids)
+		if !ok {
+			return
+		}
+		profile, err := stats.GetUserProfile(db, userID, userCalendarDays)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+				return
+			}
+			logging.FromContext(c).Error("load user profile failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if profile.Aliases, err = ids.Aliases(userID); err != nil {
+			logging.FromContext(c).Error("load user aliases failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if profile.Properties, err = profiles.Properties(db, userID); err != nil {
+			logging.FromContext(c).Error("load user properties failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		if profile.PropertyHistory, err = profiles.History(db, userID, userHistoryLimit); err != nil {
+			logging.FromContext(c).Error("load user property history failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, profile)
+	}
+}
+
+// UserEventsHandler returns one page of the user's event timeline.
+func UserEventsHandler(db *gorm.DB, ids *identity.Resolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := resolveUserParam(c, ids)
+		if !ok {
+			return
+		}
+
+		page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+		if page < 1 {
+			page = 1
+		}
+		pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "50"))
+		if pageSize < 1 || pageSize > 500 {
+			pageSize = 50
+		}
+
+		res, err := stats.ListUserEvents(db, userID, page, pageSize)
+		if err != nil {
+			logging.FromContext(c).Error("load user events failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+// resolveUserParam resolves the :user_id parameter to a canonical user ID,
+// writing an error response and returning false when it cannot.
+func resolveUserParam(c *gin.Context, ids *identity.Resolver) (string, bool) {
+	userID, err := ids.Resolve(c.Param("user_id"))
+	if err != nil {
+		logging.FromContext(c).Error("resolve user alias failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return "", false
+	}
+	return userID, true
+}
+
+// userHTMLTemplate is the HTML template for the user lookup page.
+const userHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>用户查询</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .section { max-width: 900px; margin-bottom: 32px; }
+    .calendar { display: grid; grid-template-rows: repeat(7, 12px); grid-auto-flow: column; grid-auto-columns: 12px; gap: 2px; }
+    .calendar div { width: 12px; height: 12px; background: #ebedf0; border-radius: 2px; }
+    .calendar .l1 { background: #9be9a8; }
+    .calendar .l2 { background: #40c463; }
+    .calendar .l3 { background: #30a14e; }
+    .calendar .l4 { background: #216e39; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>用户查询</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="searchForm" style="margin-bottom: 24px;">
+    <label for="userId">user_id：</label>
+    <input type="text" id="userId" size="40">
+    <button type="submit">查询</button>
+  </form>
+
+  <div id="result"></div>
+
+  <script>
+    const PAGE_SIZE = 50;
+    let currentUser = '';
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    function renderCalendar(activeDays) {
+      const counts = {};
+      for (const d of activeDays) counts[d.date] = d.events;
+
+      const today = new Date();
+      const start = new Date(Date.UTC(today.getUTCFullYear(), today.getUTCMonth(), today.getUTCDate() - 364));
+      // 从周日开始对齐
+      start.setUTCDate(start.getUTCDate() - start.getUTCDay());
+
+      let html = '<div class="calendar">';
+      for (let d = new Date(start); d <= today; d.setUTCDate(d.getUTCDate() + 1)) {
+        const key = d.toISOString().slice(0, 10);
+        const n = counts[key] || 0;
+        const level = n === 0 ? '' : n < 3 ? 'l1' : n < 10 ? 'l2' : n < 30 ? 'l3' : 'l4';
+        html += '<div class="' + level + '" title="' + key + '：' + n + ' 个事件"></div>';
+      }
+      return html + '</div>';
+    }
+
+    async function loadEvents(page) {
+      const resp = await fetch('/admin/api/users/' + encodeURIComponent(currentUser) +
+        '/events?page=' + page + '&page_size=' + PAGE_SIZE);
+      const data = await resp.json();
+      const box = document.getElementById('events');
+      if (!resp.ok) {
+        box.innerHTML = '<p class="error">' + esc(data.error) + '</p>';
+        return;
+      }
+
+      let html = '<table><tr><th>时间</th><th>事件类型</th><th>平台</th><th>版本</th><th>地区</th></tr>';
+      for (const e of data.events || []) {
+        html += '<tr><td>' + esc(fmtTime(e.event_time)) + '</td><td>' + esc(e.event_type) + '</td><td>' + esc(e.platform) +
+          '</td><td>' + esc(e.app_version) + '</td><td>' + esc(e.region) + '</td></tr>';
+      }
+      html += '</table>';
+
+      const pages = Math.max(1, Math.ceil(data.total / data.page_size));
+      html += '<div>第 ' + data.page + ' / ' + pages + ' 页（共 ' + data.total + ' 条） ';
+      if (data.page > 1) html += '<button onclick="loadEvents(' + (data.page - 1) + ')">上一页</button> ';
+      if (data.page < pages) html += '<button onclick="loadEvents(' + (data.page + 1) + ')">下一页</button>';
+      html += '</div>';
+      box.innerHTML = html;
+    }
+
+    async function search(userId) {
+      const result = document.getElementById('result');
+      currentUser = userId;
+      result.innerHTML = '加载中...';
+
+      const resp = await fetch('/admin/api/users/' + encodeURIComponent(userId));
+      const data = await resp.json();
+      if (!resp.ok) {
+        result.innerHTML = '<p class="error">' + esc(data.error) + '</p>';
+        return;
+      }
+
+      const u = data.user;
+      let html = '<div class="section"><h3>用户信息</h3><table>' +
+        '<tr><th>user_id</th><td>' + esc(u.user_id) + '</td></tr>' +
+        '<tr><th>关联标识</th><td>' + esc((data.aliases || []).join(', ') || '-') + '</td></tr>' +
+        '<tr><th>首次出现</th><td>' + esc(fmtTime(u.first_seen)) + '</td></tr>' +
+        '<tr><th>最近活跃</th><td>' + esc(fmtTime(data.last_seen)) + '</td></tr>' +
+        '<tr><th>平台</th><td>' + esc(u.platform) + '</td></tr>' +
+        '<tr><th>地区</th><td>' + esc(u.region) + '</td></tr>' +
+        '<tr><th>事件总数</th><td>' + data.total_events + '</td></tr>' +
+        '</table></div>';
+
+      const props = data.properties || {};
+      const names = Object.keys(props).sort();
+      html += '<div class="section"><h3>用户属性</h3>';
+      if (names.length) {
+        html += '<table><tr><th>属性</th><th>值</th></tr>';
+        for (const n of names) {
+          html += '<tr><td>' + esc(n) + '</td><td>' + esc(props[n]) + '</td></tr>';
+        }
+        html += '</table>';
+      } else {
+        html += '<p>暂无属性</p>';
+      }
+      html += '</div>';
+
+      const changes = data.property_history || [];
+      if (changes.length) {
+        html += '<div class="section"><h3>属性变更记录</h3><table>' +
+          '<tr><th>时间</th><th>属性</th><th>原值</th><th>新值</th></tr>';
+        for (const ch of changes) {
+          html += '<tr><td>' + esc(fmtTime(ch.changed_at)) + '</td><td>' + esc(ch.name) + '</td><td>' +
+            esc(ch.old_value == null ? '-' : ch.old_value) + '</td><td>' +
+            esc(ch.new_value == null ? '（已删除）' : ch.new_value) + '</td></tr>';
+        }
+        html += '</table></div>';
+      }
+
+      html += '<div class="section"><h3>使用过的版本</h3><table>' +
+        '<tr><th>版本</th><th>首次使用</th><th>最后使用</th><th>事件数</th></tr>';
+      for (const v of data.versions || []) {
+        html += '<tr><td>' + esc(v.version || '未知') + '</td><td>' + esc(fmtTime(v.first_seen)) +
+          '</td><td>' + esc(fmtTime(v.last_seen)) + '</td><td>' + v.events + '</td></tr>';
+      }
+      html += '</table></div>';
+
+      html += '<div class="section"><h3>活跃日历（最近一年）</h3>' + renderCalendar(data.active_days || []) + '</div>';
+      html += '<div class="section"><h3>事件时间线</h3><div id="events"></div></div>';
+      result.innerHTML = html;
+
+      history.replaceState(null, '', '?user_id=' + encodeURIComponent(userId));
+      loadEvents(1);
+    }
+
+    (function init() {
+      const input = document.getElementById('userId');
+      document.getElementById('searchForm').addEventListener('submit', function (e) {
+        e.preventDefault();
+        const v = input.value.trim();
+        if (v) search(v);
+      });
+
+      const initial = new URLSearchParams(location.search).get('user_id');
+      if (initial) {
+        input.value = initial;
+        search(initial);
+      }
+    })();
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/stats"
+)
+
+// VersionPageHandler renders the version adoption page.
+func VersionPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(versionHTMLTemplate))
+	}
+}
+
+// VersionAdoptionHandler returns per-version adoption curves and upgrade paths.
+//
+// Query: from, to (YYYY-MM-DD, default last 30 days), threshold (percent, default 50), f filters.
+func VersionAdoptionHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start, days, err := parseDateRange(c, 30, 366)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter, err := parseFilter(c, db)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		threshold, err := strconv.ParseFloat(c.DefaultQuery("threshold", "50"), 64)
+		if err != nil || threshold <= 0 || threshold > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be a percentage in (0, 100]"})
+			return
+		}
+
+		rep, err := stats.GetVersionAdoption(db, start, days, threshold/100, filter)
+		if err != nil {
+			logging.FromContext(c).Error("version adoption query failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, rep)
+	}
+}
+
+// versionHTMLTemplate is the HTML template for the version adoption page.
+const versionHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>版本采用</title>
+  <script src="https://cdn.jsdelivr.net/npm/chart.js"></script>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    .chart-container { width: 100%; max-width: 900px; margin-bottom: 40px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 14px; }
+    th { background: #f5f5f5; }
+    .down { color: #c00; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>版本采用</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="queryForm" style="margin-bottom: 16px;">
+    <label>开始日期：<input type="date" name="from"></label>
+    <label>结束日期：<input type="date" name="to"></label>
+    <label>达标占比（%）：<input type="number" name="threshold" value="50" min="1" max="100" style="width: 60px;"></label>
+    <button type="submit">查询</button>
+  </form>
+
+  <div id="status"></div>
+  <div class="chart-container">
+    <canvas id="adoptionChart"></canvas>
+  </div>
+  <div id="versions"></div>
+  <div id="upgrades"></div>
+
+  <script>
+    // 图表中最多单独展示的版本数，其余合并为“其它”
+    const MAX_SERIES = 8;
+    const COLORS = [
+      'rgba(54, 162, 235, 0.6)', 'rgba(255, 99, 132, 0.6)', 'rgba(255, 206, 86, 0.6)',
+      'rgba(75, 192, 192, 0.6)', 'rgba(153, 102, 255, 0.6)', 'rgba(255, 159, 64, 0.6)',
+      'rgba(46, 204, 113, 0.6)', 'rgba(52, 73, 94, 0.6)', 'rgba(201, 203, 207, 0.6)'
+    ];
+    let chartInstance = null;
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function pct(v) {
+      return (v * 100).toFixed(1) + '%';
+    }
+
+    function render(data) {
+      // 版本已在服务端按语义化版本从新到旧排序
+      const versions = data.versions || [];
+      const shown = versions.slice(0, MAX_SERIES);
+      const rest = versions.slice(MAX_SERIES);
+      const datasets = shown.map((v, i) => ({
+        label: v.version || '未知',
+        data: v.share.map(s => +(s * 100).toFixed(2)),
+        backgroundColor: COLORS[i % COLORS.length],
+        borderColor: COLORS[i % COLORS.length].replace('0.6', '1'),
+        fill: true,
+        pointRadius: 0
+      }));
+      if (rest.length > 0) {
+        datasets.push({
+          label: '其它',
+          data: data.days.map((_, i) => +(rest.reduce((sum, v) => sum + v.share[i], 0) * 100).toFixed(2)),
+          backgroundColor: COLORS[COLORS.length - 1],
+          fill: true,
+          pointRadius: 0
+        });
+      }
+
+      if (chartInstance) chartInstance.destroy();
+      const ctx = document.getElementById('adoptionChart').getContext('2d');
+      chartInstance = new Chart(ctx, {
+        type: 'line',
+        data: { labels: data.days, datasets },
+        options: {
+          responsive: true,
+          plugins: { title: { display: true, text: '各版本占日活比例（%）' } },
+          scales: { y: { stacked: true, beginAtZero: true, max: 100 } }
+        }
+      });
+
+      let html = '<h3>版本列表</h3><table><tr><th>版本</th><th>首次出现</th><th>最新占比</th><th>达到 ' +
+        (data.threshold * 100) + '% 用时（天）</th></tr>';
+      for (const v of versions) {
+        html += '<tr><td>' + esc(v.version || '未知') + '</td><td>' + esc(new Date(v.first_seen).toISOString().slice(0, 10)) +
+          '</td><td>' + pct(v.share[v.share.length - 1] || 0) + '</td><td>' +
+          (v.days_to_threshold == null ? '-' : v.days_to_threshold) + '</td></tr>';
+      }
+      document.getElementById('versions').innerHTML = html + '</table>';
+
+      html = '<h3>升级路径</h3><table><tr><th>从</th><th>到</th><th>用户数</th></tr>';
+      for (const u of data.upgrades || []) {
+        html += '<tr' + (u.downgrade ? ' class="down" title="降级"' : '') + '><td>' + esc(u.from) + '</td><td>' +
+          esc(u.to) + '</td><td>' + u.users + '</td></tr>';
+      }
+      document.getElementById('upgrades').innerHTML = html + '</table>';
+    }
+
+    async function load() {
+      const status = document.getElementById('status');
+      status.textContent = '加载中...';
+      const resp = await fetch('/admin/api/versions/adoption' + location.search);
+      const data = await resp.json();
+      if (!resp.ok) {
+        status.innerHTML = '<p class="error">' + esc(data.error) + '</p>';
+        return;
+      }
+      status.textContent = '';
+      render(data);
+    }
+
+    (function init() {
+      const form = document.getElementById('queryForm');
+      const params = new URLSearchParams(location.search);
+      for (const [k, v] of params) {
+        if (form.elements[k]) form.elements[k].value = v;
+      }
+      form.addEventListener('submit', function (e) {
+        e.preventDefault();
+        const p = new URLSearchParams(location.search);
+        for (const [k, v] of new FormData(form)) {
+          if (v) p.set(k, v); else p.delete(k);
+        }
+        history.replaceState(null, '', '?' + p.toString());
+        load();
+      });
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
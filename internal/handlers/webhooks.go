@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"appstats/internal/logging"
+	"appstats/internal/models"
+	"appstats/internal/webhooks"
+)
+
+// WebhookPageHandler renders the webhook endpoints and delivery log page.
+func WebhookPageHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(webhookHTMLTemplate))
+	}
+}
+
+// WebhookEndpointRequest is the payload of the webhook endpoint API. The
+// signing secret is write-only.
+type WebhookEndpointRequest struct {
+	models.WebhookEndpoint
+	Secret string `json:"secret"`
+}
+
+// WebhookEndpointView is a webhook endpoint as returned by the API. Secret
+// is only set in the response to creating it, so that a generated secret
+// can be copied once; otherwise only SecretHint, the masked secret, is.
+type WebhookEndpointView struct {
+	models.WebhookEndpoint
+	Secret     string `json:"secret,omitempty"`
+	SecretHint string `json:"secret_hint"`
+}
+
+func webhookEndpointView(ep models.WebhookEndpoint) WebhookEndpointView {
+	return WebhookEndpointView{WebhookEndpoint: ep, SecretHint: maskSecret(ep.Secret)}
+}
+
+// maskSecret returns the last four characters of secret, enough to tell
+// secrets apart.
+func maskSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+// ListWebhookEndpointsHandler lists all webhook endpoints and the events
+// they can subscribe to.
+func ListWebhookEndpointsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var eps []models.WebhookEndpoint
+		if err := db.Order("id").Find(&eps).Error; err != nil {
+			logging.FromContext(c).Error("list webhook endpoints failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		views := make([]WebhookEndpointView, 0, len(eps))
+		for _, ep := range eps {
+			views = append(views, webhookEndpointView(ep))
+		}
+		c.JSON(http.StatusOK, gin.H{"endpoints": views, "events": webhooks.Events})
+	}
+}
+
+// CreateWebhookEndpointHandler creates a webhook endpoint. A signing secret
+// is generated when none is given; the response is the only one to include
+// it.
+func CreateWebhookEndpointHandler(db *gorm.DB, hooks *webhooks.Dispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req WebhookEndpointRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ep := req.WebhookEndpoint
+		ep.ID = 0
+		ep.Secret = req.Secret
+		if err := webhooks.Validate(&ep); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Create(&ep).Error; err != nil {
+			logging.FromContext(c).Error("create webhook endpoint failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create endpoint"})
+			return
+		}
+		hooks.Invalidate()
+		view := webhookEndpointView(ep)
+		view.Secret = ep.Secret
+		c.JSON(http.StatusCreated, view)
+	}
+}
+
+// UpdateWebhookEndpointHandler replaces the configuration of an endpoint.
+// An empty secret keeps the current one.
+func UpdateWebhookEndpointHandler(db *gorm.DB, hooks *webhooks.Dispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		existing, ok := loadWebhookEndpoint(c, db)
+		if !ok {
+			return
+		}
+		var req WebhookEndpointRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ep := req.WebhookEndpoint
+		ep.ID = existing.ID
+		ep.CreatedAt = existing.CreatedAt
+		ep.Secret = req.Secret
+		if ep.Secret == "" {
+			ep.Secret = existing.Secret
+		}
+		if err := webhooks.Validate(&ep); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := db.Save(&ep).Error; err != nil {
+			logging.FromContext(c).Error("update webhook endpoint failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update endpoint"})
+			return
+		}
+		hooks.Invalidate()
+		c.JSON(http.StatusOK, webhookEndpointView(ep))
+	}
+}
+
+// DeleteWebhookEndpointHandler deletes an endpoint. Its delivery log is
+// kept; pending deliveries fail on their next attempt.
+func DeleteWebhookEndpointHandler(db *gorm.DB, hooks *webhooks.Dispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ep, ok := loadWebhookEndpoint(c, db)
+		if !ok {
+			return
+		}
+		if err := db.Delete(ep).Error; err != nil {
+			logging.FromContext(c).Error("delete webhook endpoint failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete endpoint"})
+			return
+		}
+		hooks.Invalidate()
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// ListWebhookDeliveriesHandler returns the latest deliveries, optionally
+// filtered by endpoint_id, status and event.
+func ListWebhookDeliveriesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q := db.Order("id DESC").Limit(200)
+		if v := c.Query("endpoint_id"); v != "" {
+			q = q.Where("endpoint_id = ?", v)
+		}
+		if v := c.Query("status"); v != "" {
+			q = q.Where("status = ?", v)
+		}
+		if v := c.Query("event"); v != "" {
+			q = q.Where("event = ?", v)
+		}
+		var deliveries []models.WebhookDelivery
+		if err := q.Find(&deliveries).Error; err != nil {
+			logging.FromContext(c).Error("list webhook deliveries failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+	}
+}
+
+// ReplayWebhookDeliveryHandler queues a new delivery with the payload of an
+// earlier one.
+func ReplayWebhookDeliveryHandler(hooks *webhooks.Dispatcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+			return
+		}
+		replay, err := hooks.Replay(uint(id))
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "delivery not found"})
+				return
+			}
+			logging.FromContext(c).Error("replay webhook delivery failed", slog.Any("error", err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to replay delivery"})
+			return
+		}
+		c.JSON(http.StatusCreated, replay)
+	}
+}
+
+// loadWebhookEndpoint fetches the endpoint named by the :id parameter,
+// writing an error response and returning false when it cannot.
+func loadWebhookEndpoint(c *gin.Context, db *gorm.DB) (*models.WebhookEndpoint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return nil, false
+	}
+	var ep models.WebhookEndpoint
+	if err := db.First(&ep, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "endpoint not found"})
+			return nil, false
+		}
+		logging.FromContext(c).Error("load webhook endpoint failed", slog.Any("error", err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db error"})
+		return nil, false
+	}
+	return &ep, true
+}
+
+// webhookHTMLTemplate is the HTML template for the webhooks page.
+const webhookHTMLTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+  <meta charset="UTF-8">
+  <title>Webhook</title>
+  <style>
+    body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; padding: 20px; }
+    form { display: flex; flex-wrap: wrap; gap: 8px 16px; max-width: 1100px; margin-bottom: 16px; }
+    table { border-collapse: collapse; margin-bottom: 24px; }
+    th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 13px; }
+    th { background: #f5f5f5; }
+    pre { margin: 0; max-width: 480px; max-height: 120px; overflow: auto; font-size: 12px; white-space: pre-wrap; word-break: break-all; }
+    .failed { color: #c00; font-weight: bold; }
+    .succeeded { color: #080; }
+    .error { color: #c00; }
+  </style>
+</head>
+<body>
+  <h2>Webhook</h2>
+  <p><a href="/admin">返回统计</a></p>
+
+  <form id="endpointForm">
+    <input type="hidden" name="id">
+    <label>名称：<input type="text" name="name" required></label>
+    <label>URL：<input type="text" name="url" size="40" required></label>
+    <label>签名密钥：<input type="text" name="secret" size="28" placeholder="留空自动生成/保持不变"></label>
+    <span id="eventBoxes"></span>
+    <label><input type="checkbox" name="enabled" checked> 启用</label>
+    <button type="submit" id="saveBtn">添加</button>
+    <button type="button" id="cancelBtn" style="display: none;">取消编辑</button>
+  </form>
+
+  <div id="status"></div>
+  <h3>端点</h3>
+  <table>
+    <thead>
+      <tr><th>名称</th><th>URL</th><th>事件</th><th>密钥</th><th>操作</th></tr>
+    </thead>
+    <tbody id="endpoints"></tbody>
+  </table>
+
+  <h3>投递记录</h3>
+  <p>
+    <label>状态：
+      <select id="statusFilter">
+        <option value="">全部</option>
+        <option value="pending">pending</option>
+        <option value="succeeded">succeeded</option>
+        <option value="failed">failed</option>
+      </select>
+    </label>
+    <button type="button" id="refreshBtn">刷新</button>
+  </p>
+  <table>
+    <thead>
+      <tr><th>ID</th><th>时间</th><th>端点</th><th>事件</th><th>状态</th><th>尝试次数</th><th>响应码</th><th>下次重试</th><th>错误</th><th>内容</th><th>操作</th></tr>
+    </thead>
+    <tbody id="deliveries"></tbody>
+  </table>
+
+  <script>
+    let endpoints = [];
+
+    function esc(s) {
+      return String(s == null ? '' : s).replace(/[&<>"']/g, ch => ({
+        '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'
+      })[ch]);
+    }
+
+    function showError(msg) {
+      document.getElementById('status').innerHTML = msg ? '<p class="error">' + esc(msg) + '</p>' : '';
+    }
+
+    function fmtTime(t) {
+      return t ? new Date(t).toLocaleString() : '-';
+    }
+
+    async function api(method, url, body) {
+      const resp = await fetch(url, {
+        method,
+        headers: body ? { 'Content-Type': 'application/json' } : {},
+        body: body ? JSON.stringify(body) : undefined
+      });
+      const data = await resp.json();
+      if (!resp.ok) throw new Error(data.error || resp.statusText);
+      return data;
+    }
+
+    async function loadEndpoints() {
+      const data = await api('GET', '/admin/api/webhooks/endpoints');
+      endpoints = data.endpoints || [];
+      const boxes = document.getElementById('eventBoxes');
+      if (!boxes.innerHTML) {
+        boxes.innerHTML = (data.events || []).map(e =>
+          '<label><input type="checkbox" name="events" value="' + esc(e) + '"> ' + esc(e) + '</label> '
+        ).join('');
+      }
+      document.getElementById('endpoints').innerHTML = endpoints.map(ep =>
+        '<tr><td>' + esc(ep.name) + (ep.enabled ? '' : '（停用）') + '</td><td>' + esc(ep.url) + '</td><td>' +
+        esc((ep.events || []).join(', ')) + '</td><td><code>' + esc(ep.secret_hint) + '</code></td><td>' +
+        '<button onclick="edit(' + ep.id + ')">编辑</button> <button onclick="removeEndpoint(' + ep.id + ')">删除</button></td></tr>'
+      ).join('');
+    }
+
+    async function loadDeliveries() {
+      const status = document.getElementById('statusFilter').value;
+      const data = await api('GET', '/admin/api/webhooks/deliveries' + (status ? '?status=' + status : ''));
+      const names = {};
+      endpoints.forEach(ep => { names[ep.id] = ep.name; });
+      document.getElementById('deliveries').innerHTML = (data.deliveries || []).map(d =>
+        '<tr><td>' + d.id + (d.replay_of ? '（重放 #' + d.replay_of + '）' : '') + '</td><td>' + esc(fmtTime(d.created_at)) +
+        '</td><td>' + esc(names[d.endpoint_id] || ('#' + d.endpoint_id)) + '</td><td>' + esc(d.event) + '</td><td class="' +
+        esc(d.status) + '">' + esc(d.status) + '</td><td>' + d.attempts + '</td><td>' + (d.response_status || '-') +
+        '</td><td>' + esc(fmtTime(d.next_attempt_at)) + '</td><td>' + esc(d.last_error) + '</td><td><pre>' +
+        esc(d.payload) + '</pre></td><td><button onclick="replay(' + d.id + ')">重放</button></td></tr>'
+      ).join('');
+    }
+
+    async function load() {
+      try {
+        await loadEndpoints();
+        await loadDeliveries();
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    function formToEndpoint(form) {
+      return {
+        name: form.elements.name.value.trim(),
+        url: form.elements.url.value.trim(),
+        secret: form.elements.secret.value.trim(),
+        events: Array.from(form.querySelectorAll('input[name=events]:checked')).map(el => el.value),
+        enabled: form.elements.enabled.checked
+      };
+    }
+
+    function edit(id) {
+      const ep = endpoints.find(x => x.id === id);
+      if (!ep) return;
+      const form = document.getElementById('endpointForm');
+      form.elements.id.value = ep.id;
+      form.elements.name.value = ep.name;
+      form.elements.url.value = ep.url;
+      form.elements.secret.value = '';
+      form.elements.enabled.checked = ep.enabled;
+      form.querySelectorAll('input[name=events]').forEach(el => { el.checked = (ep.events || []).includes(el.value); });
+      document.getElementById('saveBtn').textContent = '保存';
+      document.getElementById('cancelBtn').style.display = '';
+    }
+
+    function resetForm() {
+      const form = document.getElementById('endpointForm');
+      form.reset();
+      form.elements.id.value = '';
+      document.getElementById('saveBtn').textContent = '添加';
+      document.getElementById('cancelBtn').style.display = 'none';
+    }
+
+    async function removeEndpoint(id) {
+      if (!confirm('确定删除该端点？')) return;
+      try {
+        await api('DELETE', '/admin/api/webhooks/endpoints/' + id);
+        load();
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    async function replay(id) {
+      try {
+        await api('POST', '/admin/api/webhooks/deliveries/' + id + '/replay');
+        showError('');
+        loadDeliveries();
+      } catch (err) {
+        showError(err.message);
+      }
+    }
+
+    (function init() {
+      const form = document.getElementById('endpointForm');
+      form.addEventListener('submit', async function (e) {
+        e.preventDefault();
+        const id = form.elements.id.value;
+        try {
+          const ep = await api(id ? 'PUT' : 'POST', '/admin/api/webhooks/endpoints' + (id ? '/' + id : ''), formToEndpoint(form));
+          showError('');
+          if (ep.secret) {
+            document.getElementById('status').innerHTML = '<p>签名密钥（只显示这一次，请妥善保存）：<code>' + esc(ep.secret) + '</code></p>';
+          }
+          resetForm();
+          load();
+        } catch (err) {
+          showError(err.message);
+        }
+      });
+      document.getElementById('cancelBtn').addEventListener('click', resetForm);
+      document.getElementById('refreshBtn').addEventListener('click', () => loadDeliveries().catch(err => showError(err.message)));
+      document.getElementById('statusFilter').addEventListener('change', () => loadDeliveries().catch(err => showError(err.message)));
+      load();
+    })();
+  </script>
+</body>
+</html>
+`
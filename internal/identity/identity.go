@@ -0,0 +1,264 @@
+package identity
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/rollups"
+)
+
+// maxCacheEntries bounds the resolution cache; it is simply cleared when
+// full, as most lookups are for identifiers without aliases.
+const maxCacheEntries = 100000
+
+var (
+	// ErrSameID is returned when an identifier is linked to itself.
+	ErrSameID = errors.New("alias and user id must differ")
+	// ErrAlreadyLinked is returned when the alias already belongs to
+	// another user.
+	ErrAlreadyLinked = errors.New("alias is already linked to another user")
+)
+
+// Resolver maps reported identifiers to canonical user IDs through the
+// user_aliases table and merges identifiers when they are linked.
+type Resolver struct {
+	db *gorm.DB
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// NewResolver returns a resolver backed by db.
+func NewResolver(db *gorm.DB) *Resolver {
+	return &Resolver{db: db, cache: make(map[string]string)}
+}
+
+// Resolve returns the canonical user ID of id, which is id itself when it
+// is not an alias.
+func (r *Resolver) Resolve(id string) (string, error) {
+	r.mu.Lock()
+	canonical, ok := r.cache[id]
+	r.mu.Unlock()
+	if ok {
+		return canonical, nil
+	}
+
+	var aliases []models.UserAlias
+	if err := r.db.Where("alias_id = ?", id).Limit(1).Find(&aliases).Error; err != nil {
+		return "", err
+	}
+	canonical = id
+	if len(aliases) > 0 {
+		canonical = aliases[0].UserID
+	}
+
+	r.mu.Lock()
+	if len(r.cache) >= maxCacheEntries {
+		clear(r.cache)
+	}
+	r.cache[id] = canonical
+	r.mu.Unlock()
+	return canonical, nil
+}
+
+// LinkResult describes the outcome of Link.
+type LinkResult struct {
+	UserID  string `json:"user_id"`
+	AliasID string `json:"alias_id"`
+	// Created is false when the identifiers were already linked.
+	Created bool `json:"created"`
+	// MergedEvents is the number of events reattributed to UserID.
+	MergedEvents int64      `json:"merged_events"`
+	FirstSeen    *time.Time `json:"first_seen"`
+}
+
+// Link makes aliasID an alias of userID (or of the user userID itself
+// belongs to). Events already reported under aliasID are reattributed and
+// both user records are merged, keeping the earlier first_seen, so the
+// person is counted as one new user; the rollups of the days this changes
+// are marked stale. Properties of the user win over those of the alias.
+func (r *Resolver) Link(aliasID, userID string) (*LinkResult, error) {
+	if aliasID == userID {
+		return nil, ErrSameID
+	}
+	res := &LinkResult{AliasID: aliasID}
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		canonical, err := lookup(tx, userID)
+		if err != nil {
+			return err
+		}
+		res.UserID = canonical
+		if canonical == aliasID {
+			// userID is already an alias of aliasID.
+			return nil
+		}
+
+		existing, err := lookup(tx, aliasID)
+		if err != nil {
+			return err
+		}
+		if existing != aliasID {
+			if existing == canonical {
+				return nil
+			}
+			return ErrAlreadyLinked
+		}
+
+		if err := tx.Create(&models.UserAlias{AliasID: aliasID, UserID: canonical}).Error; err != nil {
+			return err
+		}
+		res.Created = true
+		// Collected before the merge changes them.
+		days, err := affectedDays(tx, aliasID, canonical)
+		if err != nil {
+			return err
+		}
+		// Keep aliases flat: whatever pointed at aliasID now points at canonical.
+		if err := tx.Model(&models.UserAlias{}).Where("user_id = ?", aliasID).
+			Update("user_id", canonical).Error; err != nil {
+			return err
+		}
+		upd := tx.Model(&models.UserEvent{}).Where("user_id = ?", aliasID).Update("user_id", canonical)
+		if upd.Error != nil {
+			return upd.Error
+		}
+		res.MergedEvents = upd.RowsAffected
+
+		if res.FirstSeen, err = mergeUsers(tx, aliasID, canonical); err != nil {
+			return err
+		}
+		if err := mergeProperties(tx, aliasID, canonical); err != nil {
+			return err
+		}
+		// The materializer recomputes the stale days on its next run.
+		return rollups.Invalidate(tx, days)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Created {
+		r.Invalidate()
+	}
+	return res, nil
+}
+
+// Invalidate drops cached resolutions, e.g. after aliases were deleted.
+func (r *Resolver) Invalidate() {
+	r.mu.Lock()
+	clear(r.cache)
+	r.mu.Unlock()
+}
+
+// Aliases returns the identifiers linked to the canonical userID.
+func (r *Resolver) Aliases(userID string) ([]string, error) {
+	var ids []string
+	err := r.db.Model(&models.UserAlias{}).Where("user_id = ?", userID).Order("id").Pluck("alias_id", &ids).Error
+	return ids, err
+}
+
+func lookup(tx *gorm.DB, id string) (string, error) {
+	var aliases []models.UserAlias
+	if err := tx.Where("alias_id = ?", id).Limit(1).Find(&aliases).Error; err != nil {
+		return "", err
+	}
+	if len(aliases) > 0 {
+		return aliases[0].UserID, nil
+	}
+	return id, nil
+}
+
+// affectedDays returns the days whose rollups change when aliasID is merged
+// into canonical: the days aliasID has events on, whose users are counted
+// again, and the first_seen days of both users, which new users move
+// between.
+func affectedDays(tx *gorm.DB, aliasID, canonical string) ([]time.Time, error) {
+	var days []time.Time
+	if err := tx.Model(&models.UserEvent{}).Where("user_id = ?", aliasID).Distinct().
+		Pluck("DATE(event_time)", &days).Error; err != nil {
+		return nil, err
+	}
+	var firstSeen []time.Time
+	if err := tx.Model(&models.User{}).Where("user_id IN ?", []string{aliasID, canonical}).
+		Pluck("first_seen", &firstSeen).Error; err != nil {
+		return nil, err
+	}
+	return append(days, firstSeen...), nil
+}
+
+// mergeUsers folds the user record of aliasID into that of canonical and
+// returns the resulting first_seen, or nil when neither exists.
+func mergeUsers(tx *gorm.DB, aliasID, canonical string) (*time.Time, error) {
+	find := func(id string) (*models.User, error) {
+		var users []models.User
+		if err := tx.Where("user_id = ?", id).Limit(1).Find(&users).Error; err != nil || len(users) == 0 {
+			return nil, err
+		}
+		return &users[0], nil
+	}
+	alias, err := find(aliasID)
+	if err != nil {
+		return nil, err
+	}
+	user, err := find(canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case alias == nil && user == nil:
+		return nil, nil
+	case alias == nil:
+		return &user.FirstSeen, nil
+	case user == nil:
+		// Only the alias was seen so far: it becomes the canonical user.
+		if err := tx.Model(alias).Update("user_id", canonical).Error; err != nil {
+			return nil, err
+		}
+		return &alias.FirstSeen, nil
+	}
+
+	updates := map[string]any{}
+	if alias.FirstSeen.Before(user.FirstSeen) {
+		updates["first_seen"] = alias.FirstSeen
+		user.FirstSeen = alias.FirstSeen
+	}
+	if user.Platform == "" && alias.Platform != "" {
+		updates["platform"] = alias.Platform
+	}
+	if user.Region == "" && alias.Region != "" {
+		updates["region"] = alias.Region
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Delete(alias).Error; err != nil {
+		return nil, err
+	}
+	return &user.FirstSeen, nil
+}
+
+// mergeProperties moves the properties and property history of aliasID to
+// canonical. Properties canonical already has are kept.
+func mergeProperties(tx *gorm.DB, aliasID, canonical string) error {
+	// The derived table lets MySQL read the table being updated.
+	if err := tx.Exec(`
+        UPDATE user_properties SET user_id = ?
+        WHERE user_id = ? AND name NOT IN (
+            SELECT name FROM (SELECT name FROM user_properties WHERE user_id = ?) AS existing
+        )
+    `, canonical, aliasID, canonical).Error; err != nil {
+		return err
+	}
+	if err := tx.Where("user_id = ?", aliasID).Delete(&models.UserProperty{}).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.UserPropertyChange{}).Where("user_id = ?", aliasID).
+		Update("user_id", canonical).Error
+}
@@ -0,0 +1,112 @@
+package identity
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestLink(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.UserAlias{}, &models.UserEvent{},
+		&models.UserProperty{}, &models.UserPropertyChange{}, &models.RollupDay{})
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	// The device was seen on March 1, the account on March 4.
+	db.Create(&models.User{UserID: "device", FirstSeen: day(1), Platform: "ios"})
+	db.Create(&models.User{UserID: "account", FirstSeen: day(4)})
+	db.Create(&models.UserEvent{UserID: "device", EventTime: day(1).Add(time.Hour)})
+	db.Create(&models.UserEvent{UserID: "device", EventTime: day(2).Add(time.Hour)})
+	db.Create(&models.UserEvent{UserID: "account", EventTime: day(4).Add(time.Hour)})
+	db.Create(&models.UserProperty{UserID: "device", Name: "plan", Value: "free"})
+	db.Create(&models.UserProperty{UserID: "device", Name: "theme", Value: "dark"})
+	db.Create(&models.UserProperty{UserID: "account", Name: "plan", Value: "pro"})
+	for d := 1; d <= 5; d++ {
+		db.Exec("INSERT INTO rollup_days (day, stale, materialized_at) VALUES (?, ?, ?)", day(d).Format("2006-01-02"), false, day(6))
+	}
+
+	r := NewResolver(db)
+	if got, _ := r.Resolve("device"); got != "device" {
+		t.Fatalf("Resolve before Link = %q", got)
+	}
+	res, err := r.Link("device", "account")
+	if err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if !res.Created || res.UserID != "account" || res.MergedEvents != 2 || res.FirstSeen == nil || !res.FirstSeen.Equal(day(1)) {
+		t.Errorf("Link = %+v", res)
+	}
+	// The cached resolution is dropped.
+	if got, _ := r.Resolve("device"); got != "account" {
+		t.Errorf("Resolve after Link = %q, want account", got)
+	}
+
+	var users []models.User
+	db.Order("id").Find(&users)
+	if len(users) != 1 || users[0].UserID != "account" || !users[0].FirstSeen.Equal(day(1)) || users[0].Platform != "ios" {
+		t.Errorf("users after Link = %+v, want one account first seen on March 1", users)
+	}
+	var events int64
+	db.Model(&models.UserEvent{}).Where("user_id = ?", "account").Count(&events)
+	if events != 3 {
+		t.Errorf("account has %d events, want 3", events)
+	}
+	props := map[string]string{}
+	var rows []models.UserProperty
+	db.Find(&rows)
+	for _, p := range rows {
+		props[p.UserID+"."+p.Name] = p.Value
+	}
+	if len(props) != 2 || props["account.plan"] != "pro" || props["account.theme"] != "dark" {
+		t.Errorf("properties after Link = %v", props)
+	}
+	// The days of the device's events and both first_seen days are stale.
+	var stale []time.Time
+	db.Raw("SELECT day FROM rollup_days WHERE stale ORDER BY day").Scan(&stale)
+	if want := []time.Time{day(1), day(2), day(4)}; !slices.EqualFunc(stale, want, time.Time.Equal) {
+		t.Errorf("stale days %v, want %v", stale, want)
+	}
+
+	// Linking again changes nothing.
+	if res, err := r.Link("device", "account"); err != nil || res.Created {
+		t.Errorf("second Link = %+v, %v", res, err)
+	}
+	if _, err := r.Link("device", "other"); !errors.Is(err, ErrAlreadyLinked) {
+		t.Errorf("Link to another user: err = %v, want ErrAlreadyLinked", err)
+	}
+	if _, err := r.Link("account", "account"); !errors.Is(err, ErrSameID) {
+		t.Errorf("Link to itself: err = %v, want ErrSameID", err)
+	}
+}
+
+func TestLinkChained(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.UserAlias{}, &models.UserEvent{},
+		&models.UserProperty{}, &models.UserPropertyChange{}, &models.RollupDay{})
+	r := NewResolver(db)
+	// device → account, then account → person: aliases stay flat.
+	for _, l := range [][2]string{{"device", "account"}, {"account", "person"}} {
+		if _, err := r.Link(l[0], l[1]); err != nil {
+			t.Fatalf("Link(%s, %s): %v", l[0], l[1], err)
+		}
+	}
+	for _, id := range []string{"device", "account", "person"} {
+		if got, err := r.Resolve(id); err != nil || got != "person" {
+			t.Errorf("Resolve(%s) = %q, %v, want person", id, got, err)
+		}
+	}
+	// Linking to an alias links to the user it belongs to.
+	res, err := r.Link("tablet", "device")
+	if err != nil || res.UserID != "person" {
+		t.Errorf("Link to an alias = %+v, %v, want user person", res, err)
+	}
+	// The reverse of an existing link is a no-op.
+	if res, err := r.Link("person", "device"); err != nil || res.Created {
+		t.Errorf("reverse Link = %+v, %v", res, err)
+	}
+	aliases, err := r.Aliases("person")
+	if err != nil || !slices.Equal(aliases, []string{"device", "account", "tablet"}) {
+		t.Errorf("Aliases = %v, %v", aliases, err)
+	}
+}
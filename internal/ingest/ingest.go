@@ -0,0 +1,126 @@
+package ingest
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"appstats/internal/metrics"
+)
+
+// ratioSlack is how many bytes a body may decompress to before MaxRatio is
+// enforced, as small bodies compress unusually well.
+const ratioSlack = 1 << 20
+
+// ErrBodyTooLarge is returned when reading a request body beyond the limits.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// Limits bound the request bodies of the ingestion endpoints.
+type Limits struct {
+	// MaxBytes bounds the size of a body after decompression; 0 disables
+	// the bound.
+	MaxBytes int64
+	// MaxRatio bounds how many times larger than the compressed body the
+	// decompressed body may grow; 0 disables the bound.
+	MaxRatio int64
+}
+
+// Decompress transparently decompresses request bodies sent with
+// Content-Encoding gzip or deflate and enforces l on every body, so that
+// handlers reading it get ErrBodyTooLarge instead of exhausting memory on a
+// decompression bomb. Other encodings are answered with 415.
+func Decompress(l Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body := c.Request.Body
+		if body == nil || body == http.NoBody {
+			c.Next()
+			return
+		}
+		raw := &countingReader{r: body}
+		var r io.Reader
+		var err error
+		switch enc := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))); enc {
+		case "", "identity":
+			c.Request.Body = &limitedBody{r: body, body: body, max: l.MaxBytes}
+			c.Next()
+			return
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(raw)
+		case "deflate":
+			r, err = newDeflateReader(raw)
+		default:
+			metrics.RecordRejected(metrics.ReasonInvalidPayload, metrics.PlatformLabel(""))
+			c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "unsupported Content-Encoding " + enc})
+			return
+		}
+		if err != nil {
+			metrics.RecordRejected(metrics.ReasonInvalidPayload, metrics.PlatformLabel(""))
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid compressed body: " + err.Error()})
+			return
+		}
+		c.Request.Body = &limitedBody{r: r, body: body, max: l.MaxBytes, ratio: l.MaxRatio, raw: raw}
+		c.Request.Header.Del("Content-Encoding")
+		c.Request.ContentLength = -1
+		c.Next()
+	}
+}
+
+// newDeflateReader reads a deflate body. HTTP's deflate is zlib-wrapped, but
+// some clients send raw deflate data, so the zlib header is checked first.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if hdr, err := br.Peek(2); err == nil && hdr[0]&0x0f == 8 && (uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// limitedBody reads a request body through r and fails with ErrBodyTooLarge
+// once more than max bytes were read or, with raw set, the bytes read exceed
+// ratio times the compressed bytes.
+type limitedBody struct {
+	r     io.Reader
+	body  io.Closer
+	max   int64
+	ratio int64
+	raw   *countingReader
+	n     int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.max > 0 && b.n > b.max {
+		return 0, ErrBodyTooLarge
+	}
+	if b.raw != nil && b.ratio > 0 && b.n > ratioSlack && b.n > b.ratio*b.raw.n {
+		return 0, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	if c, ok := b.r.(io.Closer); ok && b.raw != nil {
+		c.Close()
+	}
+	return b.body.Close()
+}
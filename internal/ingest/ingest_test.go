@@ -0,0 +1,124 @@
+package ingest
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func compress(t *testing.T, enc string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "flate":
+		w, _ = flate.NewWriter(&buf, flate.BestCompression)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Decompress(Limits{MaxBytes: 4 << 20, MaxRatio: 100}))
+	// The handler answers with the body it read, or 413.
+	r.POST("/", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if errors.Is(err, ErrBodyTooLarge) {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		c.String(http.StatusOK, "%d %s", len(body), c.GetHeader("Content-Encoding"))
+	})
+
+	small := []byte(`{"user_id":"u1","event_type":"launch"}`)
+	// Zeros compress about a thousand times, beyond MaxRatio once past
+	// the slack.
+	bomb := make([]byte, 3<<20)
+	// Random data does not compress, so only MaxBytes stops it.
+	large := make([]byte, 5<<20)
+	rand.NewChaCha8([32]byte{1}).Read(large)
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     int
+		wantBody string
+	}{
+		{name: "plain", body: small, want: http.StatusOK, wantBody: strconv.Itoa(len(small)) + " "},
+		{name: "identity", encoding: "identity", body: small, want: http.StatusOK},
+		{name: "plain over max bytes", body: large, want: http.StatusRequestEntityTooLarge},
+		{name: "gzip", encoding: "gzip", body: compress(t, "gzip", small), want: http.StatusOK, wantBody: strconv.Itoa(len(small)) + " "},
+		{name: "x-gzip", encoding: " X-Gzip ", body: compress(t, "gzip", small), want: http.StatusOK},
+		{name: "zlib deflate", encoding: "deflate", body: compress(t, "zlib", small), want: http.StatusOK, wantBody: strconv.Itoa(len(small)) + " "},
+		{name: "raw deflate", encoding: "deflate", body: compress(t, "flate", small), want: http.StatusOK, wantBody: strconv.Itoa(len(small)) + " "},
+		{name: "small bomb within slack", encoding: "gzip", body: compress(t, "gzip", bomb[:1<<20]), want: http.StatusOK},
+		{name: "bomb over ratio", encoding: "gzip", body: compress(t, "gzip", bomb), want: http.StatusRequestEntityTooLarge},
+		{name: "gzip over max bytes", encoding: "gzip", body: compress(t, "gzip", large), want: http.StatusRequestEntityTooLarge},
+		{name: "invalid gzip", encoding: "gzip", body: small, want: http.StatusBadRequest},
+		{name: "unsupported encoding", encoding: "br", body: small, want: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+			continue
+		}
+		if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+			t.Errorf("%s: body %q, want %q", tt.name, w.Body, tt.wantBody)
+		}
+	}
+}
+
+func TestDecompressUnlimited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Decompress(Limits{}))
+	var n int
+	r.POST("/", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		n = len(body)
+	})
+	bomb := make([]byte, 3<<20)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, "gzip", bomb)))
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || n != len(bomb) {
+		t.Errorf("status %d after reading %d bytes, want the whole body without limits", w.Code, n)
+	}
+}
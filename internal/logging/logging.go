@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// RequestIDHeader is read from incoming requests and echoed on responses.
+	RequestIDHeader = "X-Request-ID"
+
+	requestIDKey = "request_id"
+	loggerKey    = "logger"
+)
+
+// New builds a JSON logger writing to stdout at the given level
+// (debug/info/warn/error, defaults to info).
+func New(level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: ParseLevel(level)}))
+}
+
+// ParseLevel converts a textual level into a slog.Level.
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// RequestID assigns every request an ID (reusing a sane client supplied one),
+// exposes it on the response and attaches a request scoped logger to the context.
+func RequestID(base *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = rand.Text()
+		}
+		c.Set(requestIDKey, id)
+		c.Set(loggerKey, base.With(slog.String("request_id", id)))
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// FromContext returns the request scoped logger, or the default logger when
+// the RequestID middleware is not installed.
+func FromContext(c *gin.Context) *slog.Logger {
+	if v, ok := c.Get(loggerKey); ok {
+		if l, ok := v.(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// AccessLog logs one structured line per request. Successful requests on the
+// sampled routes are only logged one out of every sampleEvery times; errors
+// are always logged.
+func AccessLog(sampleEvery int, sampledRoutes ...string) gin.HandlerFunc {
+	sampled := make(map[string]bool, len(sampledRoutes))
+	for _, r := range sampledRoutes {
+		sampled[r] = true
+	}
+	var counter atomic.Uint64
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		route := c.FullPath()
+		if status < http.StatusBadRequest && sampleEvery > 1 && sampled[route] {
+			if counter.Add(1)%uint64(sampleEvery) != 0 {
+				return
+			}
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("bytes", c.Writer.Size()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+		FromContext(c).LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
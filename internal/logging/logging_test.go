@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouter returns a router logging to buf through RequestID and
+// AccessLog, with /ok, /fail and a handler logging on its own at /work.
+func newRouter(buf *bytes.Buffer, sampleEvery int, sampledRoutes ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	base := slog.New(slog.NewJSONHandler(buf, nil))
+	r := gin.New()
+	r.Use(RequestID(base), AccessLog(sampleEvery, sampledRoutes...))
+	r.GET("/ok", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	r.GET("/work", func(c *gin.Context) {
+		FromContext(c).Info("working")
+		c.Status(http.StatusOK)
+	})
+	return r
+}
+
+// records decodes the JSON log lines in buf.
+func records(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		out = append(out, rec)
+	}
+	return out
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "client supplied", header: "req-123", keep: true},
+		{name: "missing"},
+		{name: "too long", header: strings.Repeat("x", 65)},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		r := newRouter(&buf, 1)
+		req := httptest.NewRequest(http.MethodGet, "/work", nil)
+		if tt.header != "" {
+			req.Header.Set(RequestIDHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		id := w.Header().Get(RequestIDHeader)
+		if id == "" || (id == tt.header) != tt.keep {
+			t.Errorf("%s: response request ID %q", tt.name, id)
+		}
+		// Both the handler's line and the access log carry the ID.
+		recs := records(t, &buf)
+		if len(recs) != 2 || recs[0]["msg"] != "working" || recs[1]["msg"] != "request" {
+			t.Fatalf("%s: log = %v", tt.name, recs)
+		}
+		for _, rec := range recs {
+			if rec["request_id"] != id {
+				t.Errorf("%s: %q logged with request ID %v, want %q", tt.name, rec["msg"], rec["request_id"], id)
+			}
+		}
+	}
+}
+
+func TestFromContextWithoutMiddleware(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if FromContext(c) != slog.Default() {
+		t.Error("FromContext without RequestID is not the default logger")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	r := newRouter(&buf, 3, "/ok", "/fail")
+	get := func(path string, n int) {
+		for range n {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+	}
+	// One out of three successful requests on a sampled route is logged,
+	// every error and every request on other routes.
+	get("/ok", 6)
+	get("/fail", 2)
+	get("/work", 1)
+
+	counts := make(map[string]int)
+	for _, rec := range records(t, &buf) {
+		if rec["msg"] != "request" {
+			continue
+		}
+		counts[rec["route"].(string)]++
+		if rec["route"] == "/fail" && rec["level"] != "ERROR" {
+			t.Errorf("server error logged at %v", rec["level"])
+		}
+	}
+	if counts["/ok"] != 2 || counts["/fail"] != 2 || counts["/work"] != 1 {
+		t.Errorf("access log lines by route = %v", counts)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug": slog.LevelDebug, "WARN": slog.LevelWarn, "warning": slog.LevelWarn,
+		"error": slog.LevelError, "info": slog.LevelInfo, "": slog.LevelInfo, "loud": slog.LevelInfo,
+	}
+	for in, want := range tests {
+		if got := ParseLevel(in); got != want {
+			t.Errorf("ParseLevel(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
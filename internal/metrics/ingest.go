@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// ingestWindowMinutes is how much per-minute ingest history is kept in
+// memory for IngestErrorRate.
+const ingestWindowMinutes = 24 * 60
+
+type ingestBucket struct {
+	minute   int64 // unix minute the bucket belongs to
+	accepted int64
+	rejected int64
+}
+
+// ingestHistory keeps per-minute accepted/rejected counts of this process.
+var ingestHistory = struct {
+	sync.Mutex
+	buckets [ingestWindowMinutes]ingestBucket
+}{}
+
+// RecordAccepted counts an accepted event.
+func RecordAccepted(platform string) {
+	EventsAccepted.WithLabelValues(platform).Inc()
+	recordIngest(1, 0)
+}
+
+// RecordRejected counts a rejected event.
+func RecordRejected(reason, platform string) {
+	EventsRejected.WithLabelValues(reason, platform).Inc()
+	recordIngest(0, 1)
+}
+
+func recordIngest(accepted, rejected int64) {
+	minute := time.Now().Unix() / 60
+	ingestHistory.Lock()
+	b := &ingestHistory.buckets[minute%ingestWindowMinutes]
+	if b.minute != minute {
+		*b = ingestBucket{minute: minute}
+	}
+	b.accepted += accepted
+	b.rejected += rejected
+	ingestHistory.Unlock()
+}
+
+// IngestErrorRate returns the share of rejected events over the trailing
+// window (capped at 24h) as seen by this process, and the number of events
+// considered.
+func IngestErrorRate(window time.Duration) (float64, int64) {
+	minutes := int64(window / time.Minute)
+	if minutes > ingestWindowMinutes {
+		minutes = ingestWindowMinutes
+	}
+	now := time.Now().Unix() / 60
+
+	var accepted, rejected int64
+	ingestHistory.Lock()
+	for _, b := range ingestHistory.buckets {
+		if b.minute > now-minutes && b.minute <= now {
+			accepted += b.accepted
+			rejected += b.rejected
+		}
+	}
+	ingestHistory.Unlock()
+
+	total := accepted + rejected
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(rejected) / float64(total), total
+}
@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "appstats"
+
+var (
+	// EventsAccepted counts events written to user_events, by platform.
+	EventsAccepted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_accepted_total",
+		Help:      "Number of reported events accepted and stored.",
+	}, []string{"platform"})
+
+	// EventsRejected counts events that were not stored, by reason and platform.
+	EventsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_rejected_total",
+		Help:      "Number of reported events rejected, by reason.",
+	}, []string{"reason", "platform"})
+
+	// EventsDropped counts valid events that were deliberately not stored,
+	// by reason. They do not count as ingest errors.
+	EventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped_total",
+		Help:      "Number of reported events dropped on purpose, by reason.",
+	}, []string{"reason"})
+
+	// TrafficMatched counts events matched by a traffic rule, by action
+	// (drop or flag) and rule name.
+	TrafficMatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "traffic_rule_matches_total",
+		Help:      "Number of reported events matched by a traffic rule.",
+	}, []string{"action", "rule"})
+
+	// EventTimeAdjusted counts stored events whose client event time was
+	// changed, by adjustment: skew_corrected, clamped_past or clamped_future.
+	EventTimeAdjusted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_time_adjusted_total",
+		Help:      "Number of reported events whose event time was corrected or clamped.",
+	}, []string{"adjustment"})
+
+	// UsersCreated counts users seen for the first time, by platform.
+	UsersCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "users_created_total",
+		Help:      "Number of new users created on first event.",
+	}, []string{"platform"})
+
+	// HTTPDuration observes handler latency per route.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP handler latency in seconds.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// RetentionDeleted counts rows purged by retention policies, by app and
+	// table (events or rollups).
+	RetentionDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_deleted_rows_total",
+		Help:      "Number of rows deleted by retention policies.",
+	}, []string{"app", "table"})
+
+	// RetentionPurgedBefore is the day before which raw events of an app
+	// have been purged, as a Unix timestamp.
+	RetentionPurgedBefore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retention_purged_before_timestamp_seconds",
+		Help:      "Start of the oldest day of raw events kept per app.",
+	}, []string{"app"})
+
+	// RetentionBlocked is 1 while an app has expired raw events that are
+	// kept because their rollups are not materialized or they are not
+	// archived yet.
+	RetentionBlocked = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retention_blocked",
+		Help:      "Whether purging raw events waits for rollups or archiving.",
+	}, []string{"app"})
+
+	// PIIDetected counts reported user IDs that look like personal data, by
+	// kind (email or phone) and the action taken.
+	PIIDetected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pii_user_ids_total",
+		Help:      "Number of reported user IDs that look like an email address or phone number.",
+	}, []string{"kind", "action"})
+
+	// StatsQueryDuration observes the latency of each stats query.
+	StatsQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stats_query_duration_seconds",
+		Help:      "Latency of admin stats queries in seconds.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"query"})
+)
+
+// Rejection reasons used as the "reason" label of EventsRejected.
+const (
+	ReasonInvalidPayload = "invalid_payload"
+	ReasonDBError        = "db_error"
+	ReasonPII            = "pii"
+	ReasonEventTime      = "event_time_out_of_range"
+	ReasonSchema         = "schema_violation"
+	ReasonTooLarge       = "body_too_large"
+)
+
+// Adjustments used as the "adjustment" label of EventTimeAdjusted.
+const (
+	AdjustSkewCorrected = "skew_corrected"
+	AdjustClampedPast   = "clamped_past"
+	AdjustClampedFuture = "clamped_future"
+)
+
+// Drop reasons used as the "reason" label of EventsDropped.
+const (
+	DropOptedOut        = "opted_out"
+	DropInternalTraffic = "internal_traffic"
+)
+
+// knownPlatforms mirrors the platform list of the admin dashboard; anything
+// else is reported as "other" to keep label cardinality bounded.
+var knownPlatforms = map[string]bool{
+	"windows": true, "linux": true, "macos": true, "android": true,
+	"ios": true, "web": true, "harmonyos": true,
+}
+
+// PlatformLabel normalizes a client supplied platform into a bounded label value.
+func PlatformLabel(p string) string {
+	p = strings.ToLower(strings.TrimSpace(p))
+	if p == "" {
+		return "unknown"
+	}
+	if knownPlatforms[p] {
+		return p
+	}
+	return "other"
+}
+
+// RegisterDB exposes connection pool statistics of the given database.
+func RegisterDB(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "appstats"))
+}
+
+// ObserveQuery records the duration of a stats query started at start.
+func ObserveQuery(name string, start time.Time) {
+	StatsQueryDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+}
+
+// Middleware records handler latency for every matched route.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		HTTPDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the Prometheus exposition format.
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
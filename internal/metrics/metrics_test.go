@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sample is one gathered series.
+type sample struct {
+	labels map[string]string
+	value  float64 // of a counter
+	count  uint64  // of a histogram
+}
+
+// gather returns the series of the metric named name in the default
+// registry.
+func gather(t *testing.T, name string) []sample {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		var samples []sample
+		for _, m := range f.GetMetric() {
+			s := sample{labels: make(map[string]string), value: m.GetCounter().GetValue(),
+				count: m.GetHistogram().GetSampleCount()}
+			for _, l := range m.GetLabel() {
+				s.labels[l.GetName()] = l.GetValue()
+			}
+			samples = append(samples, s)
+		}
+		return samples
+	}
+	t.Fatalf("metric %s not registered", name)
+	return nil
+}
+
+// counter returns the value of the series of the counter named name with
+// the given labels.
+func counter(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	for _, s := range gather(t, name) {
+		if maps.Equal(s.labels, labels) {
+			return s.value
+		}
+	}
+	return 0
+}
+
+func TestRegistered(t *testing.T) {
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		observe   func()
+		labels    []string
+	}{
+		{"appstats_events_accepted_total", EventsAccepted, func() { EventsAccepted.WithLabelValues("ios").Inc() },
+			[]string{"platform"}},
+		{"appstats_events_rejected_total", EventsRejected,
+			func() { EventsRejected.WithLabelValues(ReasonSchema, "web").Inc() }, []string{"platform", "reason"}},
+		{"appstats_events_dropped_total", EventsDropped, func() { EventsDropped.WithLabelValues(DropOptedOut).Inc() },
+			[]string{"reason"}},
+		{"appstats_event_time_adjusted_total", EventTimeAdjusted,
+			func() { EventTimeAdjusted.WithLabelValues(AdjustClampedPast).Inc() }, []string{"adjustment"}},
+		{"appstats_users_created_total", UsersCreated, func() { UsersCreated.WithLabelValues("android").Inc() },
+			[]string{"platform"}},
+		{"appstats_stats_query_duration_seconds", StatsQueryDuration,
+			func() { ObserveQuery("summary", time.Now()) }, []string{"query"}},
+	}
+	for _, tt := range tests {
+		// Registering again fails, as promauto registered it already.
+		err := prometheus.Register(tt.collector)
+		if are := (prometheus.AlreadyRegisteredError{}); !errors.As(err, &are) {
+			t.Errorf("%s: Register = %v, want AlreadyRegisteredError", tt.name, err)
+		}
+		tt.observe()
+		samples := gather(t, tt.name)
+		if len(samples) == 0 {
+			t.Fatalf("%s: no series", tt.name)
+		}
+		if names := slices.Sorted(maps.Keys(samples[0].labels)); !slices.Equal(names, tt.labels) {
+			t.Errorf("%s: labels %v, want %v", tt.name, names, tt.labels)
+		}
+	}
+}
+
+func TestPlatformLabel(t *testing.T) {
+	tests := map[string]string{
+		"ios":       "ios",
+		" Android ": "android",
+		"HarmonyOS": "harmonyos",
+		"":          "unknown",
+		"  ":        "unknown",
+		"tizen":     "other",
+	}
+	for in, want := range tests {
+		if got := PlatformLabel(in); got != want {
+			t.Errorf("PlatformLabel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestRecordIngest(t *testing.T) {
+	ingestHistory.Lock()
+	clear(ingestHistory.buckets[:])
+	ingestHistory.Unlock()
+	web := map[string]string{"platform": "web"}
+	pii := map[string]string{"reason": ReasonPII, "platform": "web"}
+	accepted := counter(t, "appstats_events_accepted_total", web)
+	rejected := counter(t, "appstats_events_rejected_total", pii)
+
+	for range 3 {
+		RecordAccepted("web")
+	}
+	RecordRejected(ReasonPII, "web")
+
+	if got := counter(t, "appstats_events_accepted_total", web) - accepted; got != 3 {
+		t.Errorf("accepted counter grew by %v, want 3", got)
+	}
+	if got := counter(t, "appstats_events_rejected_total", pii) - rejected; got != 1 {
+		t.Errorf("rejected counter grew by %v, want 1", got)
+	}
+	if rate, total := IngestErrorRate(time.Hour); rate != 0.25 || total != 4 {
+		t.Errorf("IngestErrorRate = %v over %d events, want 0.25 over 4", rate, total)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware())
+	r.GET("/things/:id", func(c *gin.Context) { c.Status(http.StatusTeapot) })
+
+	for _, path := range []string{"/things/1", "/things/2", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Routes are labelled by their pattern, so IDs do not add series.
+	counts := make(map[string]uint64)
+	for _, s := range gather(t, "appstats_http_request_duration_seconds") {
+		if s.labels["method"] == http.MethodGet {
+			counts[s.labels["route"]+" "+s.labels["status"]] = s.count
+		}
+	}
+	if counts["/things/:id 418"] != 2 || counts["unmatched 404"] != 1 {
+		t.Errorf("observations by route and status = %v", counts)
+	}
+}
@@ -1,27 +1,483 @@
 package models
 
-import "time"
+import (
+	"time"
+	"unicode/utf8"
+)
 
 // User represents an application user.
 type User struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    string    `gorm:"uniqueIndex;size:64"`
-	FirstSeen time.Time `gorm:"index"`
-	Platform  string    `gorm:"size:32;index"`
-	Region    string    `gorm:"size:64;index"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"uniqueIndex;size:64" json:"user_id"`
+	FirstSeen time.Time `gorm:"index" json:"first_seen"`
+	Platform  string    `gorm:"size:32;index" json:"platform"`
+	Region    string    `gorm:"size:64;index" json:"region"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// UserAlias links an identifier, such as a device ID reported before login,
+// to the canonical user ID it belongs to. Aliases always point directly at
+// a canonical ID, never at another alias.
+type UserAlias struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	AliasID   string    `gorm:"uniqueIndex;size:64" json:"alias_id"`
+	UserID    string    `gorm:"index;size:64" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserProperty is one custom property of a user. Value holds the string
+// form so properties can be filtered on; Type records how to decode it.
+type UserProperty struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"size:64;uniqueIndex:idx_user_properties_user_name,priority:1" json:"user_id"`
+	Name      string    `gorm:"size:64;uniqueIndex:idx_user_properties_user_name,priority:2;index:idx_user_properties_name_value,priority:1" json:"name"`
+	Value     string    `gorm:"size:255;index:idx_user_properties_name_value,priority:2" json:"value"`
+	Type      string    `gorm:"size:8" json:"type"` // string/number/bool
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// UserPropertyChange records a change of a user property, including the
+// platform and region columns of User. A nil value means unset.
+type UserPropertyChange struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"size:64;index:idx_user_property_changes_user,priority:1" json:"user_id"`
+	Name      string    `gorm:"size:64" json:"name"`
+	OldValue  *string   `gorm:"size:255" json:"old_value"`
+	NewValue  *string   `gorm:"size:255" json:"new_value"`
+	ChangedAt time.Time `gorm:"index:idx_user_property_changes_user,priority:2" json:"changed_at"`
+}
+
+// DefaultApp is used for events that do not name the reporting app.
+const DefaultApp = "default"
+
 // UserEvent represents a single user event reported from the app.
 type UserEvent struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    string    `gorm:"index;size:64"`
-	AppVersion string   `gorm:"size:32;index"`
-	Platform  string    `gorm:"size:32;index"`
-	Region    string    `gorm:"size:64;index"`
-	EventTime time.Time `gorm:"index"`
-	CreatedAt time.Time
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	App        string    `gorm:"size:64;not null;default:'default';index" json:"app"`
+	UserID     string    `gorm:"index;index:idx_user_events_user_time,priority:1;size:64" json:"user_id"`
+	EventType  string    `gorm:"size:32;index" json:"event_type"`
+	AppVersion string    `gorm:"size:32;index;index:idx_user_events_version_time,priority:1" json:"app_version"`
+	Platform   string    `gorm:"size:32;index" json:"platform"`
+	Region     string    `gorm:"size:64;index" json:"region"`
+	EventTime  time.Time `gorm:"index;index:idx_user_events_user_time,priority:2;index:idx_user_events_version_time,priority:2" json:"event_time"`
+	// Properties holds arbitrary event attributes reported by the client.
+	Properties map[string]any `gorm:"serializer:json;type:json" json:"properties,omitempty"`
+	// Internal marks test or bot traffic matched by a traffic rule; it is
+	// excluded from stats unless asked for.
+	Internal bool `gorm:"not null;default:false;index" json:"internal,omitempty"`
+	// ReceivedAt is when the server received the event, while EventTime is
+	// the client event time after clock skew correction. Events stored
+	// before it was recorded have none.
+	ReceivedAt *time.Time `json:"received_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// DailyRollup holds the materialized stats of one app and day. Rows with an
+// empty Dimension are the app totals; the others count the users and events
+// of one platform, app_version or region value. Rollups are kept after the
+// raw events are purged.
+type DailyRollup struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Day         time.Time `gorm:"type:date;uniqueIndex:uk_daily_rollups,priority:1" json:"day"`
+	App         string    `gorm:"size:64;uniqueIndex:uk_daily_rollups,priority:2" json:"app"`
+	Dimension   string    `gorm:"size:16;uniqueIndex:uk_daily_rollups,priority:3" json:"dimension"` // ""/platform/app_version/region
+	Value       string    `gorm:"size:64;uniqueIndex:uk_daily_rollups,priority:4" json:"value"`
+	NewUsers    int64     `json:"new_users"`
+	ActiveUsers int64     `json:"active_users"`
+	Events      int64     `json:"events"`
+}
+
+// RollupDay records that the rollups of a day have been materialized. Stale
+// days were changed afterwards and are materialized again.
+type RollupDay struct {
+	Day            time.Time `gorm:"type:date;primaryKey" json:"day"`
+	Stale          bool      `gorm:"index" json:"stale"`
+	MaterializedAt time.Time `json:"materialized_at"`
+}
+
+// RetentionPolicy limits how long the data of one app is kept.
+type RetentionPolicy struct {
+	ID  uint   `gorm:"primaryKey" json:"id"`
+	App string `gorm:"size:64;uniqueIndex" json:"app"`
+	// RawDays is how many days of user_events are kept; 0 keeps them forever.
+	RawDays int `json:"raw_days"`
+	// RollupDays is how many days of daily_rollups are kept; 0 keeps them forever.
+	RollupDays int  `json:"rollup_days"`
+	Enabled    bool `json:"enabled"`
+
+	// PurgedBefore is the UTC day before which raw events have been purged.
+	PurgedBefore *time.Time `json:"purged_before"`
+	// DeletedEvents and DeletedRollups count the rows purged so far.
+	DeletedEvents  int64      `json:"deleted_events"`
+	DeletedRollups int64      `json:"deleted_rollups"`
+	LastRunAt      *time.Time `json:"last_run_at"`
+	LastError      string     `gorm:"size:512" json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// ArchivePartition is a gzip NDJSON file holding the user_events of one app
+// and UTC day, written to the archive store.
+type ArchivePartition struct {
+	ID  uint   `gorm:"primaryKey" json:"id"`
+	App string `gorm:"size:64;uniqueIndex:uk_archive_partitions,priority:1" json:"app"`
+	// Day is the UTC date, YYYY-MM-DD.
+	Day        string    `gorm:"size:10;uniqueIndex:uk_archive_partitions,priority:2" json:"day"`
+	Key        string    `gorm:"size:512" json:"key"`
+	Events     int64     `json:"events"`
+	Bytes      int64     `json:"bytes"`
+	SHA256     string    `gorm:"size:64" json:"sha256"`
+	MinEventID uint      `json:"min_event_id"`
+	MaxEventID uint      `json:"max_event_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TrafficRule recognizes test devices, QA builds and bots. Matching events
+// are dropped at ingest or flagged as internal traffic.
+type TrafficRule struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"size:128" json:"name"`
+	// App restricts the rule to one app; empty matches every app.
+	App  string `gorm:"size:64;index" json:"app"`
+	Kind string `gorm:"size:24" json:"kind"`
+	// Value depends on Kind: a list of user IDs, IP addresses or CIDR
+	// ranges, or app_version suffixes separated by commas or newlines, a
+	// regular expression over user IDs, or the maximum number of events per
+	// user and minute.
+	Value     string    `gorm:"type:text" json:"value"`
+	Action    string    `gorm:"size:8" json:"action"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Traffic rule kinds.
+const (
+	TrafficUserID           = "user_id"
+	TrafficUserIDPattern    = "user_id_pattern"
+	TrafficIPRange          = "ip_range"
+	TrafficAppVersionSuffix = "app_version_suffix"
+	TrafficEventRate        = "event_rate"
+)
+
+// Traffic rule actions.
+const (
+	TrafficDrop = "drop"
+	TrafficFlag = "flag"
+)
+
+// EventSchema is a version of the schema of one event type of an app.
+// Versions are not changed once created; the active version validates the
+// reported events of that type.
+type EventSchema struct {
+	ID        uint   `gorm:"primaryKey" json:"id"`
+	App       string `gorm:"size:64;uniqueIndex:uk_event_schemas,priority:1" json:"app"`
+	EventType string `gorm:"size:32;uniqueIndex:uk_event_schemas,priority:2" json:"event_type"`
+	Version   int    `gorm:"uniqueIndex:uk_event_schemas,priority:3" json:"version"`
+	// RequiredFields lists event fields besides user_id and platform that
+	// must be reported: region, app_version, event_time or sent_at.
+	RequiredFields []string         `gorm:"serializer:json;type:json" json:"required_fields"`
+	Properties     []PropertySchema `gorm:"serializer:json;type:json" json:"properties"`
+	// AdditionalProperties allows properties not listed in Properties.
+	AdditionalProperties bool      `json:"additional_properties"`
+	Active               bool      `gorm:"index" json:"active"`
+	Note                 string    `gorm:"size:255" json:"note"`
+	CreatedAt            time.Time `json:"created_at"`
+}
+
+// PropertySchema describes one event property.
+type PropertySchema struct {
+	Name string `json:"name"`
+	// Type is string, number, integer, boolean, object or array.
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+	// MaxLength bounds the number of characters of a string.
+	MaxLength int `json:"max_length,omitempty"`
+	// Enum lists the allowed values of a string or number.
+	Enum []string `json:"enum,omitempty"`
+}
+
+// Property types.
+const (
+	PropertyString  = "string"
+	PropertyNumber  = "number"
+	PropertyInteger = "integer"
+	PropertyBoolean = "boolean"
+	PropertyObject  = "object"
+	PropertyArray   = "array"
+)
+
+// DeadLetter keeps a rejected event payload for inspection. PII
+// rejections are not kept.
+type DeadLetter struct {
+	ID  uint   `gorm:"primaryKey" json:"id"`
+	App string `gorm:"size:64;index" json:"app"`
+	// UserID is the user ID of the payload as events store it, i.e.
+	// pseudonymized according to the privacy settings of the app. It
+	// replaces the reported user ID in Payload.
+	UserID string `gorm:"size:64;index" json:"user_id"`
+	// Reason is the rejection reason of the events_rejected_total metric.
+	Reason string `gorm:"size:32;index" json:"reason"`
+	// Errors maps fields to what is wrong with them.
+	Errors map[string]string `gorm:"serializer:json;type:json" json:"errors"`
+	// SchemaVersion is the version of the event schema that rejected the
+	// payload, if any.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// Payload is the request body with the user ID replaced, truncated to a
+	// few tens of KB. Bodies that are not a JSON object are not kept.
+	Payload   string    `gorm:"type:text" json:"payload"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// AppPrivacy holds the privacy settings of one app.
+type AppPrivacy struct {
+	ID  uint   `gorm:"primaryKey" json:"id"`
+	App string `gorm:"size:64;uniqueIndex" json:"app"`
+	// Pseudonymize replaces every reported user ID with a keyed hash.
+	Pseudonymize bool `json:"pseudonymize"`
+	// PIIAction says what happens to user IDs that look like an email
+	// address or phone number: allow, hash or reject.
+	PIIAction string `gorm:"size:8" json:"pii_action"`
+	// OptOutMode says what happens to events of opted-out users: drop, or
+	// count to keep anonymous event counts.
+	OptOutMode string    `gorm:"size:8" json:"opt_out_mode"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Opt-out modes.
+const (
+	OptOutDrop  = "drop"
+	OptOutCount = "count"
+)
+
+// ConsentOptOut marks a user who declined analytics in an app. Their events
+// are not stored, and their data is purged once PurgedAt is set.
+type ConsentOptOut struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	App    string `gorm:"size:64;uniqueIndex:uk_consent_opt_outs,priority:1" json:"app"`
+	UserID string `gorm:"size:64;uniqueIndex:uk_consent_opt_outs,priority:2" json:"user_id"`
+	// Source is "client" for opt-outs reported by the app and "admin" for
+	// those added in the admin.
+	Source     string     `gorm:"size:16" json:"source"`
+	CreatedAt  time.Time  `json:"created_at"`
+	PurgedAt   *time.Time `gorm:"index" json:"purged_at"`
+	PurgeError string     `gorm:"size:512" json:"purge_error"`
+}
+
+// AnonymousEventCount counts events of opted-out users per UTC day, without
+// anything identifying the user.
+type AnonymousEventCount struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Day       time.Time `gorm:"type:date;uniqueIndex:uk_anonymous_event_counts,priority:1" json:"day"`
+	App       string    `gorm:"size:64;uniqueIndex:uk_anonymous_event_counts,priority:2" json:"app"`
+	EventType string    `gorm:"size:32;uniqueIndex:uk_anonymous_event_counts,priority:3" json:"event_type"`
+	Platform  string    `gorm:"size:32;uniqueIndex:uk_anonymous_event_counts,priority:4" json:"platform"`
+	Events    int64     `json:"events"`
+}
+
+// PII actions.
+const (
+	PIIAllow  = "allow"
+	PIIHash   = "hash"
+	PIIReject = "reject"
+)
+
+// PseudonymSalt is a version of the HMAC key pseudonyms of an app are
+// derived from. Retired salts are no longer used.
+type PseudonymSalt struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	App       string     `gorm:"size:64;uniqueIndex:uk_pseudonym_salts,priority:1" json:"app"`
+	Version   int        `gorm:"uniqueIndex:uk_pseudonym_salts,priority:2" json:"version"`
+	Salt      string     `gorm:"size:64" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at"`
+}
+
+// PrivacyAudit records an export or erasure of a user's data.
+type PrivacyAudit struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	Action string `gorm:"size:16;index" json:"action"` // export/delete/anonymize
+	UserID string `gorm:"size:64;index" json:"user_id"`
+	// Operator and Reason are supplied by whoever made the request.
+	Operator string `gorm:"size:128" json:"operator"`
+	Reason   string `gorm:"size:512" json:"reason"`
+	// Rows counts the affected rows per table.
+	Rows      map[string]int64 `gorm:"serializer:json;type:json" json:"rows"`
+	Error     string           `gorm:"size:512" json:"error"`
+	CreatedAt time.Time        `gorm:"index" json:"created_at"`
 }
 
+// Privacy audit actions.
+const (
+	PrivacyExport    = "export"
+	PrivacyDelete    = "delete"
+	PrivacyAnonymize = "anonymize"
+)
 
+// Annotation marks a date on the time-series charts, e.g. a release or a campaign.
+type Annotation struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	Date     time.Time `gorm:"type:date;index" json:"date"`
+	App      string    `gorm:"size:64;uniqueIndex:uk_annotations_app_version,priority:1" json:"app"`
+	Label    string    `gorm:"size:128" json:"label"`
+	Category string    `gorm:"size:32;index" json:"category"` // release/campaign/incident/other
+	// AppVersion is set on annotations created automatically when a version
+	// is first seen; it is NULL for manual annotations.
+	AppVersion *string   `gorm:"size:32;uniqueIndex:uk_annotations_app_version,priority:2" json:"app_version,omitempty"`
+	Source     string    `gorm:"size:16" json:"source"` // manual/auto
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Annotation categories and sources.
+const (
+	AnnotationRelease  = "release"
+	AnnotationCampaign = "campaign"
+	AnnotationIncident = "incident"
+	AnnotationOther    = "other"
+
+	AnnotationSourceManual = "manual"
+	AnnotationSourceAuto   = "auto"
+)
+
+// ChannelSpec configures one notification channel, e.g.
+// {"type": "webhook", "url": "https://..."} or {"type": "email", "to": ["ops@example.com"]}.
+type ChannelSpec struct {
+	Type string   `json:"type"`
+	URL  string   `json:"url,omitempty"`
+	To   []string `json:"to,omitempty"`
+}
+
+// AlertRule evaluates a metric over a trailing window on a schedule.
+type AlertRule struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"size:128" json:"name"`
+	// App restricts the metric to one app; empty means all apps.
+	App       string `gorm:"size:64" json:"app"`
+	Metric    string `gorm:"size:32" json:"metric"`     // new_users/active_users/events/ingest_error_rate
+	EventType string `gorm:"size:32" json:"event_type"` // only for the events metric
+	// WindowMinutes is the trailing window the metric is measured over.
+	WindowMinutes int `json:"window_minutes"`
+	// Kind is "threshold" (compare with Threshold) or "anomaly" (compare
+	// with the same window in the previous BaselineWeeks weeks).
+	Kind string `gorm:"size:16" json:"kind"`
+	// Operator is "<" or ">" for threshold rules and "drop", "rise" or
+	// "both" for anomaly rules.
+	Operator string `gorm:"size:8" json:"operator"`
+	// Threshold is the metric limit for threshold rules and the relative
+	// deviation from the baseline (0.3 = 30%) for anomaly rules.
+	Threshold       float64       `json:"threshold"`
+	BaselineWeeks   int           `json:"baseline_weeks"`
+	IntervalMinutes int           `json:"interval_minutes"`
+	Channels        []ChannelSpec `gorm:"serializer:json;type:json" json:"channels"`
+	Enabled         bool          `json:"enabled"`
+
+	State           string     `gorm:"size:16" json:"state"` // ok/firing
+	LastValue       float64    `json:"last_value"`
+	LastEvaluatedAt *time.Time `json:"last_evaluated_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// Alert rule states, also used as AlertEvent statuses.
+const (
+	AlertStateOK     = "ok"
+	AlertStateFiring = "firing"
+	AlertResolved    = "resolved"
+)
+
+// AlertEvent is an entry of the alert history.
+type AlertEvent struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	RuleID      uint      `gorm:"index" json:"rule_id"`
+	RuleName    string    `gorm:"size:128" json:"rule_name"`
+	Status      string    `gorm:"size:16" json:"status"` // firing/resolved
+	Value       float64   `json:"value"`
+	Baseline    *float64  `json:"baseline"`
+	Message     string    `gorm:"size:512" json:"message"`
+	NotifyError string    `gorm:"size:512" json:"notify_error"`
+	CreatedAt   time.Time `gorm:"index" json:"created_at"`
+}
+
+// WebhookEndpoint receives signed POSTs for the subscribed event types.
+type WebhookEndpoint struct {
+	ID     uint     `gorm:"primaryKey" json:"id"`
+	Name   string   `gorm:"size:128" json:"name"`
+	URL    string   `gorm:"size:512" json:"url"`
+	Secret string   `gorm:"size:128" json:"-"`
+	Events []string `gorm:"serializer:json;type:json" json:"events"` // e.g. user.created, version.first_seen, alert.triggered
+	// Enabled endpoints receive new events; disabled ones keep their history.
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one attempt sequence of delivering an event to an endpoint.
+type WebhookDelivery struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	EndpointID     uint       `gorm:"index" json:"endpoint_id"`
+	Event          string     `gorm:"size:64;index" json:"event"`
+	Payload        string     `gorm:"type:mediumtext" json:"payload"`
+	Status         string     `gorm:"size:16;index:idx_webhook_deliveries_due,priority:1" json:"status"` // pending/succeeded/failed
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `gorm:"index:idx_webhook_deliveries_due,priority:2" json:"next_attempt_at"`
+	ResponseStatus int        `json:"response_status"`
+	LastError      string     `gorm:"size:512" json:"last_error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	// ReplayOf points at the delivery this one was replayed from.
+	ReplayOf  *uint     `json:"replay_of"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// ReportSchedule emails a periodic stats report to a list of recipients.
+type ReportSchedule struct {
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"size:128" json:"name"`
+	// Cron is a standard five-field expression, e.g. "0 9 * * *", evaluated
+	// in Timezone (an IANA name; empty means the server's local time).
+	Cron       string   `gorm:"size:64" json:"cron"`
+	Timezone   string   `gorm:"size:64" json:"timezone"`
+	Recipients []string `gorm:"serializer:json;type:json" json:"recipients"`
+	// App restricts the report to one app; empty means all apps.
+	App string `gorm:"size:64" json:"app"`
+	// Metrics lists the report sections: new_users, active_users, events,
+	// top_versions, top_platforms, top_regions.
+	Metrics []string `gorm:"serializer:json;type:json" json:"metrics"`
+	// Days is the length of the trend charts, ending with the report day.
+	Days    int  `json:"days"`
+	Enabled bool `json:"enabled"`
+
+	NextRunAt *time.Time `gorm:"index" json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at"`
+	LastError string     `gorm:"size:512" json:"last_error"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// Truncate shortens s to at most n bytes without splitting a UTF-8
+// sequence, so that it fits a column of size n, e.g. an error message.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Migration records a one-off data migration that has run, so it runs once.
+type Migration struct {
+	Name      string    `gorm:"size:64;primaryKey" json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
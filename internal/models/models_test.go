@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"", 4, ""},
+		{"abc", 3, "abc"},
+		{"abcdef", 3, "abc"},
+		{"abc", 0, ""},
+		{"数据库错误", 6, "数据"}, // 3 bytes per rune
+		{"数据库错误", 7, "数据"},
+		{"数据库错误", 8, "数据"},
+		{"数据库错误", 9, "数据库"},
+		{"a😀b", 2, "a"}, // 4 byte rune
+		{"a😀b", 5, "a😀"},
+		{"\xff\xfe\xfd", 2, "\xff\xfe"}, // invalid bytes are kept as they are
+	}
+	for _, tt := range tests {
+		got := Truncate(tt.s, tt.n)
+		if got != tt.want {
+			t.Errorf("Truncate(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+		if len(got) > tt.n || (utf8.ValidString(tt.s) && !utf8.ValidString(got)) {
+			t.Errorf("Truncate(%q, %d) = %q is too long or invalid", tt.s, tt.n, got)
+		}
+	}
+}
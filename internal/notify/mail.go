@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTPConfig configures outgoing mail. Auth is only used when Username is set.
+type SMTPConfig struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+// Mail is an outgoing email with an optional HTML body. Inline parts are
+// attached next to the HTML body and referenced from it as "cid:<ContentID>".
+type Mail struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+	Inline  []Inline
+}
+
+// Inline is a file embedded in the HTML body of a mail, such as a chart image.
+type Inline struct {
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+// Mailer sends mail through an SMTP server.
+type Mailer struct {
+	cfg SMTPConfig
+}
+
+// NewMailer returns a mailer, or nil when no SMTP server is configured.
+func NewMailer(cfg SMTPConfig) *Mailer {
+	if cfg.Addr == "" {
+		return nil
+	}
+	return &Mailer{cfg: cfg}
+}
+
+// Send delivers m. net/smtp does not accept a context, so ctx is only
+// checked before connecting.
+func (m *Mailer) Send(ctx context.Context, mail Mail) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(mail.To) == 0 {
+		return errors.New("no recipients")
+	}
+	body, err := m.build(mail)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(m.cfg.Addr)
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+	return smtp.SendMail(m.cfg.Addr, auth, m.cfg.From, mail.To, body)
+}
+
+func (m *Mailer) build(mail Mail) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, h := range [][2]string{
+		{"From", m.cfg.From},
+		{"To", strings.Join(mail.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", mail.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()},
+	} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", h[0], h[1])
+	}
+	buf.WriteString("\r\n")
+
+	if err := writeQuotedPart(mw, "text/plain; charset=utf-8", mail.Text); err != nil {
+		return nil, err
+	}
+	switch {
+	case mail.HTML != "" && len(mail.Inline) > 0:
+		if err := writeRelatedPart(mw, mail); err != nil {
+			return nil, err
+		}
+	case mail.HTML != "":
+		if err := writeQuotedPart(mw, "text/html; charset=utf-8", mail.HTML); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeRelatedPart writes the HTML body and its inline parts as a nested
+// multipart/related part.
+func writeRelatedPart(mw *multipart.Writer, mail Mail) error {
+	var related bytes.Buffer
+	rw := multipart.NewWriter(&related)
+	if err := writeQuotedPart(rw, "text/html; charset=utf-8", mail.HTML); err != nil {
+		return err
+	}
+	for _, in := range mail.Inline {
+		w, err := rw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {in.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-ID":                {"<" + in.ContentID + ">"},
+			"Content-Disposition":       {"inline"},
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeBase64(w, in.Data); err != nil {
+			return err
+		}
+	}
+	if err := rw.Close(); err != nil {
+		return err
+	}
+
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`multipart/related; type="text/html"; boundary=` + rw.Boundary()},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(related.Bytes())
+	return err
+}
+
+// writeBase64 writes data base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, data []byte) error {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 0 {
+		n := min(76, len(enc))
+		if _, err := io.WriteString(w, enc[:n]+"\r\n"); err != nil {
+			return err
+		}
+		enc = enc[n:]
+	}
+	return nil
+}
+
+func writeQuotedPart(mw *multipart.Writer, contentType, body string) error {
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
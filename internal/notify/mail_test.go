@@ -0,0 +1,216 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpServer is a stand-in SMTP server accepting every message.
+type smtpServer struct {
+	addr     string
+	messages chan smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	auth string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &smtpServer{addr: ln.Addr().String(), messages: make(chan smtpMessage, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	var msg smtpMessage
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250-localhost")
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			msg.auth = arg
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.messages <- msg
+			msg = smtpMessage{}
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+func TestNewMailerDisabled(t *testing.T) {
+	if m := NewMailer(SMTPConfig{}); m != nil {
+		t.Errorf("NewMailer without an address = %v, want nil", m)
+	}
+}
+
+func TestMailerSend(t *testing.T) {
+	srv := newSMTPServer(t)
+	m := NewMailer(SMTPConfig{Addr: srv.addr, Username: "reports", Password: "pw", From: "appstats@example.com"})
+	chart := []byte("\x89PNG fake chart")
+	err := m.Send(context.Background(), Mail{
+		To:      []string{"a@example.com", "b@example.com"},
+		Subject: "每日报表",
+		Text:    "新用户 3",
+		HTML:    `<p>新用户 3</p><img src="cid:chart">`,
+		Inline:  []Inline{{ContentID: "chart", ContentType: "image/png", Data: chart}},
+	})
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got := <-srv.messages
+
+	if got.from != "appstats@example.com" || strings.Join(got.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("envelope from %q to %v", got.from, got.to)
+	}
+	if want := "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00reports\x00pw")); got.auth != want {
+		t.Errorf("auth = %q, want %q", got.auth, want)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "每日报表" {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, %v", mediaType, err)
+	}
+
+	parts := readParts(t, multipart.NewReader(msg.Body, params["boundary"]))
+	if len(parts) != 2 {
+		t.Fatalf("got %d alternative parts, want 2", len(parts))
+	}
+	if parts[0].contentType != "text/plain" || parts[0].body != "新用户 3" {
+		t.Errorf("text part = %+v", parts[0])
+	}
+	if parts[1].contentType != "multipart/related" {
+		t.Fatalf("second part is %s, want multipart/related", parts[1].contentType)
+	}
+	related := readParts(t, multipart.NewReader(strings.NewReader(parts[1].body), parts[1].boundary))
+	if len(related) != 2 || related[0].contentType != "text/html" || !strings.Contains(related[0].body, `src="cid:chart"`) {
+		t.Fatalf("related parts = %+v", related)
+	}
+	if related[1].contentID != "<chart>" || related[1].body != string(chart) {
+		t.Errorf("inline part = %+v", related[1])
+	}
+}
+
+func TestMailerSendWithoutRecipients(t *testing.T) {
+	m := NewMailer(SMTPConfig{Addr: "127.0.0.1:1"})
+	if err := m.Send(context.Background(), Mail{Subject: "s"}); err == nil {
+		t.Error("Send without recipients succeeded")
+	}
+}
+
+func TestEmailChannelSend(t *testing.T) {
+	srv := newSMTPServer(t)
+	ch := &EmailChannel{Mailer: NewMailer(SMTPConfig{Addr: srv.addr, From: "appstats@example.com"}), To: []string{"ops@example.com"}}
+	if err := ch.Send(context.Background(), Message{Subject: "[告警] 活跃用户", Text: "active_users = 0"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	got := <-srv.messages
+	if got.auth != "" {
+		t.Errorf("authenticated without a username: %q", got.auth)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	parts := readParts(t, multipart.NewReader(msg.Body, params["boundary"]))
+	if len(parts) != 1 || parts[0].contentType != "text/plain" || parts[0].body != "active_users = 0" {
+		t.Errorf("parts = %+v, want only the text", parts)
+	}
+}
+
+type part struct {
+	contentType string
+	boundary    string
+	contentID   string
+	body        string
+}
+
+// readParts reads the parts of r, decoding their transfer encoding.
+func readParts(t *testing.T, r *multipart.Reader) []part {
+	t.Helper()
+	var parts []part
+	for {
+		p, err := r.NextRawPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		var body io.Reader = p
+		switch p.Header.Get("Content-Transfer-Encoding") {
+		case "base64":
+			body = base64.NewDecoder(base64.StdEncoding, p)
+		case "quoted-printable":
+			body = quotedprintable.NewReader(p)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("read %s part: %v", mediaType, err)
+		}
+		parts = append(parts, part{contentType: mediaType, boundary: params["boundary"],
+			contentID: p.Header.Get("Content-ID"), body: string(b)})
+	}
+}
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"appstats/internal/models"
+)
+
+// Message is a notification delivered through a Channel.
+type Message struct {
+	Subject string         `json:"subject"`
+	Text    string         `json:"text"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// Channel delivers messages to one destination.
+type Channel interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Factory builds a Channel from its configuration.
+type Factory func(spec models.ChannelSpec) (Channel, error)
+
+// Registry maps channel types to factories. New channel types can be added
+// with Register.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]Factory
+}
+
+// NewRegistry returns a registry with the built-in webhook and email channels.
+func NewRegistry(mailer *Mailer) *Registry {
+	r := &Registry{factories: make(map[string]Factory)}
+	r.Register("webhook", func(spec models.ChannelSpec) (Channel, error) {
+		if spec.URL == "" {
+			return nil, errors.New("webhook channel needs a url")
+		}
+		return &WebhookChannel{URL: spec.URL, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	})
+	r.Register("email", func(spec models.ChannelSpec) (Channel, error) {
+		if len(spec.To) == 0 {
+			return nil, errors.New("email channel needs recipients")
+		}
+		if mailer == nil {
+			return nil, errors.New("smtp is not configured")
+		}
+		return &EmailChannel{Mailer: mailer, To: spec.To}, nil
+	})
+	return r
+}
+
+// Register adds or replaces the factory for a channel type.
+func (r *Registry) Register(kind string, f Factory) {
+	r.mu.Lock()
+	r.factories[kind] = f
+	r.mu.Unlock()
+}
+
+// Build creates the channel described by spec.
+func (r *Registry) Build(spec models.ChannelSpec) (Channel, error) {
+	r.mu.RLock()
+	f, ok := r.factories[spec.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown channel type %q", spec.Type)
+	}
+	return f(spec)
+}
+
+// SendAll delivers msg to every channel, returning the joined errors of the
+// channels that failed.
+func (r *Registry) SendAll(ctx context.Context, specs []models.ChannelSpec, msg Message) error {
+	var errs []error
+	for _, spec := range specs {
+		ch, err := r.Build(spec)
+		if err == nil {
+			err = ch.Send(ctx, msg)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", spec.Type, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WebhookChannel posts the message as JSON.
+type WebhookChannel struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send implements Channel.
+func (w *WebhookChannel) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailChannel sends the message as a plain text email.
+type EmailChannel struct {
+	Mailer *Mailer
+	To     []string
+}
+
+// Send implements Channel.
+func (e *EmailChannel) Send(ctx context.Context, msg Message) error {
+	return e.Mailer.Send(ctx, Mail{To: e.To, Subject: msg.Subject, Text: msg.Text})
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+)
+
+func TestWebhookChannelSend(t *testing.T) {
+	var got Message
+	var contentType, method string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, contentType = r.Method, r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	ch := &WebhookChannel{URL: srv.URL, Client: srv.Client()}
+	msg := Message{Subject: "[告警] 新用户", Text: "new_users = 3", Fields: map[string]any{"rule_id": float64(7)}}
+	if err := ch.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if method != http.MethodPost || contentType != "application/json" {
+		t.Errorf("request = %s with Content-Type %q", method, contentType)
+	}
+	if got.Subject != msg.Subject || got.Text != msg.Text || got.Fields["rule_id"] != float64(7) {
+		t.Errorf("received %+v, want %+v", got, msg)
+	}
+}
+
+func TestWebhookChannelErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		http.Error(w, "boom", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	ch := &WebhookChannel{URL: srv.URL, Client: srv.Client()}
+	if err := ch.Send(context.Background(), Message{}); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("Send to a failing endpoint: err = %v, want the status", err)
+	}
+
+	ch = &WebhookChannel{URL: srv.URL + "/slow", Client: &http.Client{Timeout: 20 * time.Millisecond}}
+	if err := ch.Send(context.Background(), Message{}); err == nil {
+		t.Error("Send to a slow endpoint succeeded despite the client timeout")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch = &WebhookChannel{URL: srv.URL, Client: srv.Client()}
+	if err := ch.Send(ctx, Message{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Send with a cancelled context: err = %v", err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { calls++ }))
+	defer srv.Close()
+
+	r := NewRegistry(nil)
+	tests := []struct {
+		spec    models.ChannelSpec
+		wantErr string
+	}{
+		{spec: models.ChannelSpec{Type: "webhook", URL: srv.URL}},
+		{spec: models.ChannelSpec{Type: "webhook"}, wantErr: "url"},
+		{spec: models.ChannelSpec{Type: "email"}, wantErr: "recipients"},
+		{spec: models.ChannelSpec{Type: "email", To: []string{"ops@example.com"}}, wantErr: "smtp"},
+		{spec: models.ChannelSpec{Type: "sms"}, wantErr: "unknown channel type"},
+	}
+	for _, tt := range tests {
+		_, err := r.Build(tt.spec)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Build(%+v): err = %v, want %q", tt.spec, err, tt.wantErr)
+		}
+	}
+
+	// SendAll delivers to the channels it can and joins the other errors.
+	err := r.SendAll(context.Background(), []models.ChannelSpec{
+		{Type: "webhook", URL: srv.URL},
+		{Type: "sms"},
+		{Type: "webhook", URL: srv.URL},
+	}, Message{Subject: "s"})
+	if calls != 2 {
+		t.Errorf("webhook called %d times, want 2", calls)
+	}
+	if err == nil || !strings.Contains(err.Error(), "sms") {
+		t.Errorf("SendAll: err = %v, want the sms failure", err)
+	}
+
+	r.Register("sms", func(spec models.ChannelSpec) (Channel, error) {
+		return &WebhookChannel{URL: srv.URL, Client: srv.Client()}, nil
+	})
+	if err := r.SendAll(context.Background(), []models.ChannelSpec{{Type: "sms"}}, Message{}); err != nil || calls != 3 {
+		t.Errorf("registered channel: err = %v, calls = %d", err, calls)
+	}
+}
@@ -0,0 +1,329 @@
+package privacy
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/archive"
+	"appstats/internal/models"
+	"appstats/internal/rollups"
+	"appstats/internal/webhooks"
+)
+
+// Data is everything stored about one user, as returned to them on request.
+type Data struct {
+	UserID          string                      `json:"user_id"`
+	ExportedAt      time.Time                   `json:"exported_at"`
+	User            *models.User                `json:"user"`
+	Aliases         []models.UserAlias          `json:"aliases"`
+	Properties      []models.UserProperty       `json:"properties"`
+	PropertyHistory []models.UserPropertyChange `json:"property_history"`
+	Events          []models.UserEvent          `json:"events"`
+	// WebhookDeliveries are the logged webhook payloads about the user.
+	WebhookDeliveries []models.WebhookDelivery `json:"webhook_deliveries"`
+	// DeadLetters are the rejected payloads reported by the user or one of
+	// their aliases.
+	DeadLetters []models.DeadLetter `json:"dead_letters"`
+}
+
+// Empty reports whether nothing is stored about the user.
+func (d *Data) Empty() bool {
+	return d.User == nil && len(d.Aliases) == 0 && len(d.Properties) == 0 &&
+		len(d.PropertyHistory) == 0 && len(d.Events) == 0 && len(d.WebhookDeliveries) == 0 &&
+		len(d.DeadLetters) == 0
+}
+
+// Rows counts the exported rows per table.
+func (d *Data) Rows() map[string]int64 {
+	users := int64(0)
+	if d.User != nil {
+		users = 1
+	}
+	return map[string]int64{
+		"users":                 users,
+		"user_aliases":          int64(len(d.Aliases)),
+		"user_properties":       int64(len(d.Properties)),
+		"user_property_changes": int64(len(d.PropertyHistory)),
+		"user_events":           int64(len(d.Events)),
+		"webhook_deliveries":    int64(len(d.WebhookDeliveries)),
+		"dead_letters":          int64(len(d.DeadLetters)),
+	}
+}
+
+// webhookWhere selects the logged user.created deliveries about a user.
+const webhookWhere = "event = ? AND JSON_UNQUOTE(JSON_EXTRACT(payload, '$.data.user_id')) = ?"
+
+// Export collects the data of the canonical userID.
+func Export(db *gorm.DB, userID string) (*Data, error) {
+	d := &Data{UserID: userID, ExportedAt: time.Now().UTC()}
+	var users []models.User
+	if err := db.Where("user_id = ?", userID).Limit(1).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	if len(users) > 0 {
+		d.User = &users[0]
+	}
+	queries := []struct {
+		dest  any
+		query *gorm.DB
+	}{
+		{&d.Aliases, db.Where("user_id = ?", userID).Order("id")},
+		{&d.Properties, db.Where("user_id = ?", userID).Order("name")},
+		{&d.PropertyHistory, db.Where("user_id = ?", userID).Order("changed_at, id")},
+		{&d.Events, db.Where("user_id = ?", userID).Order("event_time, id")},
+		{&d.WebhookDeliveries, db.Where(webhookWhere, webhooks.EventUserCreated, userID).Order("id")},
+		{&d.DeadLetters, db.Where("user_id = ? OR user_id IN (?)", userID, aliasesOf(db, userID)).Order("id")},
+	}
+	for _, q := range queries {
+		if err := q.query.Find(q.dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Result describes the outcome of Erase.
+type Result struct {
+	UserID string `json:"user_id"`
+	Action string `json:"action"`
+	// Pseudonym replaces the user ID of anonymized events.
+	Pseudonym string           `json:"pseudonym,omitempty"`
+	Rows      map[string]int64 `json:"rows"`
+	// Days is the number of days whose rollups were recomputed.
+	Days int `json:"days"`
+}
+
+// Erase deletes or anonymizes the data of the canonical userID. Deleting
+// removes the user's events, so they no longer count in any stats.
+// Anonymizing keeps the events and the user record for the stats but moves
+// them to a random pseudonym and drops the event properties. Aliases,
+// properties, property history and logged webhook payloads are deleted in
+// both cases. The rollups of the affected days are recomputed afterwards.
+// With an archive store, the archived events of the user and their aliases
+// are deleted or anonymized the same way.
+func Erase(ctx context.Context, db *gorm.DB, store archive.Store, userID, action string) (*Result, error) {
+	if action != models.PrivacyDelete && action != models.PrivacyAnonymize {
+		return nil, fmt.Errorf("unsupported action %q", action)
+	}
+	res := &Result{UserID: userID, Action: action, Rows: make(map[string]int64)}
+	if action == models.PrivacyAnonymize {
+		res.Pseudonym = "anon-" + rand.Text()
+	}
+	// Archived events keep the IDs they were reported under, and the
+	// aliases are deleted below.
+	archived, err := withAliases(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var affected affectedDays
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if affected, err = collectDays(tx.Model(&models.UserEvent{}).Where("user_id = ?", userID)); err != nil {
+			return err
+		}
+
+		count := func(table string, q *gorm.DB) error {
+			if q.Error != nil {
+				return q.Error
+			}
+			res.Rows[table] = q.RowsAffected
+			return nil
+		}
+		events := tx.Model(&models.UserEvent{}).Where("user_id = ?", userID)
+		users := tx.Model(&models.User{}).Where("user_id = ?", userID)
+		if action == models.PrivacyDelete {
+			if err := count("user_events", events.Delete(&models.UserEvent{})); err != nil {
+				return err
+			}
+			if err := count("users", users.Delete(&models.User{})); err != nil {
+				return err
+			}
+		} else {
+			if err := count("user_events", events.Updates(map[string]any{
+				"user_id":    res.Pseudonym,
+				"properties": nil,
+			})); err != nil {
+				return err
+			}
+			if err := count("users", users.Update("user_id", res.Pseudonym)); err != nil {
+				return err
+			}
+		}
+		if err := count("user_properties", tx.Where("user_id = ?", userID).
+			Delete(&models.UserProperty{})); err != nil {
+			return err
+		}
+		if err := count("user_property_changes", tx.Where("user_id = ?", userID).
+			Delete(&models.UserPropertyChange{})); err != nil {
+			return err
+		}
+		if err := count("webhook_deliveries", tx.Where(webhookWhere, webhooks.EventUserCreated, userID).
+			Delete(&models.WebhookDelivery{})); err != nil {
+			return err
+		}
+		// Dead letters keep the reported user ID, which may be an alias, so
+		// they go before the aliases.
+		if err := count("dead_letters", tx.Where("user_id = ? OR user_id IN (?)", userID, aliasesOf(tx, userID)).
+			Delete(&models.DeadLetter{})); err != nil {
+			return err
+		}
+		if err := count("user_aliases", tx.Where("user_id = ? OR alias_id = ?", userID, userID).
+			Delete(&models.UserAlias{})); err != nil {
+			return err
+		}
+		// Should recomputing below fail, the materializer picks the days up.
+		return rollups.Invalidate(tx, slices.Collect(maps.Keys(affected)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := recompute(db, affected, res); err != nil {
+		return res, err
+	}
+	return res, eraseArchived(ctx, db, store, archived, "", res)
+}
+
+// EraseApp deletes the events the canonical userID reported to app. When
+// the user has no events in other apps left, the rest of their data is
+// deleted as by Erase, unless userID is an alias: its events are stored
+// under the user it is an alias of, so it never has any, and erasing it
+// would break the link to that user. With an archive store, the archived
+// events of app reported by the user or their aliases are deleted too.
+func EraseApp(ctx context.Context, db *gorm.DB, store archive.Store, userID, app string) (*Result, error) {
+	res := &Result{UserID: userID, Action: models.PrivacyDelete, Rows: make(map[string]int64)}
+	archived, err := withAliases(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	var affected affectedDays
+	var remaining, aliased int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if affected, err = collectDays(tx.Model(&models.UserEvent{}).Where("user_id = ? AND app = ?", userID, app)); err != nil {
+			return err
+		}
+		q := tx.Where("user_id = ? AND app = ?", userID, app).Delete(&models.UserEvent{})
+		if q.Error != nil {
+			return q.Error
+		}
+		res.Rows["user_events"] = q.RowsAffected
+		q = tx.Where("user_id = ? AND app = ?", userID, app).Delete(&models.DeadLetter{})
+		if q.Error != nil {
+			return q.Error
+		}
+		res.Rows["dead_letters"] = q.RowsAffected
+		if err := tx.Model(&models.UserEvent{}).Where("user_id = ?", userID).Count(&remaining).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.UserAlias{}).Where("alias_id = ?", userID).Count(&aliased).Error; err != nil {
+			return err
+		}
+		return rollups.Invalidate(tx, slices.Collect(maps.Keys(affected)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := recompute(db, affected, res); err != nil {
+		return res, err
+	}
+	if err := eraseArchived(ctx, db, store, archived, app, res); err != nil {
+		return res, err
+	}
+	if remaining > 0 || aliased > 0 {
+		return res, nil
+	}
+	// The user only opted out of app, so their archived events of other
+	// apps are kept.
+	rest, err := Erase(ctx, db, nil, userID, models.PrivacyDelete)
+	if rest != nil {
+		for table, n := range rest.Rows {
+			res.Rows[table] += n
+		}
+		res.Days += rest.Days
+	}
+	return res, err
+}
+
+// aliasesOf returns a subquery selecting the IDs aliased to userID.
+func aliasesOf(db *gorm.DB, userID string) *gorm.DB {
+	return db.Model(&models.UserAlias{}).Select("alias_id").Where("user_id = ?", userID)
+}
+
+// withAliases returns userID followed by the IDs aliased to it.
+func withAliases(db *gorm.DB, userID string) ([]string, error) {
+	var aliases []string
+	if err := aliasesOf(db, userID).Order("id").Pluck("alias_id", &aliases).Error; err != nil {
+		return nil, err
+	}
+	return append([]string{userID}, aliases...), nil
+}
+
+// eraseArchived erases the archived events of ids in app, or in every app
+// when app is empty, as res describes, counting them in res.Rows. It does
+// nothing without a store.
+func eraseArchived(ctx context.Context, db *gorm.DB, store archive.Store, ids []string, app string, res *Result) error {
+	if store == nil {
+		return nil
+	}
+	n, err := archive.EraseUsers(ctx, db, store, ids, app, res.Pseudonym)
+	res.Rows["archived_events"] = n
+	if err != nil {
+		return fmt.Errorf("erase archived events: %w", err)
+	}
+	return nil
+}
+
+// affectedDays holds the apps with erased events, by UTC day.
+type affectedDays map[time.Time]map[string]bool
+
+// collectDays returns the days and apps of the events selected by q.
+func collectDays(q *gorm.DB) (affectedDays, error) {
+	affected := make(affectedDays)
+	rows, err := q.Select("app, event_time").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var app string
+		var t time.Time
+		if err := rows.Scan(&app, &t); err != nil {
+			return nil, err
+		}
+		day := t.UTC().Truncate(24 * time.Hour)
+		if affected[day] == nil {
+			affected[day] = make(map[string]bool)
+		}
+		affected[day][app] = true
+	}
+	return affected, rows.Err()
+}
+
+// recompute materializes the rollups of the affected days that are stale,
+// counting them in res.Days.
+func recompute(db *gorm.DB, affected affectedDays, res *Result) error {
+	stale, err := rollups.Stale(db, slices.Collect(maps.Keys(affected)))
+	if err != nil {
+		return err
+	}
+	for _, day := range stale {
+		if err := rollups.Materialize(db, day, slices.Sorted(maps.Keys(affected[day]))...); err != nil {
+			return fmt.Errorf("recompute rollups of %s: %w", day.Format("2006-01-02"), err)
+		}
+		res.Days++
+	}
+	return nil
+}
+
+// Record stores an audit record.
+func Record(db *gorm.DB, a *models.PrivacyAudit) error {
+	a.ID = 0
+	return db.Create(a).Error
+}
@@ -0,0 +1,200 @@
+package privacy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/archive"
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	return testdb.Open(t, &models.User{}, &models.UserAlias{}, &models.UserProperty{}, &models.UserPropertyChange{},
+		&models.UserEvent{}, &models.WebhookDelivery{}, &models.DeadLetter{}, &models.RollupDay{})
+}
+
+var ctx = context.Background()
+
+func count(t *testing.T, db *gorm.DB, model any, query string, args ...any) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(model).Where(query, args...).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestEraseApp(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	seed := func(t *testing.T, db *gorm.DB, apps ...string) {
+		t.Helper()
+		db.Create(&models.User{UserID: "user", FirstSeen: at})
+		db.Create(&models.UserAlias{AliasID: "device", UserID: "user"})
+		for _, app := range apps {
+			db.Create(&models.UserEvent{App: app, UserID: "user", EventType: "launch", EventTime: at})
+			db.Create(&models.DeadLetter{App: app, UserID: "device", Reason: "schema"})
+		}
+	}
+
+	t.Run("other apps remain", func(t *testing.T) {
+		db := openTestDB(t)
+		seed(t, db, "shop", "news")
+		// Opt-outs are recorded for the reported alias and the user.
+		for _, id := range []string{"device", "user"} {
+			if _, err := EraseApp(ctx, db, nil, id, "shop"); err != nil {
+				t.Fatalf("EraseApp(%s): %v", id, err)
+			}
+		}
+		if n := count(t, db, &models.UserEvent{}, "app = ?", "shop"); n != 0 {
+			t.Errorf("%d shop events left", n)
+		}
+		if n := count(t, db, &models.UserEvent{}, "app = ?", "news"); n != 1 {
+			t.Errorf("%d news events left, want 1", n)
+		}
+		if n := count(t, db, &models.UserAlias{}, "alias_id = ?", "device"); n != 1 {
+			t.Error("erasing the alias of a user with other events broke the alias link")
+		}
+		if n := count(t, db, &models.User{}, "user_id = ?", "user"); n != 1 {
+			t.Error("user deleted although they have events in other apps")
+		}
+		if n := count(t, db, &models.DeadLetter{}, "app = ?", "shop"); n != 0 {
+			t.Errorf("%d shop dead letters left", n)
+		}
+	})
+
+	t.Run("last app", func(t *testing.T) {
+		db := openTestDB(t)
+		seed(t, db, "shop")
+		res, err := EraseApp(ctx, db, nil, "user", "shop")
+		if err != nil {
+			t.Fatalf("EraseApp: %v", err)
+		}
+		if res.Rows["user_events"] != 1 || res.Rows["users"] != 1 || res.Rows["user_aliases"] != 1 {
+			t.Errorf("rows = %v", res.Rows)
+		}
+		if n := count(t, db, &models.User{}, "1 = 1"); n != 0 {
+			t.Error("user left after erasing their last app")
+		}
+		if n := count(t, db, &models.DeadLetter{}, "1 = 1"); n != 0 {
+			t.Errorf("%d dead letters of the alias left", n)
+		}
+	})
+
+	t.Run("alias only", func(t *testing.T) {
+		db := openTestDB(t)
+		seed(t, db, "shop")
+		res, err := EraseApp(ctx, db, nil, "device", "shop")
+		if err != nil {
+			t.Fatalf("EraseApp: %v", err)
+		}
+		if res.Rows["user_aliases"] != 0 || res.Rows["users"] != 0 {
+			t.Errorf("rows = %v, want no full erase", res.Rows)
+		}
+		if n := count(t, db, &models.UserAlias{}, "alias_id = ?", "device"); n != 1 {
+			t.Error("alias link deleted")
+		}
+	})
+}
+
+func TestEraseDeletesAliasesAndDeadLetters(t *testing.T) {
+	db := openTestDB(t)
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	db.Create(&models.User{UserID: "user", FirstSeen: at})
+	db.Create(&models.User{UserID: "other", FirstSeen: at})
+	db.Create(&models.UserAlias{AliasID: "device", UserID: "user"})
+	db.Create(&models.UserEvent{App: "shop", UserID: "user", EventType: "launch", EventTime: at})
+	db.Create(&models.UserEvent{App: "shop", UserID: "other", EventType: "launch", EventTime: at})
+	db.Create(&models.DeadLetter{App: "shop", UserID: "device"})
+	db.Create(&models.DeadLetter{App: "shop", UserID: "other"})
+
+	if _, err := Erase(ctx, db, nil, "user", "unknown"); err == nil {
+		t.Error("Erase with an unknown action succeeded")
+	}
+	res, err := Erase(ctx, db, nil, "user", models.PrivacyAnonymize)
+	if err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if res.Pseudonym == "" || count(t, db, &models.UserEvent{}, "user_id = ?", res.Pseudonym) != 1 {
+		t.Errorf("events not moved to the pseudonym %q", res.Pseudonym)
+	}
+	if n := count(t, db, &models.UserAlias{}, "1 = 1"); n != 0 {
+		t.Errorf("%d aliases left", n)
+	}
+	if n := count(t, db, &models.DeadLetter{}, "1 = 1"); n != 1 {
+		t.Errorf("%d dead letters left, want only the other user's", n)
+	}
+	if n := count(t, db, &models.UserEvent{}, "user_id = ?", "other"); n != 1 {
+		t.Error("events of another user erased")
+	}
+}
+
+func TestEraseArchived(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	seed := func(t *testing.T) (*gorm.DB, archive.Store) {
+		t.Helper()
+		db := testdb.Open(t, &models.User{}, &models.UserAlias{}, &models.UserProperty{}, &models.UserPropertyChange{},
+			&models.UserEvent{}, &models.WebhookDelivery{}, &models.DeadLetter{}, &models.RollupDay{},
+			&models.ArchivePartition{}, &models.PrivacyAudit{}, &models.ConsentOptOut{})
+		store := &archive.LocalStore{Dir: t.TempDir()}
+		// The device's events were archived before it was linked to the user.
+		for _, e := range []models.UserEvent{
+			{App: "shop", UserID: "device", EventType: "launch", EventTime: day.Add(time.Hour)},
+			{App: "shop", UserID: "other", EventType: "launch", EventTime: day.Add(2 * time.Hour)},
+			{App: "news", UserID: "user", EventType: "launch", EventTime: day.Add(time.Hour)},
+		} {
+			db.Create(&e)
+		}
+		a := archive.NewArchiver(db, store, 1, time.Hour)
+		for _, app := range []string{"shop", "news"} {
+			if _, err := a.ArchiveDay(ctx, app, day); err != nil {
+				t.Fatalf("ArchiveDay(%s): %v", app, err)
+			}
+		}
+		db.Where("1 = 1").Delete(&models.UserEvent{})
+		db.Create(&models.User{UserID: "user", FirstSeen: day})
+		db.Create(&models.UserAlias{AliasID: "device", UserID: "user"})
+		return db, store
+	}
+	archived := func(t *testing.T, db *gorm.DB) map[string]int64 {
+		t.Helper()
+		var parts []models.ArchivePartition
+		db.Find(&parts)
+		events := make(map[string]int64)
+		for _, p := range parts {
+			events[p.App] = p.Events
+		}
+		return events
+	}
+
+	t.Run("erase", func(t *testing.T) {
+		db, store := seed(t)
+		res, err := Erase(ctx, db, store, "user", models.PrivacyDelete)
+		if err != nil {
+			t.Fatalf("Erase: %v", err)
+		}
+		if res.Rows["archived_events"] != 2 {
+			t.Errorf("rows = %v, want 2 archived events", res.Rows)
+		}
+		if got := archived(t, db); len(got) != 1 || got["shop"] != 1 {
+			t.Errorf("archived events by app = %v, want only the other user's", got)
+		}
+	})
+
+	t.Run("opt-out", func(t *testing.T) {
+		db, store := seed(t)
+		res, err := EraseApp(ctx, db, store, "user", "shop")
+		if err != nil {
+			t.Fatalf("EraseApp: %v", err)
+		}
+		if res.Rows["archived_events"] != 1 {
+			t.Errorf("rows = %v, want 1 archived event", res.Rows)
+		}
+		if got := archived(t, db); got["shop"] != 1 || got["news"] != 1 {
+			t.Errorf("archived events by app = %v, want the news event kept", got)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"appstats/internal/models"
+)
+
+// Property value types.
+const (
+	TypeString = "string"
+	TypeNumber = "number"
+	TypeBool   = "bool"
+)
+
+const (
+	maxNameLength  = 64
+	maxValueLength = 255
+	// maxProperties bounds the number of properties a single user can have.
+	maxProperties = 200
+)
+
+// ErrConflict is returned by Apply when an operation does not fit the
+// current properties, e.g. incrementing a string.
+var ErrConflict = errors.New("property conflict")
+
+// Update is a set of property operations applied together. Operations are
+// applied in the order unset, set_once, set, increment.
+type Update struct {
+	// Set assigns values, replacing existing ones.
+	Set map[string]any `json:"set"`
+	// SetOnce assigns values only to properties that are not set yet.
+	SetOnce map[string]any `json:"set_once"`
+	// Increment adds to numeric properties, starting from 0.
+	Increment map[string]float64 `json:"increment"`
+	// Unset removes properties.
+	Unset []string `json:"unset"`
+}
+
+// Validate checks property names and values.
+func (u *Update) Validate() error {
+	if len(u.Set)+len(u.SetOnce)+len(u.Increment)+len(u.Unset) == 0 {
+		return errors.New("no operations")
+	}
+	seen := make(map[string]string)
+	check := func(op, name string) error {
+		if name == "" || utf8.RuneCountInString(name) > maxNameLength {
+			return fmt.Errorf("%s: property name must be 1-%d characters", op, maxNameLength)
+		}
+		// Names are used in filters of the form user.<name>:op:value.
+		if strings.Contains(name, ":") {
+			return fmt.Errorf("%s: property name %q must not contain ':'", op, name)
+		}
+		if prev, ok := seen[name]; ok {
+			return fmt.Errorf("property %q is used by both %s and %s", name, prev, op)
+		}
+		seen[name] = op
+		return nil
+	}
+	for op, values := range map[string]map[string]any{"set": u.Set, "set_once": u.SetOnce} {
+		for name, v := range values {
+			if err := check(op, name); err != nil {
+				return err
+			}
+			if _, _, err := encode(v); err != nil {
+				return fmt.Errorf("%s.%s: %w", op, name, err)
+			}
+		}
+	}
+	for name := range u.Increment {
+		if err := check("increment", name); err != nil {
+			return err
+		}
+	}
+	for _, name := range u.Unset {
+		if err := check("unset", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode returns the stored form and type of a JSON value.
+func encode(v any) (string, string, error) {
+	switch x := v.(type) {
+	case string:
+		if utf8.RuneCountInString(x) > maxValueLength {
+			return "", "", fmt.Errorf("string values are limited to %d characters", maxValueLength)
+		}
+		return x, TypeString, nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), TypeNumber, nil
+	case bool:
+		return strconv.FormatBool(x), TypeBool, nil
+	}
+	return "", "", errors.New("values must be strings, numbers or booleans")
+}
+
+// decode returns the JSON value of a stored property.
+func decode(p models.UserProperty) any {
+	switch p.Type {
+	case TypeNumber:
+		if f, err := strconv.ParseFloat(p.Value, 64); err == nil {
+			return f
+		}
+	case TypeBool:
+		return p.Value == "true"
+	}
+	return p.Value
+}
+
+// Apply applies u to the properties of userID, records every change in the
+// property history and returns the resulting properties.
+func Apply(db *gorm.DB, userID string, u Update, at time.Time) (map[string]any, error) {
+	var result map[string]any
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var rows []models.UserProperty
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+			return err
+		}
+		current := make(map[string]models.UserProperty, len(rows))
+		for _, r := range rows {
+			current[r.Name] = r
+		}
+
+		type change struct {
+			old, new *models.UserProperty
+		}
+		// Validate guarantees that each name is used by a single operation.
+		changes := make(map[string]change)
+		put := func(name, value, typ string) {
+			old, ok := current[name]
+			if ok && old.Value == value && old.Type == typ {
+				return
+			}
+			next := models.UserProperty{ID: old.ID, UserID: userID, Name: name, Value: value, Type: typ}
+			c := change{new: &next}
+			if ok {
+				c.old = &old
+			}
+			changes[name] = c
+			current[name] = next
+		}
+
+		for _, name := range u.Unset {
+			if old, ok := current[name]; ok {
+				changes[name] = change{old: &old}
+				delete(current, name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(u.SetOnce)) {
+			if _, ok := current[name]; ok {
+				continue
+			}
+			value, typ, _ := encode(u.SetOnce[name])
+			put(name, value, typ)
+		}
+		for _, name := range slices.Sorted(maps.Keys(u.Set)) {
+			value, typ, _ := encode(u.Set[name])
+			put(name, value, typ)
+		}
+		for _, name := range slices.Sorted(maps.Keys(u.Increment)) {
+			var base float64
+			if old, ok := current[name]; ok {
+				f, err := strconv.ParseFloat(old.Value, 64)
+				if old.Type != TypeNumber || err != nil {
+					return fmt.Errorf("%w: property %q is not a number", ErrConflict, name)
+				}
+				base = f
+			}
+			put(name, strconv.FormatFloat(base+u.Increment[name], 'f', -1, 64), TypeNumber)
+		}
+		if len(current) > maxProperties {
+			return fmt.Errorf("%w: users are limited to %d properties", ErrConflict, maxProperties)
+		}
+
+		for _, name := range slices.Sorted(maps.Keys(changes)) {
+			c := changes[name]
+			switch {
+			case c.new == nil:
+				if err := tx.Delete(&models.UserProperty{}, c.old.ID).Error; err != nil {
+					return err
+				}
+			case c.new.ID == 0:
+				if err := tx.Create(c.new).Error; err != nil {
+					return err
+				}
+			default:
+				if err := tx.Save(c.new).Error; err != nil {
+					return err
+				}
+			}
+			var oldValue, newValue *string
+			if c.old != nil {
+				oldValue = &c.old.Value
+			}
+			if c.new != nil {
+				newValue = &c.new.Value
+			}
+			if err := RecordChange(tx, userID, name, oldValue, newValue, at); err != nil {
+				return err
+			}
+		}
+
+		result = make(map[string]any, len(current))
+		for name, p := range current {
+			result[name] = decode(p)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RecordChange appends an entry to the property history of userID. Nothing
+// is recorded when the value did not change.
+func RecordChange(db *gorm.DB, userID, name string, oldValue, newValue *string, at time.Time) error {
+	if (oldValue == nil && newValue == nil) || (oldValue != nil && newValue != nil && *oldValue == *newValue) {
+		return nil
+	}
+	return db.Create(&models.UserPropertyChange{
+		UserID:    userID,
+		Name:      name,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+		ChangedAt: at,
+	}).Error
+}
+
+// Properties returns the properties of userID.
+func Properties(db *gorm.DB, userID string) (map[string]any, error) {
+	var rows []models.UserProperty
+	if err := db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]any, len(rows))
+	for _, r := range rows {
+		res[r.Name] = decode(r)
+	}
+	return res, nil
+}
+
+// History returns the latest property changes of userID, newest first.
+func History(db *gorm.DB, userID string, limit int) ([]models.UserPropertyChange, error) {
+	var res []models.UserPropertyChange
+	err := db.Where("user_id = ?", userID).Order("changed_at DESC, id DESC").Limit(limit).Find(&res).Error
+	return res, err
+}
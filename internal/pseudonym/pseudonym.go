@@ -0,0 +1,337 @@
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+)
+
+const (
+	// settingsCacheTTL bounds how long changed settings or salts take to
+	// apply on other instances.
+	settingsCacheTTL = 30 * time.Second
+	// maxCacheEntries bounds the cache of pseudonyms chosen among several
+	// salt versions; it is simply cleared when full.
+	maxCacheEntries = 100000
+)
+
+// ErrPII is returned for user IDs that look like personal data when the app
+// rejects them.
+var ErrPII = errors.New("user_id looks like personal data (email or phone number); report a stable opaque ID instead")
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	// phonePattern matches numbers in international format and mainland
+	// China mobile numbers. Other plain digit strings are left alone, as
+	// many apps use numeric account IDs.
+	phonePattern = regexp.MustCompile(`^(\+\d[\d\s-]{6,18}\d|(86)?1[3-9]\d{9})$`)
+	// pseudonymPattern matches the IDs produced by Pseudonymizer.
+	pseudonymPattern = regexp.MustCompile(`^p(\d+)_[0-9a-f]{32}$`)
+)
+
+// DetectPII returns "email" or "phone" when id looks like one, and "" when
+// it does not.
+func DetectPII(id string) string {
+	id = strings.TrimSpace(id)
+	switch {
+	case emailPattern.MatchString(id):
+		return "email"
+	case phonePattern.MatchString(id):
+		return "phone"
+	}
+	return ""
+}
+
+// IsPseudonym reports whether id was produced by a Pseudonymizer.
+func IsPseudonym(id string) bool {
+	return pseudonymPattern.MatchString(id)
+}
+
+// Validate checks privacy settings before they are saved.
+func Validate(s *models.AppPrivacy) error {
+	s.App = strings.TrimSpace(s.App)
+	if s.App == "" {
+		return errors.New("app is required")
+	}
+	switch s.PIIAction {
+	case "":
+		s.PIIAction = models.PIIAllow
+	case models.PIIAllow, models.PIIHash, models.PIIReject:
+	default:
+		return fmt.Errorf("unknown pii_action %q", s.PIIAction)
+	}
+	switch s.OptOutMode {
+	case "":
+		s.OptOutMode = models.OptOutDrop
+	case models.OptOutDrop, models.OptOutCount:
+	default:
+		return fmt.Errorf("unknown opt_out_mode %q", s.OptOutMode)
+	}
+	return nil
+}
+
+// Pseudonymizer replaces reported user IDs with keyed hashes according to
+// the privacy settings of each app. A pseudonym is "p<version>_" followed by
+// the first 16 bytes of HMAC-SHA256(salt, user ID) in hex, so the same ID
+// always maps to the same pseudonym while the salt is kept secret.
+//
+// After a salt is rotated, IDs already seen under an older salt keep their
+// pseudonym until that salt is retired; new IDs use the newest salt.
+type Pseudonymizer struct {
+	db *gorm.DB
+	// defaultPIIAction applies to apps without settings.
+	defaultPIIAction string
+
+	mu       sync.Mutex
+	settings map[string]models.AppPrivacy
+	salts    map[string][]models.PseudonymSalt // newest first
+	loadedAt time.Time
+	chosen   map[string]string
+}
+
+// NewPseudonymizer returns a pseudonymizer backed by db. defaultPIIAction
+// applies to apps without settings and defaults to allow.
+func NewPseudonymizer(db *gorm.DB, defaultPIIAction string) *Pseudonymizer {
+	if defaultPIIAction == "" {
+		defaultPIIAction = models.PIIAllow
+	}
+	return &Pseudonymizer{db: db, defaultPIIAction: defaultPIIAction, chosen: make(map[string]string)}
+}
+
+// Invalidate drops the cached settings and salts, e.g. after they changed.
+func (p *Pseudonymizer) Invalidate() {
+	p.mu.Lock()
+	p.settings, p.salts, p.loadedAt = nil, nil, time.Time{}
+	clear(p.chosen)
+	p.mu.Unlock()
+}
+
+// Apply returns the ID to store for userID reported to app: a pseudonym
+// when the app pseudonymizes user IDs or userID looks like personal data
+// and the app hashes it, and userID itself otherwise. IDs in the pseudonym
+// format are kept only when their version is an active salt of the app;
+// others, e.g. under a retired salt, are hashed like any ID. It returns ErrPII
+// when userID looks like personal data and the app rejects it.
+func (p *Pseudonymizer) Apply(app, userID string) (string, error) {
+	settings, err := p.Settings(app)
+	if err != nil {
+		return "", err
+	}
+	if ok, err := p.isActivePseudonym(app, userID); err != nil || ok {
+		// Already pseudonymized, e.g. an ID taken from an export.
+		return userID, err
+	}
+	hash := settings.Pseudonymize
+	if kind := DetectPII(userID); kind != "" {
+		metrics.PIIDetected.WithLabelValues(kind, settings.PIIAction).Inc()
+		switch settings.PIIAction {
+		case models.PIIReject:
+			return "", ErrPII
+		case models.PIIHash:
+			hash = true
+		}
+	}
+	if !hash {
+		return userID, nil
+	}
+	return p.pseudonym(app, userID)
+}
+
+// isActivePseudonym reports whether id is a pseudonym under one of the
+// active salt versions of app.
+func (p *Pseudonymizer) isActivePseudonym(app, id string) (bool, error) {
+	m := pseudonymPattern.FindStringSubmatch(id)
+	if m == nil {
+		return false, nil
+	}
+	version, err := strconv.Atoi(m[1])
+	if err != nil {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(p.salts[app], func(s models.PseudonymSalt) bool { return s.Version == version }), nil
+}
+
+// Settings returns the privacy settings of app, or the defaults when it has
+// none.
+func (p *Pseudonymizer) Settings(app string) (models.AppPrivacy, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.load(); err != nil {
+		return models.AppPrivacy{}, err
+	}
+	if s, ok := p.settings[app]; ok {
+		return s, nil
+	}
+	return models.AppPrivacy{App: app, PIIAction: p.defaultPIIAction, OptOutMode: models.OptOutDrop}, nil
+}
+
+// load refreshes the cache when it is older than settingsCacheTTL. The
+// caller holds p.mu.
+func (p *Pseudonymizer) load() error {
+	if time.Since(p.loadedAt) <= settingsCacheTTL {
+		return nil
+	}
+	var settings []models.AppPrivacy
+	if err := p.db.Find(&settings).Error; err != nil {
+		return err
+	}
+	var salts []models.PseudonymSalt
+	if err := p.db.Where("retired_at IS NULL").Order("app, version DESC").Find(&salts).Error; err != nil {
+		return err
+	}
+	p.settings = make(map[string]models.AppPrivacy, len(settings))
+	for _, s := range settings {
+		p.settings[s.App] = s
+	}
+	p.salts = make(map[string][]models.PseudonymSalt)
+	for _, s := range salts {
+		p.salts[s.App] = append(p.salts[s.App], s)
+	}
+	p.loadedAt = time.Now()
+	return nil
+}
+
+func (p *Pseudonymizer) pseudonym(app, userID string) (string, error) {
+	p.mu.Lock()
+	if err := p.load(); err != nil {
+		p.mu.Unlock()
+		return "", err
+	}
+	salts := p.salts[app]
+	p.mu.Unlock()
+
+	if len(salts) == 0 {
+		// The first salt of an app is created on first use. Another
+		// instance may create it at the same time, so reload either way.
+		_, rerr := Rotate(p.db, app)
+		p.Invalidate()
+		p.mu.Lock()
+		err := p.load()
+		salts = p.salts[app]
+		p.mu.Unlock()
+		if err != nil {
+			return "", err
+		}
+		if len(salts) == 0 {
+			return "", fmt.Errorf("create pseudonym salt: %w", rerr)
+		}
+	}
+	candidates := make([]string, len(salts))
+	for i, s := range salts {
+		candidates[i] = Hash(s, userID)
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+
+	// Several active salts: keep the pseudonym the ID was first stored
+	// under. Only the newest candidate is used as cache key, so raw IDs are
+	// not kept in memory.
+	p.mu.Lock()
+	id, ok := p.chosen[candidates[0]]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	id = candidates[0]
+	var existing []string
+	if err := p.db.Raw("SELECT user_id FROM users WHERE user_id IN ? UNION SELECT alias_id FROM user_aliases WHERE alias_id IN ?",
+		candidates[1:], candidates[1:]).Scan(&existing).Error; err != nil {
+		return "", err
+	}
+	for _, c := range candidates[1:] {
+		if slices.Contains(existing, c) {
+			id = c
+			break
+		}
+	}
+	p.mu.Lock()
+	if len(p.chosen) >= maxCacheEntries {
+		clear(p.chosen)
+	}
+	p.chosen[candidates[0]] = id
+	p.mu.Unlock()
+	return id, nil
+}
+
+// Hash returns the pseudonym of userID under salt.
+func Hash(salt models.PseudonymSalt, userID string) string {
+	mac := hmac.New(sha256.New, []byte(salt.Salt))
+	mac.Write([]byte(userID))
+	return "p" + strconv.Itoa(salt.Version) + "_" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Lookup returns the pseudonyms userID has under the active salts of app,
+// newest first, so operators can find the data of a user who only knows
+// their raw ID.
+func Lookup(db *gorm.DB, app, userID string) ([]string, error) {
+	var salts []models.PseudonymSalt
+	if err := db.Where("app = ? AND retired_at IS NULL", app).Order("version DESC").Find(&salts).Error; err != nil {
+		return nil, err
+	}
+	res := make([]string, len(salts))
+	for i, s := range salts {
+		res[i] = Hash(s, userID)
+	}
+	return res, nil
+}
+
+// Rotate creates a new salt version for app. Older salts stay active until
+// they are retired, so known IDs keep their pseudonyms.
+func Rotate(db *gorm.DB, app string) (*models.PseudonymSalt, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	var salt *models.PseudonymSalt
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var last struct{ V *int }
+		if err := tx.Model(&models.PseudonymSalt{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("MAX(version) AS v").Where("app = ?", app).Scan(&last).Error; err != nil {
+			return err
+		}
+		version := 1
+		if last.V != nil {
+			version = *last.V + 1
+		}
+		salt = &models.PseudonymSalt{App: app, Version: version, Salt: hex.EncodeToString(key)}
+		return tx.Create(salt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Retire stops using a salt. IDs stored under it are no longer recognized
+// and get a pseudonym of the newest salt when they are reported again.
+func Retire(db *gorm.DB, id uint, now time.Time) error {
+	res := db.Model(&models.PseudonymSalt{}).Where("id = ? AND retired_at IS NULL", id).Update("retired_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
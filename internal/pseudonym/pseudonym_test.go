@@ -0,0 +1,140 @@
+package pseudonym
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestDetectPII(t *testing.T) {
+	tests := []struct {
+		id, want string
+	}{
+		{"alice@example.com", "email"},
+		{" alice.smith+tag@mail.example.cn ", "email"},
+		{"13812345678", "phone"},
+		{"8613812345678", "phone"},
+		{"+86 138-1234-5678", "phone"},
+		{"+1 415 555 0100", "phone"},
+		// Numeric account IDs are not phone numbers.
+		{"12345678", ""},
+		{"10012345678", ""},
+		{"138123456789", ""},
+		{"alice@localhost", ""},
+		{"a b@example.com", ""},
+		{"device-3f2a", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := DetectPII(tt.id); got != tt.want {
+			t.Errorf("DetectPII(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	salt := models.PseudonymSalt{Version: 3, Salt: "k1"}
+	// "p3_" + hex(HMAC-SHA256("k1", "alice")[:16])
+	want := "p3_aff3e2227d2581aeb66e413f8c39d1e2"
+	if got := Hash(salt, "alice"); got != want {
+		t.Errorf("Hash = %q, want %q", got, want)
+	}
+	if !IsPseudonym(want) {
+		t.Errorf("IsPseudonym(%q) = false", want)
+	}
+	if Hash(models.PseudonymSalt{Version: 3, Salt: "k2"}, "alice") == want || Hash(salt, "bob") == want {
+		t.Error("pseudonym does not depend on the salt and ID")
+	}
+	for _, id := range []string{"alice", "p3_aff3", "p_aff3e2227d2581aeb66e413f8c39d1e2", "P3_AFF3E2227D2581AEB66E413F8C39D1E2"} {
+		if IsPseudonym(id) {
+			t.Errorf("IsPseudonym(%q) = true", id)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	db := testdb.Open(t, &models.AppPrivacy{}, &models.PseudonymSalt{}, &models.User{}, &models.UserAlias{})
+	for _, s := range []models.AppPrivacy{
+		{App: "hashed", Pseudonymize: true, PIIAction: models.PIIAllow},
+		{App: "strict", PIIAction: models.PIIReject},
+		{App: "masked", PIIAction: models.PIIHash},
+	} {
+		if err := db.Create(&s).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := NewPseudonymizer(db, "")
+
+	tests := []struct {
+		app, id  string
+		wantHash bool
+		wantErr  error
+	}{
+		{app: "other", id: "alice@example.com"},
+		{app: "hashed", id: "u1", wantHash: true},
+		{app: "strict", id: "u1"},
+		{app: "strict", id: "13812345678", wantErr: ErrPII},
+		{app: "masked", id: "u1"},
+		{app: "masked", id: "alice@example.com", wantHash: true},
+	}
+	for _, tt := range tests {
+		got, err := p.Apply(tt.app, tt.id)
+		switch {
+		case tt.wantErr != nil:
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Apply(%s, %s): err = %v, want %v", tt.app, tt.id, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("Apply(%s, %s): %v", tt.app, tt.id, err)
+		case tt.wantHash && (!IsPseudonym(got) || got == tt.id):
+			t.Errorf("Apply(%s, %s) = %q, want a pseudonym", tt.app, tt.id, got)
+		case !tt.wantHash && got != tt.id:
+			t.Errorf("Apply(%s, %s) = %q, want the ID unchanged", tt.app, tt.id, got)
+		}
+	}
+
+	// The same ID keeps its pseudonym, and pseudonyms are not hashed again.
+	first, _ := p.Apply("hashed", "u1")
+	if again, err := p.Apply("hashed", "u1"); err != nil || again != first {
+		t.Errorf("second Apply = %q, %v, want %q", again, err, first)
+	}
+	if again, err := p.Apply("hashed", first); err != nil || again != first {
+		t.Errorf("Apply of a pseudonym = %q, %v", again, err)
+	}
+
+	// After a rotation, known IDs keep the pseudonym of the older salt and
+	// new IDs use the new one.
+	db.Create(&models.User{UserID: first, FirstSeen: time.Now()})
+	if _, err := Rotate(db, "hashed"); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	p.Invalidate()
+	if got, err := p.Apply("hashed", "u1"); err != nil || got != first {
+		t.Errorf("Apply after rotation = %q, %v, want the known pseudonym %q", got, err, first)
+	}
+	if got, err := p.Apply("hashed", "u2"); err != nil || got[:3] != "p2_" {
+		t.Errorf("Apply of a new ID after rotation = %q, %v, want the version 2 salt", got, err)
+	}
+	lookup, err := Lookup(db, "hashed", "u1")
+	if err != nil || len(lookup) != 2 || lookup[1] != first {
+		t.Errorf("Lookup = %v, %v", lookup, err)
+	}
+
+	// Only pseudonyms of active salt versions are kept as they are.
+	unknown := "p9_" + first[3:]
+	if got, err := p.Apply("hashed", unknown); err != nil || got == unknown || got[:3] != "p2_" {
+		t.Errorf("Apply of a pseudonym of an unknown version = %q, %v, want it hashed", got, err)
+	}
+	var salt1 models.PseudonymSalt
+	db.Where("app = ? AND version = 1", "hashed").First(&salt1)
+	if err := Retire(db, salt1.ID, time.Now()); err != nil {
+		t.Fatalf("Retire: %v", err)
+	}
+	p.Invalidate()
+	if got, err := p.Apply("hashed", first); err != nil || got == first || got[:3] != "p2_" {
+		t.Errorf("Apply of a pseudonym of a retired salt = %q, %v, want it hashed", got, err)
+	}
+}
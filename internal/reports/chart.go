@@ -0,0 +1,237 @@
+package reports
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"strconv"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Charts are rendered server side as PNG so they can be embedded in mail;
+// most mail clients run neither scripts nor SVG. Labels use a built-in ASCII
+// font, so titles and non-ASCII names belong in the surrounding HTML.
+const (
+	chartWidth  = 640
+	chartHeight = 220
+	marginLeft  = 56
+	marginRight = 16
+	marginTop   = 12
+	marginBot   = 26
+	gridLines   = 4
+	barHeight   = 18
+	barGap      = 6
+	barLabelW   = 120
+)
+
+var (
+	colorBG   = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	colorGrid = color.RGBA{0xe5, 0xe5, 0xe5, 0xff}
+	colorAxis = color.RGBA{0x99, 0x99, 0x99, 0xff}
+	colorText = color.RGBA{0x44, 0x44, 0x44, 0xff}
+	colorLine = color.RGBA{0x36, 0xa2, 0xeb, 0xff}
+	colorFill = color.NRGBA{0x36, 0xa2, 0xeb, 0x33}
+)
+
+// lineChart renders values as a line over the given x labels.
+func lineChart(labels []string, values []float64) ([]byte, error) {
+	img := newCanvas(chartWidth, chartHeight)
+	plotW := chartWidth - marginLeft - marginRight
+	plotH := chartHeight - marginTop - marginBot
+	top := niceMax(maxOf(values))
+
+	for i := 0; i <= gridLines; i++ {
+		y := marginTop + plotH - plotH*i/gridLines
+		c := colorGrid
+		if i == 0 {
+			c = colorAxis
+		}
+		fillRect(img, marginLeft, y, marginLeft+plotW, y+1, c)
+		label := formatNumber(top * float64(i) / gridLines)
+		drawText(img, marginLeft-6-textWidth(label), y+4, label)
+	}
+
+	n := len(values)
+	x := func(i int) int {
+		if n == 1 {
+			return marginLeft + plotW/2
+		}
+		return marginLeft + plotW*i/(n-1)
+	}
+	y := func(v float64) int {
+		return marginTop + plotH - int(math.Round(v/top*float64(plotH)))
+	}
+
+	// Area under the line, then the line itself and point markers.
+	base := marginTop + plotH
+	for i := 0; i+1 < n; i++ {
+		x0, x1 := x(i), x(i+1)
+		end := x1 // columns are filled once, the last segment includes its end
+		if i+2 == n {
+			end++
+		}
+		for px := x0; px < end; px++ {
+			t := float64(px-x0) / float64(max(x1-x0, 1))
+			py := int(math.Round(float64(y(values[i])) + t*float64(y(values[i+1])-y(values[i]))))
+			blendRect(img, px, py, px+1, base, colorFill)
+		}
+	}
+	for i := 0; i+1 < n; i++ {
+		drawLine(img, x(i), y(values[i]), x(i+1), y(values[i+1]), colorLine)
+	}
+	for i, v := range values {
+		fillRect(img, x(i)-2, y(v)-2, x(i)+3, y(v)+3, colorLine)
+	}
+
+	// X labels: first, last and a few in between so they never overlap.
+	step := max(1, (n+5)/6)
+	for i := 0; i < n; i++ {
+		if i%step != 0 && i != n-1 {
+			continue
+		}
+		if i != n-1 && n-1-i < step {
+			continue
+		}
+		w := textWidth(labels[i])
+		drawText(img, min(max(x(i)-w/2, 0), chartWidth-w), chartHeight-8, labels[i])
+	}
+	return encodePNG(img)
+}
+
+// barChart renders horizontal bars, one per label.
+func barChart(labels []string, values []float64) ([]byte, error) {
+	h := marginTop*2 + len(labels)*(barHeight+barGap)
+	img := newCanvas(chartWidth, h)
+	plotW := chartWidth - barLabelW - marginRight - 60
+	top := maxOf(values)
+	if top == 0 {
+		top = 1
+	}
+	for i, v := range values {
+		y := marginTop + i*(barHeight+barGap)
+		label := labels[i]
+		if len(label) > 14 {
+			label = label[:13] + "~"
+		}
+		drawText(img, barLabelW-8-textWidth(label), y+barHeight-5, label)
+		w := int(math.Round(v / top * float64(plotW)))
+		fillRect(img, barLabelW, y, barLabelW+max(w, 1), y+barHeight, colorLine)
+		drawText(img, barLabelW+max(w, 1)+6, y+barHeight-5, formatNumber(v))
+	}
+	return encodePNG(img)
+}
+
+func newCanvas(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(colorBG), image.Point{}, draw.Src)
+	return img
+}
+
+func fillRect(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+func blendRect(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Over)
+}
+
+// drawLine draws a two pixel wide line using Bresenham's algorithm.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		fillRect(img, x0, y0, x0+2, y0+2, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func drawText(img *image.RGBA, x, y int, s string) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(colorText),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+func textWidth(s string) int {
+	return font.MeasureString(basicfont.Face7x13, s).Round()
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// niceMax rounds v up to 1, 2 or 5 times a power of ten so grid labels are
+// round numbers.
+func niceMax(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	p := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*p {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+func maxOf(values []float64) float64 {
+	var m float64
+	for _, v := range values {
+		m = max(m, v)
+	}
+	return m
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// formatNumber prints integers without decimals and large values with a
+// k/M suffix.
+func formatNumber(v float64) string {
+	switch {
+	case v >= 1e6:
+		return strconv.FormatFloat(math.Round(v/1e5)/10, 'f', -1, 64) + "M"
+	case v >= 1e4:
+		return strconv.FormatFloat(math.Round(v/100)/10, 'f', -1, 64) + "k"
+	case v == math.Trunc(v):
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	default:
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+}
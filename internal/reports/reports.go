@@ -0,0 +1,441 @@
+package reports
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/notify"
+	"appstats/internal/stats"
+	"appstats/internal/traffic"
+)
+
+// Report sections besides the metrics of stats.Measure.
+const (
+	SectionTopVersions  = "top_versions"
+	SectionTopPlatforms = "top_platforms"
+	SectionTopRegions   = "top_regions"
+)
+
+const (
+	defaultDays = 7
+	maxDays     = 31
+	topN        = 10
+)
+
+// Sections lists every section a schedule can include, in report order.
+var Sections = []string{
+	stats.MetricNewUsers, stats.MetricActiveUsers, stats.MetricEvents,
+	SectionTopVersions, SectionTopPlatforms, SectionTopRegions,
+}
+
+var sectionTitles = map[string]string{
+	stats.MetricNewUsers:    "新增用户",
+	stats.MetricActiveUsers: "活跃用户",
+	stats.MetricEvents:      "事件数",
+	SectionTopVersions:      "版本分布",
+	SectionTopPlatforms:     "平台分布",
+	SectionTopRegions:       "地区分布",
+}
+
+// Validate checks a schedule and fills in defaults.
+func Validate(s *models.ReportSchedule) error {
+	if _, err := Location(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", s.Timezone)
+	}
+	if _, err := cron.ParseStandard(s.Cron); err != nil {
+		return fmt.Errorf("invalid cron expression: %w", err)
+	}
+	if len(s.Recipients) == 0 {
+		return errors.New("at least one recipient is required")
+	}
+	for _, to := range s.Recipients {
+		if !strings.Contains(to, "@") {
+			return fmt.Errorf("invalid recipient %q", to)
+		}
+	}
+	return ValidateContent(s)
+}
+
+// ValidateContent checks only the fields that affect the report content, so
+// drafts can be previewed before they are scheduled.
+func ValidateContent(s *models.ReportSchedule) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(s.Metrics) == 0 {
+		s.Metrics = []string{stats.MetricNewUsers, stats.MetricActiveUsers, SectionTopVersions}
+	}
+	for _, m := range s.Metrics {
+		if !slices.Contains(Sections, m) {
+			return fmt.Errorf("unsupported metric %q", m)
+		}
+	}
+	if s.Days == 0 {
+		s.Days = defaultDays
+	}
+	if s.Days < 2 || s.Days > maxDays {
+		return fmt.Errorf("days must be between 2 and %d", maxDays)
+	}
+	return nil
+}
+
+// NextRun returns the first run time of s strictly after t.
+func NextRun(s *models.ReportSchedule, t time.Time) (time.Time, error) {
+	loc, err := Location(s.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sched, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(t.In(loc)), nil
+}
+
+// Location returns the time zone of a schedule's Timezone, the server's
+// local time when it is empty.
+func Location(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// Report is the rendered content of one schedule run.
+type Report struct {
+	Name     string
+	App      string
+	Day      string
+	Subject  string
+	Sections []Section
+}
+
+// Section is one metric or breakdown of a report.
+type Section struct {
+	Key   string
+	Title string
+	// Value and Previous are the metric on the report day and the day
+	// before; breakdowns only have Rows.
+	Value    float64
+	Previous float64
+	HasValue bool
+	Rows     []Row
+	Chart    []byte // PNG
+}
+
+// Row is one entry of a breakdown.
+type Row struct {
+	Name  string
+	Users int64
+	Share float64 // of the day's active users
+}
+
+// Change formats the relative change against the previous day.
+func (s Section) Change() string {
+	if s.Previous == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (s.Value-s.Previous)/s.Previous*100)
+}
+
+// ContentID is the Content-ID of the section chart in mail.
+func (s Section) ContentID() string {
+	return "chart-" + s.Key + "@appstats"
+}
+
+// Build computes the report of s for the last full day before now in the
+// time zone of the schedule, so that a morning report covers the previous
+// local calendar day.
+func Build(db *gorm.DB, s *models.ReportSchedule, now time.Time) (*Report, error) {
+	loc, err := Location(s.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	local := now.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day()-1, 0, 0, 0, 0, loc)
+	start := day.AddDate(0, 0, -s.Days+1)
+
+	var f stats.Filter
+	if s.App != "" {
+		f = stats.Filter{{Field: stats.FieldApp, Op: stats.OpEquals, Values: []string{s.App}}}
+	}
+	f = traffic.ExcludeInternal(db, f)
+	labels := make([]string, s.Days)
+	for i := range labels {
+		labels[i] = start.AddDate(0, 0, i).Format("01-02")
+	}
+
+	r := &Report{
+		Name:    s.Name,
+		App:     s.App,
+		Day:     day.Format("2006-01-02"),
+		Subject: fmt.Sprintf("[appstats] %s %s", s.Name, day.Format("2006-01-02")),
+	}
+	var active float64
+	for _, key := range Sections {
+		if !slices.Contains(s.Metrics, key) {
+			continue
+		}
+		sec := Section{Key: key, Title: sectionTitles[key]}
+		switch key {
+		case stats.MetricNewUsers, stats.MetricActiveUsers, stats.MetricEvents:
+			values := make([]float64, s.Days)
+			for i := range values {
+				from := start.AddDate(0, 0, i)
+				if values[i], err = stats.Measure(db, key, from, from.AddDate(0, 0, 1), f); err != nil {
+					return nil, err
+				}
+			}
+			sec.HasValue = true
+			sec.Value, sec.Previous = values[len(values)-1], values[len(values)-2]
+			sec.Chart, err = lineChart(labels, values)
+		default:
+			if active == 0 {
+				if active, err = stats.Measure(db, stats.MetricActiveUsers, day, day.AddDate(0, 0, 1), f); err != nil {
+					return nil, err
+				}
+			}
+			dim := stats.DimensionVersion
+			switch key {
+			case SectionTopPlatforms:
+				dim = stats.DimensionPlatform
+			case SectionTopRegions:
+				dim = stats.DimensionRegion
+			}
+			var byValue map[string]int64
+			if byValue, err = stats.Breakdown(db, dim, day, day.AddDate(0, 0, 1), f); err != nil {
+				return nil, err
+			}
+			sec.Rows = topRows(byValue, int64(active))
+			if len(sec.Rows) > 0 {
+				names := make([]string, len(sec.Rows))
+				values := make([]float64, len(sec.Rows))
+				for i, row := range sec.Rows {
+					names[i], values[i] = row.Name, float64(row.Users)
+				}
+				sec.Chart, err = barChart(names, values)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.Sections = append(r.Sections, sec)
+	}
+	return r, nil
+}
+
+// topRows returns the topN largest entries of m, largest first.
+func topRows(m map[string]int64, active int64) []Row {
+	rows := make([]Row, 0, len(m))
+	for name, n := range m {
+		if name == "" {
+			name = "(空)"
+		}
+		row := Row{Name: name, Users: n}
+		if active > 0 {
+			row.Share = float64(n) / float64(active)
+		}
+		rows = append(rows, row)
+	}
+	slices.SortFunc(rows, func(a, b Row) int {
+		if c := cmp.Compare(b.Users, a.Users); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(rows) > topN {
+		rows = rows[:topN]
+	}
+	return rows
+}
+
+// Mail returns the report as mail with the charts attached inline.
+func (r *Report) Mail(to []string) (notify.Mail, error) {
+	html, err := r.render(func(s Section) template.URL {
+		return template.URL("cid:" + s.ContentID())
+	})
+	if err != nil {
+		return notify.Mail{}, err
+	}
+	m := notify.Mail{To: to, Subject: r.Subject, Text: r.Text(), HTML: html}
+	for _, s := range r.Sections {
+		if len(s.Chart) > 0 {
+			m.Inline = append(m.Inline, notify.Inline{ContentID: s.ContentID(), ContentType: "image/png", Data: s.Chart})
+		}
+	}
+	return m, nil
+}
+
+// PreviewHTML returns the report as a standalone page with the charts
+// embedded as data URIs.
+func (r *Report) PreviewHTML() (string, error) {
+	return r.render(func(s Section) template.URL {
+		return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(s.Chart))
+	})
+}
+
+// Text returns the plain text alternative of the report.
+func (r *Report) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n", r.Subject)
+	if r.App != "" {
+		fmt.Fprintf(&b, "应用：%s\n", r.App)
+	}
+	for _, s := range r.Sections {
+		b.WriteString("\n")
+		if s.HasValue {
+			fmt.Fprintf(&b, "%s：%s（前一日 %s，%s）\n", s.Title, formatNumber(s.Value), formatNumber(s.Previous), s.Change())
+			continue
+		}
+		fmt.Fprintf(&b, "%s：\n", s.Title)
+		for _, row := range s.Rows {
+			fmt.Fprintf(&b, "  %s  %d（%.1f%%）\n", row.Name, row.Users, row.Share*100)
+		}
+	}
+	return b.String()
+}
+
+func (r *Report) render(src func(Section) template.URL) (string, error) {
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, map[string]any{"Report": r, "Src": src})
+	return buf.String(), err
+}
+
+// reportTemplate uses inline styles only, since mail clients drop <style>.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num":     formatNumber,
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", v*100) },
+	"call":    func(f func(Section) template.URL, s Section) template.URL { return f(s) },
+}).Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head><meta charset="UTF-8"><title>{{.Report.Subject}}</title></head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', sans-serif; color: #333; max-width: 680px;">
+  <h2 style="margin-bottom: 4px;">{{.Report.Name}}</h2>
+  <p style="color: #888; margin-top: 0;">{{.Report.Day}}{{if .Report.App}} · 应用 {{.Report.App}}{{end}}（UTC）</p>
+  {{range .Report.Sections}}
+  <h3 style="margin-bottom: 4px;">{{.Title}}</h3>
+  {{if .HasValue}}
+  <p style="margin: 0 0 8px;"><span style="font-size: 24px; font-weight: bold;">{{num .Value}}</span>
+    <span style="color: #888;">前一日 {{num .Previous}}，{{.Change}}</span></p>
+  {{end}}
+  {{if .Chart}}<img src="{{call $.Src .}}" alt="{{.Title}}" width="640" style="display: block; max-width: 100%;">{{end}}
+  {{if .Rows}}
+  <table style="border-collapse: collapse; font-size: 13px; margin-top: 8px;">
+    <tr><th style="border: 1px solid #ddd; padding: 4px 10px; background: #f5f5f5; text-align: left;">名称</th>
+      <th style="border: 1px solid #ddd; padding: 4px 10px; background: #f5f5f5; text-align: left;">活跃用户</th>
+      <th style="border: 1px solid #ddd; padding: 4px 10px; background: #f5f5f5; text-align: left;">占比</th></tr>
+    {{range .Rows}}
+    <tr><td style="border: 1px solid #ddd; padding: 4px 10px;">{{.Name}}</td>
+      <td style="border: 1px solid #ddd; padding: 4px 10px;">{{.Users}}</td>
+      <td style="border: 1px solid #ddd; padding: 4px 10px;">{{percent .Share}}</td></tr>
+    {{end}}
+  </table>
+  {{else if not .HasValue}}
+  <p style="color: #888;">暂无数据</p>
+  {{end}}
+  {{end}}
+</body>
+</html>
+`))
+
+// Scheduler sends due report schedules. Only one instance should run per
+// database.
+type Scheduler struct {
+	db     *gorm.DB
+	mailer *notify.Mailer
+	tick   time.Duration
+	now    func() time.Time
+}
+
+// NewScheduler returns a scheduler checking for due schedules every tick.
+// mailer may be nil, in which case runs fail with an error.
+func NewScheduler(db *gorm.DB, mailer *notify.Mailer, tick time.Duration) *Scheduler {
+	return &Scheduler{db: db, mailer: mailer, tick: tick, now: time.Now}
+}
+
+// Run sends due reports until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	t := time.NewTicker(s.tick)
+	defer t.Stop()
+	for {
+		s.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue sends every enabled schedule whose next run time has passed. Runs
+// missed while the server was down are sent once, not once per missed run.
+func (s *Scheduler) RunDue(ctx context.Context) {
+	var schedules []models.ReportSchedule
+	now := s.now()
+	if err := s.db.Where("enabled = ? AND (next_run_at IS NULL OR next_run_at <= ?)", true, now).
+		Find(&schedules).Error; err != nil {
+		slog.Error("load report schedules failed", slog.Any("error", err))
+		return
+	}
+	for i := range schedules {
+		sch := &schedules[i]
+		if sch.NextRunAt != nil {
+			if err := s.Send(ctx, sch); err != nil {
+				slog.Error("send report failed", slog.Uint64("schedule_id", uint64(sch.ID)), slog.Any("error", err))
+			}
+		}
+		next, err := NextRun(sch, now)
+		if err != nil {
+			slog.Error("invalid report schedule", slog.Uint64("schedule_id", uint64(sch.ID)), slog.Any("error", err))
+			continue
+		}
+		if err := s.db.Model(sch).Update("next_run_at", next).Error; err != nil {
+			slog.Error("save report schedule failed", slog.Uint64("schedule_id", uint64(sch.ID)), slog.Any("error", err))
+		}
+	}
+}
+
+// Send builds and mails the report of sch immediately, recording the outcome
+// on the schedule.
+func (s *Scheduler) Send(ctx context.Context, sch *models.ReportSchedule) error {
+	err := s.send(ctx, sch)
+	now := s.now()
+	sch.LastRunAt = &now
+	sch.LastError = ""
+	if err != nil {
+		sch.LastError = models.Truncate(err.Error(), 512)
+	}
+	if uerr := s.db.Model(sch).Updates(map[string]any{"last_run_at": sch.LastRunAt, "last_error": sch.LastError}).Error; uerr != nil {
+		return errors.Join(err, uerr)
+	}
+	return err
+}
+
+func (s *Scheduler) send(ctx context.Context, sch *models.ReportSchedule) error {
+	if s.mailer == nil {
+		return errors.New("smtp is not configured")
+	}
+	r, err := Build(s.db, sch, s.now())
+	if err != nil {
+		return err
+	}
+	m, err := r.Mail(sch.Recipients)
+	if err != nil {
+		return err
+	}
+	return s.mailer.Send(ctx, m)
+}
@@ -0,0 +1,81 @@
+package reports
+
+import (
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/stats"
+	"appstats/internal/testdb"
+)
+
+func TestNextRun(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := time.Date(2024, 3, 1, 0, 30, 0, 0, time.UTC) // 08:30 in Shanghai
+	tests := []struct {
+		cron, tz string
+		want     time.Time
+		wantErr  bool
+	}{
+		{cron: "0 9 * * *", tz: "UTC", want: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{cron: "0 9 * * *", tz: "Asia/Shanghai", want: time.Date(2024, 3, 1, 9, 0, 0, 0, shanghai)},
+		{cron: "0 8 * * *", tz: "Asia/Shanghai", want: time.Date(2024, 3, 2, 8, 0, 0, 0, shanghai)},
+		{cron: "30 0 * * *", tz: "UTC", want: time.Date(2024, 3, 2, 0, 30, 0, 0, time.UTC)}, // strictly after
+		{cron: "0 9 * * 1", tz: "UTC", want: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC)},
+		{cron: "0 9 * *", tz: "UTC", wantErr: true},
+		{cron: "0 9 * * *", tz: "Mars/Olympus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := NextRun(&models.ReportSchedule{Cron: tt.cron, Timezone: tt.tz}, at)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("NextRun(%q, %q) = %v, want an error", tt.cron, tt.tz, got)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("NextRun(%q, %q) = %v, %v, want %v", tt.cron, tt.tz, got, err, tt.want)
+		}
+	}
+}
+
+func TestBuildUsesScheduleTimeZone(t *testing.T) {
+	if _, err := time.LoadLocation("Asia/Shanghai"); err != nil {
+		t.Skip(err)
+	}
+	db := testdb.Open(t, &models.User{}, &models.UserEvent{})
+	utc := func(day, hour int) time.Time { return time.Date(2024, 3, day, hour, 0, 0, 0, time.UTC) }
+	for _, e := range []models.UserEvent{
+		{App: "shop", UserID: "a", EventType: "launch", Platform: "ios", EventTime: utc(1, 15)},     // 03-01 23:00 local
+		{App: "shop", UserID: "b", EventType: "launch", Platform: "android", EventTime: utc(1, 17)}, // 03-02 01:00 local
+		{App: "shop", UserID: "c", EventType: "launch", Platform: "ios", EventTime: utc(1, 0)},      // 03-01 08:00 local
+		{App: "shop", UserID: "d", EventType: "launch", Platform: "ios", EventTime: utc(0, 17)},     // 03-01 01:00 local
+	} {
+		if err := db.Create(&e).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &models.ReportSchedule{Name: "daily", Timezone: "Asia/Shanghai", Days: 2,
+		Metrics: []string{stats.MetricEvents, SectionTopPlatforms}}
+	// 09:00 on 03-02 in Shanghai is still 03-02 01:00 in UTC.
+	r, err := Build(db, s, utc(2, 1))
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if r.Day != "2024-03-01" {
+		t.Errorf("Day = %s, want 2024-03-01", r.Day)
+	}
+	if len(r.Sections) != 2 {
+		t.Fatalf("got %d sections, want 2", len(r.Sections))
+	}
+	if events := r.Sections[0]; events.Value != 3 || events.Previous != 0 {
+		t.Errorf("events = %v (previous %v), want 3 events of 03-01 local", events.Value, events.Previous)
+	}
+	if rows := r.Sections[1].Rows; len(rows) != 1 || rows[0].Name != "ios" || rows[0].Users != 3 || rows[0].Share != 1 {
+		t.Errorf("platform rows = %+v, want only ios with 3 users", rows)
+	}
+}
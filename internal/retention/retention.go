@@ -0,0 +1,257 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/archive"
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+	"appstats/internal/rollups"
+)
+
+// batchPause is the pause between delete batches, leaving room for ingest.
+const batchPause = 100 * time.Millisecond
+
+// Validate checks a policy before it is saved.
+func Validate(p *models.RetentionPolicy) error {
+	if p.App == "" {
+		return errors.New("app is required")
+	}
+	if p.RawDays < 0 || p.RollupDays < 0 {
+		return errors.New("retention days must not be negative")
+	}
+	if p.RollupDays > 0 && (p.RawDays == 0 || p.RollupDays < p.RawDays) {
+		return errors.New("rollups must be kept at least as long as raw events")
+	}
+	return nil
+}
+
+// Result describes one run of a policy.
+type Result struct {
+	App string `json:"app"`
+	// Cutoff is the day before which raw events should be purged, and
+	// PurgedBefore the day they were actually purged up to; it is earlier
+	// when the rollups of some days are not materialized yet.
+	Cutoff         *time.Time `json:"cutoff"`
+	PurgedBefore   *time.Time `json:"purged_before"`
+	DeletedEvents  int64      `json:"deleted_events"`
+	DeletedRollups int64      `json:"deleted_rollups"`
+	// Blocked is set when expired raw events were kept because their
+	// rollups are missing or they are not archived yet.
+	Blocked string `json:"blocked,omitempty"`
+}
+
+// Purger enforces the enabled retention policies in the background.
+//
+// Only one instance should run per database.
+type Purger struct {
+	// RequireArchive keeps raw events until they are archived; it is set
+	// when an archive store is configured.
+	RequireArchive bool
+	// DeadLetterDays is how long rejected event payloads are kept; 0 keeps
+	// them forever.
+	DeadLetterDays int
+
+	db        *gorm.DB
+	tick      time.Duration
+	batchSize int
+	now       func() time.Time
+}
+
+// NewPurger returns a purger running every tick and deleting at most
+// batchSize rows per statement.
+func NewPurger(db *gorm.DB, tick time.Duration, batchSize int) *Purger {
+	if batchSize < 1 {
+		batchSize = 1000
+	}
+	return &Purger{db: db, tick: tick, batchSize: batchSize, now: time.Now}
+}
+
+// Run purges expired data until ctx is cancelled.
+func (p *Purger) Run(ctx context.Context) {
+	t := time.NewTicker(p.tick)
+	defer t.Stop()
+	for {
+		p.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue applies every enabled policy and purges expired dead letters.
+func (p *Purger) RunDue(ctx context.Context) {
+	var policies []models.RetentionPolicy
+	if err := p.db.Where("enabled = ?", true).Order("id").Find(&policies).Error; err != nil {
+		slog.Error("load retention policies failed", slog.Any("error", err))
+		return
+	}
+	for i := range policies {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, err := p.Apply(ctx, &policies[i]); err != nil {
+			slog.Error("apply retention policy failed", slog.String("app", policies[i].App), slog.Any("error", err))
+		}
+	}
+	if p.DeadLetterDays > 0 {
+		cutoff := p.now().AddDate(0, 0, -p.DeadLetterDays)
+		_, err := p.deleteBatches(ctx, "", "dead_letters", "dead_letters", "created_at < ?", cutoff)
+		if err != nil {
+			slog.Error("purge dead letters failed", slog.Any("error", err))
+		}
+	}
+}
+
+// Apply purges the data of pol that is past its retention and records the
+// progress on the policy. Raw events are only purged up to the first day
+// whose rollups are not materialized or, with RequireArchive, whose events
+// are not archived.
+func (p *Purger) Apply(ctx context.Context, pol *models.RetentionPolicy) (*Result, error) {
+	res, err := p.apply(ctx, pol)
+	now := p.now()
+	updates := map[string]any{
+		"last_run_at":     now,
+		"last_error":      "",
+		"deleted_events":  gorm.Expr("deleted_events + ?", res.DeletedEvents),
+		"deleted_rollups": gorm.Expr("deleted_rollups + ?", res.DeletedRollups),
+	}
+	switch {
+	case err != nil:
+		updates["last_error"] = models.Truncate(err.Error(), 512)
+	case res.Blocked != "":
+		updates["last_error"] = models.Truncate(res.Blocked, 512)
+	}
+	if res.PurgedBefore != nil {
+		updates["purged_before"] = *res.PurgedBefore
+	}
+	if uerr := p.db.Model(pol).Updates(updates).Error; uerr != nil && err == nil {
+		err = uerr
+	}
+	return res, err
+}
+
+func (p *Purger) apply(ctx context.Context, pol *models.RetentionPolicy) (*Result, error) {
+	res := &Result{App: pol.App}
+	now := p.now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	if pol.RawDays > 0 {
+		cutoff := today.AddDate(0, 0, -pol.RawDays)
+		res.Cutoff = &cutoff
+
+		before, err := p.purgeableBefore(pol, cutoff)
+		if err != nil {
+			return res, err
+		}
+		if before.Before(cutoff) {
+			res.Blocked = fmt.Sprintf("raw events from %s on are kept until their rollups are materialized"+
+				" and, if archiving is enabled, they are archived", before.Format("2006-01-02"))
+			metrics.RetentionBlocked.WithLabelValues(pol.App).Set(1)
+		} else {
+			metrics.RetentionBlocked.WithLabelValues(pol.App).Set(0)
+		}
+
+		n, err := p.deleteBatches(ctx, pol.App, "events", "user_events", "app = ? AND event_time < ?", pol.App, before)
+		res.DeletedEvents = n
+		if err != nil {
+			return res, err
+		}
+		if pol.PurgedBefore == nil || before.After(*pol.PurgedBefore) {
+			res.PurgedBefore = &before
+		}
+		metrics.RetentionPurgedBefore.WithLabelValues(pol.App).Set(float64(before.Unix()))
+	}
+
+	if pol.RollupDays > 0 {
+		cutoff := today.AddDate(0, 0, -pol.RollupDays).Format("2006-01-02")
+		n, err := p.deleteBatches(ctx, pol.App, "rollups", "daily_rollups", "app = ? AND day < ?", pol.App, cutoff)
+		res.DeletedRollups = n
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// purgeableBefore returns the day up to which raw events of pol may be
+// purged: cutoff, or the first earlier day whose rollups are missing or
+// stale or, with RequireArchive, whose events are not all archived.
+func (p *Purger) purgeableBefore(pol *models.RetentionPolicy, cutoff time.Time) (time.Time, error) {
+	var first struct{ T *time.Time }
+	if err := p.db.Raw("SELECT MIN(event_time) AS t FROM user_events WHERE app = ? AND event_time < ?",
+		pol.App, cutoff).Scan(&first).Error; err != nil {
+		return cutoff, err
+	}
+	if first.T == nil {
+		return cutoff, nil
+	}
+	from := first.T.UTC().Truncate(24 * time.Hour)
+	before := cutoff
+	missing, err := rollups.FirstUnmaterialized(p.db, from, cutoff)
+	if err != nil {
+		return cutoff, err
+	}
+	if missing != nil {
+		before = *missing
+	}
+	if p.RequireArchive {
+		archived, err := archive.ArchivedBefore(p.db, pol.App)
+		if err != nil {
+			return cutoff, err
+		}
+		if archived.Before(from) {
+			archived = from
+		}
+		if archived.Before(before) {
+			before = archived
+		}
+		stale, err := archive.StaleDays(p.db, pol.App, 1)
+		if err != nil {
+			return cutoff, err
+		}
+		if len(stale) > 0 && stale[0].Before(before) {
+			before = stale[0]
+		}
+	}
+	return before, nil
+}
+
+// deleteBatches deletes the rows of table matching where, batchSize rows
+// at a time in id order, pausing between batches, and returns the number of
+// rows deleted. kind labels the metric.
+func (p *Purger) deleteBatches(ctx context.Context, app, kind, table, where string, args ...any) (int64, error) {
+	var total int64
+	for {
+		var ids []uint
+		if err := p.db.Table(table).Where(where, args...).Order("id").Limit(p.batchSize).Pluck("id", &ids).Error; err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		// table is one of the constants above, so it is safe to interpolate.
+		r := p.db.Exec("DELETE FROM "+table+" WHERE id IN ?", ids)
+		if r.Error != nil {
+			return total, r.Error
+		}
+		total += r.RowsAffected
+		metrics.RetentionDeleted.WithLabelValues(app, kind).Add(float64(r.RowsAffected))
+		if len(ids) < p.batchSize {
+			return total, nil
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(batchPause):
+		}
+	}
+}
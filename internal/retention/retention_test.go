@@ -0,0 +1,131 @@
+package retention
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		p     models.RetentionPolicy
+		valid bool
+	}{
+		{models.RetentionPolicy{App: "shop", RawDays: 30, RollupDays: 365}, true},
+		{models.RetentionPolicy{App: "shop", RawDays: 30}, true},
+		{models.RetentionPolicy{App: "shop"}, true},
+		{models.RetentionPolicy{RawDays: 30}, false},
+		{models.RetentionPolicy{App: "shop", RawDays: -1}, false},
+		{models.RetentionPolicy{App: "shop", RawDays: 30, RollupDays: 7}, false},
+		{models.RetentionPolicy{App: "shop", RollupDays: 365}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(&tt.p); (err == nil) != tt.valid {
+			t.Errorf("Validate(%+v) = %v", tt.p, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	// RawDays 5 on March 10 puts the cutoff at March 5.
+	now := day(10).Add(8 * time.Hour)
+	tests := []struct {
+		name           string
+		materialized   []int // days whose rollups are materialized
+		archived       []int // days archived, when archiving is required
+		requireArchive bool
+		batchSize      int
+		wantBefore     time.Time
+		wantDeleted    int64
+		wantBlocked    bool
+	}{
+		{name: "cutoff", materialized: []int{1, 2, 3, 4}, wantBefore: day(5), wantDeleted: 8},
+		{name: "batches", materialized: []int{1, 2, 3, 4}, batchSize: 3, wantBefore: day(5), wantDeleted: 8},
+		{name: "unmaterialized day", materialized: []int{1, 2, 4}, wantBefore: day(3), wantDeleted: 4, wantBlocked: true},
+		{name: "no rollups", wantBefore: day(1), wantBlocked: true},
+		{name: "unarchived day", materialized: []int{1, 2, 3, 4}, requireArchive: true, archived: []int{1},
+			wantBefore: day(2), wantDeleted: 2, wantBlocked: true},
+		{name: "archived", materialized: []int{1, 2, 3, 4}, requireArchive: true, archived: []int{1, 2, 3, 4},
+			wantBefore: day(5), wantDeleted: 8},
+	}
+	for _, tt := range tests {
+		db := testdb.Open(t, &models.UserEvent{}, &models.RollupDay{}, &models.DailyRollup{},
+			&models.RetentionPolicy{}, &models.ArchivePartition{})
+		// Two events of the shop a day from March 1 to 7, and old events of
+		// another app.
+		for d := 1; d <= 7; d++ {
+			for h := range 2 {
+				db.Create(&models.UserEvent{App: "shop", UserID: "u1", EventTime: day(d).Add(time.Duration(h*12) * time.Hour)})
+			}
+		}
+		db.Create(&models.UserEvent{App: "news", UserID: "u2", EventTime: day(1)})
+		for _, d := range tt.materialized {
+			db.Create(&models.RollupDay{Day: day(d), MaterializedAt: now})
+		}
+		for _, d := range tt.archived {
+			db.Create(&models.ArchivePartition{App: "shop", Day: day(d).Format("2006-01-02"), MaxEventID: 100})
+		}
+		pol := models.RetentionPolicy{App: "shop", RawDays: 5, Enabled: true}
+		db.Create(&pol)
+
+		p := NewPurger(db, time.Hour, tt.batchSize)
+		p.RequireArchive = tt.requireArchive
+		p.now = func() time.Time { return now }
+		res, err := p.Apply(context.Background(), &pol)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !res.Cutoff.Equal(day(5)) || res.DeletedEvents != tt.wantDeleted || (res.Blocked != "") != tt.wantBlocked {
+			t.Errorf("%s: result %+v, want %d events deleted before %s", tt.name, res, tt.wantDeleted, tt.wantBefore)
+		}
+		var left int64
+		db.Model(&models.UserEvent{}).Where("app = ? AND event_time < ?", "shop", tt.wantBefore).Count(&left)
+		if left != 0 {
+			t.Errorf("%s: %d events before %s left", tt.name, left, tt.wantBefore)
+		}
+		var total int64
+		db.Model(&models.UserEvent{}).Count(&total)
+		if want := 15 - tt.wantDeleted; total != want {
+			t.Errorf("%s: %d events left, want %d", tt.name, total, want)
+		}
+		var saved models.RetentionPolicy
+		db.First(&saved, pol.ID)
+		if saved.PurgedBefore == nil || !saved.PurgedBefore.Equal(tt.wantBefore) || saved.DeletedEvents != tt.wantDeleted ||
+			(saved.LastError != "") != tt.wantBlocked {
+			t.Errorf("%s: policy %+v", tt.name, saved)
+		}
+		if tt.wantBlocked && !strings.Contains(saved.LastError, tt.wantBefore.Format("2006-01-02")) {
+			t.Errorf("%s: last error %q does not name %s", tt.name, saved.LastError, tt.wantBefore.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestApplyRollups(t *testing.T) {
+	db := testdb.Open(t, &models.UserEvent{}, &models.RollupDay{}, &models.DailyRollup{}, &models.RetentionPolicy{})
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	for d := 1; d <= 9; d++ {
+		db.Create(&models.DailyRollup{Day: day(d), App: "shop"})
+		db.Create(&models.DailyRollup{Day: day(d), App: "shop", Dimension: "platform", Value: "ios"})
+	}
+	db.Create(&models.DailyRollup{Day: day(1), App: "news"})
+	pol := models.RetentionPolicy{App: "shop", RollupDays: 5, Enabled: true}
+	db.Create(&pol)
+
+	p := NewPurger(db, time.Hour, 3)
+	p.now = func() time.Time { return day(10) }
+	res, err := p.Apply(context.Background(), &pol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rollups before March 5 go, in batches of three rows.
+	var left int64
+	db.Model(&models.DailyRollup{}).Count(&left)
+	if res.DeletedRollups != 8 || left != 11 || res.Cutoff != nil {
+		t.Errorf("result %+v with %d rollups left, want 8 deleted and 11 left", res, left)
+	}
+}
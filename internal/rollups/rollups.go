@@ -0,0 +1,256 @@
+package rollups
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+	"appstats/internal/stats"
+)
+
+const (
+	// settleDays is how many completed days are materialized again on every
+	// run, to pick up events reported late.
+	settleDays = 2
+	// maxDaysPerRun bounds the backfill done by a single run.
+	maxDaysPerRun = 31
+)
+
+// dimensions maps the rollup dimensions to the user_events column they group
+// by; the empty dimension holds the app totals.
+var dimensions = map[string]string{
+	"":                              "''",
+	string(stats.DimensionPlatform): "COALESCE(e.platform, '')",
+	string(stats.DimensionVersion):  "COALESCE(e.app_version, '')",
+	string(stats.DimensionRegion):   "COALESCE(e.region, '')",
+}
+
+// Materialize recomputes the rollups of day (a UTC midnight) from
+// user_events, leaving out internal traffic, and marks the day as
+// materialized. When apps is not empty only
+// the rollups of those apps are replaced; otherwise all apps except those
+// whose raw events of day were purged by a retention policy.
+func Materialize(db *gorm.DB, day time.Time, apps ...string) error {
+	defer metrics.ObserveQuery("rollup_materialize", time.Now())
+
+	day = day.UTC().Truncate(24 * time.Hour)
+	end := day.AddDate(0, 0, 1)
+	date := day.Format("2006-01-02")
+	return db.Transaction(func(tx *gorm.DB) error {
+		del := tx.Where("day = ?", date)
+		appWhere := ""
+		var appArg any
+		if len(apps) > 0 {
+			appWhere, appArg = " AND e.app IN ?", apps
+			del = del.Where("app IN ?", apps)
+		} else {
+			// The raw events of apps purged past day are gone; keep their rollups.
+			appWhere, appArg = " AND e.app NOT IN (SELECT app FROM retention_policies WHERE purged_before > ?)", day
+			del = del.Where("app NOT IN (SELECT app FROM retention_policies WHERE purged_before > ?)", day)
+		}
+		if err := del.Delete(&models.DailyRollup{}).Error; err != nil {
+			return err
+		}
+		for dim, col := range dimensions {
+			args := []any{date, dim, day, end, day, end, appArg}
+			// col comes from the dimensions table above, so it is safe to interpolate.
+			if err := tx.Exec(`
+        INSERT INTO daily_rollups (day, app, dimension, value, new_users, active_users, events)
+        SELECT ?, e.app, ?, `+col+`, COUNT(DISTINCT u.user_id), COUNT(DISTINCT e.user_id), COUNT(*)
+        FROM user_events e
+        LEFT JOIN users u ON u.user_id = e.user_id AND u.first_seen >= ? AND u.first_seen < ?
+        WHERE e.event_time >= ? AND e.event_time < ? AND e.internal = FALSE`+appWhere+`
+        GROUP BY e.app, `+col+`
+    `, args...).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Exec(`
+        INSERT INTO rollup_days (day, stale, materialized_at) VALUES (?, FALSE, ?)
+        ON DUPLICATE KEY UPDATE stale = FALSE, materialized_at = VALUES(materialized_at)
+    `, date, time.Now().UTC()).Error
+	})
+}
+
+// Invalidate marks materialized days as stale so the materializer computes
+// them again. Days that were never materialized are left alone.
+func Invalidate(db *gorm.DB, days []time.Time) error {
+	if len(days) == 0 {
+		return nil
+	}
+	return db.Model(&models.RollupDay{}).Where("day IN ?", dateStrings(days)).Update("stale", true).Error
+}
+
+// InvalidateLate marks the day of an event reported late as stale when the
+// materializer would not compute that day again anyway.
+func InvalidateLate(db *gorm.DB, eventTime, now time.Time) error {
+	day := utcDate(eventTime.UTC())
+	if !day.Before(utcDate(now.UTC()).AddDate(0, 0, -settleDays)) {
+		return nil
+	}
+	return Invalidate(db, []time.Time{day})
+}
+
+// Stale returns the days among days whose rollups are stale, oldest first.
+func Stale(db *gorm.DB, days []time.Time) ([]time.Time, error) {
+	if len(days) == 0 {
+		return nil, nil
+	}
+	var rows []models.RollupDay
+	if err := db.Where("day IN ? AND stale = ?", dateStrings(days), true).Order("day").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make([]time.Time, 0, len(rows))
+	for _, r := range rows {
+		res = append(res, utcDate(r.Day))
+	}
+	return res, nil
+}
+
+// FirstUnmaterialized returns the first day in [from, to) whose rollups are
+// missing or stale, or nil when all of them are materialized.
+func FirstUnmaterialized(db *gorm.DB, from, to time.Time) (*time.Time, error) {
+	var rows []models.RollupDay
+	if err := db.Where("day >= ? AND day < ? AND stale = ?", from.Format("2006-01-02"), to.Format("2006-01-02"), false).
+		Order("day").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	d := from
+	for _, r := range rows {
+		if !utcDate(r.Day).Equal(d) {
+			break
+		}
+		d = d.AddDate(0, 0, 1)
+	}
+	if !d.Before(to) {
+		return nil, nil
+	}
+	return &d, nil
+}
+
+// Query returns the rollups of [from, to), optionally restricted to one app
+// and dimension, ordered by day.
+func Query(db *gorm.DB, from, to time.Time, app, dimension string) ([]models.DailyRollup, error) {
+	defer metrics.ObserveQuery("rollups", time.Now())
+
+	q := db.Where("day >= ? AND day < ? AND dimension = ?", from.Format("2006-01-02"), to.Format("2006-01-02"), dimension)
+	if app != "" {
+		q = q.Where("app = ?", app)
+	}
+	var rows []models.DailyRollup
+	err := q.Order("day, app, value").Find(&rows).Error
+	return rows, err
+}
+
+// Materializer keeps the rollups of completed days up to date.
+//
+// Only one instance should run per database.
+type Materializer struct {
+	db   *gorm.DB
+	tick time.Duration
+	now  func() time.Time
+}
+
+// NewMaterializer returns a materializer running every tick.
+func NewMaterializer(db *gorm.DB, tick time.Duration) *Materializer {
+	return &Materializer{db: db, tick: tick, now: time.Now}
+}
+
+// Run materializes rollups until ctx is cancelled.
+func (m *Materializer) Run(ctx context.Context) {
+	t := time.NewTicker(m.tick)
+	defer t.Stop()
+	for {
+		m.RunDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// RunDue materializes stale days, the last settleDays completed days and
+// any completed day not materialized yet, oldest first. At most
+// maxDaysPerRun days are backfilled per call.
+func (m *Materializer) RunDue(ctx context.Context) {
+	days, err := m.dueDays()
+	if err != nil {
+		slog.Error("find rollup days failed", slog.Any("error", err))
+		return
+	}
+	for _, day := range days {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := Materialize(m.db, day); err != nil {
+			slog.Error("materialize rollups failed", slog.String("day", day.Format("2006-01-02")), slog.Any("error", err))
+			return
+		}
+	}
+}
+
+func (m *Materializer) dueDays() ([]time.Time, error) {
+	now := m.now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	due := make(map[time.Time]bool)
+	var stale []models.RollupDay
+	if err := m.db.Where("stale = ?", true).Order("day").Limit(maxDaysPerRun).Find(&stale).Error; err != nil {
+		return nil, err
+	}
+	for _, d := range stale {
+		due[utcDate(d.Day)] = true
+	}
+
+	// Continue after the last materialized day, or start at the first event.
+	var last []models.RollupDay
+	if err := m.db.Order("day DESC").Limit(1).Find(&last).Error; err != nil {
+		return nil, err
+	}
+	var start time.Time
+	if len(last) > 0 {
+		start = utcDate(last[0].Day).AddDate(0, 0, 1)
+	} else {
+		var first struct{ T *time.Time }
+		if err := m.db.Raw("SELECT MIN(event_time) AS t FROM user_events").Scan(&first).Error; err != nil {
+			return nil, err
+		}
+		if first.T == nil {
+			return nil, nil
+		}
+		start = first.T.UTC().Truncate(24 * time.Hour)
+	}
+	if settle := today.AddDate(0, 0, -settleDays); settle.Before(start) {
+		start = settle
+	}
+	for d, n := start, 0; d.Before(today) && n < maxDaysPerRun; d, n = d.AddDate(0, 0, 1), n+1 {
+		due[d] = true
+	}
+
+	days := make([]time.Time, 0, len(due))
+	for d := range due {
+		days = append(days, d)
+	}
+	slices.SortFunc(days, func(a, b time.Time) int { return a.Compare(b) })
+	return days, nil
+}
+
+// utcDate returns the UTC midnight of the calendar date of t. DATE columns
+// are scanned in the connection's time zone, so the date is taken as is.
+func utcDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func dateStrings(days []time.Time) []string {
+	res := make([]string, 0, len(days))
+	for _, d := range days {
+		res = append(res, d.UTC().Format("2006-01-02"))
+	}
+	return res
+}
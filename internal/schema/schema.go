@@ -0,0 +1,249 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+)
+
+// schemasCacheTTL bounds how long schema changes take to apply on other
+// instances.
+const schemasCacheTTL = 30 * time.Second
+
+// requiredFields are the event fields a schema may require.
+var requiredFields = []string{"region", "app_version", "event_time", "sent_at"}
+
+// Validate checks a schema before it is saved.
+func Validate(s *models.EventSchema) error {
+	s.App = strings.TrimSpace(s.App)
+	s.EventType = strings.TrimSpace(s.EventType)
+	if s.App == "" {
+		s.App = models.DefaultApp
+	}
+	if len(s.App) > 64 || len(s.EventType) > 32 {
+		return errors.New("app or event_type is too long")
+	}
+	for _, f := range s.RequiredFields {
+		if !slices.Contains(requiredFields, f) {
+			return fmt.Errorf("unknown required field %q, want one of %s", f, strings.Join(requiredFields, ", "))
+		}
+	}
+	seen := make(map[string]bool, len(s.Properties))
+	for i := range s.Properties {
+		p := &s.Properties[i]
+		p.Name = strings.TrimSpace(p.Name)
+		if p.Name == "" {
+			return errors.New("property name is required")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("property %q is listed twice", p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Type {
+		case models.PropertyString, models.PropertyNumber, models.PropertyInteger:
+		case models.PropertyBoolean, models.PropertyObject, models.PropertyArray:
+			if len(p.Enum) > 0 {
+				return fmt.Errorf("property %q: enum only applies to strings and numbers", p.Name)
+			}
+		default:
+			return fmt.Errorf("property %q: unknown type %q", p.Name, p.Type)
+		}
+		if p.MaxLength < 0 || (p.MaxLength > 0 && p.Type != models.PropertyString) {
+			return fmt.Errorf("property %q: max_length only applies to strings", p.Name)
+		}
+		for _, v := range p.Enum {
+			if p.Type != models.PropertyString {
+				if _, err := strconv.ParseFloat(v, 64); err != nil {
+					return fmt.Errorf("property %q: enum value %q is not a number", p.Name, v)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Event is the part of a reported event a schema checks.
+type Event struct {
+	App        string
+	EventType  string
+	Fields     map[string]bool // reported optional fields, e.g. "region"
+	Properties map[string]any
+}
+
+// Registry validates reported events against the active schema of their
+// app and event type.
+type Registry struct {
+	db *gorm.DB
+
+	mu       sync.Mutex
+	active   map[string]*models.EventSchema
+	loadedAt time.Time
+}
+
+// NewRegistry returns a registry backed by db.
+func NewRegistry(db *gorm.DB) *Registry {
+	return &Registry{db: db}
+}
+
+// Invalidate drops the cached schemas, e.g. after they changed.
+func (r *Registry) Invalidate() {
+	r.mu.Lock()
+	r.active, r.loadedAt = nil, time.Time{}
+	r.mu.Unlock()
+}
+
+// Check validates e against the active schema of its app and event type.
+// It returns what is wrong per field, properties being named
+// "properties.<name>", and the version of the schema; both are empty when
+// the event type has no active schema.
+func (r *Registry) Check(e Event) (map[string]string, int, error) {
+	r.mu.Lock()
+	if time.Since(r.loadedAt) > schemasCacheTTL {
+		var rows []models.EventSchema
+		if err := r.db.Where("active = ?", true).Find(&rows).Error; err != nil {
+			r.mu.Unlock()
+			return nil, 0, err
+		}
+		r.active = make(map[string]*models.EventSchema, len(rows))
+		for i := range rows {
+			r.active[rows[i].App+"\x00"+rows[i].EventType] = &rows[i]
+		}
+		r.loadedAt = time.Now()
+	}
+	s := r.active[e.App+"\x00"+e.EventType]
+	r.mu.Unlock()
+	if s == nil {
+		return nil, 0, nil
+	}
+	return check(s, e), s.Version, nil
+}
+
+func check(s *models.EventSchema, e Event) map[string]string {
+	errs := make(map[string]string)
+	for _, f := range s.RequiredFields {
+		if !e.Fields[f] {
+			errs[f] = "is required"
+		}
+	}
+	for _, p := range s.Properties {
+		v, ok := e.Properties[p.Name]
+		if !ok || v == nil {
+			if p.Required {
+				errs["properties."+p.Name] = "is required"
+			}
+			continue
+		}
+		if msg := checkValue(p, v); msg != "" {
+			errs["properties."+p.Name] = msg
+		}
+	}
+	if !s.AdditionalProperties {
+		for name := range e.Properties {
+			if !slices.ContainsFunc(s.Properties, func(p models.PropertySchema) bool { return p.Name == name }) {
+				errs["properties."+name] = "is not allowed"
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// checkValue checks a property value decoded from JSON and returns what is
+// wrong with it.
+func checkValue(p models.PropertySchema, v any) string {
+	var enumValue string
+	switch p.Type {
+	case models.PropertyString:
+		s, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if p.MaxLength > 0 && utf8.RuneCountInString(s) > p.MaxLength {
+			return fmt.Sprintf("must be at most %d characters", p.MaxLength)
+		}
+		enumValue = s
+	case models.PropertyNumber, models.PropertyInteger:
+		n, ok := v.(float64)
+		if !ok {
+			return "must be a number"
+		}
+		if p.Type == models.PropertyInteger && n != math.Trunc(n) {
+			return "must be an integer"
+		}
+		enumValue = strconv.FormatFloat(n, 'f', -1, 64)
+	case models.PropertyBoolean:
+		if _, ok := v.(bool); !ok {
+			return "must be a boolean"
+		}
+	case models.PropertyObject:
+		if _, ok := v.(map[string]any); !ok {
+			return "must be an object"
+		}
+	case models.PropertyArray:
+		if _, ok := v.([]any); !ok {
+			return "must be an array"
+		}
+	}
+	if len(p.Enum) > 0 && !slices.ContainsFunc(p.Enum, func(e string) bool { return enumEqual(p.Type, e, enumValue) }) {
+		return "must be one of " + strings.Join(p.Enum, ", ")
+	}
+	return ""
+}
+
+func enumEqual(typ, want, got string) bool {
+	if typ == models.PropertyString {
+		return want == got
+	}
+	n, err := strconv.ParseFloat(want, 64)
+	return err == nil && strconv.FormatFloat(n, 'f', -1, 64) == got
+}
+
+// Create saves s as the next version of the schema of its app and event
+// type and makes it the active one.
+func Create(db *gorm.DB, s *models.EventSchema) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var last struct{ V *int }
+		if err := tx.Model(&models.EventSchema{}).Select("MAX(version) AS v").
+			Where("app = ? AND event_type = ?", s.App, s.EventType).Scan(&last).Error; err != nil {
+			return err
+		}
+		s.Version = 1
+		if last.V != nil {
+			s.Version = *last.V + 1
+		}
+		if err := deactivate(tx, s.App, s.EventType); err != nil {
+			return err
+		}
+		s.Active = true
+		return tx.Create(s).Error
+	})
+}
+
+// Activate makes s the active version of its app and event type, e.g. to
+// roll back to an earlier one.
+func Activate(db *gorm.DB, s *models.EventSchema) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := deactivate(tx, s.App, s.EventType); err != nil {
+			return err
+		}
+		s.Active = true
+		return tx.Model(s).Update("active", true).Error
+	})
+}
+
+func deactivate(tx *gorm.DB, app, eventType string) error {
+	return tx.Model(&models.EventSchema{}).Where("app = ? AND event_type = ? AND active = ?", app, eventType, true).
+		Update("active", false).Error
+}
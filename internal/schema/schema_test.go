@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"appstats/internal/models"
+)
+
+func TestValidate(t *testing.T) {
+	prop := func(name, typ string) models.PropertySchema { return models.PropertySchema{Name: name, Type: typ} }
+	tests := []struct {
+		name    string
+		s       models.EventSchema
+		wantErr string
+	}{
+		{name: "default app", s: models.EventSchema{EventType: "purchase", Properties: []models.PropertySchema{prop(" plan ", models.PropertyString)}}},
+		{name: "required fields", s: models.EventSchema{EventType: "purchase", RequiredFields: []string{"region", "sent_at"}}},
+		{name: "unknown required field", s: models.EventSchema{EventType: "purchase", RequiredFields: []string{"user_agent"}}, wantErr: "unknown required field"},
+		{name: "long event type", s: models.EventSchema{EventType: strings.Repeat("x", 33)}, wantErr: "too long"},
+		{name: "no property name", s: models.EventSchema{Properties: []models.PropertySchema{prop(" ", models.PropertyString)}}, wantErr: "name is required"},
+		{name: "duplicate property", s: models.EventSchema{Properties: []models.PropertySchema{
+			prop("plan", models.PropertyString), prop("plan ", models.PropertyNumber)}}, wantErr: "listed twice"},
+		{name: "unknown type", s: models.EventSchema{Properties: []models.PropertySchema{prop("plan", "date")}}, wantErr: "unknown type"},
+		{name: "boolean enum", s: models.EventSchema{Properties: []models.PropertySchema{
+			{Name: "trial", Type: models.PropertyBoolean, Enum: []string{"true"}}}}, wantErr: "enum only applies"},
+		{name: "number enum", s: models.EventSchema{Properties: []models.PropertySchema{
+			{Name: "amount", Type: models.PropertyNumber, Enum: []string{"1", "2.5"}}}}},
+		{name: "bad number enum", s: models.EventSchema{Properties: []models.PropertySchema{
+			{Name: "amount", Type: models.PropertyInteger, Enum: []string{"one"}}}}, wantErr: "not a number"},
+		{name: "max length of a number", s: models.EventSchema{Properties: []models.PropertySchema{
+			{Name: "amount", Type: models.PropertyNumber, MaxLength: 3}}}, wantErr: "max_length only applies"},
+		{name: "negative max length", s: models.EventSchema{Properties: []models.PropertySchema{
+			{Name: "plan", Type: models.PropertyString, MaxLength: -1}}}, wantErr: "max_length only applies"},
+	}
+	for _, tt := range tests {
+		err := Validate(&tt.s)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	s := models.EventSchema{EventType: " purchase ", Properties: []models.PropertySchema{prop(" plan ", models.PropertyString)}}
+	if err := Validate(&s); err != nil || s.App != models.DefaultApp || s.EventType != "purchase" || s.Properties[0].Name != "plan" {
+		t.Errorf("Validate = %v, schema %+v, want trimmed names and the default app", err, s)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s := &models.EventSchema{
+		RequiredFields: []string{"region", "event_time"},
+		Properties: []models.PropertySchema{
+			{Name: "plan", Type: models.PropertyString, Required: true, MaxLength: 4, Enum: []string{"free", "pro", "专业版"}},
+			{Name: "amount", Type: models.PropertyNumber, Enum: []string{"9.9", "30"}},
+			{Name: "seats", Type: models.PropertyInteger},
+			{Name: "trial", Type: models.PropertyBoolean},
+			{Name: "cart", Type: models.PropertyObject},
+			{Name: "items", Type: models.PropertyArray},
+		},
+	}
+	fields := map[string]bool{"region": true, "event_time": true}
+	tests := []struct {
+		name   string
+		fields map[string]bool
+		props  string
+		want   map[string]string
+	}{
+		{name: "valid", fields: fields, props: `{"plan":"pro","amount":30.0,"seats":3,"trial":false,"cart":{},"items":[1]}`},
+		{name: "characters not bytes", fields: fields, props: `{"plan":"专业版"}`},
+		{name: "null is missing", fields: fields, props: `{"plan":"pro","amount":null}`},
+		{name: "missing", fields: map[string]bool{"region": true}, props: `{}`, want: map[string]string{
+			"event_time": "is required", "properties.plan": "is required"}},
+		{name: "wrong types", fields: fields, props: `{"plan":1,"amount":"30","seats":1.5,"trial":"no","cart":[],"items":{}}`, want: map[string]string{
+			"properties.plan":   "must be a string",
+			"properties.amount": "must be a number",
+			"properties.seats":  "must be an integer",
+			"properties.trial":  "must be a boolean",
+			"properties.cart":   "must be an object",
+			"properties.items":  "must be an array",
+		}},
+		{name: "enum and length", fields: fields, props: `{"plan":"enterprise","amount":10}`, want: map[string]string{
+			"properties.plan":   "must be at most 4 characters",
+			"properties.amount": "must be one of 9.9, 30",
+		}},
+		{name: "not in enum", fields: fields, props: `{"plan":"team"}`, want: map[string]string{
+			"properties.plan": "must be one of free, pro, 专业版"}},
+		{name: "additional property", fields: fields, props: `{"plan":"pro","coupon":"X"}`, want: map[string]string{
+			"properties.coupon": "is not allowed"}},
+	}
+	for _, tt := range tests {
+		var props map[string]any
+		if err := json.Unmarshal([]byte(tt.props), &props); err != nil {
+			t.Fatal(err)
+		}
+		got := check(s, Event{Fields: tt.fields, Properties: props})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: check = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	open := *s
+	open.AdditionalProperties = true
+	if got := check(&open, Event{Fields: fields, Properties: map[string]any{"plan": "pro", "coupon": "X"}}); got != nil {
+		t.Errorf("check with additional properties allowed = %v", got)
+	}
+}
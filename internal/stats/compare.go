@@ -0,0 +1,168 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// CompareMode selects the baseline period a summary is compared with.
+type CompareMode string
+
+const (
+	// CompareNone disables comparison.
+	CompareNone CompareMode = ""
+	// ComparePrevious compares with the period of equal length right before.
+	ComparePrevious CompareMode = "previous"
+	// CompareWeek compares with the same days one week earlier.
+	CompareWeek CompareMode = "week"
+	// CompareYear compares with the same dates one year earlier.
+	CompareYear CompareMode = "year"
+)
+
+// ParseCompareMode validates a comparison mode name; empty means none.
+func ParseCompareMode(s string) (CompareMode, error) {
+	switch m := CompareMode(s); m {
+	case CompareNone, ComparePrevious, CompareWeek, CompareYear:
+		return m, nil
+	}
+	return "", fmt.Errorf("unsupported compare mode %q", s)
+}
+
+// BaselineStart returns the start of the baseline period for a range of
+// days starting at start. The baseline always has the same number of days.
+func (m CompareMode) BaselineStart(start time.Time, days int) time.Time {
+	switch m {
+	case CompareWeek:
+		return start.AddDate(0, 0, -7)
+	case CompareYear:
+		return start.AddDate(-1, 0, 0)
+	default:
+		return start.AddDate(0, 0, -days)
+	}
+}
+
+// Delta compares a value with its baseline. Percent is nil when the
+// baseline is zero.
+type Delta struct {
+	Current  int64    `json:"current"`
+	Previous int64    `json:"previous"`
+	Change   int64    `json:"change"`
+	Percent  *float64 `json:"percent"`
+}
+
+// NewDelta returns the delta between cur and prev.
+func NewDelta(cur, prev int64) Delta {
+	d := Delta{Current: cur, Previous: prev, Change: cur - prev}
+	if prev != 0 {
+		p := float64(cur-prev) / float64(prev) * 100
+		d.Percent = &p
+	}
+	return d
+}
+
+// Comparison is a summary range compared with its baseline period.
+type Comparison struct {
+	Mode         CompareMode `json:"mode"`
+	BaselineFrom string      `json:"baseline_from"`
+	BaselineTo   string      `json:"baseline_to"`
+	// Baseline holds the daily stats of the baseline period; entry i lines
+	// up with day i of the compared range.
+	Baseline []DailySummary `json:"baseline"`
+	// Totals compares whole periods; users are de-duplicated per period.
+	Totals map[string]Delta `json:"totals"`
+	// Dimensions compares the distinct active users per dimension value,
+	// keyed by dimension (platform, app_version, region) and value.
+	Dimensions map[Dimension]map[string]Delta `json:"dimensions"`
+}
+
+// Compare builds the comparison of the days starting at start with the
+// baseline period selected by mode, counting only events matching f.
+func Compare(db *gorm.DB, start time.Time, days int, f Filter, mode CompareMode) (*Comparison, error) {
+	end := start.AddDate(0, 0, days)
+	bStart := mode.BaselineStart(start, days)
+	bEnd := bStart.AddDate(0, 0, days)
+
+	baseline, err := GetSummary(db, bStart, days, f)
+	if err != nil {
+		return nil, err
+	}
+	cmp := &Comparison{
+		Mode:         mode,
+		BaselineFrom: bStart.Format("2006-01-02"),
+		BaselineTo:   bEnd.AddDate(0, 0, -1).Format("2006-01-02"),
+		Baseline:     baseline,
+		Totals:       make(map[string]Delta),
+		Dimensions:   make(map[Dimension]map[string]Delta),
+	}
+
+	for _, metric := range []string{MetricNewUsers, MetricActiveUsers, MetricEvents} {
+		cur, err := Measure(db, metric, start, end, f)
+		if err != nil {
+			return nil, err
+		}
+		prev, err := Measure(db, metric, bStart, bEnd, f)
+		if err != nil {
+			return nil, err
+		}
+		cmp.Totals[metric] = NewDelta(int64(cur), int64(prev))
+	}
+
+	for _, dim := range []Dimension{DimensionPlatform, DimensionVersion, DimensionRegion} {
+		cur, err := periodBreakdown(db, dim, start, end, f)
+		if err != nil {
+			return nil, err
+		}
+		prev, err := periodBreakdown(db, dim, bStart, bEnd, f)
+		if err != nil {
+			return nil, err
+		}
+		deltas := make(map[string]Delta, len(cur))
+		for v, n := range cur {
+			deltas[v] = NewDelta(n, prev[v])
+		}
+		for v, n := range prev {
+			if _, ok := cur[v]; !ok {
+				deltas[v] = NewDelta(0, n)
+			}
+		}
+		cmp.Dimensions[dim] = deltas
+	}
+	return cmp, nil
+}
+
+// Breakdown counts the distinct active users of each value of dim in
+// [from, to) matching f.
+func Breakdown(db *gorm.DB, dim Dimension, from, to time.Time, f Filter) (map[string]int64, error) {
+	return periodBreakdown(db, dim, from, to, f)
+}
+
+// periodBreakdown counts the distinct active users of each value of dim in
+// [from, to).
+func periodBreakdown(db *gorm.DB, dim Dimension, from, to time.Time, f Filter) (map[string]int64, error) {
+	defer metrics.ObserveQuery("compare_"+string(dim), time.Now())
+
+	fw, fargs := f.where()
+	type row struct {
+		Value string
+		Cnt   int64
+	}
+	var rows []row
+	// dim is one of the Dimension constants, so it is safe to interpolate.
+	if err := db.Raw(`
+        SELECT COALESCE(`+string(dim)+`, '') AS value, COUNT(DISTINCT user_id) AS cnt
+        FROM user_events
+        WHERE event_time >= ? AND event_time < ?`+fw+`
+        GROUP BY value
+    `, append([]any{from, to}, fargs...)...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]int64, len(rows))
+	for _, r := range rows {
+		res[r.Value] = r.Cnt
+	}
+	return res, nil
+}
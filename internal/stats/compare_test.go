@@ -0,0 +1,117 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestNewDelta(t *testing.T) {
+	tests := []struct {
+		cur, prev   int64
+		wantChange  int64
+		wantPercent float64 // ignored without a baseline
+	}{
+		{cur: 15, prev: 10, wantChange: 5, wantPercent: 50},
+		{cur: 5, prev: 10, wantChange: -5, wantPercent: -50},
+		{cur: 10, prev: 10, wantChange: 0, wantPercent: 0},
+		{cur: 0, prev: 4, wantChange: -4, wantPercent: -100},
+		{cur: 3, prev: 0, wantChange: 3},
+		{cur: 0, prev: 0, wantChange: 0},
+	}
+	for _, tt := range tests {
+		d := NewDelta(tt.cur, tt.prev)
+		if d.Current != tt.cur || d.Previous != tt.prev || d.Change != tt.wantChange {
+			t.Errorf("NewDelta(%d, %d) = %+v", tt.cur, tt.prev, d)
+		}
+		if tt.prev == 0 {
+			if d.Percent != nil {
+				t.Errorf("NewDelta(%d, 0) percent = %v, want nil", tt.cur, *d.Percent)
+			}
+		} else if d.Percent == nil || *d.Percent != tt.wantPercent {
+			t.Errorf("NewDelta(%d, %d) percent = %v, want %v", tt.cur, tt.prev, d.Percent, tt.wantPercent)
+		}
+	}
+}
+
+func TestBaselineStart(t *testing.T) {
+	start := time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		mode CompareMode
+		want time.Time
+	}{
+		{ComparePrevious, time.Date(2024, 2, 27, 0, 0, 0, 0, time.UTC)},
+		{CompareWeek, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{CompareYear, time.Date(2023, 3, 8, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := tt.mode.BaselineStart(start, 10); !got.Equal(tt.want) {
+			t.Errorf("%q.BaselineStart = %s, want %s", tt.mode, got, tt.want)
+		}
+	}
+	if _, err := ParseCompareMode("month"); err == nil {
+		t.Error("ParseCompareMode accepted an unknown mode")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.UserEvent{}, &models.DailyRollup{}, &models.RetentionPolicy{})
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	// March 4-6 are compared with March 1-3.
+	for _, e := range []struct {
+		user     string
+		platform string
+		d        int
+	}{
+		{"u1", "ios", 1}, {"u1", "ios", 2},
+		{"u2", "ios", 4}, {"u3", "android", 4}, {"u3", "android", 5}, {"u4", "android", 6},
+	} {
+		db.Create(&models.UserEvent{App: "shop", UserID: e.user, Platform: e.platform, EventType: "launch",
+			EventTime: day(e.d).Add(10 * time.Hour)})
+	}
+	for user, d := range map[string]int{"u1": 1, "u2": 4, "u3": 4, "u4": 6} {
+		db.Create(&models.User{UserID: user, FirstSeen: day(d)})
+	}
+
+	cmp, err := Compare(db, day(4), 3, nil, ComparePrevious)
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	if cmp.BaselineFrom != "2024-03-01" || cmp.BaselineTo != "2024-03-03" || len(cmp.Baseline) != 3 {
+		t.Errorf("baseline %s to %s with %d days", cmp.BaselineFrom, cmp.BaselineTo, len(cmp.Baseline))
+	}
+	want := map[string][2]int64{MetricNewUsers: {3, 1}, MetricActiveUsers: {3, 1}, MetricEvents: {4, 2}}
+	for metric, w := range want {
+		if d := cmp.Totals[metric]; d.Current != w[0] || d.Previous != w[1] {
+			t.Errorf("%s = %+v, want %d against %d", metric, d, w[0], w[1])
+		}
+	}
+	platforms := cmp.Dimensions[DimensionPlatform]
+	if d := platforms["ios"]; d.Current != 1 || d.Previous != 1 || *d.Percent != 0 {
+		t.Errorf("ios = %+v", d)
+	}
+	if d := platforms["android"]; d.Current != 2 || d.Previous != 0 || d.Percent != nil {
+		t.Errorf("android = %+v, want no percent without a baseline", d)
+	}
+
+	// Nothing happened in the week before: every delta is against zero.
+	cmp, err = Compare(db, day(1), 3, nil, CompareWeek)
+	if err != nil {
+		t.Fatalf("Compare with an empty baseline: %v", err)
+	}
+	for metric, d := range cmp.Totals {
+		if d.Previous != 0 || d.Change != d.Current || d.Percent != nil {
+			t.Errorf("%s against an empty baseline = %+v", metric, d)
+		}
+	}
+	if d := cmp.Dimensions[DimensionPlatform]["ios"]; d.Current != 1 || d.Percent != nil {
+		t.Errorf("ios against an empty baseline = %+v", d)
+	}
+	for _, s := range cmp.Baseline {
+		if s.ActiveUsers != 0 || s.NewUsers != 0 {
+			t.Errorf("empty baseline day %+v", s)
+		}
+	}
+}
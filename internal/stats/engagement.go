@@ -0,0 +1,226 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// Limits of the inactivity period used for churn and resurrection.
+const (
+	DefaultInactiveDays = 7
+	MaxInactiveDays     = 90
+)
+
+// mauDays is the trailing window of monthly active users.
+const mauDays = 30
+
+// EngagementDay holds the engagement metrics of one day.
+type EngagementDay struct {
+	Date string `json:"date"`
+	DAU  int64  `json:"dau"`
+	// MAU counts the distinct users active in the 30 days ending on Date.
+	MAU        int64   `json:"mau"`
+	Stickiness float64 `json:"stickiness"` // DAU / MAU
+	// NewUsers are active users first seen on Date; the rest of DAU are
+	// returning users.
+	NewUsers       int64 `json:"new_users"`
+	ReturningUsers int64 `json:"returning_users"`
+	// Churned counts users whose last activity was exactly InactiveDays
+	// before Date, i.e. who became churned on Date. Only completed days
+	// are counted.
+	Churned int64 `json:"churned"`
+	// Resurrected counts users active on Date after at least InactiveDays
+	// days without any activity.
+	Resurrected int64 `json:"resurrected"`
+}
+
+// Engagement is the result of GetEngagement.
+type Engagement struct {
+	InactiveDays int             `json:"inactive_days"`
+	Days         []EngagementDay `json:"days"`
+	// Breakdown holds the same metrics per value of the requested
+	// dimension; users active with several values count for each of them.
+	Breakdown map[string][]EngagementDay `json:"breakdown,omitempty"`
+}
+
+// GetEngagement computes the engagement metrics for the given days starting
+// at start, counting only events matching f. Whether a user was away is
+// judged on all of their activity, regardless of f. When dim is not empty
+// the metrics are also broken down by that dimension.
+func GetEngagement(db *gorm.DB, start time.Time, days, inactiveDays int, f Filter, dim Dimension) (*Engagement, error) {
+	switch dim {
+	case "", DimensionPlatform, DimensionVersion, DimensionRegion:
+	default:
+		return nil, fmt.Errorf("unsupported dimension %q", dim)
+	}
+	if inactiveDays < 1 || inactiveDays > MaxInactiveDays {
+		return nil, fmt.Errorf("inactive days must be between 1 and %d", MaxInactiveDays)
+	}
+	defer metrics.ObserveQuery("engagement", time.Now())
+
+	end := start.AddDate(0, 0, days)
+	windowStart := start.AddDate(0, 0, -max(mauDays-1, inactiveDays))
+	churnEnd := end
+	if today := Today(); churnEnd.After(today) {
+		churnEnd = today
+	}
+
+	fw, fargs := f.where()
+	value := "''"
+	if dim != "" {
+		// dim is validated above, so it is safe to interpolate as a column name.
+		value = "COALESCE(user_events." + string(dim) + ", '')"
+	}
+	// ud holds the (user, day, value) activity matching the filter; act all
+	// (user, day) activity, used to decide whether a user was away.
+	ud := `ud AS (
+            SELECT DISTINCT user_id, DATE(event_time) AS day, ` + value + ` AS value
+            FROM user_events
+            WHERE event_time >= ? AND event_time < ?` + fw + `
+        )`
+	udArgs := append([]any{windowStart, end}, fargs...)
+	act := `act AS (
+            SELECT DISTINCT user_id, DATE(event_time) AS day
+            FROM user_events
+            WHERE event_time >= ? AND event_time < ?
+        )`
+	actArgs := []any{windowStart, end}
+
+	type row struct {
+		Day   time.Time
+		Value string
+		Cnt   int64
+	}
+	res := make(map[string]map[string]*EngagementDay)
+	get := func(r row) *EngagementDay {
+		byDay := res[r.Value]
+		if byDay == nil {
+			byDay = make(map[string]*EngagementDay)
+			res[r.Value] = byDay
+		}
+		key := r.Day.Format("2006-01-02")
+		d := byDay[key]
+		if d == nil {
+			d = &EngagementDay{Date: key}
+			byDay[key] = d
+		}
+		return d
+	}
+	queries := []struct {
+		sql  string
+		args []any
+		set  func(*EngagementDay, int64)
+	}{
+		{
+			sql: `
+        WITH ` + ud + `
+        SELECT day, value, COUNT(DISTINCT user_id) AS cnt
+        FROM ud
+        WHERE day >= ?
+        GROUP BY day, value`,
+			args: append(append([]any{}, udArgs...), start),
+			set:  func(d *EngagementDay, n int64) { d.DAU = n },
+		},
+		{
+			sql: `
+        WITH RECURSIVE days (d) AS (
+            SELECT CAST(? AS DATE)
+            UNION ALL
+            SELECT d + INTERVAL 1 DAY FROM days WHERE d + INTERVAL 1 DAY < ?
+        ), ` + ud + `
+        SELECT days.d AS day, ud.value, COUNT(DISTINCT ud.user_id) AS cnt
+        FROM days
+        JOIN ud ON ud.day BETWEEN days.d - INTERVAL ` + fmt.Sprint(mauDays-1) + ` DAY AND days.d
+        GROUP BY days.d, ud.value`,
+			args: append([]any{start, end}, udArgs...),
+			set:  func(d *EngagementDay, n int64) { d.MAU = n },
+		},
+		{
+			sql: `
+        WITH ` + ud + `
+        SELECT ud.day, ud.value, COUNT(DISTINCT ud.user_id) AS cnt
+        FROM ud
+        JOIN users u ON u.user_id = ud.user_id AND DATE(u.first_seen) = ud.day
+        WHERE ud.day >= ?
+        GROUP BY ud.day, ud.value`,
+			args: append(append([]any{}, udArgs...), start),
+			set:  func(d *EngagementDay, n int64) { d.NewUsers = n },
+		},
+		{
+			sql: `
+        WITH ` + ud + `, ` + act + `
+        SELECT a.day, a.value, COUNT(DISTINCT a.user_id) AS cnt
+        FROM ud a
+        JOIN users u ON u.user_id = a.user_id AND DATE(u.first_seen) < a.day
+        WHERE a.day >= ?
+          AND NOT EXISTS (SELECT 1 FROM act b WHERE b.user_id = a.user_id
+                          AND b.day >= a.day - INTERVAL ? DAY AND b.day < a.day)
+        GROUP BY a.day, a.value`,
+			args: append(append(append([]any{}, udArgs...), actArgs...), start, inactiveDays),
+			set:  func(d *EngagementDay, n int64) { d.Resurrected = n },
+		},
+		{
+			sql: `
+        WITH ` + ud + `, ` + act + `
+        SELECT a.day + INTERVAL ? DAY AS day, a.value, COUNT(DISTINCT a.user_id) AS cnt
+        FROM ud a
+        WHERE a.day + INTERVAL ? DAY >= ? AND a.day + INTERVAL ? DAY < ?
+          AND NOT EXISTS (SELECT 1 FROM act b WHERE b.user_id = a.user_id
+                          AND b.day > a.day AND b.day <= a.day + INTERVAL ? DAY)
+        GROUP BY a.day, a.value`,
+			args: append(append(append([]any{}, udArgs...), actArgs...),
+				inactiveDays, inactiveDays, start, inactiveDays, churnEnd, inactiveDays),
+			set: func(d *EngagementDay, n int64) { d.Churned = n },
+		},
+	}
+	for _, q := range queries {
+		var rows []row
+		if err := db.Raw(q.sql, q.args...).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			q.set(get(r), r.Cnt)
+		}
+	}
+
+	e := &Engagement{InactiveDays: inactiveDays}
+	if dim == "" {
+		e.Days = engagementSeries(start, days, res[""])
+		return e, nil
+	}
+	e.Breakdown = make(map[string][]EngagementDay, len(res))
+	for v, byDay := range res {
+		e.Breakdown[v] = engagementSeries(start, days, byDay)
+	}
+	// Totals de-duplicate users across values, so they need their own pass.
+	total, err := GetEngagement(db, start, days, inactiveDays, f, "")
+	if err != nil {
+		return nil, err
+	}
+	e.Days = total.Days
+	return e, nil
+}
+
+// engagementSeries returns the metrics of byDay, keyed by date, for the
+// given days starting at start, filling in the days without activity and
+// the derived returning users and stickiness.
+func engagementSeries(start time.Time, days int, byDay map[string]*EngagementDay) []EngagementDay {
+	out := make([]EngagementDay, 0, days)
+	for i := 0; i < days; i++ {
+		key := start.AddDate(0, 0, i).Format("2006-01-02")
+		d := EngagementDay{Date: key}
+		if v := byDay[key]; v != nil {
+			d = *v
+		}
+		d.ReturningUsers = d.DAU - d.NewUsers
+		if d.MAU > 0 {
+			d.Stickiness = float64(d.DAU) / float64(d.MAU)
+		}
+		out = append(out, d)
+	}
+	return out
+}
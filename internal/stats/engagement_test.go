@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEngagementSeries(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	byDay := map[string]*EngagementDay{
+		"2024-03-01": {Date: "2024-03-01", DAU: 4, MAU: 8, NewUsers: 1, Churned: 2},
+		// Only churn on a day without activity.
+		"2024-03-03": {Date: "2024-03-03", Churned: 1},
+		"2024-03-04": {Date: "2024-03-04", DAU: 3, MAU: 9, NewUsers: 3},
+		// Outside the range.
+		"2024-03-05": {Date: "2024-03-05", DAU: 7, MAU: 7},
+	}
+	want := []EngagementDay{
+		{Date: "2024-03-01", DAU: 4, MAU: 8, Stickiness: 0.5, NewUsers: 1, ReturningUsers: 3, Churned: 2},
+		{Date: "2024-03-02"},
+		{Date: "2024-03-03", Churned: 1},
+		{Date: "2024-03-04", DAU: 3, MAU: 9, Stickiness: 1.0 / 3, NewUsers: 3},
+	}
+	if got := engagementSeries(start, 4, byDay); !reflect.DeepEqual(got, want) {
+		t.Errorf("engagementSeries =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := engagementSeries(start, 2, nil); len(got) != 2 || got[1] != (EngagementDay{Date: "2024-03-02"}) {
+		t.Errorf("engagementSeries without activity = %+v", got)
+	}
+}
+
+func TestGetEngagementValidates(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		inactiveDays int
+		dim          Dimension
+	}{
+		{name: "no inactivity", inactiveDays: 0},
+		{name: "long inactivity", inactiveDays: MaxInactiveDays + 1},
+		{name: "dimension", inactiveDays: DefaultInactiveDays, dim: "user_id"},
+	}
+	for _, tt := range tests {
+		// Invalid arguments are rejected before querying.
+		if _, err := GetEngagement(nil, start, 7, tt.inactiveDays, nil, tt.dim); err == nil {
+			t.Errorf("%s: GetEngagement succeeded", tt.name)
+		}
+	}
+}
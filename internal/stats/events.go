@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+)
+
+// EventQuery selects raw events for the event explorer. Empty fields are not
+// filtered on.
+type EventQuery struct {
+	From       *time.Time
+	To         *time.Time
+	App        string
+	UserID     string
+	Platform   string
+	AppVersion string
+	Region     string
+	EventType  string
+
+	// BeforeID pages backwards (newest first) from the given cursor.
+	BeforeID uint
+	// AfterID returns events newer than the given id in ascending order,
+	// used by live-tail polling. It takes precedence over BeforeID.
+	AfterID uint
+	Limit   int
+}
+
+// EventList is a page of raw events with keyset cursors.
+type EventList struct {
+	Events []models.UserEvent `json:"events"`
+	// NextCursor is the before_id for the next (older) page, 0 when exhausted.
+	NextCursor uint `json:"next_cursor"`
+	// LatestID is the highest id in this page, used as after_id when tailing.
+	// When the newest page is empty it is the highest id of all events, so
+	// that tailing starts from now.
+	LatestID uint `json:"latest_id"`
+}
+
+// ListEvents returns raw events matching q using keyset pagination on id.
+func ListEvents(db *gorm.DB, q EventQuery) (*EventList, error) {
+	defer metrics.ObserveQuery("list_events", time.Now())
+
+	tx := db.Model(&models.UserEvent{})
+	if q.From != nil {
+		tx = tx.Where("event_time >= ?", *q.From)
+	}
+	if q.To != nil {
+		tx = tx.Where("event_time < ?", *q.To)
+	}
+	for _, f := range []struct{ col, val string }{
+		{"app", q.App},
+		{"user_id", q.UserID},
+		{"platform", q.Platform},
+		{"app_version", q.AppVersion},
+		{"region", q.Region},
+		{"event_type", q.EventType},
+	} {
+		if f.val != "" {
+			tx = tx.Where(f.col+" = ?", f.val)
+		}
+	}
+
+	if q.AfterID > 0 {
+		tx = tx.Where("id > ?", q.AfterID).Order("id ASC")
+	} else {
+		if q.BeforeID > 0 {
+			tx = tx.Where("id < ?", q.BeforeID)
+		}
+		tx = tx.Order("id DESC")
+	}
+
+	// Fetch one extra row to know whether another page exists.
+	var events []models.UserEvent
+	if err := tx.Limit(q.Limit + 1).Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	res := EventList{Events: events}
+	if q.AfterID > 0 {
+		res.LatestID = q.AfterID
+		if len(events) > q.Limit {
+			res.Events = events[:q.Limit]
+		}
+		if n := len(res.Events); n > 0 {
+			res.LatestID = res.Events[n-1].ID
+		}
+		return &res, nil
+	}
+
+	if len(events) > q.Limit {
+		res.Events = events[:q.Limit]
+		res.NextCursor = res.Events[q.Limit-1].ID
+	}
+	if len(res.Events) > 0 {
+		res.LatestID = res.Events[0].ID
+	} else if q.BeforeID == 0 {
+		if err := db.Model(&models.UserEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&res.LatestID).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &res, nil
+}
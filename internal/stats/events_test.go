@@ -0,0 +1,58 @@
+package stats
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func eventIDs(events []models.UserEvent) []uint {
+	ids := make([]uint, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return ids
+}
+
+func TestListEvents(t *testing.T) {
+	db := testdb.Open(t, &models.UserEvent{})
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, app := range []string{"shop", "news", "shop", "shop"} {
+		db.Create(&models.UserEvent{App: app, UserID: "u", EventType: "launch", EventTime: at.Add(time.Duration(i) * time.Minute)})
+	}
+
+	tests := []struct {
+		name       string
+		q          EventQuery
+		wantIDs    []uint
+		wantNext   uint
+		wantLatest uint
+	}{
+		{name: "newest first", q: EventQuery{Limit: 10}, wantIDs: []uint{4, 3, 2, 1}, wantLatest: 4},
+		{name: "first page", q: EventQuery{App: "shop", Limit: 2}, wantIDs: []uint{4, 3}, wantNext: 3, wantLatest: 4},
+		{name: "next page", q: EventQuery{App: "shop", BeforeID: 3, Limit: 2}, wantIDs: []uint{1}, wantLatest: 1},
+		{name: "tail", q: EventQuery{AfterID: 1, Limit: 2}, wantIDs: []uint{2, 3}, wantLatest: 3},
+		{name: "tail up to date", q: EventQuery{AfterID: 4, Limit: 2}, wantIDs: []uint{}, wantLatest: 4},
+		// An empty first page still gives a cursor, or tailing would start
+		// with after_id=0 and list old events.
+		{name: "empty page", q: EventQuery{App: "other", Limit: 10}, wantIDs: []uint{}, wantLatest: 4},
+		{name: "empty older page", q: EventQuery{App: "news", BeforeID: 2, Limit: 10}, wantIDs: []uint{}, wantLatest: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ListEvents(db, tt.q)
+			if err != nil {
+				t.Fatalf("ListEvents: %v", err)
+			}
+			if ids := eventIDs(res.Events); !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if res.NextCursor != tt.wantNext || res.LatestID != tt.wantLatest {
+				t.Errorf("next_cursor = %d, latest_id = %d, want %d, %d", res.NextCursor, res.LatestID, tt.wantNext, tt.wantLatest)
+			}
+		})
+	}
+}
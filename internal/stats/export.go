@@ -0,0 +1,156 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// Granularity is the period used to bucket exported rows.
+type Granularity string
+
+const (
+	GranularityDay   Granularity = "day"
+	GranularityWeek  Granularity = "week"
+	GranularityMonth Granularity = "month"
+)
+
+// ParseGranularity validates a granularity name, defaulting to day when empty.
+func ParseGranularity(s string) (Granularity, error) {
+	switch Granularity(s) {
+	case "":
+		return GranularityDay, nil
+	case GranularityDay, GranularityWeek, GranularityMonth:
+		return Granularity(s), nil
+	}
+	return "", fmt.Errorf("unsupported granularity %q", s)
+}
+
+// periodExpr renders the SQL expression producing the period key of col.
+// Weeks use ISO numbering, e.g. 2025-W51.
+func (g Granularity) periodExpr(col string) string {
+	switch g {
+	case GranularityWeek:
+		return "DATE_FORMAT(" + col + ", '%x-W%v')"
+	case GranularityMonth:
+		return "DATE_FORMAT(" + col + ", '%Y-%m')"
+	default:
+		return "DATE_FORMAT(" + col + ", '%Y-%m-%d')"
+	}
+}
+
+// Dimension is an event column that breakdowns can be grouped by.
+type Dimension string
+
+const (
+	DimensionPlatform Dimension = "platform"
+	DimensionVersion  Dimension = "app_version"
+	DimensionRegion   Dimension = "region"
+)
+
+// SummaryRow is one period of the exported summary.
+type SummaryRow struct {
+	Period      string
+	NewUsers    int64
+	ActiveUsers int64
+}
+
+// BreakdownRow is one (period, dimension value) pair of an exported breakdown.
+type BreakdownRow struct {
+	Period      string
+	Value       string
+	ActiveUsers int64
+}
+
+// StreamSummary calls fn for every period in [start, end) that has activity
+// matching f. Active users are de-duplicated within each period. Rows are
+// read from the database cursor one by one so large ranges are never buffered.
+func StreamSummary(db *gorm.DB, start, end time.Time, g Granularity, f Filter, fn func(SummaryRow) error) error {
+	defer metrics.ObserveQuery("export_summary", time.Now())
+
+	fw, fargs := f.where()
+	args := append([]any{start, end}, fargs...)
+
+	newUsers := `
+            SELECT ` + g.periodExpr("first_seen") + ` AS period, COUNT(*) AS cnt
+            FROM users
+            WHERE first_seen >= ? AND first_seen < ?
+            GROUP BY period`
+	newArgs := []any{start, end}
+	if len(f) > 0 {
+		newUsers = `
+            SELECT ` + g.periodExpr("event_time") + ` AS period, COUNT(DISTINCT user_id) AS cnt
+            FROM user_events
+            WHERE event_time >= ? AND event_time < ?` + fw + newUsersWhere(g.periodExpr) + `
+            GROUP BY period`
+		newArgs = args
+	}
+
+	rows, err := db.Raw(`
+        SELECT a.period, COALESCE(n.cnt, 0) AS new_users, a.cnt AS active_users
+        FROM (
+            SELECT `+g.periodExpr("event_time")+` AS period, COUNT(DISTINCT user_id) AS cnt
+            FROM user_events
+            WHERE event_time >= ? AND event_time < ?`+fw+`
+            GROUP BY period
+        ) a
+        LEFT JOIN (`+newUsers+`
+        ) n ON n.period = a.period
+        ORDER BY a.period
+    `, append(append([]any{}, args...), newArgs...)...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r SummaryRow
+		if err := rows.Scan(&r.Period, &r.NewUsers, &r.ActiveUsers); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// StreamBreakdown calls fn for every (period, value) of the dimension in
+// [start, end), counting only events matching f.
+func StreamBreakdown(db *gorm.DB, dim Dimension, start, end time.Time, g Granularity, f Filter, fn func(BreakdownRow) error) error {
+	switch dim {
+	case DimensionPlatform, DimensionVersion, DimensionRegion:
+	default:
+		return fmt.Errorf("unsupported dimension %q", dim)
+	}
+	defer metrics.ObserveQuery("export_"+string(dim), time.Now())
+
+	fw, fargs := f.where()
+
+	// dim is validated above, so it is safe to interpolate as a column name.
+	rows, err := db.Raw(`
+        SELECT `+g.periodExpr("event_time")+` AS period, COALESCE(`+string(dim)+`, '') AS value, COUNT(DISTINCT user_id) AS cnt
+        FROM user_events
+        WHERE event_time >= ? AND event_time < ?`+fw+`
+        GROUP BY period, value
+        ORDER BY period, value
+    `, append([]any{start, end}, fargs...)...).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r BreakdownRow
+		if err := rows.Scan(&r.Period, &r.Value, &r.ActiveUsers); err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,218 @@
+package stats
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPropertyNameLength matches the size of user_properties.name.
+const maxPropertyNameLength = 64
+
+// FilterField is a dimension that summaries can be segmented by.
+type FilterField string
+
+const (
+	FieldApp        FilterField = "app"
+	FieldPlatform   FilterField = "platform"
+	FieldAppVersion FilterField = "app_version"
+	FieldRegion     FilterField = "region"
+	FieldEventType  FilterField = "event_type"
+	// FieldCohort matches the user's first-seen date (YYYY-MM-DD), so a
+	// prefix of "2025-12" selects the December 2025 cohort.
+	FieldCohort FilterField = "cohort"
+	// FieldInternal matches events flagged as internal traffic ("true") or
+	// not ("false"); only eq is supported.
+	FieldInternal FilterField = "internal"
+)
+
+// UserPropertyPrefix starts fields that match a user property, e.g.
+// "user.plan" matches the "plan" property set through the profile API.
+const UserPropertyPrefix = "user."
+
+// UserProperty returns the property name of a user property field.
+func (f FilterField) UserProperty() (string, bool) {
+	return strings.CutPrefix(string(f), UserPropertyPrefix)
+}
+
+// FilterOp is the comparison applied to a field.
+type FilterOp string
+
+const (
+	OpEquals FilterOp = "eq"
+	OpIn     FilterOp = "in"
+	OpPrefix FilterOp = "prefix"
+)
+
+// Condition is a single field comparison. OpIn uses all Values, the other
+// operators only the first one.
+type Condition struct {
+	Field  FilterField `json:"field"`
+	Op     FilterOp    `json:"op"`
+	Values []string    `json:"values"`
+}
+
+// Filter is a list of conditions that must all match. A nil Filter matches
+// every event.
+type Filter []Condition
+
+// ParseFilter parses URL encoded conditions of the form field:op:value, where
+// the values of an "in" condition are comma separated, e.g.
+// "platform:in:android,ios" or "region:prefix:CN-Guangdong".
+func ParseFilter(raw []string) (Filter, error) {
+	var f Filter
+	for _, s := range raw {
+		parts := strings.SplitN(s, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid filter %q, want field:op:value", s)
+		}
+		c := Condition{Field: FilterField(parts[0]), Op: FilterOp(parts[1])}
+		switch c.Field {
+		case FieldApp, FieldPlatform, FieldAppVersion, FieldRegion, FieldEventType, FieldCohort:
+		case FieldInternal:
+			if c.Op != OpEquals || (parts[2] != "true" && parts[2] != "false") {
+				return nil, fmt.Errorf("invalid filter %q, want internal:eq:true or internal:eq:false", s)
+			}
+		default:
+			name, ok := c.Field.UserProperty()
+			if !ok {
+				return nil, fmt.Errorf("unsupported filter field %q", parts[0])
+			}
+			if name == "" || utf8.RuneCountInString(name) > maxPropertyNameLength {
+				return nil, fmt.Errorf("invalid user property %q", name)
+			}
+		}
+		switch c.Op {
+		case OpEquals, OpPrefix:
+			c.Values = []string{parts[2]}
+		case OpIn:
+			for _, v := range strings.Split(parts[2], ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					c.Values = append(c.Values, v)
+				}
+			}
+			if len(c.Values) == 0 {
+				return nil, fmt.Errorf("filter %q has no values", s)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported filter op %q", parts[1])
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+// ExcludeInternal returns f with events flagged as internal traffic
+// excluded, unless f already has a condition on them.
+func (f Filter) ExcludeInternal() Filter {
+	for _, c := range f {
+		if c.Field == FieldInternal {
+			return f
+		}
+	}
+	return append(slices.Clip(f), Condition{Field: FieldInternal, Op: OpEquals, Values: []string{"false"}})
+}
+
+// Encode returns the URL representation accepted by ParseFilter.
+func (f Filter) Encode() []string {
+	out := make([]string, 0, len(f))
+	for _, c := range f {
+		out = append(out, string(c.Field)+":"+string(c.Op)+":"+strings.Join(c.Values, ","))
+	}
+	return out
+}
+
+// where renders the filter as an SQL fragment (starting with " AND ") to be
+// appended to a WHERE clause over the user_events table.
+func (f Filter) where() (string, []any) {
+	var b strings.Builder
+	var args []any
+	for _, c := range f {
+		col := "user_events." + string(c.Field)
+		prop, isProp := c.Field.UserProperty()
+		switch {
+		case c.Field == FieldInternal:
+			b.WriteString(" AND " + col + " = ?")
+			args = append(args, c.Values[0] == "true")
+			continue
+		case c.Field == FieldCohort:
+			col = "DATE_FORMAT(u.first_seen, '%Y-%m-%d')"
+		case isProp:
+			col = "up.value"
+			args = append(args, prop)
+		}
+
+		var cond string
+		switch c.Op {
+		case OpIn:
+			cond = col + " IN ?"
+			args = append(args, c.Values)
+		case OpPrefix:
+			cond = col + " LIKE ?"
+			args = append(args, EscapeLike(c.Values[0])+"%")
+		default:
+			cond = col + " = ?"
+			args = append(args, c.Values[0])
+		}
+
+		switch {
+		case c.Field == FieldCohort:
+			cond = "EXISTS (SELECT 1 FROM users u WHERE u.user_id = user_events.user_id AND " + cond + ")"
+		case isProp:
+			// Properties are matched against their current value.
+			cond = "EXISTS (SELECT 1 FROM user_properties up WHERE up.user_id = user_events.user_id" +
+				" AND up.name = ? AND " + cond + ")"
+		}
+		b.WriteString(" AND ")
+		b.WriteString(cond)
+	}
+	return b.String(), args
+}
+
+// rollupWhere renders the filter as an SQL fragment over the daily_rollups
+// table r. Rollups are kept per app and leave out internal traffic, so only
+// filters on the app and excluding internal traffic can be answered; ok is
+// false for any other filter.
+func (f Filter) rollupWhere() (where string, args []any, ok bool) {
+	var b strings.Builder
+	for _, c := range f {
+		switch {
+		case c.Field == FieldInternal && c.Values[0] == "false":
+			continue
+		case c.Field != FieldApp:
+			return "", nil, false
+		}
+		switch c.Op {
+		case OpIn:
+			b.WriteString(" AND r.app IN ?")
+			args = append(args, c.Values)
+		case OpPrefix:
+			b.WriteString(" AND r.app LIKE ?")
+			args = append(args, EscapeLike(c.Values[0])+"%")
+		default:
+			b.WriteString(" AND r.app = ?")
+			args = append(args, c.Values[0])
+		}
+	}
+	return b.String(), args, true
+}
+
+// newUsersWhere restricts user_events rows to those reported in the same
+// period (as rendered by periodExpr) as the user's first_seen. Counting
+// distinct users over the remaining rows yields filtered new users.
+func newUsersWhere(periodExpr func(col string) string) string {
+	return " AND EXISTS (SELECT 1 FROM users nu WHERE nu.user_id = user_events.user_id AND " +
+		periodExpr("nu.first_seen") + " = " + periodExpr("user_events.event_time") + ")"
+}
+
+// dateExpr buckets a time column by day.
+func dateExpr(col string) string {
+	return "DATE(" + col + ")"
+}
+
+// EscapeLike escapes the wildcards of a LIKE pattern, with backslash as the
+// escape character.
+func EscapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
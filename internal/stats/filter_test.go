@@ -0,0 +1,180 @@
+package stats
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		raw     []string
+		want    Filter
+		wantErr string
+	}{
+		{raw: nil, want: nil},
+		{raw: []string{"platform:eq:ios"}, want: Filter{{Field: FieldPlatform, Op: OpEquals, Values: []string{"ios"}}}},
+		{raw: []string{"platform:in:android, ios,,"}, want: Filter{{Field: FieldPlatform, Op: OpIn, Values: []string{"android", "ios"}}}},
+		// Only the first two colons separate, values may contain more.
+		{raw: []string{"region:prefix:CN:Guangdong"}, want: Filter{{Field: FieldRegion, Op: OpPrefix, Values: []string{"CN:Guangdong"}}}},
+		{raw: []string{"app:eq:shop", "cohort:prefix:2025-12"}, want: Filter{
+			{Field: FieldApp, Op: OpEquals, Values: []string{"shop"}},
+			{Field: FieldCohort, Op: OpPrefix, Values: []string{"2025-12"}},
+		}},
+		{raw: []string{"app_version:eq:"}, want: Filter{{Field: FieldAppVersion, Op: OpEquals, Values: []string{""}}}},
+		{raw: []string{"user.plan:in:pro,team"}, want: Filter{{Field: "user.plan", Op: OpIn, Values: []string{"pro", "team"}}}},
+		{raw: []string{"user.:eq:pro"}, wantErr: "invalid user property"},
+		{raw: []string{"user." + strings.Repeat("长", 65) + ":eq:pro"}, wantErr: "invalid user property"},
+		{raw: []string{"internal:eq:true"}, want: Filter{{Field: FieldInternal, Op: OpEquals, Values: []string{"true"}}}},
+		{raw: []string{"internal:eq:yes"}, wantErr: "internal:eq:true"},
+		{raw: []string{"internal:in:true,false"}, wantErr: "internal:eq:true"},
+		{raw: []string{"platform:ios"}, wantErr: "want field:op:value"},
+		{raw: []string{"device:eq:x"}, wantErr: "unsupported filter field"},
+		{raw: []string{"platform:like:ios"}, wantErr: "unsupported filter op"},
+		{raw: []string{"platform:in: , ,"}, wantErr: "no values"},
+		{raw: []string{"app:eq:shop", "bad"}, wantErr: "want field:op:value"},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilter(tt.raw)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseFilter(%q): err = %v, want %q", tt.raw, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilter(%q) = %+v, %v, want %+v", tt.raw, got, err, tt.want)
+			continue
+		}
+		// Encode gives back what ParseFilter accepts.
+		again, err := ParseFilter(got.Encode())
+		if err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("ParseFilter(%q.Encode()) = %+v, %v", tt.raw, again, err)
+		}
+	}
+}
+
+func TestFilterWhere(t *testing.T) {
+	tests := []struct {
+		name     string
+		f        Filter
+		wantSQL  string
+		wantArgs []any
+	}{
+		{name: "none", f: nil, wantSQL: "", wantArgs: nil},
+		{
+			name:     "eq",
+			f:        Filter{{Field: FieldPlatform, Op: OpEquals, Values: []string{"ios"}}},
+			wantSQL:  " AND user_events.platform = ?",
+			wantArgs: []any{"ios"},
+		},
+		{
+			name:     "in",
+			f:        Filter{{Field: FieldRegion, Op: OpIn, Values: []string{"CN", "US"}}},
+			wantSQL:  " AND user_events.region IN ?",
+			wantArgs: []any{[]string{"CN", "US"}},
+		},
+		{
+			name:     "prefix escapes LIKE wildcards",
+			f:        Filter{{Field: FieldAppVersion, Op: OpPrefix, Values: []string{`1_0%\`}}},
+			wantSQL:  " AND user_events.app_version LIKE ?",
+			wantArgs: []any{`1\_0\%\\%`},
+		},
+		{
+			name: "cohort",
+			f: Filter{
+				{Field: FieldApp, Op: OpEquals, Values: []string{"shop"}},
+				{Field: FieldCohort, Op: OpPrefix, Values: []string{"2025-12"}},
+			},
+			wantSQL: " AND user_events.app = ? AND EXISTS (SELECT 1 FROM users u WHERE u.user_id = user_events.user_id" +
+				" AND DATE_FORMAT(u.first_seen, '%Y-%m-%d') LIKE ?)",
+			wantArgs: []any{"shop", "2025-12%"},
+		},
+		{
+			name:     "internal",
+			f:        Filter{{Field: FieldPlatform, Op: OpEquals, Values: []string{"ios"}}}.ExcludeInternal(),
+			wantSQL:  " AND user_events.platform = ? AND user_events.internal = ?",
+			wantArgs: []any{"ios", false},
+		},
+		{
+			name: "user property",
+			f:    Filter{{Field: "user.plan", Op: OpPrefix, Values: []string{"pro"}}},
+			wantSQL: " AND EXISTS (SELECT 1 FROM user_properties up WHERE up.user_id = user_events.user_id" +
+				" AND up.name = ? AND up.value LIKE ?)",
+			wantArgs: []any{"plan", "pro%"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, args := tt.f.where()
+			if sql != tt.wantSQL {
+				t.Errorf("sql = %q\nwant  %q", sql, tt.wantSQL)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestMeasureWithFilter(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.UserEvent{}, &models.UserProperty{})
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	db.Create(&models.UserProperty{UserID: "a", Name: "plan", Value: "pro"})
+	db.Create(&models.UserProperty{UserID: "b", Name: "seats", Value: "pro"})
+	for _, e := range []models.UserEvent{
+		{App: "shop", UserID: "a", Platform: "ios", AppVersion: "1_0", EventTime: at},
+		{App: "shop", UserID: "b", Platform: "android", AppVersion: "110", EventTime: at},
+		{App: "shop", UserID: "b", Platform: "android", AppVersion: "1_0.1", EventTime: at},
+		{App: "news", UserID: "c", Platform: "ios", AppVersion: "2.0", EventTime: at},
+	} {
+		db.Create(&e)
+	}
+	tests := []struct {
+		raw  []string
+		want float64
+	}{
+		{raw: nil, want: 3},
+		{raw: []string{"app:eq:shop"}, want: 2},
+		{raw: []string{"platform:in:ios,web"}, want: 2},
+		{raw: []string{"app:eq:shop", "platform:eq:ios"}, want: 1},
+		{raw: []string{"app_version:prefix:1"}, want: 2},
+		{raw: []string{"user.plan:eq:pro"}, want: 1},
+		{raw: []string{"user.plan:in:basic"}, want: 0},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Measure(db, MetricActiveUsers, at.Add(-time.Hour), at.Add(time.Hour), f)
+		if err != nil || got != tt.want {
+			t.Errorf("active users with %q = %v, %v, want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestExcludeInternal(t *testing.T) {
+	base := Filter{{Field: FieldApp, Op: OpEquals, Values: []string{"shop"}}}
+	got := base[:1:1].ExcludeInternal()
+	if len(got) != 2 || got[1].Field != FieldInternal || got[1].Values[0] != "false" {
+		t.Errorf("ExcludeInternal = %+v", got)
+	}
+	// An explicit condition on internal traffic is kept.
+	flagged := Filter{{Field: FieldInternal, Op: OpEquals, Values: []string{"true"}}}
+	if got := flagged.ExcludeInternal(); !reflect.DeepEqual(got, flagged) {
+		t.Errorf("ExcludeInternal of %+v = %+v", flagged, got)
+	}
+	// The receiver's backing array is not written to.
+	spare := make(Filter, 1, 2)
+	copy(spare, base)
+	a, b := spare.ExcludeInternal(), spare.ExcludeInternal()
+	a[1].Values = []string{"true"}
+	if b[1].Values[0] != "false" {
+		t.Error("ExcludeInternal results share memory")
+	}
+}
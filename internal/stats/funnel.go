@@ -0,0 +1,271 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// PropertyCondition restricts the events matching a funnel step. Property
+// is either an event column (platform, app_version, region) or a key of the
+// event's properties.
+type PropertyCondition struct {
+	Property string   `json:"property"`
+	Op       FilterOp `json:"op"`
+	Values   []string `json:"values"`
+}
+
+// FunnelStep is one step of a funnel: an event type plus optional conditions.
+type FunnelStep struct {
+	EventType  string              `json:"event_type"`
+	Conditions []PropertyCondition `json:"conditions,omitempty"`
+}
+
+// FunnelQuery describes a conversion funnel. Users enter the funnel with
+// their first step-1 event in [Start, End) and must complete each following
+// step in order within Window of entering.
+type FunnelQuery struct {
+	Steps  []FunnelStep
+	Start  time.Time
+	End    time.Time
+	Window time.Duration
+	// BreakdownBy splits results by the platform or app_version of the
+	// entering event. Empty disables the breakdown.
+	BreakdownBy Dimension
+	Filter      Filter
+}
+
+// FunnelStepResult is the number of users reaching a step.
+type FunnelStepResult struct {
+	EventType string `json:"event_type"`
+	Users     int64  `json:"users"`
+	// Conversion is the share of users of the first step reaching this step.
+	Conversion float64 `json:"conversion"`
+	// DropOff is the number of users of the previous step not reaching this step.
+	DropOff int64 `json:"drop_off"`
+}
+
+// FunnelResult holds overall step counts and the optional breakdown.
+type FunnelResult struct {
+	Steps     []FunnelStepResult            `json:"steps"`
+	Breakdown map[string][]FunnelStepResult `json:"breakdown,omitempty"`
+}
+
+// maxFunnelSteps bounds the work done per event.
+const maxFunnelSteps = 10
+
+// Validate checks the query before running it.
+func (q FunnelQuery) Validate() error {
+	if len(q.Steps) < 2 || len(q.Steps) > maxFunnelSteps {
+		return fmt.Errorf("funnel needs between 2 and %d steps", maxFunnelSteps)
+	}
+	for i, s := range q.Steps {
+		if s.EventType == "" {
+			return fmt.Errorf("step %d: event_type is required", i+1)
+		}
+		for _, c := range s.Conditions {
+			if c.Property == "" || len(c.Values) == 0 {
+				return fmt.Errorf("step %d: condition needs a property and values", i+1)
+			}
+			switch c.Op {
+			case OpEquals, OpIn, OpPrefix:
+			default:
+				return fmt.Errorf("step %d: unsupported op %q", i+1, c.Op)
+			}
+		}
+	}
+	if q.Window <= 0 {
+		return errors.New("conversion window must be positive")
+	}
+	if !q.End.After(q.Start) {
+		return errors.New("end must be after start")
+	}
+	switch q.BreakdownBy {
+	case "", DimensionPlatform, DimensionVersion:
+	default:
+		return fmt.Errorf("unsupported breakdown %q", q.BreakdownBy)
+	}
+	return nil
+}
+
+// funnelEvent is the subset of an event needed to evaluate funnel steps.
+type funnelEvent struct {
+	UserID     string
+	EventType  string
+	Platform   string
+	AppVersion string
+	Region     string
+	Properties []byte
+	EventTime  time.Time
+}
+
+// RunFunnel computes the funnel by streaming the candidate events of every
+// user in time order, so memory stays proportional to a single user.
+func RunFunnel(db *gorm.DB, q FunnelQuery) (*FunnelResult, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	defer metrics.ObserveQuery("funnel", time.Now())
+
+	types := make([]string, 0, len(q.Steps))
+	for _, s := range q.Steps {
+		types = append(types, s.EventType)
+	}
+	fw, fargs := q.Filter.where()
+	args := append([]any{types, q.Start, q.End.Add(q.Window)}, fargs...)
+
+	rows, err := db.Raw(`
+        SELECT user_id, event_type, COALESCE(platform, '') AS platform, COALESCE(app_version, '') AS app_version,
+            COALESCE(region, '') AS region, properties, event_time
+        FROM user_events
+        WHERE event_type IN ? AND event_time >= ? AND event_time < ?`+fw+`
+        ORDER BY user_id, event_time, id
+    `, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	total := make([]int64, len(q.Steps))
+	breakdown := make(map[string][]int64)
+
+	var (
+		curUser string
+		reached int // steps completed by the current user
+		entered time.Time
+		segment string
+	)
+	flush := func() {
+		for i := 0; i < reached; i++ {
+			total[i]++
+		}
+		if q.BreakdownBy != "" && reached > 0 {
+			if breakdown[segment] == nil {
+				breakdown[segment] = make([]int64, len(q.Steps))
+			}
+			for i := 0; i < reached; i++ {
+				breakdown[segment][i]++
+			}
+		}
+	}
+
+	for rows.Next() {
+		var e funnelEvent
+		if err := rows.Scan(&e.UserID, &e.EventType, &e.Platform, &e.AppVersion, &e.Region, &e.Properties, &e.EventTime); err != nil {
+			return nil, err
+		}
+		if e.UserID != curUser {
+			flush()
+			curUser, reached = e.UserID, 0
+		}
+		if reached == len(q.Steps) {
+			continue
+		}
+
+		if reached == 0 {
+			// Entering is only possible inside the query range.
+			if e.EventTime.Before(q.Start) || !e.EventTime.Before(q.End) || !q.Steps[0].matches(&e) {
+				continue
+			}
+			reached, entered = 1, e.EventTime
+			segment = e.Platform
+			if q.BreakdownBy == DimensionVersion {
+				segment = e.AppVersion
+			}
+			continue
+		}
+
+		if e.EventTime.Sub(entered) > q.Window {
+			continue
+		}
+		if q.Steps[reached].matches(&e) {
+			reached++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	res := &FunnelResult{Steps: funnelStepResults(q.Steps, total)}
+	if q.BreakdownBy != "" {
+		res.Breakdown = make(map[string][]FunnelStepResult, len(breakdown))
+		for k, counts := range breakdown {
+			res.Breakdown[k] = funnelStepResults(q.Steps, counts)
+		}
+	}
+	return res, nil
+}
+
+func funnelStepResults(steps []FunnelStep, counts []int64) []FunnelStepResult {
+	out := make([]FunnelStepResult, len(steps))
+	for i, s := range steps {
+		out[i] = FunnelStepResult{EventType: s.EventType, Users: counts[i]}
+		if counts[0] > 0 {
+			out[i].Conversion = float64(counts[i]) / float64(counts[0])
+		}
+		if i > 0 {
+			out[i].DropOff = counts[i-1] - counts[i]
+		}
+	}
+	return out
+}
+
+// matches reports whether the event satisfies the step.
+func (s FunnelStep) matches(e *funnelEvent) bool {
+	if e.EventType != s.EventType {
+		return false
+	}
+	if len(s.Conditions) == 0 {
+		return true
+	}
+
+	var props map[string]any
+	if len(e.Properties) > 0 {
+		// Malformed properties simply fail property conditions.
+		_ = json.Unmarshal(e.Properties, &props)
+	}
+	for _, c := range s.Conditions {
+		var v string
+		switch c.Property {
+		case "platform":
+			v = e.Platform
+		case "app_version":
+			v = e.AppVersion
+		case "region":
+			v = e.Region
+		default:
+			raw, ok := props[c.Property]
+			if !ok {
+				return false
+			}
+			v = fmt.Sprint(raw)
+		}
+		if !c.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c PropertyCondition) matches(v string) bool {
+	switch c.Op {
+	case OpIn:
+		for _, want := range c.Values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	case OpPrefix:
+		return strings.HasPrefix(v, c.Values[0])
+	default:
+		return v == c.Values[0]
+	}
+}
@@ -0,0 +1,136 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestFunnelStepMatches(t *testing.T) {
+	e := &funnelEvent{
+		EventType: "purchase", Platform: "ios", AppVersion: "2.1.0", Region: "CN-Guangdong",
+		Properties: []byte(`{"plan":"pro","amount":30,"trial":false}`),
+	}
+	tests := []struct {
+		name string
+		step FunnelStep
+		want bool
+	}{
+		{name: "event type", step: FunnelStep{EventType: "purchase"}, want: true},
+		{name: "other event type", step: FunnelStep{EventType: "launch"}, want: false},
+		{name: "column eq", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "platform", Op: OpEquals, Values: []string{"ios"}}}}, want: true},
+		{name: "column in", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "platform", Op: OpIn, Values: []string{"android", "web"}}}}, want: false},
+		{name: "column prefix", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "region", Op: OpPrefix, Values: []string{"CN-"}}}}, want: true},
+		{name: "property", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "plan", Op: OpIn, Values: []string{"basic", "pro"}}}}, want: true},
+		{name: "number property", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "amount", Op: OpEquals, Values: []string{"30"}}}}, want: true},
+		{name: "bool property", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "trial", Op: OpEquals, Values: []string{"false"}}}}, want: true},
+		{name: "missing property", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "coupon", Op: OpEquals, Values: []string{""}}}}, want: false},
+		{name: "all conditions", step: FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{
+			{Property: "app_version", Op: OpPrefix, Values: []string{"2."}},
+			{Property: "plan", Op: OpEquals, Values: []string{"basic"}}}}, want: false},
+	}
+	for _, tt := range tests {
+		if got := tt.step.matches(e); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	malformed := &funnelEvent{EventType: "purchase", Properties: []byte(`{`)}
+	step := FunnelStep{EventType: "purchase", Conditions: []PropertyCondition{{Property: "plan", Op: OpEquals, Values: []string{"pro"}}}}
+	if step.matches(malformed) {
+		t.Error("malformed properties matched a property condition")
+	}
+}
+
+func TestRunFunnel(t *testing.T) {
+	db := testdb.Open(t, &models.UserEvent{})
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+	for _, e := range []models.UserEvent{
+		// a completes the funnel.
+		{UserID: "a", EventType: "view", Platform: "ios", EventTime: at(1)},
+		{UserID: "a", EventType: "cart", Platform: "ios", EventTime: at(2)},
+		{UserID: "a", EventType: "buy", Platform: "ios", EventTime: at(3)},
+		// b buys before adding to the cart, so only reaches the cart.
+		{UserID: "b", EventType: "view", Platform: "android", EventTime: at(1)},
+		{UserID: "b", EventType: "buy", Platform: "android", EventTime: at(2)},
+		{UserID: "b", EventType: "cart", Platform: "android", EventTime: at(3)},
+		// c adds to the cart after the window.
+		{UserID: "c", EventType: "view", Platform: "ios", EventTime: at(1)},
+		{UserID: "c", EventType: "cart", Platform: "ios", EventTime: at(30)},
+		// d enters before the range and does not count.
+		{UserID: "d", EventType: "view", Platform: "ios", EventTime: at(-1)},
+		{UserID: "d", EventType: "cart", Platform: "ios", EventTime: at(1)},
+		// e enters late in the range and completes after its end.
+		{UserID: "e", EventType: "view", Platform: "ios", EventTime: at(47)},
+		{UserID: "e", EventType: "cart", Platform: "ios", EventTime: at(49)},
+		{UserID: "e", EventType: "buy", Platform: "ios", EventTime: at(50)},
+	} {
+		db.Create(&e)
+	}
+
+	res, err := RunFunnel(db, FunnelQuery{
+		Steps:       []FunnelStep{{EventType: "view"}, {EventType: "cart"}, {EventType: "buy"}},
+		Start:       start,
+		End:         at(48),
+		Window:      24 * time.Hour,
+		BreakdownBy: DimensionPlatform,
+	})
+	if err != nil {
+		t.Fatalf("RunFunnel: %v", err)
+	}
+	want := []FunnelStepResult{
+		{EventType: "view", Users: 4, Conversion: 1},
+		{EventType: "cart", Users: 3, Conversion: 0.75, DropOff: 1},
+		{EventType: "buy", Users: 2, Conversion: 0.5, DropOff: 1},
+	}
+	if !reflect.DeepEqual(res.Steps, want) {
+		t.Errorf("steps = %+v\nwant %+v", res.Steps, want)
+	}
+	if android := res.Breakdown["android"]; len(android) != 3 || android[0].Users != 1 || android[1].Users != 1 || android[2].Users != 0 {
+		t.Errorf("android = %+v", android)
+	}
+	if ios := res.Breakdown["ios"]; len(ios) != 3 || ios[0].Users != 3 || ios[2].Users != 2 {
+		t.Errorf("ios = %+v", ios)
+	}
+}
+
+func TestFunnelQueryValidate(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	valid := FunnelQuery{Steps: []FunnelStep{{EventType: "view"}, {EventType: "buy"}}, Start: start, End: start.AddDate(0, 0, 1), Window: time.Hour}
+	tests := []struct {
+		name  string
+		edit  func(*FunnelQuery)
+		valid bool
+	}{
+		{name: "valid", edit: func(q *FunnelQuery) {}, valid: true},
+		{name: "one step", edit: func(q *FunnelQuery) { q.Steps = q.Steps[:1] }},
+		{name: "no event type", edit: func(q *FunnelQuery) { q.Steps = []FunnelStep{{EventType: "view"}, {}} }},
+		{name: "bad op", edit: func(q *FunnelQuery) {
+			q.Steps = []FunnelStep{{EventType: "view", Conditions: []PropertyCondition{{Property: "plan", Op: "like", Values: []string{"p"}}}}, {EventType: "buy"}}
+		}},
+		{name: "condition without values", edit: func(q *FunnelQuery) {
+			q.Steps = []FunnelStep{{EventType: "view", Conditions: []PropertyCondition{{Property: "plan", Op: OpEquals}}}, {EventType: "buy"}}
+		}},
+		{name: "no window", edit: func(q *FunnelQuery) { q.Window = 0 }},
+		{name: "empty range", edit: func(q *FunnelQuery) { q.End = q.Start }},
+		{name: "region breakdown", edit: func(q *FunnelQuery) { q.BreakdownBy = DimensionRegion }},
+	}
+	for _, tt := range tests {
+		q := valid
+		tt.edit(&q)
+		if err := q.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// Metrics that can be measured over an arbitrary time window.
+const (
+	MetricNewUsers    = "new_users"
+	MetricActiveUsers = "active_users"
+	MetricEvents      = "events"
+)
+
+// Measure returns the value of metric over [from, to) for events matching f.
+func Measure(db *gorm.DB, metric string, from, to time.Time, f Filter) (float64, error) {
+	defer metrics.ObserveQuery("measure_"+metric, time.Now())
+
+	fw, fargs := f.where()
+	args := append([]any{from, to}, fargs...)
+
+	var query string
+	switch metric {
+	case MetricActiveUsers:
+		query = `
+        SELECT COUNT(DISTINCT user_id) FROM user_events
+        WHERE event_time >= ? AND event_time < ?` + fw
+	case MetricEvents:
+		query = `
+        SELECT COUNT(*) FROM user_events
+        WHERE event_time >= ? AND event_time < ?` + fw
+	case MetricNewUsers:
+		if len(f) == 0 {
+			query = `
+        SELECT COUNT(*) FROM users
+        WHERE first_seen >= ? AND first_seen < ?`
+			args = args[:2]
+			break
+		}
+		query = `
+        SELECT COUNT(DISTINCT user_id) FROM user_events
+        WHERE event_time >= ? AND event_time < ?` + fw + `
+          AND EXISTS (SELECT 1 FROM users nu WHERE nu.user_id = user_events.user_id
+                      AND nu.first_seen >= ? AND nu.first_seen < ?)`
+		args = append(args, from, to)
+	default:
+		return 0, fmt.Errorf("unsupported metric %q", metric)
+	}
+
+	var n int64
+	if err := db.Raw(query, args...).Row().Scan(&n); err != nil {
+		return 0, err
+	}
+	return float64(n), nil
+}
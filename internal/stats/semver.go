@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// CompareVersions compares two app versions component by component so that
+// "1.10.0" sorts after "1.9.0". A leading "v" is ignored, numeric components
+// compare numerically, and a pre-release suffix ("1.2.0-beta") sorts before
+// the release. Pre-releases are ordered as in SemVer, so "beta.2" sorts
+// before "beta.10". It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	aCore, aPre := splitVersion(a)
+	bCore, bPre := splitVersion(b)
+
+	for i := 0; i < len(aCore) || i < len(bCore); i++ {
+		var x, y string
+		if i < len(aCore) {
+			x = aCore[i]
+		}
+		if i < len(bCore) {
+			y = bCore[i]
+		}
+		if c := compareComponent(x, y); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return comparePreRelease(aPre, bPre)
+}
+
+// comparePreRelease compares dot-separated pre-release identifiers: numeric
+// identifiers numerically and below alphanumeric ones, which compare
+// lexically, and a shorter list first when it is a prefix of the other.
+func comparePreRelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, xErr := strconv.ParseUint(as[i], 10, 64)
+		y, yErr := strconv.ParseUint(bs[i], 10, 64)
+		var c int
+		switch {
+		case xErr == nil && yErr == nil:
+			c = cmp.Compare(x, y)
+		case xErr == nil:
+			c = -1
+		case yErr == nil:
+			c = 1
+		default:
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
+func splitVersion(v string) ([]string, string) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	if i := strings.IndexByte(v, '+'); i >= 0 {
+		v = v[:i] // build metadata does not affect ordering
+	}
+	pre := ""
+	if i := strings.IndexByte(v, '-'); i >= 0 {
+		v, pre = v[:i], v[i+1:]
+	}
+	if v == "" {
+		return nil, pre
+	}
+	return strings.Split(v, "."), pre
+}
+
+// compareComponent compares numerically when both parts are numbers and
+// lexically otherwise; a missing part counts as 0.
+func compareComponent(x, y string) int {
+	if x == "" {
+		x = "0"
+	}
+	if y == "" {
+		y = "0"
+	}
+	xi, xErr := strconv.Atoi(x)
+	yi, yErr := strconv.Atoi(y)
+	if xErr == nil && yErr == nil {
+		switch {
+		case xi < yi:
+			return -1
+		case xi > yi:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(x, y)
+}
@@ -0,0 +1,45 @@
+package stats
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.9.9", "1.10.0", -1},
+		{"2.0", "10.0", -1},
+		{"v1.2.3", "1.2.3", 0},
+		{" 1.2.3 ", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"1.2.0-beta", "1.2.0", -1},
+		{"1.2.0", "1.2.0-rc.1", 1},
+		{"1.2.0-alpha", "1.2.0-beta", -1},
+		{"1.3.0-beta", "1.2.0", 1},
+		// Numeric pre-release identifiers compare as numbers.
+		{"1.2.0-beta.2", "1.2.0-beta.10", -1},
+		{"1.2.0-rc.1", "1.2.0-rc.1", 0},
+		{"1.2.0-1", "1.2.0-alpha", -1},
+		{"1.2.0-alpha", "1.2.0-alpha.1", -1},
+		{"1.2.0-alpha.beta", "1.2.0-alpha.1", 1},
+		{"1.2.0-beta.11", "1.2.0-rc.1", -1},
+		{"1.2.0+build.7", "1.2.0+build.9", 0},
+		{"1.2.0-beta+7", "1.2.0-beta", 0},
+		// Non-numeric components compare lexically.
+		{"1.2.a", "1.2.b", -1},
+		{"1.2.b", "1.2.10", 1},
+		{"", "0", 0},
+		{"", "0.0.1", -1},
+	}
+	for _, tt := range tests {
+		if got := CompareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
 )
 
 // DailySummary is used to prepare data for the admin page.
@@ -19,8 +21,21 @@ type DailySummary struct {
 
 // GetLastNDaysSummary queries DB and builds per-day stats including per-platform active users.
 func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
-	today := time.Now().UTC()
-	start := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -days+1)
+	return GetSummary(db, Today().AddDate(0, 0, -days+1), days, nil)
+}
+
+// Today returns the start of the current UTC day.
+func Today() time.Time {
+	now := time.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// GetSummary builds per-day stats for the given number of days starting at
+// start. Only events matching f are counted.
+func GetSummary(db *gorm.DB, start time.Time, days int, f Filter) ([]DailySummary, error) {
+	end := start.AddDate(0, 0, days)
+	fw, fargs := f.where()
+	args := append([]any{start, end}, fargs...)
 
 	// 1) New users per day.
 	type NewRow struct {
@@ -28,15 +43,28 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		Cnt int64
 	}
 	var newRows []NewRow
-	if err := db.Raw(`
+	qStart := time.Now()
+	newQuery := db.Raw(`
         SELECT DATE(first_seen) AS day, COUNT(*) AS cnt
         FROM users
-        WHERE first_seen >= ?
+        WHERE first_seen >= ? AND first_seen < ?
         GROUP BY DATE(first_seen)
         ORDER BY day
-    `, start).Scan(&newRows).Error; err != nil {
+    `, start, end)
+	if len(f) > 0 {
+		// With a filter, new users are those with a matching event on their first day.
+		newQuery = db.Raw(`
+        SELECT DATE(event_time) AS day, COUNT(DISTINCT user_id) AS cnt
+        FROM user_events
+        WHERE event_time >= ? AND event_time < ?`+fw+newUsersWhere(dateExpr)+`
+        GROUP BY DATE(event_time)
+        ORDER BY day
+    `, args...)
+	}
+	if err := newQuery.Scan(&newRows).Error; err != nil {
 		return nil, err
 	}
+	metrics.ObserveQuery("new_users", qStart)
 	newMap := make(map[string]int64)
 	for _, r := range newRows {
 		newMap[r.Day.Format("2006-01-02")] = r.Cnt
@@ -48,15 +76,17 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		Cnt int64
 	}
 	var activeRows []ActiveRow
+	qStart = time.Now()
 	if err := db.Raw(`
         SELECT DATE(event_time) AS day, COUNT(DISTINCT user_id) AS cnt
         FROM user_events
-        WHERE event_time >= ?
+        WHERE event_time >= ? AND event_time < ?`+fw+`
         GROUP BY DATE(event_time)
         ORDER BY day
-    `, start).Scan(&activeRows).Error; err != nil {
+    `, args...).Scan(&activeRows).Error; err != nil {
 		return nil, err
 	}
+	metrics.ObserveQuery("active_users", qStart)
 	activeMap := make(map[string]int64)
 	for _, r := range activeRows {
 		activeMap[r.Day.Format("2006-01-02")] = r.Cnt
@@ -69,15 +99,17 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		Cnt      int64
 	}
 	var pRows []PlatformRow
+	qStart = time.Now()
 	if err := db.Raw(`
         SELECT DATE(event_time) AS day, platform, COUNT(DISTINCT user_id) AS cnt
         FROM user_events
-        WHERE event_time >= ?
+        WHERE event_time >= ? AND event_time < ?`+fw+`
         GROUP BY DATE(event_time), platform
         ORDER BY day, platform
-    `, start).Scan(&pRows).Error; err != nil {
+    `, args...).Scan(&pRows).Error; err != nil {
 		return nil, err
 	}
+	metrics.ObserveQuery("platform_active", qStart)
 	platformMap := make(map[string]map[string]int64)
 	for _, r := range pRows {
 		dayStr := r.Day.Format("2006-01-02")
@@ -94,15 +126,17 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		Cnt     int64
 	}
 	var vRows []VersionRow
+	qStart = time.Now()
 	if err := db.Raw(`
         SELECT DATE(event_time) AS day, app_version AS version, COUNT(DISTINCT user_id) AS cnt
         FROM user_events
-        WHERE event_time >= ?
+        WHERE event_time >= ? AND event_time < ?`+fw+`
         GROUP BY DATE(event_time), app_version
         ORDER BY day, app_version
-    `, start).Scan(&vRows).Error; err != nil {
+    `, args...).Scan(&vRows).Error; err != nil {
 		return nil, err
 	}
+	metrics.ObserveQuery("version_active", qStart)
 	versionMap := make(map[string]map[string]int64)
 	for _, r := range vRows {
 		dayStr := r.Day.Format("2006-01-02")
@@ -119,15 +153,17 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		Cnt    int64
 	}
 	var rRows []RegionRow
+	qStart = time.Now()
 	if err := db.Raw(`
         SELECT DATE(event_time) AS day, region, COUNT(DISTINCT user_id) AS cnt
         FROM user_events
-        WHERE event_time >= ?
+        WHERE event_time >= ? AND event_time < ?`+fw+`
         GROUP BY DATE(event_time), region
         ORDER BY day, region
-    `, start).Scan(&rRows).Error; err != nil {
+    `, args...).Scan(&rRows).Error; err != nil {
 		return nil, err
 	}
+	metrics.ObserveQuery("region_active", qStart)
 	regionMap := make(map[string]map[string]int64)
 	for _, r := range rRows {
 		dayStr := r.Day.Format("2006-01-02")
@@ -137,7 +173,39 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 		regionMap[dayStr][r.Region] = r.Cnt
 	}
 
-	// 6) Build continuous N days result.
+	// 6) Days whose raw events a retention policy purged are read from the
+	// rollups kept for them. Users active in several apps count once per app.
+	purged, err := purgedRollups(db, start, end, f)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range purged {
+		dayStr := r.Day.Format("2006-01-02")
+		var m map[string]map[string]int64
+		switch Dimension(r.Dimension) {
+		case "":
+			activeMap[dayStr] += r.ActiveUsers
+			if len(f) > 0 {
+				// Without a filter new users come from users, which is not purged.
+				newMap[dayStr] += r.NewUsers
+			}
+			continue
+		case DimensionPlatform:
+			m = platformMap
+		case DimensionVersion:
+			m = versionMap
+		case DimensionRegion:
+			m = regionMap
+		default:
+			continue
+		}
+		if m[dayStr] == nil {
+			m[dayStr] = make(map[string]int64)
+		}
+		m[dayStr][r.Value] += r.ActiveUsers
+	}
+
+	// 7) Build continuous N days result.
 	res := make([]DailySummary, 0, days)
 	for d := 0; d < days; d++ {
 		day := start.AddDate(0, 0, d)
@@ -160,4 +228,31 @@ func GetLastNDaysSummary(db *gorm.DB, days int) ([]DailySummary, error) {
 	return res, nil
 }
 
+// rollupRow is a row of daily_rollups.
+type rollupRow struct {
+	Day         time.Time
+	Dimension   string
+	Value       string
+	NewUsers    int64
+	ActiveUsers int64
+}
 
+// purgedRollups returns the rollups in [start, end) of the days whose raw
+// events were purged by a retention policy, or nothing when f cannot be
+// answered from rollups.
+func purgedRollups(db *gorm.DB, start, end time.Time, f Filter) ([]rollupRow, error) {
+	fw, fargs, ok := f.rollupWhere()
+	if !ok {
+		return nil, nil
+	}
+	defer metrics.ObserveQuery("purged_rollups", time.Now())
+	var rows []rollupRow
+	err := db.Raw(`
+        SELECT r.day, r.dimension, r.value, r.new_users, r.active_users
+        FROM daily_rollups r
+        JOIN retention_policies p ON p.app = r.app
+        WHERE r.day >= ? AND r.day < ? AND r.day < p.purged_before`+fw+`
+        ORDER BY r.day
+    `, append([]any{start.Format("2006-01-02"), end.Format("2006-01-02")}, fargs...)...).Scan(&rows).Error
+	return rows, err
+}
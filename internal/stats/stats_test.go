@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestGetSummaryPurgedDays(t *testing.T) {
+	db := testdb.Open(t, &models.User{}, &models.UserEvent{}, &models.DailyRollup{}, &models.RetentionPolicy{})
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	// The raw events of the shop before March 3 were purged; news keeps
+	// them, so its rollups are not used.
+	purged := day(3)
+	db.Create(&models.RetentionPolicy{App: "shop", RawDays: 30, Enabled: true, PurgedBefore: &purged})
+	for _, r := range []models.DailyRollup{
+		{Day: day(1), App: "shop", NewUsers: 2, ActiveUsers: 5},
+		{Day: day(1), App: "shop", Dimension: "platform", Value: "ios", ActiveUsers: 3},
+		{Day: day(1), App: "shop", Dimension: "platform", Value: "android", ActiveUsers: 2},
+		{Day: day(1), App: "news", NewUsers: 7, ActiveUsers: 7},
+		{Day: day(3), App: "shop", NewUsers: 1, ActiveUsers: 1},
+	} {
+		db.Create(&r)
+	}
+	db.Create(&models.User{UserID: "u1", FirstSeen: day(3)})
+	db.Create(&models.UserEvent{App: "shop", UserID: "u1", Platform: "ios", EventTime: day(3).Add(10 * time.Hour)})
+
+	type want struct {
+		newUsers, active [3]int64
+		ios              int64 // on March 1
+	}
+	tests := []struct {
+		name string
+		f    Filter
+		want want
+	}{
+		// Without a filter new users come from users, which is not purged.
+		{name: "no filter", want: want{newUsers: [3]int64{0, 0, 1}, active: [3]int64{5, 0, 1}, ios: 3}},
+		{name: "app", f: Filter{{Field: FieldApp, Op: OpEquals, Values: []string{"shop"}}}.ExcludeInternal(),
+			want: want{newUsers: [3]int64{2, 0, 1}, active: [3]int64{5, 0, 1}, ios: 3}},
+		{name: "app prefix", f: Filter{{Field: FieldApp, Op: OpPrefix, Values: []string{"sh"}}},
+			want: want{newUsers: [3]int64{2, 0, 1}, active: [3]int64{5, 0, 1}, ios: 3}},
+		{name: "other app", f: Filter{{Field: FieldApp, Op: OpIn, Values: []string{"news"}}}},
+		// Rollups cannot answer other filters.
+		{name: "platform", f: Filter{{Field: FieldPlatform, Op: OpEquals, Values: []string{"ios"}}},
+			want: want{newUsers: [3]int64{0, 0, 1}, active: [3]int64{0, 0, 1}}},
+		{name: "internal", f: Filter{{Field: FieldInternal, Op: OpEquals, Values: []string{"true"}}}},
+	}
+	for _, tt := range tests {
+		got, err := GetSummary(db, day(1), 3, tt.f)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var w want
+		for i, s := range got {
+			w.newUsers[i], w.active[i] = s.NewUsers, s.ActiveUsers
+		}
+		w.ios = got[0].PlatformActive["ios"]
+		if w != tt.want {
+			t.Errorf("%s: summary %+v, want %+v", tt.name, w, tt.want)
+		}
+	}
+}
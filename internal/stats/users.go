@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+	"appstats/internal/models"
+)
+
+// VersionUsage describes one app version used by a user.
+type VersionUsage struct {
+	Version   string    `json:"version"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Events    int64     `json:"events"`
+}
+
+// ActiveDay is the number of events a user reported on one day.
+type ActiveDay struct {
+	Date   string `json:"date"`
+	Events int64  `json:"events"`
+}
+
+// UserProfile aggregates what we know about a single user.
+type UserProfile struct {
+	User    models.User `json:"user"`
+	Aliases []string    `json:"aliases"`
+	// Properties and PropertyHistory are filled from the user properties
+	// store; see package profiles.
+	Properties      map[string]any              `json:"properties"`
+	PropertyHistory []models.UserPropertyChange `json:"property_history"`
+	TotalEvents     int64                       `json:"total_events"`
+	LastSeen        *time.Time                  `json:"last_seen"`
+	Versions        []VersionUsage              `json:"versions"`
+	ActiveDays      []ActiveDay                 `json:"active_days"`
+}
+
+// GetUserProfile loads the user record, the versions they used and their
+// active days within the last calendarDays days. It returns
+// gorm.ErrRecordNotFound when the user does not exist.
+func GetUserProfile(db *gorm.DB, userID string, calendarDays int) (*UserProfile, error) {
+	defer metrics.ObserveQuery("user_profile", time.Now())
+
+	var p UserProfile
+	if err := db.Where("user_id = ?", userID).First(&p.User).Error; err != nil {
+		return nil, err
+	}
+
+	type totalsRow struct {
+		Cnt  int64
+		Last *time.Time
+	}
+	var totals totalsRow
+	if err := db.Raw(`
+        SELECT COUNT(*) AS cnt, MAX(event_time) AS last
+        FROM user_events
+        WHERE user_id = ?
+    `, userID).Scan(&totals).Error; err != nil {
+		return nil, err
+	}
+	p.TotalEvents = totals.Cnt
+	p.LastSeen = totals.Last
+
+	if err := db.Raw(`
+        SELECT app_version AS version, MIN(event_time) AS first_seen, MAX(event_time) AS last_seen, COUNT(*) AS events
+        FROM user_events
+        WHERE user_id = ?
+        GROUP BY app_version
+        ORDER BY first_seen
+    `, userID).Scan(&p.Versions).Error; err != nil {
+		return nil, err
+	}
+
+	type dayRow struct {
+		Day time.Time
+		Cnt int64
+	}
+	var dayRows []dayRow
+	if err := db.Raw(`
+        SELECT DATE(event_time) AS day, COUNT(*) AS cnt
+        FROM user_events
+        WHERE user_id = ? AND event_time >= ?
+        GROUP BY DATE(event_time)
+        ORDER BY day
+    `, userID, Today().AddDate(0, 0, -calendarDays+1)).Scan(&dayRows).Error; err != nil {
+		return nil, err
+	}
+	p.ActiveDays = make([]ActiveDay, 0, len(dayRows))
+	for _, r := range dayRows {
+		p.ActiveDays = append(p.ActiveDays, ActiveDay{Date: r.Day.Format("2006-01-02"), Events: r.Cnt})
+	}
+
+	return &p, nil
+}
+
+// EventPage is one page of a user's event timeline, newest first.
+type EventPage struct {
+	Events   []models.UserEvent `json:"events"`
+	Total    int64              `json:"total"`
+	Page     int                `json:"page"`
+	PageSize int                `json:"page_size"`
+}
+
+// ListUserEvents returns the page-th (1-based) page of a user's events.
+func ListUserEvents(db *gorm.DB, userID string, page, pageSize int) (*EventPage, error) {
+	defer metrics.ObserveQuery("user_events", time.Now())
+
+	res := EventPage{Page: page, PageSize: pageSize}
+	q := db.Model(&models.UserEvent{}).Where("user_id = ?", userID)
+	if err := q.Count(&res.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := q.Order("event_time DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&res.Events).Error; err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
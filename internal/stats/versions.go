@@ -0,0 +1,153 @@
+package stats
+
+import (
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/metrics"
+)
+
+// VersionAdoption is the daily share of active users on one app version.
+type VersionAdoption struct {
+	Version   string    `json:"version"`
+	FirstSeen time.Time `json:"first_seen"`
+	// Share is the fraction of DAU on this version, aligned with AdoptionReport.Days.
+	Share []float64 `json:"share"`
+	// DaysToThreshold is the number of days from FirstSeen until the share
+	// first reached the threshold, nil if it has not within the range.
+	DaysToThreshold *int `json:"days_to_threshold"`
+}
+
+// VersionUpgrade counts users that moved from one version to another.
+type VersionUpgrade struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Users     int64  `json:"users"`
+	Downgrade bool   `json:"downgrade"`
+}
+
+// AdoptionReport describes version adoption over a date range.
+type AdoptionReport struct {
+	Days      []string          `json:"days"`
+	Threshold float64           `json:"threshold"`
+	Versions  []VersionAdoption `json:"versions"`
+	Upgrades  []VersionUpgrade  `json:"upgrades"`
+}
+
+// GetVersionAdoption computes per-version share of DAU, the days each version
+// took to reach threshold (a fraction, e.g. 0.5) and the upgrade paths
+// observed between successive events of the same user. Versions are sorted
+// newest first using CompareVersions.
+func GetVersionAdoption(db *gorm.DB, start time.Time, days int, threshold float64, f Filter) (*AdoptionReport, error) {
+	summary, err := GetSummary(db, start, days, f)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &AdoptionReport{Threshold: threshold, Days: make([]string, len(summary))}
+	shares := make(map[string][]float64)
+	for i, d := range summary {
+		rep.Days[i] = d.Date
+		if d.ActiveUsers == 0 {
+			continue
+		}
+		for v, n := range d.VersionActive {
+			if shares[v] == nil {
+				shares[v] = make([]float64, len(summary))
+			}
+			shares[v][i] = float64(n) / float64(d.ActiveUsers)
+		}
+	}
+	if len(shares) == 0 {
+		return rep, nil
+	}
+
+	versions := make([]string, 0, len(shares))
+	for v := range shares {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return CompareVersions(versions[i], versions[j]) > 0 })
+
+	firstSeen, err := versionFirstSeen(db, versions, f)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		a := VersionAdoption{Version: v, FirstSeen: firstSeen[v], Share: shares[v]}
+		for i, s := range a.Share {
+			if s >= threshold {
+				day, _ := time.Parse("2006-01-02", rep.Days[i])
+				first := a.FirstSeen.UTC().Truncate(24 * time.Hour)
+				n := int(day.Sub(first).Hours() / 24)
+				if n < 0 {
+					n = 0
+				}
+				a.DaysToThreshold = &n
+				break
+			}
+		}
+		rep.Versions = append(rep.Versions, a)
+	}
+
+	rep.Upgrades, err = getVersionUpgrades(db, start, start.AddDate(0, 0, days), f)
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// versionFirstSeen returns the earliest event time of each version among
+// the events matching f.
+func versionFirstSeen(db *gorm.DB, versions []string, f Filter) (map[string]time.Time, error) {
+	defer metrics.ObserveQuery("version_first_seen", time.Now())
+
+	fw, fargs := f.where()
+	type row struct {
+		Version   string
+		FirstSeen time.Time
+	}
+	var rows []row
+	if err := db.Raw(`
+        SELECT app_version AS version, MIN(event_time) AS first_seen
+        FROM user_events
+        WHERE app_version IN ?`+fw+`
+        GROUP BY app_version
+    `, append([]any{versions}, fargs...)...).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[string]time.Time, len(rows))
+	for _, r := range rows {
+		res[r.Version] = r.FirstSeen
+	}
+	return res, nil
+}
+
+// getVersionUpgrades counts users per (previous version, next version) pair
+// of successive events inside [start, end). Requires MySQL 8 window functions.
+func getVersionUpgrades(db *gorm.DB, start, end time.Time, f Filter) ([]VersionUpgrade, error) {
+	defer metrics.ObserveQuery("version_upgrades", time.Now())
+
+	fw, fargs := f.where()
+	var res []VersionUpgrade
+	if err := db.Raw(`
+        SELECT from_version AS `+"`from`"+`, to_version AS `+"`to`"+`, COUNT(DISTINCT user_id) AS users
+        FROM (
+            SELECT user_id, app_version AS to_version,
+                   LAG(app_version) OVER (PARTITION BY user_id ORDER BY event_time, id) AS from_version
+            FROM user_events
+            WHERE event_time >= ? AND event_time < ? AND app_version <> ''`+fw+`
+        ) t
+        WHERE from_version IS NOT NULL AND from_version <> to_version
+        GROUP BY from_version, to_version
+        ORDER BY users DESC
+        LIMIT 100
+    `, append([]any{start, end}, fargs...)...).Scan(&res).Error; err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].Downgrade = CompareVersions(res[i].To, res[i].From) < 0
+	}
+	return res, nil
+}
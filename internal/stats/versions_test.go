@@ -0,0 +1,32 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestVersionFirstSeen(t *testing.T) {
+	db := testdb.Open(t, &models.UserEvent{})
+	at := func(day int) time.Time { return time.Date(2024, 3, day, 12, 0, 0, 0, time.UTC) }
+	for _, e := range []models.UserEvent{
+		{App: "news", UserID: "a", AppVersion: "2.0.0", EventTime: at(1)},
+		{App: "shop", UserID: "qa", AppVersion: "2.0.0", EventTime: at(2), Internal: true},
+		{App: "shop", UserID: "b", AppVersion: "2.0.0", EventTime: at(5)},
+		{App: "shop", UserID: "b", AppVersion: "1.0.0", EventTime: at(3)},
+	} {
+		db.Create(&e)
+	}
+	// Versions first seen in another app or in internal traffic do not
+	// count for the shop.
+	f := Filter{{Field: FieldApp, Op: OpEquals, Values: []string{"shop"}}}.ExcludeInternal()
+	got, err := versionFirstSeen(db, []string{"1.0.0", "2.0.0", "3.0.0"}, f)
+	if err != nil {
+		t.Fatalf("versionFirstSeen: %v", err)
+	}
+	if len(got) != 2 || !got["2.0.0"].Equal(at(5)) || !got["1.0.0"].Equal(at(3)) {
+		t.Errorf("first seen = %v", got)
+	}
+}
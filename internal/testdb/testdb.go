@@ -0,0 +1,148 @@
+// Package testdb opens in-memory SQLite databases for tests of code written
+// against MySQL.
+package testdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync"
+	"testing"
+	"time"
+
+	sqlite3 "github.com/glebarez/go-sqlite"
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const driverName = "appstats-test-sqlite"
+
+var register sync.Once
+
+// Open returns an empty in-memory database with the tables of models,
+// closed when the test ends.
+//
+// SQLite stores times as text, so time arguments are converted to UTC to
+// compare like MySQL compares datetimes, and JSON_UNQUOTE is provided for
+// the JSON_UNQUOTE(JSON_EXTRACT(...)) expressions the code uses. Times and
+// dates computed by expressions such as MIN(event_time) or DATE(event_time)
+// come back as time.Time, as they do from MySQL.
+func Open(t testing.TB, models ...any) *gorm.DB {
+	t.Helper()
+	register.Do(func() {
+		// Wrap the registered driver, which holds the functions below.
+		base, err := sql.Open(sqlite.DriverName, "")
+		if err != nil {
+			panic(err)
+		}
+		sql.Register(driverName, utcDriver{base.Driver()})
+		base.Close()
+		// SQLite's json_extract already unquotes strings.
+		sqlite3.MustRegisterDeterministicScalarFunction("json_unquote", 1,
+			func(ctx *sqlite3.FunctionContext, args []driver.Value) (driver.Value, error) { return args[0], nil })
+	})
+	db, err := gorm.Open(sqlite.Dialector{DriverName: driverName, DSN: ":memory:"},
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection would get its own in-memory database.
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return db
+}
+
+type utcDriver struct {
+	driver.Driver
+}
+
+func (d utcDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return utcConn{c}, nil
+}
+
+type utcConn struct {
+	driver.Conn
+}
+
+// CheckNamedValue converts time arguments to UTC and leaves the rest to the
+// default conversion.
+func (utcConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if t, ok := nv.Value.(time.Time); ok {
+		nv.Value = t.UTC()
+	}
+	return driver.ErrSkip
+}
+
+func (c utcConn) Prepare(query string) (driver.Stmt, error) {
+	s, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return timeStmt{s}, nil
+}
+
+// timeStmt returns rows that parse times stored as text.
+type timeStmt struct {
+	driver.Stmt
+}
+
+func (s timeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s timeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return timeRows{rows}, nil
+}
+
+type timeRows struct {
+	driver.Rows
+}
+
+// storedTime is the layout the driver writes times in, and DATE() returns
+// dates.
+const (
+	storedTime = "2006-01-02 15:04:05.999999999-07:00"
+	dateOnly   = "2006-01-02"
+)
+
+// Next parses times and dates returned by expressions such as
+// MIN(event_time) and DATE(event_time), which MySQL types while SQLite
+// returns text. Columns declared as datetimes are parsed by the driver.
+func (r timeRows) Next(dest []driver.Value) error {
+	if err := r.Rows.Next(dest); err != nil {
+		return err
+	}
+	types, _ := r.Rows.(driver.RowsColumnTypeDatabaseTypeName)
+	for i, v := range dest {
+		s, ok := v.(string)
+		switch {
+		case !ok || types != nil && types.ColumnTypeDatabaseTypeName(i) != "":
+			// Declared columns keep their type, e.g. dates kept as text.
+		case len(s) == len(dateOnly):
+			if t, err := time.Parse(dateOnly, s); err == nil {
+				dest[i] = t
+			}
+		case len(s) >= len("2006-01-02 15:04:05-07:00"):
+			if t, err := time.Parse(storedTime, s); err == nil {
+				dest[i] = t
+			}
+		}
+	}
+	return nil
+}
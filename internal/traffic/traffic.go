@@ -0,0 +1,430 @@
+package traffic
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/rollups"
+	"appstats/internal/stats"
+)
+
+const (
+	// rulesCacheTTL bounds how long changed rules take to apply on other
+	// instances.
+	rulesCacheTTL = 30 * time.Second
+	// maxRateEntries bounds the per-user event counters of one minute.
+	maxRateEntries = 200000
+	// historyBatchSize is how many user IDs each statement of
+	// ApplyToHistory flags.
+	historyBatchSize = 1000
+)
+
+// Validate checks a rule before it is saved.
+func Validate(r *models.TrafficRule) error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.App = strings.TrimSpace(r.App)
+	r.Value = strings.TrimSpace(r.Value)
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	switch r.Action {
+	case models.TrafficDrop, models.TrafficFlag:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	_, err := compile(*r)
+	return err
+}
+
+// rule is a compiled traffic rule.
+type rule struct {
+	models.TrafficRule
+	values   map[string]bool
+	pattern  *regexp.Regexp
+	prefixes []netip.Prefix
+	suffixes []string
+	maxRate  int
+}
+
+func compile(r models.TrafficRule) (*rule, error) {
+	c := &rule{TrafficRule: r}
+	items := splitList(r.Value)
+	switch r.Kind {
+	case models.TrafficUserID:
+		if len(items) == 0 {
+			return nil, errors.New("at least one user_id is required")
+		}
+		c.values = make(map[string]bool, len(items))
+		for _, v := range items {
+			c.values[v] = true
+		}
+	case models.TrafficUserIDPattern:
+		p, err := regexp.Compile(r.Value)
+		if err != nil || r.Value == "" {
+			return nil, fmt.Errorf("invalid user_id pattern %q", r.Value)
+		}
+		c.pattern = p
+	case models.TrafficIPRange:
+		if len(items) == 0 {
+			return nil, errors.New("at least one IP address or range is required")
+		}
+		for _, v := range items {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(v)
+				if aerr != nil {
+					return nil, fmt.Errorf("invalid IP address or range %q", v)
+				}
+				p = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			c.prefixes = append(c.prefixes, p.Masked())
+		}
+	case models.TrafficAppVersionSuffix:
+		if len(items) == 0 {
+			return nil, errors.New("at least one app_version suffix is required")
+		}
+		c.suffixes = items
+	case models.TrafficEventRate:
+		n, err := strconv.Atoi(r.Value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("event rate must be a positive number of events per minute, got %q", r.Value)
+		}
+		c.maxRate = n
+	default:
+		return nil, fmt.Errorf("unknown kind %q", r.Kind)
+	}
+	return c, nil
+}
+
+func splitList(s string) []string {
+	var res []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// Event is what rules are matched against.
+type Event struct {
+	App string
+	// UserIDs are the identifiers of the reporting user: as reported, as
+	// stored after pseudonymization, and the user they are an alias of.
+	UserIDs    []string
+	AppVersion string
+	IP         netip.Addr
+}
+
+// Match is the outcome of matching an event.
+type Match struct {
+	// Action is drop, flag or empty when no rule matched.
+	Action string
+	// Rule is the name of the deciding rule.
+	Rule string
+}
+
+// Filter matches reported events against the enabled traffic rules. Event
+// rates are counted per instance, so with several instances behind a load
+// balancer a rate rule applies to the share of events each one receives.
+type Filter struct {
+	db *gorm.DB
+
+	mu       sync.Mutex
+	rules    []*rule
+	loadedAt time.Time
+	loading  bool
+	gen      int // incremented by Invalidate
+	minute   int64
+	counts   map[string]int
+}
+
+// NewFilter returns a filter backed by db.
+func NewFilter(db *gorm.DB) *Filter {
+	return &Filter{db: db, counts: make(map[string]int)}
+}
+
+// Invalidate drops the cached rules, e.g. after they changed.
+func (f *Filter) Invalidate() {
+	f.mu.Lock()
+	f.rules, f.loadedAt = nil, time.Time{}
+	f.gen++
+	f.mu.Unlock()
+}
+
+// Match matches e against the enabled rules of its app. A dropping rule
+// wins over a flagging one. Every call counts towards the event rate of
+// the user.
+func (f *Filter) Match(e Event) (Match, error) {
+	rules, err := f.load()
+	if err != nil {
+		return Match{}, err
+	}
+	f.mu.Lock()
+	rate := f.count(e)
+	f.mu.Unlock()
+
+	var m Match
+	for _, r := range rules {
+		if r.App != "" && r.App != e.App {
+			continue
+		}
+		if m.Action == models.TrafficDrop || (m.Action == models.TrafficFlag && r.Action == models.TrafficFlag) {
+			continue
+		}
+		if r.matches(e, rate) {
+			m = Match{Action: r.Action, Rule: r.Name}
+		}
+	}
+	return m, nil
+}
+
+// load returns the rules, reloading them when they are older than
+// rulesCacheTTL. The query runs without holding f.mu, so events are not
+// queued behind it; while one caller reloads, others keep the old rules.
+// The new rules replace the old slice, which is never modified.
+func (f *Filter) load() ([]*rule, error) {
+	f.mu.Lock()
+	if time.Since(f.loadedAt) <= rulesCacheTTL || f.loading && f.rules != nil {
+		rules := f.rules
+		f.mu.Unlock()
+		return rules, nil
+	}
+	f.loading = true
+	gen := f.gen
+	f.mu.Unlock()
+
+	rules, err := f.query()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loading = false
+	if err != nil {
+		return nil, err
+	}
+	// Rules invalidated during the query may be older than the change.
+	if gen == f.gen {
+		f.rules, f.loadedAt = rules, time.Now()
+	}
+	return rules, nil
+}
+
+func (f *Filter) query() ([]*rule, error) {
+	var rows []models.TrafficRule
+	if err := f.db.Where("enabled = ?", true).Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	rules := make([]*rule, 0, len(rows))
+	for _, r := range rows {
+		c, err := compile(r)
+		if err != nil {
+			// Rules are validated when saved; skip anything broken since.
+			slog.Warn("skipping invalid traffic rule", slog.Uint64("id", uint64(r.ID)), slog.Any("error", err))
+			continue
+		}
+		rules = append(rules, c)
+	}
+	return rules, nil
+}
+
+// count adds e to the event count of its user in the current minute and
+// returns the new count. The caller holds f.mu.
+func (f *Filter) count(e Event) int {
+	if len(e.UserIDs) == 0 {
+		return 0
+	}
+	minute := time.Now().Unix() / 60
+	if minute != f.minute || len(f.counts) >= maxRateEntries {
+		clear(f.counts)
+		f.minute = minute
+	}
+	key := e.App + "\x00" + e.UserIDs[len(e.UserIDs)-1]
+	f.counts[key]++
+	return f.counts[key]
+}
+
+func (r *rule) matches(e Event, rate int) bool {
+	switch r.Kind {
+	case models.TrafficUserID:
+		for _, id := range e.UserIDs {
+			if r.values[id] {
+				return true
+			}
+		}
+	case models.TrafficUserIDPattern:
+		for _, id := range e.UserIDs {
+			if r.pattern.MatchString(id) {
+				return true
+			}
+		}
+	case models.TrafficIPRange:
+		if !e.IP.IsValid() {
+			return false
+		}
+		ip := e.IP.Unmap()
+		for _, p := range r.prefixes {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+	case models.TrafficAppVersionSuffix:
+		for _, s := range r.suffixes {
+			if strings.HasSuffix(e.AppVersion, s) {
+				return true
+			}
+		}
+	case models.TrafficEventRate:
+		return rate > r.maxRate
+	}
+	return false
+}
+
+// ApplyToHistory flags the stored events matching r as internal traffic and
+// marks the rollups of the affected days stale. Only user_id, user_id
+// pattern and app_version suffix rules can be applied, as IP addresses and
+// rates are not stored. The pattern is matched in Go against the distinct
+// stored user IDs, as it is for new events. It returns the number of
+// events flagged.
+func ApplyToHistory(db *gorm.DB, r *models.TrafficRule) (int64, error) {
+	c, err := compile(*r)
+	if err != nil {
+		return 0, err
+	}
+	where := "internal = FALSE"
+	var args []any
+	if r.App != "" {
+		where += " AND app = ?"
+		args = append(args, r.App)
+	}
+	var ids []string
+	switch r.Kind {
+	case models.TrafficUserID:
+		ids = splitList(r.Value)
+	case models.TrafficUserIDPattern:
+		if ids, err = matchingUserIDs(db, where, args, c.pattern); err != nil {
+			return 0, err
+		}
+	case models.TrafficAppVersionSuffix:
+		conds := make([]string, len(c.suffixes))
+		for i, s := range c.suffixes {
+			conds[i] = "app_version LIKE ?"
+			args = append(args, "%"+stats.EscapeLike(s))
+		}
+		where += " AND (" + strings.Join(conds, " OR ") + ")"
+	default:
+		return 0, fmt.Errorf("%s rules only apply to new events", r.Kind)
+	}
+
+	var total int64
+	var first, last *time.Time
+	flag := func(where string, args []any) error {
+		var span struct{ First, Last *time.Time }
+		if err := db.Model(&models.UserEvent{}).Select("MIN(event_time) AS first, MAX(event_time) AS last").
+			Where(where, args...).Scan(&span).Error; err != nil {
+			return err
+		}
+		if span.First == nil {
+			return nil
+		}
+		res := db.Model(&models.UserEvent{}).Where(where, args...).Update("internal", true)
+		if res.Error != nil {
+			return res.Error
+		}
+		total += res.RowsAffected
+		if first == nil || span.First.Before(*first) {
+			first = span.First
+		}
+		if last == nil || span.Last.After(*last) {
+			last = span.Last
+		}
+		return nil
+	}
+	if r.Kind == models.TrafficAppVersionSuffix {
+		err = flag(where, args)
+	} else {
+		for batch := range slices.Chunk(ids, historyBatchSize) {
+			if err = flag(where+" AND user_id IN ?", append(slices.Clip(args), batch)); err != nil {
+				break
+			}
+		}
+	}
+	if total > 0 {
+		MarkInternal()
+	}
+	if err != nil || first == nil {
+		return total, err
+	}
+	var days []time.Time
+	for d := first.UTC().Truncate(24 * time.Hour); !d.After(*last); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	// The materializer recomputes the stale days on its next run.
+	return total, rollups.Invalidate(db, days)
+}
+
+// matchingUserIDs returns the distinct user IDs of the events matching
+// where that match pattern.
+func matchingUserIDs(db *gorm.DB, where string, args []any, pattern *regexp.Regexp) ([]string, error) {
+	rows, err := db.Model(&models.UserEvent{}).Distinct("user_id").Where(where, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if pattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// internalCache remembers whether any event is flagged as internal traffic.
+var internalCache struct {
+	sync.Mutex
+	has      bool
+	loadedAt time.Time
+}
+
+// MarkInternal records that an event was flagged, so ExcludeInternal
+// applies right away on this instance.
+func MarkInternal() {
+	internalCache.Lock()
+	internalCache.has = true
+	internalCache.Unlock()
+}
+
+// ExcludeInternal returns f restricted to events not flagged as internal
+// traffic. While no event is flagged, f is returned unchanged, which keeps
+// the faster unfiltered queries.
+func ExcludeInternal(db *gorm.DB, f stats.Filter) stats.Filter {
+	internalCache.Lock()
+	defer internalCache.Unlock()
+	if !internalCache.has && time.Since(internalCache.loadedAt) > rulesCacheTTL {
+		var ids []uint
+		if err := db.Model(&models.UserEvent{}).Where("internal = ?", true).Limit(1).Pluck("id", &ids).Error; err != nil {
+			slog.Warn("check internal traffic failed", slog.Any("error", err))
+			return f.ExcludeInternal()
+		}
+		internalCache.has, internalCache.loadedAt = len(ids) > 0, time.Now()
+	}
+	if !internalCache.has {
+		return f
+	}
+	return f.ExcludeInternal()
+}
@@ -0,0 +1,175 @@
+package traffic
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		kind, value string
+		wantErr     string
+	}{
+		{kind: models.TrafficUserID, value: "qa-1, qa-2\nqa-3"},
+		{kind: models.TrafficUserID, value: " ,\n", wantErr: "user_id is required"},
+		{kind: models.TrafficUserIDPattern, value: `^test-\d+$`},
+		{kind: models.TrafficUserIDPattern, value: `^test-(`, wantErr: "invalid user_id pattern"},
+		{kind: models.TrafficUserIDPattern, value: "", wantErr: "invalid user_id pattern"},
+		{kind: models.TrafficIPRange, value: "10.0.0.0/8, 192.168.1.7, 2001:db8::/32"},
+		{kind: models.TrafficIPRange, value: "10.0.0.0/33", wantErr: "invalid IP"},
+		{kind: models.TrafficIPRange, value: "intranet", wantErr: "invalid IP"},
+		{kind: models.TrafficAppVersionSuffix, value: "-debug,-qa"},
+		{kind: models.TrafficAppVersionSuffix, value: "", wantErr: "suffix is required"},
+		{kind: models.TrafficEventRate, value: "600"},
+		{kind: models.TrafficEventRate, value: "0", wantErr: "positive number"},
+		{kind: models.TrafficEventRate, value: "fast", wantErr: "positive number"},
+		{kind: "user_agent", value: "bot", wantErr: "unknown kind"},
+	}
+	for _, tt := range tests {
+		_, err := compile(models.TrafficRule{Kind: tt.kind, Value: tt.value})
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("compile(%s %q): err = %v, want %q", tt.kind, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind, value string
+		e           Event
+		rate        int
+		want        bool
+	}{
+		{name: "user id", kind: models.TrafficUserID, value: "qa-1,qa-2", e: Event{UserIDs: []string{"qa-2"}}, want: true},
+		{name: "alias of listed user", kind: models.TrafficUserID, value: "qa-1", e: Event{UserIDs: []string{"device-9", "qa-1"}}, want: true},
+		{name: "other user id", kind: models.TrafficUserID, value: "qa-1", e: Event{UserIDs: []string{"qa-10"}}},
+		{name: "pattern", kind: models.TrafficUserIDPattern, value: `^test-\d+$`, e: Event{UserIDs: []string{"test-42"}}, want: true},
+		{name: "pattern is not a prefix", kind: models.TrafficUserIDPattern, value: `^test-\d+$`, e: Event{UserIDs: []string{"test-42x"}}},
+		{name: "ip in range", kind: models.TrafficIPRange, value: "10.0.0.0/8", e: Event{IP: netip.MustParseAddr("10.20.30.40")}, want: true},
+		{name: "ipv4 mapped ipv6", kind: models.TrafficIPRange, value: "10.0.0.0/8", e: Event{IP: netip.MustParseAddr("::ffff:10.1.2.3")}, want: true},
+		{name: "single ip", kind: models.TrafficIPRange, value: "192.168.1.7", e: Event{IP: netip.MustParseAddr("192.168.1.8")}},
+		{name: "unmasked range", kind: models.TrafficIPRange, value: "192.168.1.7/24", e: Event{IP: netip.MustParseAddr("192.168.1.200")}, want: true},
+		{name: "ipv6 range", kind: models.TrafficIPRange, value: "2001:db8::/32", e: Event{IP: netip.MustParseAddr("2001:db8::1")}, want: true},
+		{name: "no ip", kind: models.TrafficIPRange, value: "0.0.0.0/0", e: Event{}},
+		{name: "version suffix", kind: models.TrafficAppVersionSuffix, value: "-debug", e: Event{AppVersion: "2.1.0-debug"}, want: true},
+		{name: "version without suffix", kind: models.TrafficAppVersionSuffix, value: "-debug", e: Event{AppVersion: "2.1.0-debug.1"}},
+		{name: "rate at limit", kind: models.TrafficEventRate, value: "5", rate: 5},
+		{name: "rate over limit", kind: models.TrafficEventRate, value: "5", rate: 6, want: true},
+	}
+	for _, tt := range tests {
+		r, err := compile(models.TrafficRule{Kind: tt.kind, Value: tt.value})
+		if err != nil {
+			t.Fatalf("%s: compile: %v", tt.name, err)
+		}
+		if got := r.matches(tt.e, tt.rate); got != tt.want {
+			t.Errorf("%s: matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	db := testdb.Open(t, &models.TrafficRule{})
+	for _, r := range []models.TrafficRule{
+		{Name: "qa devices", Kind: models.TrafficUserIDPattern, Value: "^qa-", Action: models.TrafficFlag, Enabled: true},
+		{Name: "office", Kind: models.TrafficIPRange, Value: "10.0.0.0/8", Action: models.TrafficDrop, Enabled: true},
+		{Name: "shop debug", App: "shop", Kind: models.TrafficAppVersionSuffix, Value: "-debug", Action: models.TrafficDrop, Enabled: true},
+		{Name: "disabled", Kind: models.TrafficUserID, Value: "u1", Action: models.TrafficDrop},
+	} {
+		if err := db.Create(&r).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := NewFilter(db)
+	office := netip.MustParseAddr("10.1.1.1")
+
+	tests := []struct {
+		name string
+		e    Event
+		want Match
+	}{
+		{name: "no rule", e: Event{App: "shop", UserIDs: []string{"u1"}}},
+		{name: "flag", e: Event{App: "shop", UserIDs: []string{"qa-1"}}, want: Match{Action: models.TrafficFlag, Rule: "qa devices"}},
+		{name: "drop wins over flag", e: Event{App: "shop", UserIDs: []string{"qa-2"}, IP: office}, want: Match{Action: models.TrafficDrop, Rule: "office"}},
+		{name: "app rule", e: Event{App: "shop", UserIDs: []string{"u3"}, AppVersion: "1.0-debug"}, want: Match{Action: models.TrafficDrop, Rule: "shop debug"}},
+		{name: "rule of another app", e: Event{App: "news", UserIDs: []string{"u4"}, AppVersion: "1.0-debug"}},
+	}
+	for _, tt := range tests {
+		got, err := f.Match(tt.e)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: Match = %+v, %v, want %+v", tt.name, got, err, tt.want)
+		}
+	}
+
+	// Changed rules apply after Invalidate, while concurrent matches keep
+	// working.
+	db.Model(&models.TrafficRule{}).Where("name = ?", "disabled").Update("enabled", true)
+	f.Invalidate()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			f.Match(Event{App: "shop", UserIDs: []string{"u2"}})
+		}
+	}()
+	got, err := f.Match(Event{App: "shop", UserIDs: []string{"u1"}})
+	<-done
+	if want := (Match{Action: models.TrafficDrop, Rule: "disabled"}); err != nil || got != want {
+		t.Errorf("Match after Invalidate = %+v, %v, want %+v", got, err, want)
+	}
+}
+
+func TestApplyToHistory(t *testing.T) {
+	day := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		r    models.TrafficRule
+		want []string // IDs of the events flagged
+	}{
+		{name: "user ids", r: models.TrafficRule{Kind: models.TrafficUserID, Value: "u1, qa-2"}, want: []string{"qa-2", "u1"}},
+		{name: "pattern", r: models.TrafficRule{Kind: models.TrafficUserIDPattern, Value: `^qa-\d+$`}, want: []string{"qa-1", "qa-2"}},
+		// \d is not supported by every MySQL version; Go's syntax applies.
+		{name: "pattern of an app", r: models.TrafficRule{App: "shop", Kind: models.TrafficUserIDPattern, Value: `^qa-\d+$`}, want: []string{"qa-1"}},
+		{name: "version suffix", r: models.TrafficRule{Kind: models.TrafficAppVersionSuffix, Value: "-debug,_x"}, want: []string{"u2"}},
+		{name: "no match", r: models.TrafficRule{Kind: models.TrafficUserIDPattern, Value: "^bot"}},
+	}
+	for _, tt := range tests {
+		db := testdb.Open(t, &models.UserEvent{}, &models.RollupDay{})
+		for i, e := range []models.UserEvent{
+			{App: "shop", UserID: "qa-1", AppVersion: "1.0"},
+			{App: "news", UserID: "qa-2", AppVersion: "1.0"},
+			{App: "shop", UserID: "u1", AppVersion: "1.0"},
+			{App: "shop", UserID: "u2", AppVersion: "1.1-debug"},
+			// The LIKE wildcard in the suffix is matched literally.
+			{App: "shop", UserID: "u3", AppVersion: "1.1-x"},
+		} {
+			e.EventTime = day.Add(time.Duration(i) * time.Hour)
+			if err := db.Create(&e).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, d := range []string{"2024-03-01", "2024-03-02"} {
+			db.Exec("INSERT INTO rollup_days (day, stale, materialized_at) VALUES (?, ?, ?)", d, false, day)
+		}
+
+		n, err := ApplyToHistory(db, &tt.r)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var flagged []string
+		db.Model(&models.UserEvent{}).Where("internal = ?", true).Order("id").Pluck("user_id", &flagged)
+		if n != int64(len(tt.want)) || strings.Join(flagged, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: flagged %d %v, want %v", tt.name, n, flagged, tt.want)
+		}
+		var stale []time.Time
+		db.Raw("SELECT day FROM rollup_days WHERE stale").Scan(&stale)
+		if wantStale := len(tt.want) > 0; (len(stale) == 1 && stale[0].Equal(day.Truncate(24*time.Hour))) != wantStale {
+			t.Errorf("%s: stale days %v", tt.name, stale)
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+)
+
+// Event types published to webhooks.
+const (
+	EventUserCreated      = "user.created"
+	EventVersionFirstSeen = "version.first_seen"
+	EventAlertTriggered   = "alert.triggered"
+	EventAlertResolved    = "alert.resolved"
+)
+
+const (
+	signatureHeader = "X-Appstats-Signature"
+	eventHeader     = "X-Appstats-Event"
+	deliveryHeader  = "X-Appstats-Delivery"
+
+	maxAttempts       = 8
+	baseBackoff       = 10 * time.Second
+	maxBackoff        = time.Hour
+	endpointCacheTTL  = 30 * time.Second
+	deliveryBatchSize = 50
+	maxErrorLength    = 512
+)
+
+// Events lists the event types endpoints can subscribe to.
+var Events = []string{EventUserCreated, EventVersionFirstSeen, EventAlertTriggered, EventAlertResolved}
+
+// Payload is the JSON body posted to endpoints.
+type Payload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// Validate checks an endpoint configuration and generates a secret when
+// none is given.
+func Validate(ep *models.WebhookEndpoint) error {
+	ep.Name = strings.TrimSpace(ep.Name)
+	ep.URL = strings.TrimSpace(ep.URL)
+	if ep.Name == "" {
+		return errors.New("name is required")
+	}
+	u, err := url.Parse(ep.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	if len(ep.Events) == 0 {
+		return errors.New("at least one event is required")
+	}
+	for _, e := range ep.Events {
+		if !slices.Contains(Events, e) {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	if ep.Secret == "" {
+		ep.Secret = rand.Text()
+	}
+	return nil
+}
+
+// Dispatcher queues events as persistent deliveries and sends them in the
+// background, retrying failures with exponential backoff.
+type Dispatcher struct {
+	db     *gorm.DB
+	client *http.Client
+	wake   chan struct{}
+
+	mu        sync.Mutex
+	endpoints []models.WebhookEndpoint
+	loadedAt  time.Time
+}
+
+// NewDispatcher returns a dispatcher backed by db.
+func NewDispatcher(db *gorm.DB) *Dispatcher {
+	return &Dispatcher{
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Invalidate drops the cached endpoint list after endpoints were changed.
+func (d *Dispatcher) Invalidate() {
+	d.mu.Lock()
+	d.endpoints = nil
+	d.loadedAt = time.Time{}
+	d.mu.Unlock()
+}
+
+func (d *Dispatcher) subscribers(event string) ([]models.WebhookEndpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.loadedAt) > endpointCacheTTL {
+		var eps []models.WebhookEndpoint
+		if err := d.db.Where("enabled = ?", true).Find(&eps).Error; err != nil {
+			return nil, err
+		}
+		d.endpoints, d.loadedAt = eps, time.Now()
+	}
+
+	var res []models.WebhookEndpoint
+	for _, ep := range d.endpoints {
+		if slices.Contains(ep.Events, event) {
+			res = append(res, ep)
+		}
+	}
+	return res, nil
+}
+
+// Publish queues event for every enabled endpoint subscribed to it.
+func (d *Dispatcher) Publish(event string, data any) error {
+	eps, err := d.subscribers(event)
+	if err != nil || len(eps) == 0 {
+		return err
+	}
+
+	body, err := json.Marshal(Payload{ID: rand.Text(), Event: event, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	deliveries := make([]models.WebhookDelivery, 0, len(eps))
+	for _, ep := range eps {
+		deliveries = append(deliveries, models.WebhookDelivery{
+			EndpointID:    ep.ID,
+			Event:         event,
+			Payload:       string(body),
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+		})
+	}
+	if err := d.db.Create(&deliveries).Error; err != nil {
+		return err
+	}
+	d.notify()
+	return nil
+}
+
+// Replay queues a copy of an earlier delivery, keeping the original payload.
+func (d *Dispatcher) Replay(id uint) (*models.WebhookDelivery, error) {
+	var orig models.WebhookDelivery
+	if err := d.db.First(&orig, id).Error; err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	replay := models.WebhookDelivery{
+		EndpointID:    orig.EndpointID,
+		Event:         orig.Event,
+		Payload:       orig.Payload,
+		Status:        models.DeliveryPending,
+		NextAttemptAt: &now,
+		ReplayOf:      &orig.ID,
+	}
+	if err := d.db.Create(&replay).Error; err != nil {
+		return nil, err
+	}
+	d.notify()
+	return &replay, nil
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		d.sendDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *Dispatcher) sendDue(ctx context.Context) {
+	for {
+		var due []models.WebhookDelivery
+		if err := d.db.Where("status = ? AND next_attempt_at <= ?", models.DeliveryPending, time.Now()).
+			Order("next_attempt_at").Limit(deliveryBatchSize).Find(&due).Error; err != nil {
+			slog.Error("load webhook deliveries failed", slog.Any("error", err))
+			return
+		}
+		if len(due) == 0 {
+			return
+		}
+
+		endpoints := make(map[uint]*models.WebhookEndpoint)
+		for i := range due {
+			if ctx.Err() != nil {
+				return
+			}
+			dl := &due[i]
+			ep, ok := endpoints[dl.EndpointID]
+			if !ok {
+				var e models.WebhookEndpoint
+				if err := d.db.First(&e, dl.EndpointID).Error; err == nil {
+					ep = &e
+				}
+				endpoints[dl.EndpointID] = ep
+			}
+			d.attempt(ctx, ep, dl)
+		}
+		if len(due) < deliveryBatchSize {
+			return
+		}
+	}
+}
+
+// attempt sends one delivery and records the outcome.
+func (d *Dispatcher) attempt(ctx context.Context, ep *models.WebhookEndpoint, dl *models.WebhookDelivery) {
+	dl.Attempts++
+	var err error
+	switch {
+	case ep == nil:
+		err = fmt.Errorf("endpoint %d no longer exists", dl.EndpointID)
+		dl.Attempts = maxAttempts
+	case !ep.Enabled:
+		err = fmt.Errorf("endpoint %d is disabled", dl.EndpointID)
+		dl.Attempts = maxAttempts
+	default:
+		dl.ResponseStatus, err = d.send(ctx, ep, dl)
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		dl.Status = models.DeliverySucceeded
+		dl.DeliveredAt = &now
+		dl.NextAttemptAt = nil
+		dl.LastError = ""
+	case dl.Attempts >= maxAttempts:
+		dl.Status = models.DeliveryFailed
+		dl.NextAttemptAt = nil
+		dl.LastError = models.Truncate(err.Error(), maxErrorLength)
+	default:
+		next := now.Add(Backoff(dl.Attempts))
+		dl.NextAttemptAt = &next
+		dl.LastError = models.Truncate(err.Error(), maxErrorLength)
+	}
+	if err := d.db.Save(dl).Error; err != nil {
+		slog.Error("save webhook delivery failed", slog.Uint64("delivery_id", uint64(dl.ID)), slog.Any("error", err))
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, ep *models.WebhookEndpoint, dl *models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.URL, bytes.NewReader([]byte(dl.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, dl.Event)
+	req.Header.Set(deliveryHeader, strconv.FormatUint(uint64(dl.ID), 10))
+	req.Header.Set(signatureHeader, Sign(ep.Secret, time.Now(), []byte(dl.Payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s: %s", resp.Status, snippet)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the signature header value "t=<unix>,v1=<hex>", where v1 is
+// the HMAC-SHA256 of "<unix>.<body>" keyed with the endpoint secret.
+// Receivers should recompute it and reject stale timestamps.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the next attempt after n failed attempts.
+func Backoff(n int) time.Duration {
+	d := baseBackoff << (n - 1)
+	if d <= 0 || d > maxBackoff {
+		return maxBackoff
+	}
+	return d
+}
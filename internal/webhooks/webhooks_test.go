@@ -0,0 +1,174 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+
+	"appstats/internal/models"
+	"appstats/internal/testdb"
+)
+
+func TestSign(t *testing.T) {
+	at := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	body := []byte(`{"id":"1"}`)
+	// HMAC-SHA256("secret", "1709251200.{\"id\":\"1\"}")
+	want := "t=1709251200,v1=8b374bd784fe9044ba562d0ddcf999f0168c61b2a6cb223e7c6ec1055188e12e"
+	if got := Sign("secret", at, body); got != want {
+		t.Errorf("Sign = %q, want %q", got, want)
+	}
+	if Sign("other", at, body) == want || Sign("secret", at.Add(time.Second), body) == want {
+		t.Error("signature does not depend on the secret and time")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{7, 640 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{64, time.Hour},
+		{200, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.n); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ep      models.WebhookEndpoint
+		wantErr string
+	}{
+		{name: "valid", ep: models.WebhookEndpoint{Name: " ops ", URL: " https://example.com/hook ", Events: []string{EventUserCreated}}},
+		{name: "no name", ep: models.WebhookEndpoint{URL: "https://example.com", Events: []string{EventUserCreated}}, wantErr: "name"},
+		{name: "relative url", ep: models.WebhookEndpoint{Name: "ops", URL: "/hook", Events: []string{EventUserCreated}}, wantErr: "url"},
+		{name: "ftp url", ep: models.WebhookEndpoint{Name: "ops", URL: "ftp://example.com", Events: []string{EventUserCreated}}, wantErr: "url"},
+		{name: "no events", ep: models.WebhookEndpoint{Name: "ops", URL: "https://example.com"}, wantErr: "event"},
+		{name: "unknown event", ep: models.WebhookEndpoint{Name: "ops", URL: "https://example.com", Events: []string{"user.deleted"}}, wantErr: "unknown event"},
+	}
+	for _, tt := range tests {
+		err := Validate(&tt.ep)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.ep.Name != "ops" || tt.ep.URL != "https://example.com/hook" || tt.ep.Secret == "" {
+			t.Errorf("%s: endpoint = %+v, want trimmed fields and a generated secret", tt.name, tt.ep)
+		}
+	}
+}
+
+func deliveries(t *testing.T, db *gorm.DB) map[uint]models.WebhookDelivery {
+	t.Helper()
+	var dls []models.WebhookDelivery
+	if err := db.Find(&dls).Error; err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[uint]models.WebhookDelivery, len(dls))
+	for _, dl := range dls {
+		res[dl.EndpointID] = dl
+	}
+	return res
+}
+
+func TestDispatcher(t *testing.T) {
+	type request struct {
+		event, signature string
+		body             []byte
+	}
+	received := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- request{event: r.Header.Get(eventHeader), signature: r.Header.Get(signatureHeader), body: body}
+	}))
+	defer srv.Close()
+
+	db := testdb.Open(t, &models.WebhookEndpoint{}, &models.WebhookDelivery{})
+	eps := []models.WebhookEndpoint{
+		{Name: "ok", URL: srv.URL + "/ok", Secret: "s1", Events: []string{EventUserCreated}, Enabled: true},
+		{Name: "fail", URL: srv.URL + "/fail", Secret: "s2", Events: []string{EventUserCreated}, Enabled: true},
+		{Name: "other event", URL: srv.URL + "/ok", Secret: "s3", Events: []string{EventAlertTriggered}, Enabled: true},
+	}
+	if err := db.Create(&eps).Error; err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(db)
+	d.client = srv.Client()
+
+	if err := d.Publish(EventUserCreated, map[string]string{"user_id": "u1"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	d.sendDue(context.Background())
+
+	select {
+	case r := <-received:
+		if r.event != EventUserCreated {
+			t.Errorf("event header = %q", r.event)
+		}
+		var p Payload
+		if err := json.Unmarshal(r.body, &p); err != nil || p.Event != EventUserCreated || p.ID == "" {
+			t.Errorf("payload = %s, %v", r.body, err)
+		}
+		ts, _, _ := strings.Cut(strings.TrimPrefix(r.signature, "t="), ",")
+		unix, _ := strconv.ParseInt(ts, 10, 64)
+		if want := Sign("s1", time.Unix(unix, 0), r.body); r.signature != want {
+			t.Errorf("signature = %q, want %q", r.signature, want)
+		}
+	default:
+		t.Fatal("the subscribed endpoint received nothing")
+	}
+	select {
+	case r := <-received:
+		t.Errorf("unexpected delivery of %s", r.event)
+	default:
+	}
+
+	got := deliveries(t, db)
+	if len(got) != 2 {
+		t.Fatalf("got %d deliveries, want one per subscribed endpoint", len(got))
+	}
+	if ok := got[eps[0].ID]; ok.Status != models.DeliverySucceeded || ok.Attempts != 1 || ok.ResponseStatus != http.StatusOK {
+		t.Errorf("delivery to ok = %+v", ok)
+	}
+	failed := got[eps[1].ID]
+	if failed.Status != models.DeliveryPending || failed.Attempts != 1 || failed.ResponseStatus != http.StatusInternalServerError ||
+		failed.NextAttemptAt == nil || !strings.Contains(failed.LastError, "500") {
+		t.Errorf("delivery to fail = %+v, want a pending retry", failed)
+	}
+
+	// Deliveries still pending when their endpoint is disabled fail at once.
+	db.Model(&eps[1]).Update("enabled", false)
+	db.Model(&failed).Update("next_attempt_at", time.Now().Add(-time.Second))
+	d.sendDue(context.Background())
+	failed = deliveries(t, db)[eps[1].ID]
+	if failed.Status != models.DeliveryFailed || failed.NextAttemptAt != nil || !strings.Contains(failed.LastError, "disabled") {
+		t.Errorf("delivery to a disabled endpoint = %+v, want failed", failed)
+	}
+}
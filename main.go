@@ -1,43 +1,297 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
 
+	"appstats/internal/alerts"
+	"appstats/internal/annotations"
+	"appstats/internal/archive"
 	"appstats/internal/config"
+	"appstats/internal/consent"
+	"appstats/internal/eventtime"
 	"appstats/internal/handlers"
+	"appstats/internal/identity"
+	"appstats/internal/ingest"
+	"appstats/internal/logging"
+	"appstats/internal/metrics"
 	"appstats/internal/models"
+	"appstats/internal/notify"
+	"appstats/internal/pseudonym"
+	"appstats/internal/reports"
+	"appstats/internal/retention"
+	"appstats/internal/rollups"
+	"appstats/internal/schema"
+	"appstats/internal/traffic"
+	"appstats/internal/webhooks"
 )
 
 func main() {
 	cfg := config.Load()
 
-	db, err := gorm.Open(mysql.Open(cfg.DSN), &gorm.Config{})
+	log := logging.New(cfg.LogLevel)
+	slog.SetDefault(log)
+
+	db, err := gorm.Open(mysql.Open(cfg.DSN), &gorm.Config{
+		Logger: logger.NewSlogLogger(log.With(slog.String("component", "gorm")), logger.Config{
+			SlowThreshold:             200 * time.Millisecond,
+			LogLevel:                  logger.Warn,
+			IgnoreRecordNotFoundError: true,
+		}),
+	})
+	if err != nil {
+		fatal("failed to connect db", err)
+	}
+
+	if err := db.AutoMigrate(
+		&models.User{}, &models.UserAlias{}, &models.UserProperty{}, &models.UserPropertyChange{},
+		&models.UserEvent{}, &models.Annotation{},
+		&models.AlertRule{}, &models.AlertEvent{},
+		&models.WebhookEndpoint{}, &models.WebhookDelivery{}, &models.ReportSchedule{},
+		&models.DailyRollup{}, &models.RollupDay{}, &models.PrivacyAudit{}, &models.RetentionPolicy{},
+		&models.ArchivePartition{}, &models.AppPrivacy{}, &models.PseudonymSalt{},
+		&models.ConsentOptOut{}, &models.AnonymousEventCount{}, &models.TrafficRule{},
+		&models.EventSchema{}, &models.DeadLetter{}, &models.Migration{},
+	); err != nil {
+		fatal("auto migrate failed", err)
+	}
+	// Events stored before apps were recorded belong to the default app.
+	if err := migrateOnce(db, "backfill_event_apps", func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE user_events SET app = ? WHERE app = ''", models.DefaultApp).Error
+	}); err != nil {
+		fatal("backfill event apps failed", err)
+	}
+
+	sqlDB, err := db.DB()
 	if err != nil {
-		log.Fatalf("failed to connect db: %v", err)
+		fatal("failed to get sql db", err)
+	}
+	metrics.RegisterDB(sqlDB)
+
+	mailer := notify.NewMailer(notify.SMTPConfig{
+		Addr:     cfg.SMTPAddr,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.SMTPFrom,
+	})
+	channels := notify.NewRegistry(mailer)
+
+	// Outbound webhooks, delivered in the background.
+	hooks := webhooks.NewDispatcher(db)
+	go hooks.Run(context.Background())
+
+	ids := identity.NewResolver(db)
+	pseudo := pseudonym.NewPseudonymizer(db, cfg.PIIAction)
+	optOuts := consent.NewRegistry(db)
+	rules := traffic.NewFilter(db)
+	schemas := schema.NewRegistry(db)
+	times := eventtime.Policy{
+		MaxAge:    time.Duration(cfg.EventMaxAgeHours) * time.Hour,
+		MaxFuture: time.Duration(cfg.EventMaxFutureSeconds) * time.Second,
+		Action:    cfg.EventTimeAction,
+	}
+	if err := times.Validate(); err != nil {
+		fatal("invalid event time settings", err)
+	}
+
+	versions := annotations.NewVersionWatcher(db)
+	versions.OnFirstSeen = func(ann models.Annotation) {
+		if err := hooks.Publish(webhooks.EventVersionFirstSeen, ann); err != nil {
+			slog.Warn("failed to publish webhook", slog.String("event", webhooks.EventVersionFirstSeen), slog.Any("error", err))
+		}
 	}
 
-	if err := db.AutoMigrate(&models.User{}, &models.UserEvent{}); err != nil {
-		log.Fatalf("auto migrate failed: %v", err)
+	// Background alert evaluation.
+	alertEngine := alerts.NewEngine(db, channels, time.Duration(cfg.AlertTickSeconds)*time.Second)
+	alertEngine.OnTransition = func(rule models.AlertRule, evt models.AlertEvent) {
+		event := webhooks.EventAlertTriggered
+		if evt.Status == models.AlertResolved {
+			event = webhooks.EventAlertResolved
+		}
+		if err := hooks.Publish(event, gin.H{"rule": rule, "event": evt}); err != nil {
+			slog.Warn("failed to publish webhook", slog.String("event", event), slog.Any("error", err))
+		}
 	}
+	go alertEngine.Run(context.Background())
 
-	r := gin.Default()
+	// Scheduled email reports.
+	reportScheduler := reports.NewScheduler(db, mailer, time.Duration(cfg.ReportTickSeconds)*time.Second)
+	go reportScheduler.Run(context.Background())
 
-	// Write-only API for event reporting.
-	api := r.Group("/api")
+	// Daily rollups of completed days.
+	materializer := rollups.NewMaterializer(db, time.Duration(cfg.RollupTickSeconds)*time.Second)
+	go materializer.Run(context.Background())
+
+	// Archiving of old events, if a store is configured. The store is opened
+	// first, as retention must not purge events before they are archived.
+	archiveStore, err := archive.OpenStore(archive.ConfigFrom(cfg))
+	if err != nil {
+		fatal("failed to open archive store", err)
+	}
+	if archiveStore != nil {
+		archiver := archive.NewArchiver(db, archiveStore, cfg.ArchiveAfterDays, time.Duration(cfg.ArchiveTickSeconds)*time.Second)
+		go archiver.Run(context.Background())
+	}
+
+	// Retention policies, purging expired data in small batches.
+	purger := retention.NewPurger(db, time.Duration(cfg.RetentionTickSeconds)*time.Second, cfg.RetentionBatchSize)
+	purger.RequireArchive = archiveStore != nil
+	purger.DeadLetterDays = cfg.DeadLetterDays
+	go purger.Run(context.Background())
+
+	// Purging the data of users who opted out.
+	consentPurger := consent.NewPurger(db, time.Duration(cfg.ConsentTickSeconds)*time.Second)
+	consentPurger.Archive = archiveStore
+	go consentPurger.Run(context.Background())
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(
+		logging.RequestID(log),
+		logging.AccessLog(cfg.IngestLogSampleEvery, "/api/events/report"),
+		gin.CustomRecovery(func(c *gin.Context, rec any) {
+			logging.FromContext(c).Error("panic recovered", slog.Any("panic", rec))
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}),
+		metrics.Middleware(),
+	)
+
+	// Write-only API for event reporting. Bodies may be gzip or deflate
+	// compressed.
+	api := r.Group("/api", ingest.Decompress(ingest.Limits{
+		MaxBytes: int64(cfg.MaxBodyBytes),
+		MaxRatio: int64(cfg.MaxDecompressionRatio),
+	}))
 	{
-		api.POST("/events/report", handlers.ReportEventHandler(db))
+		api.POST("/events/report", handlers.ReportEventHandler(db, ids, pseudo, optOuts, rules, times, schemas, versions, hooks))
+		api.POST("/identify", handlers.IdentifyHandler(ids, pseudo))
+		api.POST("/users/profile", handlers.UpdateProfileHandler(db, ids, pseudo))
+		api.GET("/consent", handlers.GetConsentHandler(ids, pseudo, optOuts))
+		api.POST("/consent", handlers.SetConsentHandler(ids, pseudo, optOuts))
 	}
 
 	// Admin dashboard: server-side query + chart rendering in browser.
 	r.GET("/admin", handlers.AdminPageHandler(db))
+	r.GET("/admin/export/:report", handlers.ExportHandler(db))
+	r.GET("/admin/users", handlers.UserPageHandler())
+	r.GET("/admin/events", handlers.EventExplorerPageHandler())
+	r.GET("/admin/funnel", handlers.FunnelPageHandler())
+	r.GET("/admin/versions", handlers.VersionPageHandler())
+	r.GET("/admin/annotations", handlers.AnnotationPageHandler())
+	r.GET("/admin/alerts", handlers.AlertPageHandler())
+	r.GET("/admin/webhooks", handlers.WebhookPageHandler())
+	r.GET("/admin/reports", handlers.ReportPageHandler())
+	r.GET("/admin/privacy", handlers.PrivacyPageHandler())
+	r.GET("/admin/retention", handlers.RetentionPageHandler())
+	r.GET("/admin/app-privacy", handlers.AppPrivacyPageHandler())
+	r.GET("/admin/traffic", handlers.TrafficPageHandler())
+	r.GET("/admin/schemas", handlers.SchemaPageHandler())
 
-	log.Println("server listening on :8080")
-	if err := r.Run(":8080"); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("server error: %v", err)
+	adminAPI := r.Group("/admin/api")
+	{
+		adminAPI.GET("/summary", handlers.SummaryHandler(db))
+		adminAPI.GET("/engagement", handlers.EngagementHandler(db))
+		adminAPI.GET("/users/:user_id", handlers.UserProfileHandler(db, ids))
+		adminAPI.GET("/users/:user_id/events", handlers.UserEventsHandler(db, ids))
+		adminAPI.GET("/events", handlers.ListEventsHandler(db))
+		adminAPI.POST("/funnel", handlers.FunnelHandler(db))
+		adminAPI.GET("/versions/adoption", handlers.VersionAdoptionHandler(db))
+		adminAPI.GET("/annotations", handlers.ListAnnotationsHandler(db))
+		adminAPI.POST("/annotations", handlers.CreateAnnotationHandler(db))
+		adminAPI.PUT("/annotations/:id", handlers.UpdateAnnotationHandler(db))
+		adminAPI.DELETE("/annotations/:id", handlers.DeleteAnnotationHandler(db))
+		adminAPI.GET("/alerts/rules", handlers.ListAlertRulesHandler(db))
+		adminAPI.POST("/alerts/rules", handlers.CreateAlertRuleHandler(db))
+		adminAPI.PUT("/alerts/rules/:id", handlers.UpdateAlertRuleHandler(db))
+		adminAPI.DELETE("/alerts/rules/:id", handlers.DeleteAlertRuleHandler(db))
+		adminAPI.POST("/alerts/rules/:id/evaluate", handlers.EvaluateAlertRuleHandler(db, alertEngine))
+		adminAPI.GET("/alerts/events", handlers.ListAlertEventsHandler(db))
+		adminAPI.GET("/webhooks/endpoints", handlers.ListWebhookEndpointsHandler(db))
+		adminAPI.POST("/webhooks/endpoints", handlers.CreateWebhookEndpointHandler(db, hooks))
+		adminAPI.PUT("/webhooks/endpoints/:id", handlers.UpdateWebhookEndpointHandler(db, hooks))
+		adminAPI.DELETE("/webhooks/endpoints/:id", handlers.DeleteWebhookEndpointHandler(db, hooks))
+		adminAPI.GET("/webhooks/deliveries", handlers.ListWebhookDeliveriesHandler(db))
+		adminAPI.POST("/webhooks/deliveries/:id/replay", handlers.ReplayWebhookDeliveryHandler(hooks))
+		adminAPI.GET("/reports/schedules", handlers.ListReportSchedulesHandler(db))
+		adminAPI.POST("/reports/schedules", handlers.CreateReportScheduleHandler(db))
+		adminAPI.PUT("/reports/schedules/:id", handlers.UpdateReportScheduleHandler(db))
+		adminAPI.DELETE("/reports/schedules/:id", handlers.DeleteReportScheduleHandler(db))
+		adminAPI.GET("/reports/schedules/:id/preview", handlers.PreviewReportScheduleHandler(db))
+		adminAPI.POST("/reports/schedules/:id/send", handlers.SendReportScheduleHandler(db, reportScheduler))
+		adminAPI.POST("/reports/preview", handlers.PreviewReportHandler(db))
+		adminAPI.GET("/rollups", handlers.ListRollupsHandler(db))
+		adminAPI.GET("/privacy/users/:user_id/export", handlers.ExportUserDataHandler(db, ids))
+		adminAPI.POST("/privacy/users/:user_id/erase", handlers.EraseUserDataHandler(db, ids, archiveStore))
+		adminAPI.GET("/privacy/audit", handlers.ListPrivacyAuditHandler(db))
+		adminAPI.GET("/archive/partitions", handlers.ListArchivePartitionsHandler(db))
+		adminAPI.GET("/retention/policies", handlers.ListRetentionPoliciesHandler(db))
+		adminAPI.POST("/retention/policies", handlers.CreateRetentionPolicyHandler(db))
+		adminAPI.PUT("/retention/policies/:id", handlers.UpdateRetentionPolicyHandler(db))
+		adminAPI.DELETE("/retention/policies/:id", handlers.DeleteRetentionPolicyHandler(db))
+		adminAPI.POST("/retention/policies/:id/run", handlers.RunRetentionPolicyHandler(db, purger))
+		adminAPI.GET("/app-privacy/settings", handlers.ListAppPrivacyHandler(db))
+		adminAPI.POST("/app-privacy/settings", handlers.CreateAppPrivacyHandler(db, pseudo))
+		adminAPI.PUT("/app-privacy/settings/:id", handlers.UpdateAppPrivacyHandler(db, pseudo))
+		adminAPI.DELETE("/app-privacy/settings/:id", handlers.DeleteAppPrivacyHandler(db, pseudo))
+		adminAPI.GET("/app-privacy/salts", handlers.ListPseudonymSaltsHandler(db))
+		adminAPI.POST("/app-privacy/salts", handlers.RotatePseudonymSaltHandler(db, pseudo))
+		adminAPI.POST("/app-privacy/salts/:id/retire", handlers.RetirePseudonymSaltHandler(db, pseudo))
+		adminAPI.POST("/app-privacy/lookup", handlers.LookupPseudonymHandler(db))
+		adminAPI.GET("/consent/opt-outs", handlers.ListOptOutsHandler(db))
+		adminAPI.POST("/consent/opt-outs", handlers.CreateOptOutHandler(ids, optOuts))
+		adminAPI.DELETE("/consent/opt-outs/:id", handlers.DeleteOptOutHandler(db, optOuts))
+		adminAPI.GET("/consent/anonymous-counts", handlers.ListAnonymousCountsHandler(db))
+		adminAPI.GET("/traffic/rules", handlers.ListTrafficRulesHandler(db))
+		adminAPI.POST("/traffic/rules", handlers.CreateTrafficRuleHandler(db, rules))
+		adminAPI.PUT("/traffic/rules/:id", handlers.UpdateTrafficRuleHandler(db, rules))
+		adminAPI.DELETE("/traffic/rules/:id", handlers.DeleteTrafficRuleHandler(db, rules))
+		adminAPI.POST("/traffic/rules/:id/apply", handlers.ApplyTrafficRuleHandler(db))
+		adminAPI.GET("/schemas", handlers.ListEventSchemasHandler(db))
+		adminAPI.POST("/schemas", handlers.CreateEventSchemaHandler(db, schemas))
+		adminAPI.POST("/schemas/:id/activate", handlers.ActivateEventSchemaHandler(db, schemas))
+		adminAPI.DELETE("/schemas/:id", handlers.DeleteEventSchemaHandler(db, schemas))
+		adminAPI.GET("/dead-letters", handlers.ListDeadLettersHandler(db))
 	}
-}
\ No newline at end of file
+
+	// Prometheus scrape endpoint.
+	r.GET("/metrics", metrics.Handler())
+
+	log.Info("server listening", slog.String("addr", cfg.Addr))
+	if err := r.Run(cfg.Addr); err != nil && err != http.ErrServerClosed {
+		fatal("server error", err)
+	}
+}
+
+// migrateOnce runs fn unless the migration name has run before, and records
+// it in the same transaction. The update must be idempotent: instances that
+// start together may both run it.
+func migrateOnce(db *gorm.DB, name string, fn func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(&models.Migration{}).Where("name = ?", name).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return nil
+		}
+		if err := fn(tx); err != nil {
+			return err
+		}
+		slog.Info("migration applied", slog.String("name", name))
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Migration{Name: name, AppliedAt: time.Now()}).Error
+	})
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, slog.Any("error", err))
+	os.Exit(1)
+}